@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminOnly wraps an HTTP handler so that it requires the admin token as an
+// "Authorization: Bearer" header. The admin API is disabled when no admin
+// token is configured.
+func adminOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The occupancy analytics settings
+const (
+	occupancyBucket   = time.Minute        // length of a time bucket
+	occupancyTTL      = 7 * 24 * time.Hour // how long buckets are kept, the longest range
+	maxOccupancyRooms = 50                 // rooms a connection can watch
+)
+
+var (
+	occupancymu   sync.Mutex                 // guard occupancySubM
+	occupancySubM map[string]map[string]bool // connID -> roomIDs it watches
+)
+
+// occupancyKey returns the Redis key of the occupancy of a room in the time
+// bucket starting at the Unix time
+func occupancyKey(roomID string, bucket int64) string {
+	return "occupancy:" + roomID + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// recordOccupancy counts an enter or exit event of a room in its time bucket,
+// along with the occupants of the room after the event, and lets the
+// connections watching the room know
+func recordOccupancy(detect, roomID, msg string) {
+	occupants := roomOccupants(roomID)
+	pushOccupancy(roomID, occupants, detect)
+	if _, ok := claimRoomEvent("occupancy", detect, roomID, msg); !ok {
+		return // another instance counts this event
+	}
+	field := "enters"
+	if detect == "exit" {
+		field = "exits"
+	}
+	key := occupancyKey(roomID, time.Now().Truncate(occupancyBucket).Unix())
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HINCRBY", key, field, 1)
+	b.Send("HSET", key, "occupants", occupants)
+	b.Send("EXPIRE", key, int(occupancyTTL/time.Second))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("occupancy record failed", "room", roomID, "err", err)
+	}
+}
+
+// roomOccupants returns the number of people inside of a room, on every
+// instance, from the people collections of its namespace. The members known
+// to this instance are counted when the fence cannot be searched.
+func roomOccupants(roomID string) int {
+	roommu.Lock()
+	room, ok := rooms[roomID]
+	var object, floor string
+	if ok {
+		object, floor = room.Object, room.Floor
+	}
+	roommu.Unlock()
+	if object == "" {
+		return len(roomMembers(roomID))
+	}
+	ns, _ := splitRoom(roomID)
+	keys := []string{floorKey(peopleKey(ns), floor)}
+	if floor == "" {
+		keys = floorKeys(peopleKey(ns))
+	}
+	var occupants int
+	for _, key := range keys {
+		people, err := geo.Intersects(key, Area{Object: object}, Search{IDs: true})
+		if err != nil {
+			lg.Error("occupants lookup failed", "room", roomID, "err", err)
+			return len(roomMembers(roomID))
+		}
+		occupants += len(people)
+	}
+	return occupants
+}
+
+// occupancyMessage is a websocket message handler that watches the occupancy
+// of rooms of the namespace of the connection. The current occupancy of each
+// room is sent right away. An empty list of rooms stops watching.
+func occupancyMessage(connID, msg string) {
+	var o protocol.Occupancy
+	if err := protocol.Decode(msg, &o); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if len(o.Rooms) > maxOccupancyRooms {
+		sendError(connID, "invalid_occupancy", "Occupancy takes up to 50 rooms")
+		return
+	}
+	ns := connNamespace(connID)
+	watched := make(map[string]bool, len(o.Rooms))
+	for _, id := range o.Rooms {
+		watched[namespaceRoom(ns, id)] = true
+	}
+	occupancymu.Lock()
+	if len(watched) == 0 {
+		delete(occupancySubM, connID)
+	} else {
+		occupancySubM[connID] = watched
+	}
+	occupancymu.Unlock()
+	for roomID := range watched {
+		if roomExists(roomID) {
+			send(connID, occupancyFrame(roomID, roomOccupants(roomID), ""))
+		}
+	}
+}
+
+// occupancyFrame returns the Occupancy message of a room
+func occupancyFrame(roomID string, occupants int, event string) string {
+	msg, _ := protocol.Encode(protocol.Occupancy{
+		Envelope:  protocol.Envelope{Type: protocol.TypeOccupancy},
+		Room:      localRoom(roomID),
+		Occupants: occupants,
+		Event:     event,
+	})
+	return msg
+}
+
+// pushOccupancy sends the occupancy of a room to the connections watching it
+func pushOccupancy(roomID string, occupants int, event string) {
+	var connIDs []string
+	occupancymu.Lock()
+	for connID, watched := range occupancySubM {
+		if watched[roomID] {
+			connIDs = append(connIDs, connID)
+		}
+	}
+	occupancymu.Unlock()
+	if len(connIDs) == 0 {
+		return
+	}
+	msg := occupancyFrame(roomID, occupants, event)
+	for _, connID := range connIDs {
+		send(connID, msg)
+	}
+}
+
+// forgetOccupancy stops a connection from watching rooms
+func forgetOccupancy(connID string) {
+	occupancymu.Lock()
+	delete(occupancySubM, connID)
+	occupancymu.Unlock()
+}
+
+// occupancyPoint is the occupancy of a room in a time bucket. Occupants is
+// carried over from the bucket before when nobody entered or exited.
+type occupancyPoint struct {
+	Time      time.Time `json:"time"`
+	Enters    int       `json:"enters"`
+	Exits     int       `json:"exits"`
+	Occupants int       `json:"occupants"`
+}
+
+// occupancySeries is the occupancy of a room over a range of time
+type occupancySeries struct {
+	Room      string           `json:"room"`
+	Namespace string           `json:"namespace,omitempty"`
+	Range     string           `json:"range"`
+	Bucket    string           `json:"bucket"`
+	Occupants int              `json:"occupants"` // right now
+	Enters    int              `json:"enters"`    // over the range
+	Exits     int              `json:"exits"`     // over the range
+	Series    []occupancyPoint `json:"series"`
+}
+
+// analyticsAPI is an HTTP handler with the occupancy of a room over time, in
+// buckets of a minute. Rooms of a namespace are at
+// /api/analytics/places/{namespace}/{id}. The range is at most 7 days.
+//
+//	GET /api/analytics/places/{id}?range=1h  enters, exits and occupants
+func analyticsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fenceID := strings.TrimPrefix(r.URL.Path, "/api/analytics/places/")
+	var ns string
+	if i := strings.IndexByte(fenceID, '/'); i >= 0 {
+		ns, fenceID = fenceID[:i], fenceID[i+1:]
+		if ns == "" || !knownNamespace(ns) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !validFenceID.MatchString(fenceID) {
+		http.Error(w, "invalid fence id", http.StatusBadRequest)
+		return
+	}
+	span := time.Hour
+	if s := r.URL.Query().Get("range"); s != "" {
+		var err error
+		if span, err = time.ParseDuration(s); err != nil || span <= 0 || span > occupancyTTL {
+			http.Error(w, "range must be a duration of up to 168h", http.StatusBadRequest)
+			return
+		}
+	}
+	roomID := namespaceRoom(ns, fenceID)
+
+	end := time.Now().Truncate(occupancyBucket)
+	start := end.Add(-span + occupancyBucket)
+	b := newBatch(store)
+	defer b.Close()
+	for t := start; !t.After(end); t = t.Add(occupancyBucket) {
+		b.Send("HMGET", occupancyKey(roomID, t.Unix()), "enters", "exits", "occupants")
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("occupancy lookup failed", "room", roomID, "err", err)
+		http.Error(w, "occupancy is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	series := occupancySeries{
+		Room:      fenceID,
+		Namespace: ns,
+		Range:     span.String(),
+		Bucket:    occupancyBucket.String(),
+		Occupants: roomOccupants(roomID),
+		Series:    make([]occupancyPoint, 0, len(replies)),
+	}
+	var occupants int
+	for i, reply := range replies {
+		values, _ := redis.Ints(reply, nil)
+		point := occupancyPoint{Time: start.Add(time.Duration(i) * occupancyBucket), Occupants: occupants}
+		if len(values) == 3 {
+			point.Enters, point.Exits = values[0], values[1]
+			if point.Enters > 0 || point.Exits > 0 {
+				point.Occupants = values[2]
+			}
+		}
+		occupants = point.Occupants
+		series.Enters += point.Enters
+		series.Exits += point.Exits
+		series.Series = append(series.Series, point)
+	}
+	writeJSON(w, series)
+}
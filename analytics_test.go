@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRoomOccupants(t *testing.T) {
+	id := testRoom(t, "atrium")
+	roommu.Lock()
+	rooms[id].Object = `{"type":"Polygon","coordinates":[[[-105.501,40.001],[-105.5,40.001],` +
+		`[-105.5,40.002],[-105.501,40.002],[-105.501,40.001]]]}`
+	roommu.Unlock()
+	// people of other instances are only in the store
+	a, b, c := testID(1), testID(2), testID(3)
+	// away from the people of the other tests
+	geo.SetFeature(peopleKey(""), a, testFeature(a, 40.0015, -105.5005), 0)
+	geo.SetFeature(peopleKey(""), b, testFeature(b, 40.0016, -105.5004), 0)
+	geo.SetFeature(peopleKey(""), c, testFeature(c, 40.01, -105.49), 0)
+	t.Cleanup(func() {
+		for _, id := range []string{a, b, c} {
+			geo.DelFeature(peopleKey(""), id)
+		}
+	})
+	if n := roomOccupants(id); n != 2 {
+		t.Fatalf("got %d occupants, want the 2 people inside", n)
+	}
+}
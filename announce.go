@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// announceMovement tells the members of a room inside of it, on this
+// instance, that a person entered or exited it with a system chat message,
+// and sends an entering person the people already inside. Hidden people
+// enter and exit without an announcement.
+func announceMovement(detect, roomID, msg string) {
+	if !cfg.Announce {
+		return
+	}
+	clientID := gjson.Get(msg, "object.id").String()
+	feature := secureFeature(gjson.Get(msg, "object").Raw)
+	roommu.Lock()
+	room, ok := rooms[roomID]
+	if !ok {
+		roommu.Unlock()
+		return
+	}
+	name, object := room.Name, room.Object
+	members := make([]string, 0, len(room.members))
+	for member := range room.members {
+		if member != clientID {
+			members = append(members, member)
+		}
+	}
+	roommu.Unlock()
+
+	ns, fenceID := splitRoom(roomID)
+	if detect == "enter" {
+		sendOccupants(clientID, ns, fenceID, object)
+	}
+	if isHidden(feature) {
+		return
+	}
+	who := profileName(clientID)
+	if who == "" {
+		who = "Someone"
+	}
+	text := who + " entered " + name
+	if detect == "exit" {
+		text = who + " left " + name
+	}
+	amsg, _ := protocol.Encode(protocol.ChatMessage{
+		Envelope: protocol.Envelope{Type: protocol.TypeMessage},
+		Feature:  []byte(shownFeature(feature)),
+		Text:     text,
+		Room:     fenceID,
+		System:   true,
+	})
+	idmu.Lock()
+	var conns []string
+	for _, member := range members {
+		if connID, ok := clientConnM[member]; ok {
+			conns = append(conns, connID)
+		}
+	}
+	idmu.Unlock()
+	for _, connID := range conns {
+		if !hiddenConn(connID, amsg) {
+			send(connID, amsg)
+		}
+	}
+}
+
+// sendOccupants sends a person who entered a room the people inside of it,
+// when the person is connected to this instance
+func sendOccupants(clientID, ns, fenceID, object string) {
+	idmu.Lock()
+	connID, ok := clientConnM[clientID]
+	idmu.Unlock()
+	if !ok {
+		return
+	}
+	people, err := geo.Intersects(floorKey(peopleKey(ns), clientFloor(clientID)), Area{Object: object}, Search{})
+	if err != nil {
+		lg.Error("occupants query failed", "room", fenceID, "err", err)
+		return
+	}
+	features := []json.RawMessage{}
+	for _, p := range people {
+		if p.ID == clientID || isHidden(p.Object) {
+			continue
+		}
+		feature := secureFeature(p.Object)
+		if !hidden(clientID, feature) {
+			features = append(features, json.RawMessage(feature))
+		}
+	}
+	omsg, _ := protocol.Encode(protocol.Occupants{
+		Envelope: protocol.Envelope{Type: protocol.TypeOccupants},
+		Room:     fenceID,
+		Features: features,
+	})
+	send(connID, omsg)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The announcement settings
+const (
+	announcementsKey    = "announcements"     // hash of announcement id -> announcement
+	announcementsDueKey = "announcements:due" // sorted set of ids by next delivery
+	announceInterval    = time.Second         // time between checks for due announcements
+	minAnnounceEvery    = time.Minute         // shortest repeat interval
+	maxAnnounceText     = 1000                // characters of an announcement
+	maxAnnounceSize     = 64 << 10            // bytes of an announcement request
+	maxAnnouncements    = 100                 // due announcements delivered per check
+)
+
+// Announcement is a message of the operators scheduled for everyone inside of
+// a room, or everyone in a namespace when Room is empty. It is delivered at
+// At, and again every Every when it repeats.
+type Announcement struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Room      string    `json:"room,omitempty"` // fence ID of the room
+	Text      string    `json:"text"`
+	At        time.Time `json:"at"`              // next delivery
+	Every     string    `json:"every,omitempty"` // repeat interval, as a duration
+}
+
+// every returns the repeat interval of an announcement, 0 for none
+func (a *Announcement) every() time.Duration {
+	d, _ := time.ParseDuration(a.Every)
+	return d
+}
+
+// check returns a description of the problem when the announcement cannot be
+// scheduled, or an empty string when it can
+func (a *Announcement) check() string {
+	if strings.TrimSpace(a.Text) == "" {
+		return "text is required"
+	}
+	if utf8.RuneCountInString(a.Text) > maxAnnounceText {
+		return "text is too long"
+	}
+	if !knownNamespace(a.Namespace) {
+		return "unknown namespace"
+	}
+	if a.Room != "" && !validFenceID.MatchString(a.Room) {
+		return "invalid room"
+	}
+	if a.Every != "" {
+		d, err := time.ParseDuration(a.Every)
+		if err != nil || d < minAnnounceEvery {
+			return "every must be a duration of at least a minute"
+		}
+	}
+	return ""
+}
+
+// announcementsAPI is an HTTP handler for scheduling announcements. Without
+// an at time an announcement is delivered right away.
+//
+//	GET    /api/announcements       list the scheduled announcements
+//	POST   /api/announcements       schedule an announcement
+//	DELETE /api/announcements/{id}  cancel an announcement
+func announcementsAPI(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/announcements"), "/")
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		list, err := loadAnnouncements()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && id == "":
+		var a Announcement
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnounceSize)).Decode(&a); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if msg := a.check(); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		a.ID = newMessageID()
+		if a.At.IsZero() {
+			a.At = time.Now()
+		}
+		if err := scheduleAnnouncement(&a); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		created, _ := json.Marshal(a)
+		auditRequest(r, "announcement_create", string(created))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	case r.Method == http.MethodDelete && id != "":
+		removed, err := redis.Int(storeDo("HDEL", announcementsKey, id))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		storeDo("ZREM", announcementsDueKey, id)
+		if removed == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		removal, _ := sjson.Set(`{}`, "id", id)
+		auditRequest(r, "announcement_delete", removal)
+		w.WriteHeader(http.StatusNoContent)
+	case id == "":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduleAnnouncement stores an announcement and queues it for its next
+// delivery
+func scheduleAnnouncement(a *Announcement) error {
+	data, _ := json.Marshal(a)
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HSET", announcementsKey, a.ID, data)
+	b.Send("ZADD", announcementsDueKey, a.At.UnixNano()/int64(time.Millisecond), a.ID)
+	_, err := b.Flush()
+	return err
+}
+
+// loadAnnouncements returns the scheduled announcements by their next
+// delivery
+func loadAnnouncements() ([]Announcement, error) {
+	vals, err := redis.StringMap(storeDo("HGETALL", announcementsKey))
+	if err != nil {
+		return nil, err
+	}
+	list := []Announcement{}
+	for _, v := range vals {
+		var a Announcement
+		if json.Unmarshal([]byte(v), &a) == nil {
+			list = append(list, a)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list, nil
+}
+
+// runAnnouncements delivers the due announcements, once per announce
+// interval. Every instance checks, and the one that takes an announcement off
+// the due set delivers it to the whole cluster.
+func runAnnouncements() {
+	for range time.Tick(announceInterval) {
+		if isDraining() {
+			return
+		}
+		now := time.Now()
+		ids, err := redis.Strings(storeDo("ZRANGEBYSCORE", announcementsDueKey,
+			"-inf", now.UnixNano()/int64(time.Millisecond), "LIMIT", 0, maxAnnouncements))
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			if claimed, _ := redis.Int(storeDo("ZREM", announcementsDueKey, id)); claimed == 1 {
+				announceDue(id, now)
+			}
+		}
+	}
+}
+
+// announceDue delivers an announcement that was taken off the due set, and
+// schedules its next delivery or forgets it
+func announceDue(id string, now time.Time) {
+	data, err := redis.String(storeDo("HGET", announcementsKey, id))
+	if err != nil {
+		// cancelled in the meantime
+		return
+	}
+	var a Announcement
+	if err := json.Unmarshal([]byte(data), &a); err != nil {
+		storeDo("HDEL", announcementsKey, id)
+		return
+	}
+	announce(&a)
+	if every := a.every(); every > 0 {
+		for !a.At.After(now) {
+			a.At = a.At.Add(every)
+		}
+		if err := scheduleAnnouncement(&a); err != nil {
+			lg.Error("announcement schedule failed", "id", id, "err", err)
+		}
+		return
+	}
+	storeDo("HDEL", announcementsKey, id)
+}
+
+// announce sends an announcement to the members of its room, or to every
+// connection of its namespace on all instances
+func announce(a *Announcement) {
+	msg, _ := protocol.Encode(protocol.Announcement{
+		Envelope: protocol.Envelope{Type: protocol.TypeAnnouncement},
+		ID:       a.ID,
+		Text:     a.Text,
+		Room:     a.Room,
+	})
+	if a.Room != "" {
+		members := roomMembers(namespaceRoom(a.Namespace, a.Room))
+		deliver(members, msg)
+		lg.Info("announcement sent", "id", a.ID, "room", namespaceRoom(a.Namespace, a.Room),
+			"members", len(members))
+		return
+	}
+	broadcastNamespace(a.Namespace, msg)
+	env, _ := sjson.Set(`{"kind":"announcement"}`, "ns", a.Namespace)
+	publish(env, msg)
+	lg.Info("announcement sent", "id", a.ID, "ns", a.Namespace)
+}
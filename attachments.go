@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The lifetimes of attachments
+const (
+	uploadURLTTL   = 15 * time.Minute   // how long an upload URL can be used
+	uploadTTL      = time.Hour          // how long an upload can be attached to a message
+	downloadURLTTL = 7 * 24 * time.Hour // how long a download URL works, the longest S3 allows
+)
+
+// uploadKey returns the Redis key of an upload slot, by object key
+func uploadKey(objectKey string) string {
+	return "upload:" + objectKey
+}
+
+// uploadMessage is a websocket message handler that hands out an upload slot
+// for an attachment. The size and type are checked against the limits, and
+// the presigned URL only accepts an object of that size and type.
+func uploadMessage(connID, msg string) {
+	var u protocol.Upload
+	if err := protocol.Decode(msg, &u); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if cfg.S3Endpoint == "" {
+		sendError(connID, "unavailable", "Attachments are disabled")
+		return
+	}
+	if err := validateUpload(&u); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before an Upload")
+		return
+	}
+
+	objectKey := "attachments/" + newMessageID()
+	if _, err := storeDo("HMSET", uploadKey(objectKey), "sender", clientID,
+		"type", u.ContentType, "size", u.Size); err != nil {
+		lg.Error("upload slot failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Attachments are unavailable")
+		return
+	}
+	storeDo("EXPIRE", uploadKey(objectKey), int(uploadTTL/time.Second))
+
+	reply, _ := protocol.Encode(protocol.Upload{
+		Envelope:    protocol.Envelope{Type: protocol.TypeUpload},
+		ContentType: u.ContentType,
+		Size:        u.Size,
+		Key:         objectKey,
+		URL: presignS3("PUT", objectKey, map[string]string{
+			"content-type":   u.ContentType,
+			"content-length": strconv.FormatInt(u.Size, 10),
+		}, uploadURLTTL),
+		Expires: time.Now().Add(uploadURLTTL).UnixNano() / int64(time.Millisecond),
+	})
+	send(connID, reply)
+}
+
+// validateUpload checks the size and type of an upload
+func validateUpload(u *protocol.Upload) *validationError {
+	if u.Size <= 0 || u.Size > int64(cfg.MaxUpload) {
+		return invalid("invalid_upload", "Attachment is too large")
+	}
+	for _, typ := range cfg.UploadTypes {
+		if u.ContentType == typ {
+			return nil
+		}
+	}
+	return invalid("invalid_upload", "Attachment type is not allowed")
+}
+
+// resolveAttachment checks that an attachment is an upload of the sender and
+// fills in its type, size and download URL
+func resolveAttachment(clientID string, a *protocol.Attachment) *validationError {
+	if cfg.S3Endpoint == "" {
+		return invalid("unavailable", "Attachments are disabled")
+	}
+	vals, err := redis.StringMap(storeDo("HGETALL", uploadKey(a.Key)))
+	if err != nil {
+		lg.Error("attachment lookup failed", "key", a.Key, "err", err)
+		return invalid("unavailable", "Attachments are unavailable")
+	}
+	if vals["sender"] != clientID {
+		return invalid("invalid_attachment", "Unknown attachment")
+	}
+	a.ContentType = vals["type"]
+	a.Size, _ = strconv.ParseInt(vals["size"], 10, 64)
+	a.URL = presignS3("GET", a.Key, nil, downloadURLTTL)
+	return nil
+}
+
+// presignS3 returns a URL for an object in the S3 bucket, signed with AWS
+// Signature Version 4 so that it can be used without credentials until it
+// expires. The headers are part of the signature and must be sent as given.
+func presignS3(method, objectKey string, headers map[string]string, expires time.Duration) string {
+	endpoint, _ := url.Parse(cfg.S3Endpoint)
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + cfg.S3Region + "/s3/aws4_request"
+
+	// canonical headers, the host always included
+	all := map[string]string{"host": endpoint.Host}
+	for name, value := range headers {
+		all[strings.ToLower(name)] = value
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(all[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    cfg.S3AccessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(expires / time.Second)),
+		"X-Amz-SignedHeaders": signedHeaders,
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = s3Escape(k, true) + "=" + s3Escape(query[k], true)
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	path := strings.TrimSuffix(endpoint.Path, "/") + "/" + cfg.S3Bucket + "/" + objectKey
+	canonicalURI := s3Escape(path, false)
+	canonicalRequest := strings.Join([]string{
+		method, canonicalURI, canonicalQuery, canonicalHeaders.String(),
+		signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.S3SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, cfg.S3Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return endpoint.Scheme + "://" + endpoint.Host + canonicalURI + "?" +
+		canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape URI encodes a string the way Signature Version 4 expects, leaving
+// slashes alone in paths
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
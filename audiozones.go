@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// audioZone is a distance band that voice chat clients attenuate the volume
+// of people by, such as talk for people within 30 meters
+type audioZone struct {
+	Name   string
+	Radius float64 // meters
+}
+
+// validZoneName matches the names of audio zones
+var validZoneName = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// parseAudioZones parses a comma separated list of audio zones with their
+// radius in meters, like whisper=10,talk=30,shout=100. The zones are sorted
+// from the nearest to the farthest.
+func parseAudioZones(s string) ([]audioZone, error) {
+	var zones []audioZone
+	seen := make(map[string]bool)
+	for _, part := range splitList(s) {
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("zone %q has no radius", part)
+		}
+		name := strings.TrimSpace(part[:i])
+		if !validZoneName.MatchString(name) {
+			return nil, fmt.Errorf("invalid zone %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate zone %q", name)
+		}
+		seen[name] = true
+		radius, err := strconv.ParseFloat(strings.TrimSpace(part[i+1:]), 64)
+		if err != nil || radius <= 0 {
+			return nil, fmt.Errorf("invalid radius of zone %q", name)
+		}
+		zones = append(zones, audioZone{name, radius})
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Radius < zones[j].Radius })
+	return zones, nil
+}
+
+// zoneAt returns the nearest audio zone that a distance in meters is in,
+// empty beyond the farthest zone
+func zoneAt(distance float64) string {
+	for _, zone := range cfg.AudioZones {
+		if distance <= zone.Radius {
+			return zone.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+)
+
+// The audit log settings
+const (
+	auditQueue   = 256 // entries waiting to be written
+	auditPage    = 50  // entries per page of the audit API
+	maxAuditPage = 500 // entries per page a client can ask for
+)
+
+// The actors of audited actions that are not people
+const (
+	auditAdmin  = "admin"  // an operator with the admin token
+	auditServer = "server" // the server itself
+)
+
+// auditEntry is an entry of the audit log
+type auditEntry struct {
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"`
+	Addr    string          `json:"addr,omitempty"`
+	Action  string          `json:"action"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// validStreamID matches the ids of the entries of a Redis stream
+var validStreamID = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
+
+var (
+	auditEntries chan string // audit entries waiting to be written
+	auditmu      sync.Mutex  // guard auditFile
+	auditFile    *os.File    // audit log file, nil for a Redis stream
+	auditStream  string      // Redis stream of the audit log
+)
+
+// startAudit opens the audit log when one is configured. The audit log is an
+// append-only file of JSON lines, or a Redis stream for "redis:<key>", that
+// every administrative and moderation action is written to.
+func startAudit() error {
+	if cfg.Audit == "" {
+		return nil
+	}
+	auditEntries = make(chan string, auditQueue)
+	if strings.HasPrefix(cfg.Audit, "redis:") {
+		auditStream = strings.TrimPrefix(cfg.Audit, "redis:")
+	} else {
+		f, err := os.OpenFile(cfg.Audit, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		auditFile = f
+	}
+	go writeAudit()
+	return nil
+}
+
+// audit adds an action to the audit log, with its actor, the address it came
+// from when known and its payload as JSON. Unlike the recorder the audit log
+// does not drop entries, and audit blocks while the queue is full.
+func audit(actor, addr, action, payload string) {
+	if auditEntries == nil {
+		return
+	}
+	entry, _ := json.Marshal(auditEntry{
+		Time:    time.Now().UTC(),
+		Actor:   actor,
+		Addr:    addr,
+		Action:  action,
+		Payload: json.RawMessage(payload),
+	})
+	auditEntries <- string(entry)
+}
+
+// auditRequest adds an action taken with the admin API to the audit log
+func auditRequest(r *http.Request, action, payload string) {
+	var addr string
+	if ip := clientIP(r); ip != nil {
+		addr = ip.String()
+	}
+	audit(auditAdmin, addr, action, payload)
+}
+
+// writeAudit writes the queued audit entries to the file or the stream
+func writeAudit() {
+	for entry := range auditEntries {
+		if auditFile == nil {
+			if _, err := storeDo("XADD", auditStream, "*", "entry", entry); err != nil {
+				lg.Error("audit failed", "stream", auditStream, "err", err)
+			}
+			continue
+		}
+		auditmu.Lock()
+		_, err := auditFile.WriteString(entry + "\n")
+		auditmu.Unlock()
+		if err != nil {
+			lg.Error("audit failed", "file", auditFile.Name(), "err", err)
+		}
+	}
+}
+
+// auditAPI is an HTTP handler for the audit log, newest entries first. Each
+// entry has an id, and a page with more entries after it has the id to pass
+// as before for the next page as "next".
+//
+//	GET /api/admin/audit?limit=50&before={id}  a page of audit entries
+func auditAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if auditEntries == nil {
+		http.Error(w, "audit log is disabled", http.StatusConflict)
+		return
+	}
+	limit := auditPage
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxAuditPage {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	before := r.URL.Query().Get("before")
+	var ids, entries []string
+	var err error
+	if auditFile == nil {
+		ids, entries, err = auditStreamPage(before, limit)
+	} else {
+		ids, entries, err = auditFilePage(before, limit)
+	}
+	if err == errInvalidCursor {
+		http.Error(w, "invalid before", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	page := `{"entries":[]}`
+	for i, entry := range entries {
+		entry, _ = sjson.Set(entry, "id", ids[i])
+		page, _ = sjson.SetRaw(page, "entries.-1", entry)
+	}
+	if len(entries) == limit {
+		page, _ = sjson.Set(page, "next", ids[len(ids)-1])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(page))
+}
+
+// errInvalidCursor is returned for a before id that is not an audit entry id
+var errInvalidCursor = errors.New("invalid audit cursor")
+
+// auditStreamPage returns up to limit entries of the audit stream before an
+// id, or the newest ones without one, with their stream ids
+func auditStreamPage(before string, limit int) (ids, entries []string, err error) {
+	end, count := "+", limit
+	if before != "" {
+		if !validStreamID.MatchString(before) {
+			return nil, nil, errInvalidCursor
+		}
+		// the range includes the before entry, which is skipped
+		end, count = before, limit+1
+	}
+	values, err := redis.Values(storeDo("XREVRANGE", auditStream, end, "-", "COUNT", count))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, value := range values {
+		item, err := redis.Values(value, nil)
+		if err != nil || len(item) != 2 {
+			continue
+		}
+		id, _ := redis.String(item[0], nil)
+		fields, _ := redis.StringMap(item[1], nil)
+		if id == before || len(entries) == limit {
+			continue
+		}
+		ids = append(ids, id)
+		entries = append(entries, fields["entry"])
+	}
+	return ids, entries, nil
+}
+
+// auditFilePage returns up to limit entries of the audit file before an id,
+// or the newest ones without one. The ids of entries are their line numbers.
+func auditFilePage(before string, limit int) (ids, entries []string, err error) {
+	end := -1
+	if before != "" {
+		if end, err = strconv.Atoi(before); err != nil || end < 1 {
+			return nil, nil, errInvalidCursor
+		}
+	}
+	auditmu.Lock()
+	defer auditmu.Unlock()
+	if _, err := auditFile.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	// keep the last limit lines before the end in a ring
+	ring := make([]string, limit)
+	rd := bufio.NewReader(auditFile)
+	var n int
+	for end < 0 || n+1 < end {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		ring[n%limit] = strings.TrimSuffix(line, "\n")
+		n++
+	}
+	for i := n; i > 0 && n-i < limit; i-- {
+		ids = append(ids, strconv.Itoa(i))
+		entries = append(entries, ring[(i-1)%limit])
+	}
+	return ids, entries, nil
+}
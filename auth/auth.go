@@ -0,0 +1,117 @@
+// Package auth verifies the identity of clients connecting to the chat server.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// ErrNoToken is returned when a request does not carry a token
+	ErrNoToken = errors.New("auth: no token")
+	// ErrInvalidToken is returned when a token is malformed or its signature
+	// does not match
+	ErrInvalidToken = errors.New("auth: invalid token")
+	// ErrExpiredToken is returned when a token is expired or not yet valid
+	ErrExpiredToken = errors.New("auth: token expired")
+)
+
+// Verifier verifies a token and returns the user ID that it is bound to
+type Verifier interface {
+	Verify(token string) (userID string, err error)
+}
+
+// VerifierFunc is an adapter to allow the use of ordinary functions as a
+// Verifier, such as a lookup of opaque tokens in an external store
+type VerifierFunc func(token string) (userID string, err error)
+
+// Verify calls f(token)
+func (f VerifierFunc) Verify(token string) (string, error) {
+	return f(token)
+}
+
+// JWT is a Verifier for HS256 signed JSON Web Tokens. The user ID is taken
+// from the "sub" claim.
+type JWT struct {
+	Secret []byte           // The shared HMAC secret
+	Now    func() time.Time // Optional clock, defaults to time.Now
+}
+
+// Verify checks the signature and the "exp" and "nbf" claims of the token
+func (j *JWT) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if gjson.GetBytes(header, "alg").String() != "HS256" {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, j.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", ErrInvalidToken
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	now := time.Now
+	if j.Now != nil {
+		now = j.Now
+	}
+	ts := now().Unix()
+	if exp := gjson.GetBytes(claims, "exp"); exp.Exists() && ts >= exp.Int() {
+		return "", ErrExpiredToken
+	}
+	if nbf := gjson.GetBytes(claims, "nbf"); nbf.Exists() && ts < nbf.Int() {
+		return "", ErrExpiredToken
+	}
+	sub := gjson.GetBytes(claims, "sub").String()
+	if sub == "" {
+		return "", ErrInvalidToken
+	}
+	return sub, nil
+}
+
+// Claim returns a string claim of a JSON Web Token, or an empty string when
+// the token does not have the claim or is not a JWT. The token is not
+// verified, only use Claim on tokens that passed Verify.
+func Claim(token, name string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	return gjson.GetBytes(claims, name).String()
+}
+
+// TokenFromRequest returns the token from the "Authorization: Bearer" header
+// or, because browsers cannot set headers on websocket requests, from the
+// "token" query parameter
+func TokenFromRequest(r *http.Request) (string, error) {
+	if v := r.Header.Get("Authorization"); strings.HasPrefix(v, "Bearer ") {
+		return strings.TrimPrefix(v, "Bearer "), nil
+	}
+	if v := r.URL.Query().Get("token"); v != "" {
+		return v, nil
+	}
+	return "", ErrNoToken
+}
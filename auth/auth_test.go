@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sign returns an HS256 JWT with claims signed with a secret
+func sign(secret, claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	payload := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return payload + "." + enc(mac.Sum(nil))
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Unix(1000, 0)
+	j := &JWT{Secret: []byte("secret"), Now: func() time.Time { return now }}
+	if sub, err := j.Verify(sign("secret", `{"sub":"ann","exp":2000,"nbf":500}`)); err != nil || sub != "ann" {
+		t.Fatalf("got %q, %v", sub, err)
+	}
+	for token, want := range map[string]error{
+		sign("other", `{"sub":"ann"}`):             ErrInvalidToken,
+		sign("secret", `{"sub":"ann","exp":1000}`): ErrExpiredToken,
+		sign("secret", `{"sub":"ann","nbf":1001}`): ErrExpiredToken,
+		sign("secret", `{"exp":2000}`):             ErrInvalidToken,
+		"a.b":                                      ErrInvalidToken,
+		"eyJhbGciOiJub25lIn0.e30.":                 ErrInvalidToken,
+	} {
+		if _, err := j.Verify(token); err != want {
+			t.Errorf("%s: got %v, want %v", token, err, want)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	token := sign("secret", `{"sub":"ann","name":"Ann Smith"}`)
+	if name := Claim(token, "name"); name != "Ann Smith" {
+		t.Fatalf("got %q", name)
+	}
+	if name := Claim("opaque", "name"); name != "" {
+		t.Fatalf("got %q for a token that is not a JWT", name)
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?token=query", nil)
+	if token, err := TokenFromRequest(r); err != nil || token != "query" {
+		t.Fatalf("query: got %q, %v", token, err)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if token, err := TokenFromRequest(r); err != nil || token != "header" {
+		t.Fatalf("header: got %q, %v", token, err)
+	}
+	if _, err := TokenFromRequest(httptest.NewRequest("GET", "/ws", nil)); err != ErrNoToken {
+		t.Fatalf("got %v, want ErrNoToken", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// batch pipelines commands on a single connection. Commands are queued with
+// Send and all of their replies are read at once with Flush, so a batch costs
+// one round trip and one pool connection no matter how many queries it holds.
+type batch struct {
+	conn redis.Conn
+	n    int // number of replies pending
+}
+
+// newBatch starts a batch on a connection from the pool. The batch must be
+// closed when done.
+func newBatch(p *redis.Pool) *batch {
+	return &batch{conn: p.Get()}
+}
+
+// Send queues a command
+func (b *batch) Send(cmd string, args ...interface{}) error {
+	if err := b.conn.Send(cmd, args...); err != nil {
+		return err
+	}
+	b.n++
+	return nil
+}
+
+// Flush sends all queued commands and returns their replies in order. A
+// command that failed on the server has its redis.Error as reply, the error
+// is only returned for connection failures.
+func (b *batch) Flush() (replies []interface{}, err error) {
+	span := storeSpan("pipeline", attribute.Int("commands", b.n))
+	defer func() { endStoreSpan(span, err) }()
+	if err := b.conn.Flush(); err != nil {
+		return nil, err
+	}
+	replies = make([]interface{}, 0, b.n)
+	for ; b.n > 0; b.n-- {
+		reply, err := b.conn.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return nil, err
+			}
+			reply = err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// Do executes a single command on the connection of the batch
+func (b *batch) Do(cmd string, args ...interface{}) (interface{}, error) {
+	span := storeSpan(cmd)
+	reply, err := b.conn.Do(cmd, args...)
+	endStoreSpan(span, err)
+	return reply, err
+}
+
+// Close releases the connection of the batch
+func (b *batch) Close() error {
+	return b.conn.Close()
+}
+
+// QueryNearbyAndPlaces returns the clientIDs of all people of a namespace and
+// floor within meters of a point and the ids of all rooms of the floor
+// containing it. Both searches run at the same time.
+func QueryNearbyAndPlaces(ns, floor string, lat, lng, meters float64) (clientIDs, roomIDs []string, err error) {
+	var roomErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		point := `{"type":"Point","coordinates":[` +
+			strconv.FormatFloat(lng, 'f', -1, 64) + `,` +
+			strconv.FormatFloat(lat, 'f', -1, 64) + `]}`
+		var rooms []Object
+		rooms, roomErr = geo.Intersects(roomsKey(ns), Area{Object: point}, Search{IDs: true})
+		for _, room := range rooms {
+			if roomID := namespaceRoom(ns, room.ID); roomOnFloor(roomID, floor) {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}()
+	clientIDs, err = nearbyIDs(ns, floor, lat, lng, meters)
+	<-done
+	if err == nil {
+		err = roomErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientIDs, roomIDs, nil
+}
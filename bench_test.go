@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// benchFeature is the feature of a person as stored in the people collection
+const benchFeature = `{"type":"Feature","id":"aaaaaaaaaaaaaaaaaaaaaaaa",` +
+	`"properties":{"name":"Ann","color":"#e91e63"},` +
+	`"geometry":{"type":"Point","coordinates":[-104.9903,39.7392]}}`
+
+var benchOnce sync.Once
+
+// benchInit sets up the state that the server sets up in main, with the
+// default config and send queues
+func benchInit(b *testing.B) {
+	benchOnce.Do(func() {
+		var err error
+		if cfg, err = loadConfig(nil); err != nil {
+			b.Fatal(err)
+		}
+		h.QueueSize = cfg.SendQueue
+		h.Workers = cfg.SendWorkers
+		connClientM = make(map[string]string)
+		clientConnM = make(map[string]string)
+		secureM = make(map[string]string)
+		connNSM = make(map[string]string)
+		sessionM = make(map[string]*session)
+		connSessionM = make(map[string]*session)
+		clientSessionM = make(map[string]*session)
+		profileM = make(map[string]string)
+		blockM = make(map[string]map[string]string)
+	})
+}
+
+// benchConns opens n websocket connections to the handler that discard the
+// frames they receive, each bound to a person with an empty block list. It
+// returns the clientIDs of the people and a func that closes the connections.
+func benchConns(b *testing.B, n int) ([]string, func()) {
+	benchInit(b)
+	srv := httptest.NewServer(&h)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	var conns []*websocket.Conn
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		srv.Close()
+	}
+	for i := 0; i < n; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			closeAll()
+			b.Fatal(err)
+		}
+		conns = append(conns, conn)
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); connCount() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			closeAll()
+			b.Fatal("connections were not registered")
+		}
+	}
+
+	var clientIDs []string
+	idmu.Lock()
+	blockmu.Lock()
+	h.Range(func(connID string, _ *socket.Conn) bool {
+		clientID := fmt.Sprintf("%024x", len(clientIDs))
+		connClientM[connID] = clientID
+		clientConnM[clientID] = connID
+		blockM[clientID] = make(map[string]string)
+		clientIDs = append(clientIDs, clientID)
+		return true
+	})
+	blockmu.Unlock()
+	idmu.Unlock()
+	return clientIDs, func() {
+		idmu.Lock()
+		blockmu.Lock()
+		for _, clientID := range clientIDs {
+			delete(connClientM, clientConnM[clientID])
+			delete(clientConnM, clientID)
+			delete(secureM, secureClientID(clientID))
+			delete(blockM, clientID)
+		}
+		blockmu.Unlock()
+		idmu.Unlock()
+		closeAll()
+		for connCount() > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// connCount returns the number of connections of the handler
+func connCount() int {
+	return h.Len()
+}
+
+// BenchmarkBroadcastLocal measures sending a notification to every
+// connection of the instance
+func BenchmarkBroadcastLocal(b *testing.B) {
+	msg := notification(protocol.TypeFeature, secureFeature(benchFeature), "", false)
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			_, closeAll := benchConns(b, n)
+			defer closeAll()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				broadcastLocal(msg)
+			}
+		})
+	}
+}
+
+// BenchmarkDeliver measures delivering a chat message to the people around
+// the sender, through their block lists
+func BenchmarkDeliver(b *testing.B) {
+	msg, _ := protocol.Encode(protocol.ChatMessage{
+		Envelope: protocol.Envelope{Type: protocol.TypeMessage},
+		ID:       newMessageID(),
+		Feature:  []byte(secureFeature(benchFeature)),
+		Text:     "hello",
+	})
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("recipients=%d", n), func(b *testing.B) {
+			clientIDs, closeAll := benchConns(b, n)
+			defer closeAll()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				deliver(clientIDs, msg)
+			}
+		})
+	}
+}
+
+// BenchmarkConnectedClients measures counting the connected clients, which
+// the stats and the tombstones of the viewports walk
+func BenchmarkConnectedClients(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			_, closeAll := benchConns(b, n)
+			defer closeAll()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if connCount() != n {
+					b.Fatal("connections changed")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSecureFeature measures re-hashing the id of a feature, which
+// every notification about a person does
+func BenchmarkSecureFeature(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		secureFeature(benchFeature)
+	}
+}
+
+// BenchmarkRelativeFeature measures setting the distance and the bearing of
+// someone nearby on their feature
+func BenchmarkRelativeFeature(b *testing.B) {
+	person := gjson.Parse(benchFeature)
+	nearby := gjson.Parse(strings.Replace(benchFeature, "-104.9903", "-104.9901", 1))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		relativeFeature(person, nearby)
+	}
+}
+
+// BenchmarkAttachProfile measures setting the profile of a person on their
+// feature with sjson.SetRaw, as every Feature and chat message does
+func BenchmarkAttachProfile(b *testing.B) {
+	benchInit(b)
+	clientID := gjson.Get(benchFeature, "id").String()
+	profilemu.Lock()
+	profileM[clientID] = `{"id":"` + secureClientID(clientID) + `","name":"Ann","avatar":"https://example.com/ann.png"}`
+	profilemu.Unlock()
+	defer forgetProfile(clientID)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		attachProfile(clientID, benchFeature)
+	}
+}
+
+// BenchmarkNotification measures encoding a notification about a feature
+func BenchmarkNotification(b *testing.B) {
+	feature := secureFeature(benchFeature)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		notification(protocol.TypeNearby, feature, "", false)
+	}
+}
@@ -0,0 +1,360 @@
+// Package bot runs virtual participants of the chat. A bot is a person on the
+// map at a fixed position, or walking a script of stops, that answers the
+// slash commands of the people around it in the chat of its rooms.
+//
+//	b := bot.New("Concierge")
+//	b.Script = []bot.Stop{{Lat: 39.7425, Lng: -104.9965}}
+//	b.Command("ping", "answers pong", func(r *bot.Request) string {
+//		return "pong"
+//	})
+//	log.Fatal(b.Run(":8000"))
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/client"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The bot settings
+const (
+	DefaultSpeed  = 1.4              // meters per second walked between stops
+	stepInterval  = time.Second      // time between positions while walking
+	roomsInterval = 10 * time.Second // time between refreshes of the rooms
+	profileWait   = 10 * time.Second // time to wait for the reply to the profile
+)
+
+// Stop is a position of the script of a bot, where it stays for a while
+// before walking on to the next one
+type Stop struct {
+	Lat, Lng float64
+	Stay     time.Duration
+}
+
+// Room is a room that a bot is inside of
+type Room struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Occupants int    `json:"occupants"`
+}
+
+// Request is a command sent to a bot
+type Request struct {
+	Bot      *Bot
+	Message  protocol.ChatMessage // the chat message of the command
+	Sender   string               // display name of the sender, empty when unknown
+	Lat, Lng float64              // position of the sender
+	Command  string               // name of the command, without the slash
+	Args     string               // text after the command
+}
+
+// Command answers a request. An empty answer sends nothing.
+type Command func(r *Request) string
+
+// command is a registered command with its help
+type command struct {
+	help string
+	fn   Command
+}
+
+// Bot is a virtual participant of the chat. Set its fields before Run.
+type Bot struct {
+	Name    string         // display name
+	Color   string         // color of the marker, empty for the default one
+	Script  []Stop         // positions, a single stop for a fixed position
+	Speed   float64        // meters per second between stops, 0 uses DefaultSpeed
+	Options client.Options // connection settings, such as the Namespace and Token
+
+	commands map[string]command
+
+	mu      sync.Mutex
+	c       *client.Client
+	rooms   []Room
+	done    chan struct{}
+	profile chan error // the reply to the profile
+}
+
+// New returns a bot with a help command
+func New(name string) *Bot {
+	b := &Bot{Name: name, commands: make(map[string]command),
+		done: make(chan struct{}), profile: make(chan error, 1)}
+	b.Command("help", "lists the commands", helpCommand)
+	return b
+}
+
+// Command registers a command, answered to messages like "/name args"
+func (b *Bot) Command(name, help string, fn Command) {
+	b.commands[strings.ToLower(name)] = command{help, fn}
+}
+
+// Run connects the bot to the server at addr and walks its script until the
+// bot is closed. It puts the bot at the first stop and sets its profile
+// before walking, and returns the error of a profile that the server refused.
+func (b *Bot) Run(addr string) error {
+	if len(b.Script) == 0 {
+		return errors.New("bot: no script")
+	}
+	if b.Speed <= 0 {
+		b.Speed = DefaultSpeed
+	}
+	opts := b.Options
+	if b.Color != "" {
+		if opts.Properties == nil {
+			opts.Properties = map[string]interface{}{}
+		}
+		opts.Properties["color"] = b.Color
+	}
+	opts.OnMessage = b.onMessage
+	opts.OnNotification = b.onNotification
+	opts.OnFrame = b.onFrame
+	c, err := client.Connect(addr, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	b.mu.Lock()
+	b.c = c
+	b.mu.Unlock()
+	// the server takes a profile only from a person on the map
+	start := b.Script[0]
+	if err := c.UpdatePosition(start.Lat, start.Lng); err != nil {
+		return err
+	}
+	if err := c.SetProfile(protocol.Profile{Name: b.Name, Color: b.Color}); err != nil {
+		return err
+	}
+	select {
+	case err := <-b.profile:
+		if err != nil {
+			return err
+		}
+	case <-time.After(profileWait):
+		return errors.New("bot: no reply to the profile")
+	case <-b.done:
+		return nil
+	}
+	go b.refreshRooms()
+	b.walk()
+	return nil
+}
+
+// Close disconnects the bot
+func (b *Bot) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+}
+
+// Client returns the client of a running bot
+func (b *Bot) Client() *client.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.c
+}
+
+// Rooms returns the rooms that the bot is inside of, with their occupants
+func (b *Bot) Rooms() []Room {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Room(nil), b.rooms...)
+}
+
+// Position returns the position of the bot
+func (b *Bot) Position() (lat, lng float64) {
+	return b.Client().Position()
+}
+
+// Say sends a chat message to the people around the bot
+func (b *Bot) Say(text string) error {
+	_, err := b.Client().Send(text)
+	return err
+}
+
+// walk moves the bot along its script until it is closed, staying at every
+// stop and walking straight to the next one
+func (b *Bot) walk() {
+	c := b.Client()
+	for i := 0; ; i = (i + 1) % len(b.Script) {
+		stop := b.Script[i]
+		c.UpdatePosition(stop.Lat, stop.Lng)
+		if len(b.Script) == 1 {
+			<-b.done
+			return
+		}
+		if !b.wait(stop.Stay) {
+			return
+		}
+		next := b.Script[(i+1)%len(b.Script)]
+		steps := int(Distance(stop.Lat, stop.Lng, next.Lat, next.Lng) / (b.Speed * stepInterval.Seconds()))
+		for s := 1; s < steps; s++ {
+			if !b.wait(stepInterval) {
+				return
+			}
+			f := float64(s) / float64(steps)
+			c.UpdatePosition(stop.Lat+(next.Lat-stop.Lat)*f, stop.Lng+(next.Lng-stop.Lng)*f)
+		}
+		if !b.wait(stepInterval) {
+			return
+		}
+	}
+}
+
+// wait waits for a while, returning false when the bot was closed
+func (b *Bot) wait(d time.Duration) bool {
+	select {
+	case <-b.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// refreshRooms asks for the rooms of the bot now and then, so that their
+// occupants stay current
+func (b *Bot) refreshRooms() {
+	tick := time.NewTicker(roomsInterval)
+	defer tick.Stop()
+	for {
+		b.askRooms()
+		select {
+		case <-b.done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// askRooms asks the server for the rooms of the bot
+func (b *Bot) askRooms() {
+	if c := b.Client(); c != nil {
+		c.SendFrame(protocol.Envelope{Type: protocol.TypeRooms})
+	}
+}
+
+// onFrame keeps the rooms of the server's Rooms replies, and passes on the
+// reply to the profile
+func (b *Bot) onFrame(typ, frame string) {
+	switch typ {
+	case protocol.TypeProfile:
+		b.replyProfile(nil)
+		return
+	case protocol.TypeError:
+		var e protocol.Error
+		if protocol.Decode(frame, &e) == nil && e.Request == protocol.TypeSetProfile {
+			b.replyProfile(fmt.Errorf("bot: profile: %s (%s)", e.Message, e.Code))
+		}
+		return
+	case protocol.TypeRooms:
+	default:
+		return
+	}
+	var rooms []Room
+	if err := json.Unmarshal([]byte(gjson.Get(frame, "rooms").Raw), &rooms); err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.rooms = rooms
+	b.mu.Unlock()
+}
+
+// replyProfile passes on the reply to the profile, unless one is waiting
+func (b *Bot) replyProfile(err error) {
+	select {
+	case b.profile <- err:
+	default:
+	}
+}
+
+// onNotification asks for the rooms again when the bot enters or leaves one
+func (b *Bot) onNotification(n protocol.Notification) {
+	if n.Me && (n.Type == protocol.TypeInside || n.Type == protocol.TypeOutside) {
+		go b.askRooms()
+	}
+}
+
+// onMessage answers the commands in the chat messages of others
+func (b *Bot) onMessage(m protocol.ChatMessage) {
+	text := strings.TrimSpace(m.Text)
+	if m.System || !strings.HasPrefix(text, "/") {
+		return
+	}
+	c := b.Client()
+	feature := string(m.Feature)
+	if c == nil || gjson.Get(feature, "id").String() == c.SecureID() {
+		return
+	}
+	name, args := text[1:], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	cmd, ok := b.commands[strings.ToLower(name)]
+	if !ok {
+		return
+	}
+	r := &Request{
+		Bot:     b,
+		Message: m,
+		Sender:  gjson.Get(feature, "properties.name").String(),
+		Lat:     gjson.Get(feature, "geometry.coordinates.1").Float(),
+		Lng:     gjson.Get(feature, "geometry.coordinates.0").Float(),
+		Command: strings.ToLower(name),
+		Args:    args,
+	}
+	go func() {
+		if answer := cmd.fn(r); answer != "" {
+			b.Say(answer)
+		}
+	}()
+}
+
+// helpCommand lists the commands of a bot
+func helpCommand(r *Request) string {
+	names := make([]string, 0, len(r.Bot.commands))
+	for name := range r.Bot.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{"Commands:"}
+	for _, name := range names {
+		lines = append(lines, "/"+name+" "+r.Bot.commands[name].help)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Distance returns the distance in meters between two positions
+func Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	const radius = 6371e3
+	φ1, φ2 := lat1*math.Pi/180, lat2*math.Pi/180
+	Δφ, Δλ := φ2-φ1, (lng2-lng1)*math.Pi/180
+	a := math.Sin(Δφ/2)*math.Sin(Δφ/2) + math.Cos(φ1)*math.Cos(φ2)*math.Sin(Δλ/2)*math.Sin(Δλ/2)
+	return 2 * radius * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Bearing returns the initial bearing in degrees from one position to another
+func Bearing(lat1, lng1, lat2, lng2 float64) float64 {
+	φ1, φ2 := lat1*math.Pi/180, lat2*math.Pi/180
+	Δλ := (lng2 - lng1) * math.Pi / 180
+	y := math.Sin(Δλ) * math.Cos(φ2)
+	x := math.Cos(φ1)*math.Sin(φ2) - math.Sin(φ1)*math.Cos(φ2)*math.Cos(Δλ)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// Compass returns the compass point of a bearing, like "north-east"
+func Compass(bearing float64) string {
+	points := []string{"north", "north-east", "east", "south-east",
+		"south", "south-west", "west", "north-west"}
+	return points[int(math.Mod(bearing+22.5, 360)/45)]
+}
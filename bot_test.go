@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/bot"
+)
+
+func TestBotProfile(t *testing.T) {
+	url := testServer(t)
+	b := bot.New("Concierge")
+	b.Options.ID = testID(1)
+	b.Script = []bot.Stop{{Lat: 39.7425, Lng: -104.9965}}
+	errc := make(chan error, 1)
+	go func() { errc <- b.Run(url) }()
+	defer b.Close()
+	waitFor(t, func() bool {
+		return gjson.Get(loadProfile(b.Options.ID), "name").String() == "Concierge"
+	})
+	select {
+	case err := <-errc:
+		t.Fatalf("run: %v", err)
+	default:
+	}
+}
+
+func TestBotProfileRefused(t *testing.T) {
+	b := bot.New(strings.Repeat("n", maxNameLen+1))
+	b.Options.ID = testID(2)
+	b.Script = []bot.Stop{{Lat: 39.7425, Lng: -104.9965}}
+	defer b.Close()
+	if err := b.Run(testServer(t)); err == nil || !strings.Contains(err.Error(), "invalid_profile") {
+		t.Fatalf("got %v, want the error of the profile", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// instanceID uniquely identifies this server instance on the message bus
+var instanceID = func() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}()
+
+// deliver sends a message to the connections of clientIDs. Clients that are
+// not connected to this instance are handed to the other instances over the
+// message bus. Returns the number of clients it was sent to on this instance.
+func deliver(clientIDs []string, msg string) int {
+	return deliverTracked("", clientIDs, msg)
+}
+
+// deliverTracked is deliver for a chat message with a delivery status. Every
+// instance counts the clients that it sent the message to.
+func deliverTracked(msgID string, clientIDs []string, msg string) int {
+	var remote []string
+	var delivered int
+	m := socket.NewMessage(msg)
+	for _, clientID := range clientIDs {
+		known, sent := sendVisible(clientID, m)
+		if !known {
+			remote = append(remote, clientID)
+		} else if sent {
+			delivered++
+		}
+	}
+	if len(remote) > 0 {
+		env := `{"kind":"deliver"}`
+		env, _ = sjson.Set(env, "to", remote)
+		if msgID != "" {
+			env, _ = sjson.Set(env, "status", msgID)
+		}
+		publish(env, msg)
+	}
+	return delivered
+}
+
+// broadcast sends a message to every connection on every instance
+func broadcast(msg string) {
+	broadcastLocal(msg)
+	publish(`{"kind":"broadcast"}`, msg)
+}
+
+// broadcastLocal sends a message to every connection on this instance
+func broadcastLocal(msg string) {
+	m := socket.NewMessage(msg)
+	h.Range(func(_ string, c *socket.Conn) bool {
+		sendConn(c, m)
+		return true
+	})
+}
+
+// broadcastNamespace sends a message to every connection of a namespace on
+// this instance
+func broadcastNamespace(ns, msg string) {
+	m := socket.NewMessage(msg)
+	h.Range(func(connID string, c *socket.Conn) bool {
+		if connNamespace(connID) == ns {
+			sendConn(c, m)
+		}
+		return true
+	})
+}
+
+// publish sends an envelope and its message to the other instances
+func publish(env, msg string) {
+	if cfg.BusChannel == "" {
+		return
+	}
+	env, _ = sjson.Set(env, "origin", instanceID)
+	env, _ = sjson.SetRaw(env, "msg", msg)
+	if _, err := storeDo("PUBLISH", cfg.BusChannel, env); err != nil {
+		lg.Error("bus publish failed", "err", err)
+	}
+}
+
+// busSub listens for envelopes from the other instances on the message bus
+// and delivers them to the local connections
+var busSub = &Subscriber{
+	Name: "bus",
+	Handle: func(_ string, data []byte) bool {
+		env := string(data)
+		if gjson.Get(env, "origin").String() == instanceID {
+			return true
+		}
+		return busReceive(env)
+	},
+}
+
+// busReceive handles an envelope from another instance. Returns false when the
+// envelope is not understood.
+func busReceive(env string) bool {
+	msg := gjson.Get(env, "msg").Raw
+	switch gjson.Get(env, "kind").String() {
+	case "deliver":
+		if tp := gjson.Get(msg, "trace").String(); tp != "" {
+			// continue the trace of the chat message of the other instance
+			span := remoteSpan(tp, "bus deliver")
+			defer span.End()
+		}
+		var delivered int
+		m := socket.NewMessage(msg)
+		for _, to := range gjson.Get(env, "to").Array() {
+			if _, sent := sendVisible(to.String(), m); sent {
+				delivered++
+			}
+		}
+		if msgID := gjson.Get(env, "status").String(); msgID != "" {
+			countDelivered(msgID, delivered)
+		}
+	case "broadcast":
+		broadcastLocal(msg)
+	case "fence":
+		// a fence changed on another instance, keep the rooms in sync
+		ns := gjson.Get(env, "ns").String()
+		fenceID := gjson.Get(msg, "id").String()
+		if gjson.Get(msg, "deleted").Bool() {
+			deleteRoom(namespaceRoom(ns, fenceID))
+		} else {
+			putRoom(newNamespaceRoom(ns, fenceID, gjson.Get(msg, "feature").Raw))
+		}
+		broadcastNamespace(ns, msg)
+	case "secure":
+		sendSecure(gjson.Get(env, "to").String(), msg)
+	case "kick":
+		kickClient(gjson.Get(msg, "id").String())
+	case "unshadow":
+		liftShadow(gjson.Get(msg, "id").String())
+	case "gone":
+		tombstone(gjson.Get(env, "ns").String(), msg)
+	case "spectate":
+		spectateLocal(gjson.Get(env, "ns").String(), msg)
+	case "announcement":
+		broadcastNamespace(gjson.Get(env, "ns").String(), msg)
+	case "follow":
+		followChanged(gjson.Get(env, "id").String(), gjson.Get(env, "follower").String(),
+			gjson.Get(env, "added").Bool())
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,751 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: chat.proto
+
+// Package chatpb is the gRPC API of the proximity chat server, for backends
+// that inject positions and chat messages and consume geofence events.
+
+package chatpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Feature is the position of a person. Properties is a JSON object. The
+// feature expires after ttl_seconds without an update, 10 seconds when unset.
+type Feature struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Lat                  float64  `protobuf:"fixed64,3,opt,name=lat,proto3" json:"lat,omitempty"`
+	Lng                  float64  `protobuf:"fixed64,4,opt,name=lng,proto3" json:"lng,omitempty"`
+	Properties           string   `protobuf:"bytes,5,opt,name=properties,proto3" json:"properties,omitempty"`
+	TtlSeconds           int32    `protobuf:"varint,6,opt,name=ttl_seconds,json=ttlSeconds,proto3" json:"ttl_seconds,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Feature) Reset()         { *m = Feature{} }
+func (m *Feature) String() string { return proto.CompactTextString(m) }
+func (*Feature) ProtoMessage()    {}
+func (*Feature) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{0}
+}
+
+func (m *Feature) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Feature.Unmarshal(m, b)
+}
+func (m *Feature) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Feature.Marshal(b, m, deterministic)
+}
+func (m *Feature) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Feature.Merge(m, src)
+}
+func (m *Feature) XXX_Size() int {
+	return xxx_messageInfo_Feature.Size(m)
+}
+func (m *Feature) XXX_DiscardUnknown() {
+	xxx_messageInfo_Feature.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Feature proto.InternalMessageInfo
+
+func (m *Feature) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Feature) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *Feature) GetLat() float64 {
+	if m != nil {
+		return m.Lat
+	}
+	return 0
+}
+
+func (m *Feature) GetLng() float64 {
+	if m != nil {
+		return m.Lng
+	}
+	return 0
+}
+
+func (m *Feature) GetProperties() string {
+	if m != nil {
+		return m.Properties
+	}
+	return ""
+}
+
+func (m *Feature) GetTtlSeconds() int32 {
+	if m != nil {
+		return m.TtlSeconds
+	}
+	return 0
+}
+
+type PublishReply struct {
+	// rooms the person is inside of
+	Rooms                []string `protobuf:"bytes,1,rep,name=rooms,proto3" json:"rooms,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PublishReply) Reset()         { *m = PublishReply{} }
+func (m *PublishReply) String() string { return proto.CompactTextString(m) }
+func (*PublishReply) ProtoMessage()    {}
+func (*PublishReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{1}
+}
+
+func (m *PublishReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PublishReply.Unmarshal(m, b)
+}
+func (m *PublishReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PublishReply.Marshal(b, m, deterministic)
+}
+func (m *PublishReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PublishReply.Merge(m, src)
+}
+func (m *PublishReply) XXX_Size() int {
+	return xxx_messageInfo_PublishReply.Size(m)
+}
+func (m *PublishReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_PublishReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PublishReply proto.InternalMessageInfo
+
+func (m *PublishReply) GetRooms() []string {
+	if m != nil {
+		return m.Rooms
+	}
+	return nil
+}
+
+type RemoveRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RemoveRequest) Reset()         { *m = RemoveRequest{} }
+func (m *RemoveRequest) String() string { return proto.CompactTextString(m) }
+func (*RemoveRequest) ProtoMessage()    {}
+func (*RemoveRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{2}
+}
+
+func (m *RemoveRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RemoveRequest.Unmarshal(m, b)
+}
+func (m *RemoveRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RemoveRequest.Marshal(b, m, deterministic)
+}
+func (m *RemoveRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RemoveRequest.Merge(m, src)
+}
+func (m *RemoveRequest) XXX_Size() int {
+	return xxx_messageInfo_RemoveRequest.Size(m)
+}
+func (m *RemoveRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RemoveRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RemoveRequest proto.InternalMessageInfo
+
+func (m *RemoveRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *RemoveRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+type RemoveReply struct {
+	Removed              bool     `protobuf:"varint,1,opt,name=removed,proto3" json:"removed,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RemoveReply) Reset()         { *m = RemoveReply{} }
+func (m *RemoveReply) String() string { return proto.CompactTextString(m) }
+func (*RemoveReply) ProtoMessage()    {}
+func (*RemoveReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{3}
+}
+
+func (m *RemoveReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RemoveReply.Unmarshal(m, b)
+}
+func (m *RemoveReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RemoveReply.Marshal(b, m, deterministic)
+}
+func (m *RemoveReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RemoveReply.Merge(m, src)
+}
+func (m *RemoveReply) XXX_Size() int {
+	return xxx_messageInfo_RemoveReply.Size(m)
+}
+func (m *RemoveReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_RemoveReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RemoveReply proto.InternalMessageInfo
+
+func (m *RemoveReply) GetRemoved() bool {
+	if m != nil {
+		return m.Removed
+	}
+	return false
+}
+
+// ChatMessage is a chat message from the person with the id, sent at their
+// published position
+type ChatMessage struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Text                 string   `protobuf:"bytes,3,opt,name=text,proto3" json:"text,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ChatMessage) Reset()         { *m = ChatMessage{} }
+func (m *ChatMessage) String() string { return proto.CompactTextString(m) }
+func (*ChatMessage) ProtoMessage()    {}
+func (*ChatMessage) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{4}
+}
+
+func (m *ChatMessage) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ChatMessage.Unmarshal(m, b)
+}
+func (m *ChatMessage) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ChatMessage.Marshal(b, m, deterministic)
+}
+func (m *ChatMessage) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ChatMessage.Merge(m, src)
+}
+func (m *ChatMessage) XXX_Size() int {
+	return xxx_messageInfo_ChatMessage.Size(m)
+}
+func (m *ChatMessage) XXX_DiscardUnknown() {
+	xxx_messageInfo_ChatMessage.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ChatMessage proto.InternalMessageInfo
+
+func (m *ChatMessage) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *ChatMessage) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *ChatMessage) GetText() string {
+	if m != nil {
+		return m.Text
+	}
+	return ""
+}
+
+type SendReply struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Recipients           int32    `protobuf:"varint,2,opt,name=recipients,proto3" json:"recipients,omitempty"`
+	Delivered            int32    `protobuf:"varint,3,opt,name=delivered,proto3" json:"delivered,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SendReply) Reset()         { *m = SendReply{} }
+func (m *SendReply) String() string { return proto.CompactTextString(m) }
+func (*SendReply) ProtoMessage()    {}
+func (*SendReply) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{5}
+}
+
+func (m *SendReply) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SendReply.Unmarshal(m, b)
+}
+func (m *SendReply) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SendReply.Marshal(b, m, deterministic)
+}
+func (m *SendReply) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendReply.Merge(m, src)
+}
+func (m *SendReply) XXX_Size() int {
+	return xxx_messageInfo_SendReply.Size(m)
+}
+func (m *SendReply) XXX_DiscardUnknown() {
+	xxx_messageInfo_SendReply.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SendReply proto.InternalMessageInfo
+
+func (m *SendReply) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *SendReply) GetRecipients() int32 {
+	if m != nil {
+		return m.Recipients
+	}
+	return 0
+}
+
+func (m *SendReply) GetDelivered() int32 {
+	if m != nil {
+		return m.Delivered
+	}
+	return 0
+}
+
+// StreamRequest selects the events of a namespace. Rooms limit the events of
+// rooms to those rooms, and ids limit all events to those of the people.
+// Empty rooms and ids select everything.
+type StreamRequest struct {
+	Namespace            string   `protobuf:"bytes,1,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Rooms                []string `protobuf:"bytes,2,rep,name=rooms,proto3" json:"rooms,omitempty"`
+	Ids                  []string `protobuf:"bytes,3,rep,name=ids,proto3" json:"ids,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StreamRequest) Reset()         { *m = StreamRequest{} }
+func (m *StreamRequest) String() string { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()    {}
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{6}
+}
+
+func (m *StreamRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamRequest.Unmarshal(m, b)
+}
+func (m *StreamRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamRequest.Marshal(b, m, deterministic)
+}
+func (m *StreamRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamRequest.Merge(m, src)
+}
+func (m *StreamRequest) XXX_Size() int {
+	return xxx_messageInfo_StreamRequest.Size(m)
+}
+func (m *StreamRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamRequest proto.InternalMessageInfo
+
+func (m *StreamRequest) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *StreamRequest) GetRooms() []string {
+	if m != nil {
+		return m.Rooms
+	}
+	return nil
+}
+
+func (m *StreamRequest) GetIds() []string {
+	if m != nil {
+		return m.Ids
+	}
+	return nil
+}
+
+// Notification is a geofence event. Type is Nearby or Faraway for people
+// meeting, with the other person as nearby_id, and Inside or Outside for
+// rooms. Ids are the ids that features were published with. Feature is the
+// GeoJSON feature of the person.
+type Notification struct {
+	Type                 string   `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Namespace            string   `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Id                   string   `protobuf:"bytes,3,opt,name=id,proto3" json:"id,omitempty"`
+	NearbyId             string   `protobuf:"bytes,4,opt,name=nearby_id,json=nearbyId,proto3" json:"nearby_id,omitempty"`
+	Room                 string   `protobuf:"bytes,5,opt,name=room,proto3" json:"room,omitempty"`
+	Feature              string   `protobuf:"bytes,6,opt,name=feature,proto3" json:"feature,omitempty"`
+	Time                 int64    `protobuf:"varint,7,opt,name=time,proto3" json:"time,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Notification) Reset()         { *m = Notification{} }
+func (m *Notification) String() string { return proto.CompactTextString(m) }
+func (*Notification) ProtoMessage()    {}
+func (*Notification) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8c585a45e2093e54, []int{7}
+}
+
+func (m *Notification) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Notification.Unmarshal(m, b)
+}
+func (m *Notification) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Notification.Marshal(b, m, deterministic)
+}
+func (m *Notification) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Notification.Merge(m, src)
+}
+func (m *Notification) XXX_Size() int {
+	return xxx_messageInfo_Notification.Size(m)
+}
+func (m *Notification) XXX_DiscardUnknown() {
+	xxx_messageInfo_Notification.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Notification proto.InternalMessageInfo
+
+func (m *Notification) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *Notification) GetNamespace() string {
+	if m != nil {
+		return m.Namespace
+	}
+	return ""
+}
+
+func (m *Notification) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Notification) GetNearbyId() string {
+	if m != nil {
+		return m.NearbyId
+	}
+	return ""
+}
+
+func (m *Notification) GetRoom() string {
+	if m != nil {
+		return m.Room
+	}
+	return ""
+}
+
+func (m *Notification) GetFeature() string {
+	if m != nil {
+		return m.Feature
+	}
+	return ""
+}
+
+func (m *Notification) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*Feature)(nil), "chatpb.Feature")
+	proto.RegisterType((*PublishReply)(nil), "chatpb.PublishReply")
+	proto.RegisterType((*RemoveRequest)(nil), "chatpb.RemoveRequest")
+	proto.RegisterType((*RemoveReply)(nil), "chatpb.RemoveReply")
+	proto.RegisterType((*ChatMessage)(nil), "chatpb.ChatMessage")
+	proto.RegisterType((*SendReply)(nil), "chatpb.SendReply")
+	proto.RegisterType((*StreamRequest)(nil), "chatpb.StreamRequest")
+	proto.RegisterType((*Notification)(nil), "chatpb.Notification")
+}
+
+func init() { proto.RegisterFile("chat.proto", fileDescriptor_8c585a45e2093e54) }
+
+var fileDescriptor_8c585a45e2093e54 = []byte{
+	// 486 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x93, 0xcb, 0x8a, 0x14, 0x31,
+	0x14, 0x86, 0x49, 0x57, 0xdf, 0xea, 0xf4, 0xcc, 0xa8, 0x35, 0x23, 0x84, 0x56, 0xc6, 0xa2, 0x10,
+	0xac, 0x55, 0x23, 0x8a, 0xb8, 0x10, 0x37, 0x2a, 0x82, 0x0b, 0x2f, 0xa4, 0x71, 0xa1, 0x9b, 0x21,
+	0x5d, 0x75, 0xa6, 0x3b, 0x50, 0x37, 0x93, 0xf4, 0x60, 0xbf, 0x8b, 0xef, 0xe0, 0xf3, 0xb9, 0x93,
+	0x24, 0x95, 0xae, 0xea, 0xde, 0x0c, 0xb3, 0x3b, 0xf9, 0x48, 0xce, 0xe5, 0x3f, 0x7f, 0x00, 0xb2,
+	0x0d, 0xd7, 0x8b, 0x46, 0xd6, 0xba, 0x8e, 0xc6, 0x26, 0x6e, 0x56, 0xc9, 0x1f, 0x02, 0x93, 0x8f,
+	0xc8, 0xf5, 0x56, 0x62, 0x74, 0x06, 0x03, 0x91, 0x53, 0x12, 0x93, 0x34, 0x64, 0x03, 0x91, 0x47,
+	0x8f, 0x21, 0xac, 0x78, 0x89, 0xaa, 0xe1, 0x19, 0xd2, 0x81, 0xc5, 0x1d, 0x88, 0xee, 0x43, 0x50,
+	0x70, 0x4d, 0x83, 0x98, 0xa4, 0x84, 0x99, 0xd0, 0x92, 0x6a, 0x4d, 0x87, 0x2d, 0xa9, 0xd6, 0xd1,
+	0x25, 0x40, 0x23, 0xeb, 0x06, 0xa5, 0x16, 0xa8, 0xe8, 0xc8, 0xa6, 0xe8, 0x91, 0xe8, 0x09, 0xcc,
+	0xb4, 0x2e, 0xae, 0x14, 0x66, 0x75, 0x95, 0x2b, 0x3a, 0x8e, 0x49, 0x3a, 0x62, 0xa0, 0x75, 0xb1,
+	0x74, 0x24, 0x79, 0x0a, 0x27, 0xdf, 0xb6, 0xab, 0x42, 0xa8, 0x0d, 0xc3, 0xa6, 0xd8, 0x45, 0x17,
+	0x30, 0x92, 0x75, 0x5d, 0x2a, 0x4a, 0xe2, 0x20, 0x0d, 0x99, 0x3b, 0x24, 0x6f, 0xe1, 0x94, 0x61,
+	0x59, 0xdf, 0x20, 0xc3, 0x5f, 0x5b, 0x54, 0xfa, 0x6e, 0x93, 0x24, 0xcf, 0x60, 0xe6, 0x9f, 0x9b,
+	0x1a, 0x14, 0x26, 0xd2, 0x1e, 0x5d, 0x86, 0x29, 0xf3, 0xc7, 0xe4, 0x2b, 0xcc, 0xde, 0x6f, 0xb8,
+	0xfe, 0x8c, 0x4a, 0xf1, 0xf5, 0x5d, 0xf5, 0x8a, 0x60, 0xa8, 0xf1, 0xb7, 0x13, 0x2c, 0x64, 0x36,
+	0x4e, 0x7e, 0x40, 0xb8, 0xc4, 0x2a, 0x77, 0x75, 0x8f, 0xd3, 0x5d, 0x02, 0x48, 0xcc, 0x44, 0x23,
+	0xb0, 0xd2, 0xca, 0xe6, 0x1b, 0xb1, 0x1e, 0x31, 0xe5, 0x72, 0x2c, 0xc4, 0x0d, 0x4a, 0xcc, 0x6d,
+	0xd6, 0x11, 0xeb, 0x40, 0xf2, 0x1d, 0x4e, 0x97, 0x5a, 0x22, 0x2f, 0xbd, 0x26, 0x07, 0xdd, 0x91,
+	0xe3, 0xee, 0xf6, 0xc2, 0x0e, 0x7a, 0xc2, 0x9a, 0x8d, 0x8a, 0x5c, 0xd1, 0xc0, 0x32, 0x13, 0x26,
+	0x7f, 0x09, 0x9c, 0x7c, 0xa9, 0xb5, 0xb8, 0x16, 0x19, 0xd7, 0xa2, 0xae, 0xec, 0x58, 0xbb, 0xc6,
+	0x67, 0xb4, 0xf1, 0x2d, 0x42, 0xb8, 0x39, 0x83, 0xfd, 0x9c, 0x8f, 0x20, 0xac, 0x90, 0xcb, 0xd5,
+	0xee, 0x4a, 0xe4, 0xd6, 0x3c, 0x21, 0x9b, 0x3a, 0xf0, 0x29, 0x37, 0xe9, 0x4d, 0x2b, 0xad, 0x77,
+	0x6c, 0x6c, 0x16, 0x74, 0xed, 0x2c, 0x6b, 0x1d, 0x13, 0x32, 0x7f, 0xb4, 0xcd, 0x88, 0x12, 0xe9,
+	0x24, 0x26, 0x69, 0xc0, 0x6c, 0xfc, 0xe2, 0x1f, 0x81, 0xa1, 0xd9, 0x5a, 0xf4, 0x1a, 0xce, 0x5a,
+	0x2f, 0x79, 0xc3, 0xdf, 0x5b, 0xb8, 0x5f, 0xb0, 0x68, 0xc1, 0xfc, 0xc2, 0x83, 0x03, 0xd3, 0xbd,
+	0xf1, 0xf6, 0xf2, 0xef, 0x1e, 0xfa, 0x6b, 0x07, 0xae, 0x9b, 0x9f, 0x1f, 0x63, 0xf3, 0xf8, 0x15,
+	0xcc, 0xcc, 0x8a, 0xbd, 0x67, 0xf6, 0x77, 0x7a, 0x46, 0x9a, 0x3f, 0xf0, 0xb0, 0x33, 0xc3, 0x07,
+	0x38, 0x77, 0xeb, 0xeb, 0x8b, 0xad, 0xba, 0xca, 0x07, 0xbb, 0xed, 0xfa, 0xee, 0xdf, 0x7e, 0x4e,
+	0xde, 0x4d, 0x7f, 0xb6, 0xff, 0x7c, 0x35, 0xb6, 0xdf, 0xfe, 0xe5, 0xff, 0x01, 0x00, 0xca, 0xe5,
+	0xf0, 0x54, 0x04, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// ChatClient is the client API for Chat service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type ChatClient interface {
+	// PublishFeature creates or updates the position of a person
+	PublishFeature(ctx context.Context, in *Feature, opts ...grpc.CallOption) (*PublishReply, error)
+	// RemoveFeature removes a person right away, instead of when they expire
+	RemoveFeature(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveReply, error)
+	// SendMessage sends a chat message from a published person to the people
+	// nearby and the rooms they are in
+	SendMessage(ctx context.Context, in *ChatMessage, opts ...grpc.CallOption) (*SendReply, error)
+	// StreamNotifications streams the geofence events of a namespace
+	StreamNotifications(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Chat_StreamNotificationsClient, error)
+}
+
+type chatClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewChatClient(cc *grpc.ClientConn) ChatClient {
+	return &chatClient{cc}
+}
+
+func (c *chatClient) PublishFeature(ctx context.Context, in *Feature, opts ...grpc.CallOption) (*PublishReply, error) {
+	out := new(PublishReply)
+	err := c.cc.Invoke(ctx, "/chatpb.Chat/PublishFeature", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatClient) RemoveFeature(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveReply, error) {
+	out := new(RemoveReply)
+	err := c.cc.Invoke(ctx, "/chatpb.Chat/RemoveFeature", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatClient) SendMessage(ctx context.Context, in *ChatMessage, opts ...grpc.CallOption) (*SendReply, error) {
+	out := new(SendReply)
+	err := c.cc.Invoke(ctx, "/chatpb.Chat/SendMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatClient) StreamNotifications(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Chat_StreamNotificationsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Chat_serviceDesc.Streams[0], "/chatpb.Chat/StreamNotifications", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chatStreamNotificationsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Chat_StreamNotificationsClient interface {
+	Recv() (*Notification, error)
+	grpc.ClientStream
+}
+
+type chatStreamNotificationsClient struct {
+	grpc.ClientStream
+}
+
+func (x *chatStreamNotificationsClient) Recv() (*Notification, error) {
+	m := new(Notification)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ChatServer is the server API for Chat service.
+type ChatServer interface {
+	// PublishFeature creates or updates the position of a person
+	PublishFeature(context.Context, *Feature) (*PublishReply, error)
+	// RemoveFeature removes a person right away, instead of when they expire
+	RemoveFeature(context.Context, *RemoveRequest) (*RemoveReply, error)
+	// SendMessage sends a chat message from a published person to the people
+	// nearby and the rooms they are in
+	SendMessage(context.Context, *ChatMessage) (*SendReply, error)
+	// StreamNotifications streams the geofence events of a namespace
+	StreamNotifications(*StreamRequest, Chat_StreamNotificationsServer) error
+}
+
+func RegisterChatServer(s *grpc.Server, srv ChatServer) {
+	s.RegisterService(&_Chat_serviceDesc, srv)
+}
+
+func _Chat_PublishFeature_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Feature)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatServer).PublishFeature(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/chatpb.Chat/PublishFeature",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatServer).PublishFeature(ctx, req.(*Feature))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chat_RemoveFeature_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatServer).RemoveFeature(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/chatpb.Chat/RemoveFeature",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatServer).RemoveFeature(ctx, req.(*RemoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chat_SendMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatMessage)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatServer).SendMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/chatpb.Chat/SendMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatServer).SendMessage(ctx, req.(*ChatMessage))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Chat_StreamNotifications_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChatServer).StreamNotifications(m, &chatStreamNotificationsServer{stream})
+}
+
+type Chat_StreamNotificationsServer interface {
+	Send(*Notification) error
+	grpc.ServerStream
+}
+
+type chatStreamNotificationsServer struct {
+	grpc.ServerStream
+}
+
+func (x *chatStreamNotificationsServer) Send(m *Notification) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Chat_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "chatpb.Chat",
+	HandlerType: (*ChatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PublishFeature",
+			Handler:    _Chat_PublishFeature_Handler,
+		},
+		{
+			MethodName: "RemoveFeature",
+			Handler:    _Chat_RemoveFeature_Handler,
+		},
+		{
+			MethodName: "SendMessage",
+			Handler:    _Chat_SendMessage_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamNotifications",
+			Handler:       _Chat_StreamNotifications_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "chat.proto",
+}
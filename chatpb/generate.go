@@ -0,0 +1,3 @@
+package chatpb
+
+//go:generate protoc --go_out=plugins=grpc:. chat.proto
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The cleanup settings. Every instance sends a heartbeat with each cleanup,
+// and an instance that missed instanceTimeout worth of them crashed.
+const (
+	instancesKey    = "instances"     // sorted set of instance id -> last heartbeat
+	cleanupInterval = time.Minute     // time between cleanups
+	instanceTimeout = 3 * time.Minute // time without a heartbeat after which an instance is gone
+)
+
+// orphanChans are the channels that the previous cleanup found no room or
+// namespace for. A channel is only deleted when two cleanups in a row find
+// it orphaned, so that fences that another instance just created are kept
+// until the room reaches this instance.
+var orphanChans map[string]bool
+
+// instanceClientsKey returns the Redis key of the people of an instance, by
+// clientID with their namespace
+func instanceClientsKey(instance string) string {
+	return "instance:" + instance + ":clients"
+}
+
+// registerClient records that a person is connected to this instance, so
+// that their feature is cleaned up when the instance crashes
+func registerClient(clientID, ns string) {
+	if _, err := storeDo("HSET", instanceClientsKey(instanceID), clientID, ns); err != nil {
+		lg.Error("client register failed", "client", clientID, "err", err)
+	}
+}
+
+// unregisterClient forgets that a person is connected to this instance
+func unregisterClient(clientID string) {
+	storeDo("HDEL", instanceClientsKey(instanceID), clientID)
+}
+
+// runCleanup removes the state that crashed instances left behind in the
+// GeoStore, on startup and once per cleanup interval
+func runCleanup() {
+	orphanChans = make(map[string]bool)
+	for {
+		if isDraining() {
+			return
+		}
+		now := time.Now()
+		if _, err := storeDo("ZADD", instancesKey, now.UnixNano()/int64(time.Millisecond), instanceID); err == nil {
+			cleanupPeople(now)
+		}
+		cleanupChannels()
+		time.Sleep(cleanupInterval)
+	}
+}
+
+// cleanupChannels deletes the room and roaming channels of rooms, namespaces
+// and floors that no longer exist
+func cleanupChannels() {
+	live := make(map[string]bool)
+	for _, ns := range allNamespaces() {
+		for _, channel := range floorKeys(roamChannel(ns)) {
+			live[channel] = true
+		}
+		for channel := range kindFences(ns) {
+			live[channel] = true
+		}
+	}
+	roommu.Lock()
+	for roomID := range rooms {
+		for _, channel := range floorKeys(roomChannel(roomID)) {
+			live[channel] = true
+		}
+	}
+	roommu.Unlock()
+
+	var names []string
+	for _, pattern := range []string{roomChannel("*"), roamChannel("") + "*"} {
+		chans, err := geo.Channels(pattern)
+		if err != nil {
+			lg.Error("channel cleanup failed", "err", err)
+			return
+		}
+		names = append(names, chans...)
+	}
+	orphans := make(map[string]bool)
+	for _, name := range names {
+		if live[name] {
+			continue
+		}
+		if !orphanChans[name] {
+			orphans[name] = true
+			continue
+		}
+		if err := geo.DelFence(name); err != nil {
+			lg.Error("channel cleanup failed", "channel", name, "err", err)
+			continue
+		}
+		lg.Info("orphaned channel deleted", "channel", name)
+	}
+	orphanChans = orphans
+}
+
+// cleanupPeople deletes the features of the people of instances that stopped
+// sending heartbeats, unless they connected again since. Every instance
+// checks, and the one that takes a gone instance off the instances set
+// cleans up after it.
+func cleanupPeople(now time.Time) {
+	before := now.Add(-instanceTimeout).UnixNano() / int64(time.Millisecond)
+	gone, err := redis.Strings(storeDo("ZRANGEBYSCORE", instancesKey, "-inf", before))
+	if err != nil || len(gone) == 0 {
+		return
+	}
+	alive, err := redis.Strings(storeDo("ZRANGEBYSCORE", instancesKey, "("+strconv.FormatInt(before, 10), "+inf"))
+	if err != nil {
+		return
+	}
+	for _, instance := range gone {
+		if claimed, _ := redis.Int(storeDo("ZREM", instancesKey, instance)); claimed != 1 {
+			continue
+		}
+		clients, err := redis.StringMap(storeDo("HGETALL", instanceClientsKey(instance)))
+		if err != nil {
+			lg.Error("people cleanup failed", "instance", instance, "err", err)
+			continue
+		}
+		var removed int
+		for clientID, ns := range clients {
+			if !connectedElsewhere(clientID, alive) {
+				removed += removeOrphan(ns, clientID)
+			}
+		}
+		storeDo("DEL", instanceClientsKey(instance))
+		lg.Info("orphaned people deleted", "instance", instance, "people", removed)
+	}
+}
+
+// connectedElsewhere returns true when a person is connected to this
+// instance or to one of the instances that are alive
+func connectedElsewhere(clientID string, alive []string) bool {
+	idmu.Lock()
+	_, ok := clientConnM[clientID]
+	idmu.Unlock()
+	if ok {
+		return true
+	}
+	for _, instance := range alive {
+		if n, _ := redis.Int(storeDo("HEXISTS", instanceClientsKey(instance), clientID)); n == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOrphan deletes the feature of a person that nobody serves anymore
+// from the people collections of every floor and the entity collections, and
+// lets the viewers know that they are gone. Returns the number of features
+// deleted.
+func removeOrphan(ns, clientID string) int {
+	var removed int
+	for _, key := range append(floorKeys(peopleKey(ns)), kindKeys(ns)...) {
+		feature, err := geo.GetFeature(key, clientID)
+		if err != nil {
+			continue
+		}
+		if err := geo.DelFeature(key, clientID); err != nil {
+			lg.Error("people cleanup failed", "client", clientID, "err", err)
+			continue
+		}
+		removed++
+		if !isHidden(feature) {
+			msg := notification(protocol.TypeGone, secureFeature(feature), "", false)
+			tombstone(ns, msg)
+			env, _ := sjson.Set(`{"kind":"gone"}`, "ns", ns)
+			publish(env, msg)
+		}
+	}
+	return removed
+}
+
+// leaveCluster takes this instance off the instances set when it shuts down
+// and has deleted its people
+func leaveCluster() {
+	storeDo("ZREM", instancesKey, instanceID)
+	storeDo("DEL", instanceClientsKey(instanceID))
+}
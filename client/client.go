@@ -0,0 +1,481 @@
+// Package client is a Go client of the chat protocol, for bots and
+// integrations. A Client is a person on the map: it keeps its position,
+// profile and viewport on the server, and reconnects and resumes its session
+// when the connection drops.
+//
+//	c, err := client.Connect(":8000", client.Options{
+//		OnMessage: func(m protocol.ChatMessage) { fmt.Println(m.Text) },
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close()
+//	c.UpdatePosition(39.7425, -104.9965)
+//	c.Send("hello")
+package client
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The defaults of the options
+const (
+	DefaultFeatureInterval = 5 * time.Second  // the server keeps people for 10 seconds
+	DefaultReconnectMin    = time.Second      // first wait before a reconnect
+	DefaultReconnectMax    = 30 * time.Second // longest wait before a reconnect
+)
+
+// ErrClosed is returned by the methods of a closed client
+var ErrClosed = errors.New("client: closed")
+
+// ErrDisconnected is returned when a frame is sent while the client is
+// reconnecting. The position, profile and viewport are sent again once it is
+// connected.
+var ErrDisconnected = errors.New("client: disconnected")
+
+// Options are the settings of a client. The handlers are called one at a time
+// from the read loop of the client, and must not block for long.
+type Options struct {
+	Namespace  string                 // chat world, empty for the default one
+	Token      string                 // JWT of the server auth secret, sent as a bearer token
+	ID         string                 // id of 24 hex characters, random when empty
+	Properties map[string]interface{} // properties of the feature, such as "color"
+	Header     http.Header            // extra headers of the upgrade request
+	Dialer     *websocket.Dialer      // nil uses the default dialer
+
+	// FeatureInterval is how often the position is sent again while it does
+	// not change, so that the server keeps the person. Reconnects wait from
+	// ReconnectMin, doubling up to ReconnectMax.
+	FeatureInterval time.Duration
+	ReconnectMin    time.Duration
+	ReconnectMax    time.Duration
+
+	// OnConnect is called for every connection and OnDisconnect with the
+	// error that dropped it. OnSession is called with the Session of each
+	// connection, which tells whether the server resumed the previous one.
+	OnConnect    func()
+	OnDisconnect func(err error)
+	OnSession    func(s protocol.Session)
+
+	OnMessage      func(m protocol.ChatMessage)   // chat messages from people nearby
+	OnNotification func(n protocol.Notification)  // Nearby, Faraway, Inside, Outside and Gone
+	OnUpdate       func(u protocol.Update)        // people in the viewport
+	OnAck          func(a protocol.MessageAck)    // acks of the messages sent
+	OnError        func(e protocol.Error)         // errors about the frames sent
+	OnFrame        func(typ string, frame string) // every frame, before the handlers above
+}
+
+// Client is a connection to the server as a person on the map
+type Client struct {
+	opts Options
+	url  string
+
+	mu       sync.Mutex
+	ws       *websocket.Conn // nil while reconnecting
+	closed   bool
+	session  string // token of the session to resume
+	lat, lng float64
+	located  bool              // the position was set
+	sent     time.Time         // when the feature was last sent
+	profile  *protocol.Profile // profile to set again on reconnect
+	viewport *protocol.Viewport
+	refs     int64 // refs of the messages sent
+
+	done chan struct{} // closed by Close
+}
+
+// Connect connects to the server at addr, an address like ":8000" or a URL
+// like "wss://chat.example.com". The client reconnects by itself until it is
+// closed, only the first connection must succeed.
+func Connect(addr string, opts Options) (*Client, error) {
+	if opts.ID == "" {
+		var b [12]byte
+		rand.Read(b[:])
+		opts.ID = hex.EncodeToString(b[:])
+	}
+	if opts.FeatureInterval == 0 {
+		opts.FeatureInterval = DefaultFeatureInterval
+	}
+	if opts.ReconnectMin == 0 {
+		opts.ReconnectMin = DefaultReconnectMin
+	}
+	if opts.ReconnectMax == 0 {
+		opts.ReconnectMax = DefaultReconnectMax
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	u, err := wsURL(addr, opts.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{opts: opts, url: u, done: make(chan struct{})}
+	ws, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(ws)
+	go c.keepAlive()
+	return c, nil
+}
+
+// wsURL returns the websocket URL of a server address and namespace
+func wsURL(addr, ns string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "ws://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", errors.New("client: unsupported scheme " + u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	if ns != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + url.PathEscape(ns)
+	}
+	return u.String(), nil
+}
+
+// ID returns the id of the person of the client
+func (c *Client) ID() string {
+	return c.opts.ID
+}
+
+// SecureID returns the id that others see the person of the client as, in
+// the features of its chat messages and notifications
+func (c *Client) SecureID() string {
+	b := md5.Sum([]byte(c.opts.ID))
+	return hex.EncodeToString(b[:12])
+}
+
+// Position returns the last position of the client
+func (c *Client) Position() (lat, lng float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lat, c.lng
+}
+
+// dial opens a connection, resuming the session of the previous one, and
+// sends the state of the client
+func (c *Client) dial() (*websocket.Conn, error) {
+	header := http.Header{}
+	for k, v := range c.opts.Header {
+		header[k] = v
+	}
+	if c.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	c.mu.Lock()
+	u := c.url
+	if c.session != "" {
+		u += "?session=" + url.QueryEscape(c.session)
+	}
+	c.mu.Unlock()
+	ws, resp, err := c.opts.Dialer.Dial(u, header)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		ws.Close()
+		return nil, ErrClosed
+	}
+	c.ws = ws
+	frames := []interface{}{protocol.Hello{
+		Envelope: protocol.Envelope{Type: protocol.TypeHello, Version: protocol.Version},
+	}}
+	if c.located {
+		frames = append(frames, c.feature())
+		c.sent = time.Now()
+	}
+	if c.profile != nil {
+		frames = append(frames, c.profile)
+	}
+	if c.viewport != nil {
+		frames = append(frames, c.viewport)
+	}
+	for _, v := range frames {
+		if err := c.writeLocked(v); err != nil {
+			ws.Close()
+			c.ws = nil
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// run reads the frames of a connection and reconnects when it drops
+func (c *Client) run(ws *websocket.Conn) {
+	wait := c.opts.ReconnectMin
+	for {
+		if c.opts.OnConnect != nil {
+			c.opts.OnConnect()
+		}
+		err := c.read(ws)
+		c.mu.Lock()
+		c.ws = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if c.opts.OnDisconnect != nil {
+			c.opts.OnDisconnect(err)
+		}
+		for {
+			if closed {
+				return
+			}
+			select {
+			case <-c.done:
+				return
+			case <-time.After(wait):
+			}
+			if ws, err = c.dial(); err == nil {
+				wait = c.opts.ReconnectMin
+				break
+			} else if err == ErrClosed {
+				return
+			}
+			if wait *= 2; wait > c.opts.ReconnectMax {
+				wait = c.opts.ReconnectMax
+			}
+		}
+	}
+}
+
+// read dispatches the frames of a connection until it fails
+func (c *Client) read(ws *websocket.Conn) error {
+	defer ws.Close()
+	for {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		c.dispatch(string(b))
+	}
+}
+
+// dispatch calls the handlers of a frame
+func (c *Client) dispatch(frame string) {
+	typ := gjson.Get(frame, "type").String()
+	if c.opts.OnFrame != nil {
+		c.opts.OnFrame(typ, frame)
+	}
+	c.handle(typ, frame)
+}
+
+// handle calls the typed handler of a frame. The notifications of a
+// FeatureCollection are handled one by one.
+func (c *Client) handle(typ, frame string) {
+	switch typ {
+	case protocol.TypeMessage:
+		var m protocol.ChatMessage
+		if c.opts.OnMessage != nil && protocol.Decode(frame, &m) == nil {
+			c.opts.OnMessage(m)
+		}
+	case protocol.TypeNearby, protocol.TypeFaraway, protocol.TypeInside,
+		protocol.TypeOutside, protocol.TypeGone:
+		var n protocol.Notification
+		if c.opts.OnNotification != nil && protocol.Decode(frame, &n) == nil {
+			c.opts.OnNotification(n)
+		}
+	case protocol.TypeFeatureCollection:
+		for _, n := range gjson.Get(frame, "notifications").Array() {
+			c.handle(n.Get("type").String(), n.Raw)
+		}
+	case protocol.TypeUpdate:
+		var u protocol.Update
+		if c.opts.OnUpdate != nil && protocol.Decode(frame, &u) == nil {
+			c.opts.OnUpdate(u)
+		}
+	case protocol.TypeMessageAck:
+		var a protocol.MessageAck
+		if c.opts.OnAck != nil && protocol.Decode(frame, &a) == nil {
+			c.opts.OnAck(a)
+		}
+	case protocol.TypeError:
+		var e protocol.Error
+		if c.opts.OnError != nil && protocol.Decode(frame, &e) == nil {
+			c.opts.OnError(e)
+		}
+	case protocol.TypeSession:
+		var s protocol.Session
+		if protocol.Decode(frame, &s) != nil {
+			return
+		}
+		c.mu.Lock()
+		c.session = s.Token
+		c.mu.Unlock()
+		if c.opts.OnSession != nil {
+			c.opts.OnSession(s)
+		}
+	}
+}
+
+// keepAlive sends the position again when it was not sent for the feature
+// interval
+func (c *Client) keepAlive() {
+	tick := time.NewTicker(c.opts.FeatureInterval / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick.C:
+		}
+		c.mu.Lock()
+		if c.ws != nil && c.located && time.Since(c.sent) >= c.opts.FeatureInterval {
+			if c.writeLocked(c.feature()) == nil {
+				c.sent = time.Now()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// feature returns the feature of the person at its position. Must be called
+// with the lock held.
+func (c *Client) feature() json.RawMessage {
+	props := c.opts.Properties
+	if props == nil {
+		props = map[string]interface{}{}
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"type": "Feature",
+		"id":   c.opts.ID,
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{c.lng, c.lat},
+		},
+		"properties": props,
+	})
+	return b
+}
+
+// UpdatePosition moves the person of the client
+func (c *Client) UpdatePosition(lat, lng float64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lat, c.lng, c.located = lat, lng, true
+	if err := c.writeLocked(c.feature()); err != nil {
+		return err
+	}
+	c.sent = time.Now()
+	return nil
+}
+
+// SetProfile sets the display name, avatar and color of the person
+func (c *Client) SetProfile(p protocol.Profile) error {
+	p.Type = protocol.TypeSetProfile
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.profile = &p
+	return c.writeLocked(p)
+}
+
+// SetViewport sets the area of the map that the client receives Updates of
+func (c *Client) SetViewport(v protocol.Viewport) error {
+	v.Type = protocol.TypeViewport
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.viewport = &v
+	return c.writeLocked(v)
+}
+
+// Send sends a chat message to the people nearby and returns its ref, which
+// the MessageAck of the server echoes. The position must be set first.
+func (c *Client) Send(text string) (string, error) {
+	return c.sendMessage(protocol.ChatMessage{Text: text})
+}
+
+// Reply sends a chat message that replies to the message msgID in the
+// history of a room, and returns its ref like Send
+func (c *Client) Reply(room, msgID, text string) (string, error) {
+	return c.sendMessage(protocol.ChatMessage{Text: text, Room: room, ReplyTo: msgID})
+}
+
+// sendMessage sends a chat message from the position of the client
+func (c *Client) sendMessage(m protocol.ChatMessage) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.located {
+		return "", errors.New("client: no position")
+	}
+	c.refs++
+	m.Envelope = protocol.Envelope{Type: protocol.TypeMessage}
+	m.Ref = c.opts.ID[:8] + "-" + strconv.FormatInt(c.refs, 36)
+	m.Feature = c.feature()
+	return m.Ref, c.writeLocked(m)
+}
+
+// SendFrame sends any frame of the protocol, encoded as JSON
+func (c *Client) SendFrame(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(v)
+}
+
+// writeLocked sends a frame as JSON. Must be called with the lock held.
+func (c *Client) writeLocked(v interface{}) error {
+	if c.closed {
+		return ErrClosed
+	}
+	if c.ws == nil {
+		return ErrDisconnected
+	}
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = []byte(v)
+	case json.RawMessage:
+		b = v
+	default:
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// Close disconnects the client and stops it from reconnecting
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.ws == nil {
+		return nil
+	}
+	c.ws.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return c.ws.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// clusterCell is the size of a cluster grid cell in pixels of a 256 pixel
+// map tile
+const clusterCell = 64
+
+// cluster is a grid cell with the people inside of it
+type cluster struct {
+	count    int
+	lat, lng float64 // sums of the coordinates
+	feature  string  // the only feature while count is 1
+}
+
+// clusterUpdate groups features into the cells of a grid sized for the zoom
+// level and encodes an Update with a feature for every cell. Cells with a
+// single person keep the feature of that person.
+func clusterUpdate(features []string, zoom float64) string {
+	size := 360 / math.Pow(2, zoom) * clusterCell / 256
+	cells := make(map[[2]int64]*cluster)
+	var order [][2]int64
+	for _, feature := range features {
+		lng := gjson.Get(feature, "geometry.coordinates.0").Float()
+		lat := gjson.Get(feature, "geometry.coordinates.1").Float()
+		key := [2]int64{int64(math.Floor(lng / size)), int64(math.Floor(lat / size))}
+		c, ok := cells[key]
+		if !ok {
+			c = &cluster{feature: feature}
+			cells[key] = c
+			order = append(order, key)
+		}
+		c.count++
+		c.lat += lat
+		c.lng += lng
+	}
+
+	update := protocol.Update{
+		Envelope:  protocol.Envelope{Type: protocol.TypeUpdate},
+		Features:  make([]json.RawMessage, 0, len(order)),
+		Clustered: true,
+	}
+	for _, key := range order {
+		c := cells[key]
+		if c.count == 1 {
+			update.Features = append(update.Features, json.RawMessage(c.feature))
+			continue
+		}
+		n := float64(c.count)
+		feature := `{"type":"Feature","geometry":{"type":"Point"}}`
+		feature, _ = sjson.Set(feature, "id", "cluster:"+
+			strconv.FormatInt(key[0], 10)+":"+strconv.FormatInt(key[1], 10))
+		feature, _ = sjson.Set(feature, "geometry.coordinates",
+			[]float64{c.lng / n, c.lat / n})
+		feature, _ = sjson.Set(feature, "properties.cluster", true)
+		feature, _ = sjson.Set(feature, "properties.count", c.count)
+		update.Features = append(update.Features, json.RawMessage(feature))
+	}
+	msg, _ := protocol.Encode(update)
+	return msg
+}
@@ -0,0 +1,281 @@
+// Command chatctl is a command line client of the chat protocol, for
+// debugging servers without a browser. It connects to /ws at a position and
+// prints the frames of the server, one per line.
+//
+//	chatctl -pos 39.7425,-104.9965                  chat from stdin
+//	chatctl -pos 39.7425,-104.9965 -send "hi there" send a message and exit
+//	chatctl -pos 39.7425,-104.9965 -events          tail enter and exit events
+//
+// Lines read from stdin are sent as chat messages, except for commands:
+//
+//	/pos lat,lng  move to a position
+//	/raw {json}   send a frame as it is
+//	/quit         disconnect
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// featureInterval is how often the position is sent again, so that the
+// feature is kept while it does not move
+const featureInterval = 5 * time.Second
+
+// client is a connection to the server at a position
+type client struct {
+	mu       sync.Mutex
+	ws       *websocket.Conn
+	id       string
+	lat, lng float64
+	name     string
+}
+
+func main() {
+	addr := flag.String("a", ":8000", "server address")
+	ns := flag.String("ns", "", "namespace, empty for the default one")
+	token := flag.String("token", "", "JWT of the server auth secret")
+	id := flag.String("id", "", "id of 24 hex characters, random when empty")
+	pos := flag.String("pos", "", "position as lat,lng")
+	name := flag.String("name", "", "display name, set as the profile")
+	send := flag.String("send", "", "send a chat message, wait for its ack and exit")
+	events := flag.Bool("events", false, "only print room enter and exit and nearby and faraway events")
+	raw := flag.Bool("json", false, "print frames as JSON")
+	flag.Parse()
+
+	lat, lng, err := parsePosition(*pos)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *id == "" {
+		var b [12]byte
+		rand.Read(b[:])
+		*id = hex.EncodeToString(b[:])
+	}
+	u := "ws://" + *addr + "/ws"
+	if *ns != "" {
+		u += "/" + url.PathEscape(*ns)
+	}
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Authorization", "Bearer "+*token)
+	}
+	ws, resp, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	c := &client{ws: ws, id: *id, lat: lat, lng: lng, name: *name}
+	defer ws.Close()
+
+	if err := c.sendFeature(); err != nil {
+		log.Fatal(err)
+	}
+	if c.name != "" {
+		c.write(protocol.Profile{
+			Envelope: protocol.Envelope{Type: protocol.TypeSetProfile},
+			Name:     c.name,
+		})
+	}
+	go func() {
+		for range time.Tick(featureInterval) {
+			if err := c.sendFeature(); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, b, err := ws.ReadMessage()
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			msg := string(b)
+			typ := gjson.Get(msg, "type").String()
+			if *events && !isEvent(typ) {
+				continue
+			}
+			if *raw {
+				fmt.Println(msg)
+			} else {
+				fmt.Println(describe(msg))
+			}
+			if *send != "" && typ == protocol.TypeMessageAck {
+				return
+			}
+		}
+	}()
+
+	if *send != "" {
+		if err := c.sendMessage(*send); err != nil {
+			log.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			log.Fatal("no ack from the server")
+		}
+		return
+	}
+	if !*events {
+		go c.readInput()
+	}
+	<-done
+}
+
+// readInput sends the lines of stdin as chat messages and commands
+func (c *client) readInput() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var err error
+		switch {
+		case line == "":
+		case line == "/quit":
+			c.ws.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case strings.HasPrefix(line, "/pos "):
+			var lat, lng float64
+			if lat, lng, err = parsePosition(strings.TrimPrefix(line, "/pos ")); err == nil {
+				c.mu.Lock()
+				c.lat, c.lng = lat, lng
+				c.mu.Unlock()
+				err = c.sendFeature()
+			}
+		case strings.HasPrefix(line, "/raw "):
+			c.mu.Lock()
+			err = c.ws.WriteMessage(websocket.TextMessage, []byte(strings.TrimPrefix(line, "/raw ")))
+			c.mu.Unlock()
+		case strings.HasPrefix(line, "/"):
+			err = errors.New("commands are /pos lat,lng, /raw {json} and /quit")
+		default:
+			err = c.sendMessage(line)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// feature returns the feature of the client at its position
+func (c *client) feature() json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, _ := json.Marshal(map[string]interface{}{
+		"type": "Feature",
+		"id":   c.id,
+		"geometry": map[string]interface{}{
+			"type":        "Point",
+			"coordinates": []float64{c.lng, c.lat},
+		},
+		"properties": map[string]interface{}{},
+	})
+	return b
+}
+
+// sendFeature sends the position of the client
+func (c *client) sendFeature() error {
+	return c.write(c.feature())
+}
+
+// sendMessage sends a chat message at the position of the client
+func (c *client) sendMessage(text string) error {
+	return c.write(protocol.ChatMessage{
+		Envelope: protocol.Envelope{Type: protocol.TypeMessage},
+		Ref:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		Feature:  c.feature(),
+		Text:     text,
+	})
+}
+
+// write sends a frame as JSON
+func (c *client) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// isEvent returns true for the notifications of rooms and people nearby
+func isEvent(typ string) bool {
+	switch typ {
+	case protocol.TypeInside, protocol.TypeOutside, protocol.TypeNearby, protocol.TypeFaraway:
+		return true
+	}
+	return false
+}
+
+// describe returns a line about a frame of the server
+func describe(msg string) string {
+	typ := gjson.Get(msg, "type").String()
+	who := gjson.Get(msg, "feature.properties.name").String()
+	if who == "" {
+		who = gjson.Get(msg, "feature.id").String()
+	}
+	at := time.Now().Format("15:04:05")
+	switch typ {
+	case protocol.TypeMessage:
+		return at + " " + who + ": " + gjson.Get(msg, "text").String()
+	case protocol.TypeInside, protocol.TypeOutside:
+		verb := "entered"
+		if typ == protocol.TypeOutside {
+			verb = "exited"
+		}
+		if gjson.Get(msg, "me").Bool() {
+			who = "you"
+		}
+		return at + " " + who + " " + verb + " " + gjson.Get(msg, "room").String()
+	case protocol.TypeNearby, protocol.TypeFaraway:
+		line := at + " " + who + " is " + strings.ToLower(typ)
+		if locality := gjson.Get(msg, "locality").String(); locality != "" {
+			line += " in " + locality
+		}
+		return line
+	case protocol.TypeMessageAck:
+		return at + " sent to " + gjson.Get(msg, "recipients").String() + ", delivered to " +
+			gjson.Get(msg, "delivered").String()
+	case protocol.TypeError:
+		return at + " error " + gjson.Get(msg, "code").String() + ": " + gjson.Get(msg, "message").String()
+	}
+	return at + " " + msg
+}
+
+// parsePosition parses a lat,lng position
+func parsePosition(s string) (lat, lng float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("position must be lat,lng")
+	}
+	if lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+		return 0, 0, err
+	}
+	if lng, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
@@ -0,0 +1,145 @@
+// Command concierge runs a bot that helps people find their way in the chat
+// of the rooms it is in. It stands at a position, or walks a script of stops,
+// and answers commands:
+//
+//	/where      how far and in which direction the sender is from the bot
+//	/occupancy  the people in the rooms of the bot
+//	/help       the commands
+//
+// Stops are lat,lng positions separated by semicolons, each optionally
+// followed by @ and the time the bot stays there:
+//
+//	concierge -stops 39.7425,-104.9965
+//	concierge -stops "39.7425,-104.9965@1m;39.7431,-104.9950@30s" -name Guide
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tile38/proximity-chat/bot"
+	"github.com/tile38/proximity-chat/client"
+)
+
+func main() {
+	addr := flag.String("a", ":8000", "server address")
+	ns := flag.String("ns", "", "namespace, empty for the default one")
+	token := flag.String("token", "", "JWT of the server auth secret")
+	id := flag.String("id", "", "id of 24 hex characters, random when empty")
+	name := flag.String("name", "Concierge", "display name")
+	color := flag.String("color", "#2b83ba", "marker color")
+	stops := flag.String("stops", "", "positions as lat,lng[@stay];...")
+	speed := flag.Float64("speed", bot.DefaultSpeed, "meters per second walked between stops")
+	flag.Parse()
+
+	script, err := parseStops(*stops)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := bot.New(*name)
+	b.Color = *color
+	b.Script = script
+	b.Speed = *speed
+	b.Options = client.Options{Namespace: *ns, Token: *token, ID: *id}
+	b.Command("where", "tells how far and which way you are from me", where)
+	b.Command("occupancy", "tells how many people are in my rooms", occupancy)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		b.Close()
+	}()
+	log.Printf("%s at %s", *name, *stops)
+	if err := b.Run(*addr); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// where answers with the distance and direction of the sender from the bot
+func where(r *bot.Request) string {
+	lat, lng := r.Bot.Position()
+	d := bot.Distance(lat, lng, r.Lat, r.Lng)
+	place := ""
+	if rooms := r.Bot.Rooms(); len(rooms) > 0 {
+		place = " in " + rooms[0].Name
+	}
+	you := "You"
+	if r.Sender != "" {
+		you = r.Sender + ", you"
+	}
+	if d < 5 {
+		return you + " are right next to me" + place
+	}
+	return fmt.Sprintf("%s are %s %s of me%s", you, meters(d),
+		bot.Compass(bot.Bearing(lat, lng, r.Lat, r.Lng)), place)
+}
+
+// occupancy answers with the people in the rooms of the bot
+func occupancy(r *bot.Request) string {
+	rooms := r.Bot.Rooms()
+	if len(rooms) == 0 {
+		return "I am not in a room"
+	}
+	parts := make([]string, len(rooms))
+	for i, room := range rooms {
+		people := "people"
+		if room.Occupants == 1 {
+			people = "person"
+		}
+		parts[i] = fmt.Sprintf("%s: %d %s", room.Name, room.Occupants, people)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// meters returns a distance rounded for speaking
+func meters(d float64) string {
+	if d >= 1000 {
+		return strconv.FormatFloat(math.Round(d/100)/10, 'f', -1, 64) + " km"
+	}
+	return strconv.Itoa(int(math.Round(d/5)*5)) + " m"
+}
+
+// parseStops parses a script of stops, as lat,lng[@stay];...
+func parseStops(s string) ([]bot.Stop, error) {
+	var stops []bot.Stop
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var stop bot.Stop
+		if i := strings.IndexByte(part, '@'); i >= 0 {
+			stay, err := time.ParseDuration(part[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid stay %q", part[i+1:])
+			}
+			stop.Stay, part = stay, part[:i]
+		}
+		pos := strings.Split(part, ",")
+		if len(pos) != 2 {
+			return nil, fmt.Errorf("invalid stop %q, must be lat,lng", part)
+		}
+		var err error
+		if stop.Lat, err = strconv.ParseFloat(strings.TrimSpace(pos[0]), 64); err != nil {
+			return nil, fmt.Errorf("invalid stop %q", part)
+		}
+		if stop.Lng, err = strconv.ParseFloat(strings.TrimSpace(pos[1]), 64); err != nil {
+			return nil, fmt.Errorf("invalid stop %q", part)
+		}
+		stops = append(stops, stop)
+	}
+	if len(stops) == 0 {
+		return nil, errors.New("at least one stop is required")
+	}
+	return stops, nil
+}
@@ -0,0 +1,64 @@
+// Command protocoltest runs the fake chat server of the protocoltest package,
+// and prints or checks frames for client test suites that are not written in
+// Go.
+//
+//	protocoltest -a :8000        serve the fake server at ws://localhost:8000/ws
+//	protocoltest -golden         print the golden frames as a JSON array
+//	protocoltest -check < frames check client frames, one per line
+//
+// With -check, every frame that fails is printed with its error, and the
+// exit status is 1 when any did.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tile38/proximity-chat/protocoltest"
+)
+
+func main() {
+	addr := flag.String("a", ":8000", "address of the fake server")
+	golden := flag.Bool("golden", false, "print the golden frames and exit")
+	check := flag.Bool("check", false, "check the client frames of stdin and exit")
+	flag.Parse()
+
+	switch {
+	case *golden:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(protocoltest.Cases); err != nil {
+			log.Fatal(err)
+		}
+	case *check:
+		failed := false
+		sc := bufio.NewScanner(os.Stdin)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			frame := strings.TrimSpace(sc.Text())
+			if frame == "" {
+				continue
+			}
+			if err := protocoltest.Check(frame); err != nil {
+				fmt.Printf("%s\n\t%v\n", frame, err)
+				failed = true
+			}
+		}
+		if err := sc.Err(); err != nil {
+			log.Fatal(err)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	default:
+		log.Printf("fake server listening at %s/ws", *addr)
+		log.Fatal(http.ListenAndServe(*addr, &protocoltest.FakeServer{}))
+	}
+}
@@ -0,0 +1,184 @@
+// Command seed loads sample room fences, such as the parks and venues of a
+// city, so that a new deployment has places to chat in out of the box. The
+// fences come from the bundled sample of downtown Denver, a GeoJSON
+// FeatureCollection, or the named areas of an OpenStreetMap XML extract, and
+// are created through the fences API of a running server, which stores them
+// in Tile38 and sets up their geofence channels, or written to a fences
+// directory for the server to load.
+//
+//	seed -a :8000 -admin-token secret                  the bundled sample
+//	seed -a :8000 -admin-token secret -osm denver.osm  parks and venues of an extract
+//	seed -geojson venues.geojson -out web/fences       write fence files
+//
+// Fences created through the API live until the server restarts, fence files
+// are kept.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// requestTimeout is the timeout of each request to the fences API
+const requestTimeout = 10 * time.Second
+
+// fence is a room fence to seed, a GeoJSON feature with a Polygon or
+// MultiPolygon geometry
+type fence struct {
+	ID     string
+	Object string
+}
+
+func main() {
+	addr := flag.String("a", ":8000", "server address")
+	admin := flag.String("admin-token", "", "admin token of the server")
+	ns := flag.String("ns", "", "namespace of the fences, empty for the default one")
+	osm := flag.String("osm", "", "OpenStreetMap XML extract to take the named areas of")
+	tags := flag.String("tags", defaultTags, "comma separated OSM tags of the areas to seed, like leisure=park")
+	file := flag.String("geojson", "", "GeoJSON FeatureCollection of fences")
+	out := flag.String("out", "", "directory to write fence files to instead of creating them on the server")
+	max := flag.Int("max", 500, "maximum number of fences")
+	flag.Parse()
+
+	var fences []fence
+	var err error
+	switch {
+	case *osm != "":
+		fences, err = readOSM(*osm, strings.Split(*tags, ","))
+	case *file != "":
+		fences, err = readGeoJSON(*file)
+	default:
+		fences = sampleFences()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(fences) > *max {
+		fences = fences[:*max]
+	}
+	if len(fences) == 0 {
+		log.Fatal("no fences to seed")
+	}
+	for _, f := range fences {
+		if *out != "" {
+			err = writeFence(*out, *ns, f)
+		} else {
+			err = putFence(*addr, *admin, *ns, f)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", f.ID, err)
+		}
+		fmt.Println(f.ID, gjson.Get(f.Object, "properties.name").String())
+	}
+	log.Printf("seeded %d fences", len(fences))
+}
+
+// putFence creates or replaces a fence through the fences API
+func putFence(addr, admin, ns string, f fence) error {
+	if admin == "" {
+		return errors.New("an admin token is required to create fences on the server")
+	}
+	u := "http://" + addr + "/api/fences/"
+	if ns != "" {
+		u += url.PathEscape(ns) + "/"
+	}
+	req, err := http.NewRequest(http.MethodPut, u+f.ID, strings.NewReader(f.Object))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("Content-Type", "application/geo+json")
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// writeFence writes a fence to its file in the fences directory, or in the
+// subdirectory of its namespace
+func writeFence(dir, ns string, f fence) error {
+	dir = filepath.Join(dir, ns)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, f.ID+".geojson"), []byte(f.Object+"\n"), 0644)
+}
+
+// readGeoJSON reads the fences of a FeatureCollection. The id of a fence is
+// its "id" property, or else made from its "name" property.
+func readGeoJSON(path string) ([]fence, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if gjson.GetBytes(data, "type").String() != "FeatureCollection" {
+		return nil, fmt.Errorf("%s: not a FeatureCollection", path)
+	}
+	var fences []fence
+	ids := make(map[string]bool)
+	for i, feature := range gjson.GetBytes(data, "features").Array() {
+		switch feature.Get("geometry.type").String() {
+		case "Polygon", "MultiPolygon":
+		default:
+			continue
+		}
+		id := feature.Get("properties.id").String()
+		if id == "" {
+			id = slug(feature.Get("properties.name").String())
+		}
+		if !validFenceID.MatchString(id) {
+			return nil, fmt.Errorf("%s: feature %d: invalid or missing id", path, i)
+		}
+		id = uniqueID(ids, id)
+		object, _ := sjson.Delete(feature.Raw, "properties.id")
+		fences = append(fences, fence{ID: id, Object: object})
+	}
+	return fences, nil
+}
+
+// validFenceID matches the ids that the fences API accepts
+var validFenceID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// nonSlug matches the runs of characters that are left out of slugs
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// slug returns a fence id made from a name, like union-station for Union
+// Station
+func slug(name string) string {
+	s := strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(s) > 56 {
+		s = strings.TrimRight(s[:56], "-")
+	}
+	return s
+}
+
+// uniqueID returns the id, or the id with a number when it was taken
+func uniqueID(ids map[string]bool, id string) string {
+	unique := id
+	for n := 2; ids[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", id, n)
+	}
+	ids[unique] = true
+	return unique
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tidwall/sjson"
+)
+
+// defaultTags are the OSM tags of the areas that are seeded by default
+const defaultTags = "leisure=park,leisure=garden,leisure=stadium,tourism=museum," +
+	"tourism=attraction,amenity=theatre,amenity=marketplace,amenity=university"
+
+// tagColors are the display colors of the fences by the key of their tag
+var tagColors = map[string]string{
+	"leisure": "#4caf50",
+	"tourism": "#9c27b0",
+	"amenity": "#3f51b5",
+}
+
+// osmNode is a node of an OSM extract
+type osmNode struct {
+	ID  int64   `xml:"id,attr"`
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+// osmWay is a way of an OSM extract
+type osmWay struct {
+	Nodes []struct {
+		Ref int64 `xml:"ref,attr"`
+	} `xml:"nd"`
+	Tags []struct {
+		Key   string `xml:"k,attr"`
+		Value string `xml:"v,attr"`
+	} `xml:"tag"`
+}
+
+// readOSM reads a fence for every named and closed way of an OSM XML extract
+// with one of the tags. Multipolygon relations are left out.
+func readOSM(path string, tags []string) ([]fence, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	wanted := make(map[string]bool)
+	for _, tag := range tags {
+		wanted[strings.TrimSpace(tag)] = true
+	}
+
+	// nodes come before the ways that refer to them in OSM extracts
+	nodes := make(map[int64][2]float64)
+	var fences []fence
+	ids := make(map[string]bool)
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "node":
+			var n osmNode
+			if err := dec.DecodeElement(&n, &start); err != nil {
+				return nil, err
+			}
+			nodes[n.ID] = [2]float64{n.Lon, n.Lat}
+		case "way":
+			var w osmWay
+			if err := dec.DecodeElement(&w, &start); err != nil {
+				return nil, err
+			}
+			if object := wayFence(w, nodes, wanted); object != "" {
+				name := wayTag(w, "name")
+				if id := slug(name); id != "" {
+					fences = append(fences, fence{ID: uniqueID(ids, id), Object: object})
+				}
+			}
+		}
+	}
+	return fences, nil
+}
+
+// wayFence returns the fence of a way, or empty when the way is not a named
+// and closed way with one of the wanted tags
+func wayFence(w osmWay, nodes map[int64][2]float64, wanted map[string]bool) string {
+	name := wayTag(w, "name")
+	n := len(w.Nodes)
+	if name == "" || n < 4 || w.Nodes[0].Ref != w.Nodes[n-1].Ref {
+		return ""
+	}
+	var kind string
+	for _, tag := range w.Tags {
+		if wanted[tag.Key+"="+tag.Value] {
+			kind = tag.Key
+			break
+		}
+	}
+	if kind == "" {
+		return ""
+	}
+	ring := make([][2]float64, 0, n)
+	for _, nd := range w.Nodes {
+		coord, ok := nodes[nd.Ref]
+		if !ok {
+			// the way leaves the extract
+			return ""
+		}
+		ring = append(ring, coord)
+	}
+	object := `{"type":"Feature","properties":{},"geometry":{"type":"Polygon"}}`
+	object, _ = sjson.Set(object, "properties.name", name)
+	object, _ = sjson.Set(object, "properties.color", tagColors[kind])
+	object, _ = sjson.Set(object, "geometry.coordinates", [][][2]float64{ring})
+	return object
+}
+
+// wayTag returns the value of a tag of a way
+func wayTag(w osmWay, key string) string {
+	for _, tag := range w.Tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
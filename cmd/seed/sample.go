@@ -0,0 +1,40 @@
+package main
+
+import "github.com/tidwall/sjson"
+
+// sample is a place of the bundled sample, fenced by its bounding box
+type sample struct {
+	id, name, color          string
+	west, south, east, north float64
+}
+
+// samples are parks and venues of downtown Denver, around the demo map
+var samples = []sample{
+	{"civic-center-park", "Civic Center Park", "#4caf50", -104.9878, 39.7366, -104.9846, 39.7381},
+	{"union-station", "Union Station", "#3f51b5", -105.0010, 39.7524, -104.9989, 39.7538},
+	{"coors-field", "Coors Field", "#3f51b5", -104.9957, 39.7545, -104.9920, 39.7576},
+	{"ball-arena", "Ball Arena", "#3f51b5", -105.0092, 39.7472, -105.0053, 39.7500},
+	{"larimer-square", "Larimer Square", "#9c27b0", -104.9996, 39.7471, -104.9975, 39.7483},
+	{"denver-art-museum", "Denver Art Museum", "#9c27b0", -104.9904, 39.7362, -104.9884, 39.7376},
+	{"confluence-park", "Confluence Park", "#4caf50", -105.0091, 39.7534, -105.0061, 39.7556},
+	{"commons-park", "Commons Park", "#4caf50", -105.0080, 39.7563, -105.0029, 39.7611},
+	{"cheesman-park", "Cheesman Park", "#4caf50", -104.9691, 39.7301, -104.9630, 39.7350},
+	{"city-park", "City Park", "#4caf50", -104.9599, 39.7441, -104.9430, 39.7541},
+}
+
+// sampleFences returns the fences of the bundled sample
+func sampleFences() []fence {
+	var fences []fence
+	for _, s := range samples {
+		ring := [][2]float64{
+			{s.west, s.south}, {s.east, s.south}, {s.east, s.north},
+			{s.west, s.north}, {s.west, s.south},
+		}
+		object := `{"type":"Feature","properties":{},"geometry":{"type":"Polygon"}}`
+		object, _ = sjson.Set(object, "properties.name", s.name)
+		object, _ = sjson.Set(object, "properties.color", s.color)
+		object, _ = sjson.Set(object, "geometry.coordinates", [][][2]float64{ring})
+		fences = append(fences, fence{ID: s.id, Object: object})
+	}
+	return fences
+}
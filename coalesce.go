@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// flushWorkers is the number of features written to Tile38 at once by a flush
+const flushWorkers = 8
+
+// pendingFeature is the latest feature of a person that waits for the next
+// flush, and the collection it goes to
+type pendingFeature struct {
+	key     string
+	feature string
+}
+
+// writtenFeature is the collection that the feature of a person was last
+// written to, and when
+type writtenFeature struct {
+	key string
+	at  time.Time
+}
+
+var (
+	pendingmu sync.Mutex
+	pendingM  map[string]pendingFeature // clientID -> latest feature not written yet
+	writtenM  map[string]writtenFeature // clientID -> last write of the feature
+	coalesced uint64                    // features skipped for a newer position before they were written
+)
+
+// writeFeature stores the feature of a person in a people collection. When
+// the feature flush is set, only the latest feature of every person is
+// written once per interval, and the positions in between are skipped, so
+// that a slow Tile38 gets fewer writes instead of a longer queue. The first
+// feature of a person, the first one on another floor and the first one
+// after the feature expired are written at once so that the person shows up
+// without waiting for the flush.
+func writeFeature(clientID, key, feature string) {
+	ttl := live().PeopleTTL
+	if cfg.FeatureFlush <= 0 {
+		geo.SetFeature(key, clientID, feature, ttl)
+		return
+	}
+	now := time.Now()
+	pendingmu.Lock()
+	if w, ok := writtenM[clientID]; !ok || w.key != key || now.Sub(w.at) >= ttl {
+		writtenM[clientID] = writtenFeature{key, now}
+		delete(pendingM, clientID)
+		pendingmu.Unlock()
+		geo.SetFeature(key, clientID, feature, ttl)
+		return
+	}
+	if _, ok := pendingM[clientID]; ok {
+		atomic.AddUint64(&coalesced, 1)
+	}
+	pendingM[clientID] = pendingFeature{key, feature}
+	pendingmu.Unlock()
+}
+
+// runFlush writes the pending features once per feature flush interval. A
+// flush that takes longer than the interval delays the next one, while new
+// positions keep replacing the pending ones.
+func runFlush() {
+	if cfg.FeatureFlush <= 0 {
+		return
+	}
+	tick := time.NewTicker(cfg.FeatureFlush)
+	defer tick.Stop()
+	for now := range tick.C {
+		pendingmu.Lock()
+		pending := pendingM
+		pendingM = make(map[string]pendingFeature, len(pending))
+		for clientID := range pending {
+			writtenM[clientID] = writtenFeature{pending[clientID].key, now}
+		}
+		expireWritten(now)
+		pendingmu.Unlock()
+		if len(pending) > 0 {
+			flushFeatures(pending)
+		}
+	}
+}
+
+// expireWritten forgets the writes of the features that expired from the
+// people collections since, such as those of people whose session was
+// suspended. Must be called with the lock held.
+func expireWritten(now time.Time) {
+	ttl := live().PeopleTTL
+	for clientID, w := range writtenM {
+		if now.Sub(w.at) >= ttl {
+			delete(writtenM, clientID)
+		}
+	}
+}
+
+// flushFeatures writes features to their collections, a few at a time. A
+// pending feature takes the profile and public key that the person has now,
+// which may have changed since it was buffered.
+func flushFeatures(pending map[string]pendingFeature) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < flushWorkers && i < len(pending); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for clientID := range jobs {
+				p := pending[clientID]
+				feature := currentFeature(clientID, p.feature)
+				if err := geo.SetFeature(p.key, clientID, feature, live().PeopleTTL); err != nil {
+					lg.Error("feature flush failed", "client", clientID, "err", err)
+				}
+			}
+		}()
+	}
+	for clientID := range pending {
+		jobs <- clientID
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// currentFeature sets the current profile and public key of a person as the
+// properties of their feature
+func currentFeature(clientID, feature string) string {
+	idmu.Lock()
+	connID := clientConnM[clientID]
+	idmu.Unlock()
+	return attachKey(connID, attachProfile(clientID, feature))
+}
+
+// forgetPending drops the pending feature of a person who left. A flush that
+// already took it may still write it, the people ttl expires it then.
+func forgetPending(clientID string) {
+	pendingmu.Lock()
+	delete(pendingM, clientID)
+	delete(writtenM, clientID)
+	pendingmu.Unlock()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// testFlush turns on the feature flush for a test, without the flush loop
+func testFlush(t *testing.T) {
+	testServer(t)
+	prev := cfg.FeatureFlush
+	cfg.FeatureFlush = time.Hour
+	t.Cleanup(func() { cfg.FeatureFlush = prev })
+}
+
+// storedPosition returns the latitude of the stored feature of a person
+func storedPosition(t *testing.T, key, clientID string) float64 {
+	t.Helper()
+	feature, err := geo.GetFeature(key, clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gjson.Get(feature, "geometry.coordinates.1").Float()
+}
+
+func TestCoalesceFeatures(t *testing.T) {
+	testFlush(t)
+	id, key := testID(1), "coalesce-test"
+	defer forgetPending(id)
+	writeFeature(id, key, testFeature(id, 39.1, -104.9))
+	if lat := storedPosition(t, key, id); lat != 39.1 {
+		t.Fatalf("first feature: got %v, want it written at once", lat)
+	}
+	writeFeature(id, key, testFeature(id, 39.2, -104.9))
+	writeFeature(id, key, testFeature(id, 39.3, -104.9))
+	if lat := storedPosition(t, key, id); lat != 39.1 {
+		t.Fatalf("got %v, want the features buffered", lat)
+	}
+
+	// the profile set after the feature was buffered is written with it
+	profilemu.Lock()
+	profileM[id] = `{"id":"x","name":"Ann"}`
+	profilemu.Unlock()
+	defer forgetProfile(id)
+	pendingmu.Lock()
+	pending := pendingM
+	pendingM = make(map[string]pendingFeature)
+	pendingmu.Unlock()
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending features, want the latest one", len(pending))
+	}
+	flushFeatures(pending)
+	feature, _ := geo.GetFeature(key, id)
+	if lat := gjson.Get(feature, "geometry.coordinates.1").Float(); lat != 39.3 {
+		t.Fatalf("flushed: got %v", lat)
+	}
+	if name := gjson.Get(feature, "properties.profile.name").String(); name != "Ann" {
+		t.Fatalf("flushed: got %s, want the current profile", feature)
+	}
+}
+
+func TestCoalesceExpired(t *testing.T) {
+	testFlush(t)
+	id, key := testID(2), "coalesce-test"
+	defer forgetPending(id)
+	writeFeature(id, key, testFeature(id, 39.1, -104.9))
+
+	// the feature expired from the collection since it was written
+	pendingmu.Lock()
+	writtenM[id] = writtenFeature{key, time.Now().Add(-live().PeopleTTL)}
+	pendingmu.Unlock()
+	writeFeature(id, key, testFeature(id, 39.2, -104.9))
+	if lat := storedPosition(t, key, id); lat != 39.2 {
+		t.Fatalf("got %v, want the feature written at once", lat)
+	}
+
+	pendingmu.Lock()
+	writtenM[id] = writtenFeature{key, time.Now().Add(-live().PeopleTTL)}
+	expireWritten(time.Now())
+	_, ok := writtenM[id]
+	pendingmu.Unlock()
+	if ok {
+		t.Fatal("the write of an expired feature must be forgotten")
+	}
+}
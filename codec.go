@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/tile38/proximity-chat/msgpack"
+)
+
+// msgpackProtocol is the websocket subprotocol of MessagePack clients
+const msgpackProtocol = "proximity-chat.msgpack"
+
+// frameCacheSize is the number of binary frames kept for fan-out
+const frameCacheSize = 1024
+
+// msgpackCodec transcodes JSON messages to MessagePack. The same message is
+// usually sent to many connections, so the binary frames of recent messages
+// are cached and every message is transcoded only once.
+type msgpackCodec struct {
+	mu     sync.Mutex
+	frames map[string][]byte // JSON message -> binary frame
+}
+
+// Encode returns the binary frame of a message
+func (c *msgpackCodec) Encode(msg string) ([]byte, error) {
+	c.mu.Lock()
+	frame, ok := c.frames[msg]
+	c.mu.Unlock()
+	if ok {
+		return frame, nil
+	}
+	frame, err := msgpack.FromJSON([]byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.frames == nil || len(c.frames) >= frameCacheSize {
+		c.frames = make(map[string][]byte, frameCacheSize)
+	}
+	c.frames[msg] = frame
+	c.mu.Unlock()
+	return frame, nil
+}
+
+// Decode returns the JSON message of a binary frame
+func (c *msgpackCodec) Decode(data []byte) (string, error) {
+	msg, err := msgpack.ToJSON(data)
+	return string(msg), err
+}
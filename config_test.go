@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+func TestConfigPingMisses(t *testing.T) {
+	for misses, ok := range map[string]bool{"0": false, "-1": false, "1": true, "3": true} {
+		_, err := loadConfig([]string{"-demo", "-ping-misses", misses})
+		if (err == nil) != ok {
+			t.Errorf("ping misses %s: got %v", misses, err)
+		}
+	}
+}
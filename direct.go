@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// directMessage is a websocket message handler that delivers a chat message
+// to a single nearby person. The target is the secure id that clients see on
+// features. A DirectMessageReceipt is always sent back to the sender.
+func directMessage(connID, msg string) {
+	target := gjson.Get(msg, "target").String()
+	receipt := `{"type":"` + protocol.TypeDirectMessageReceipt + `"}`
+	receipt, _ = sjson.Set(receipt, "target", target)
+	if ref := gjson.Get(msg, "ref"); ref.Exists() {
+		receipt, _ = sjson.Set(receipt, "ref", ref.String())
+	}
+	text := gjson.Get(msg, "text").String()
+	encrypted := gjson.Get(msg, "encrypted")
+	if encrypted.Exists() {
+		if err := validateEncrypted([]byte(encrypted.Raw), text); err != nil {
+			sendError(connID, err.Code, err.Message)
+			return
+		}
+	}
+	status := deliverDirect(connID, target, text, encrypted.Raw)
+	receipt, _ = sjson.Set(receipt, "status", status)
+	send(connID, receipt)
+}
+
+// deliverDirect sends the text to the target and returns the delivery status:
+// "delivered" when the target is connected to this instance, "relayed" when it
+// was handed to the other instances, "faraway" when the target is not within
+// the roaming distance, or "unknown". An encrypted payload is relayed as is.
+func deliverDirect(connID, target, text, encrypted string) string {
+	_, sender, targetID, status := nearbyTarget(connID, target)
+	if status != "" {
+		return status
+	}
+
+	dm := `{"type":"` + protocol.TypeDirectMessage + `"}`
+	dm, _ = sjson.SetRaw(dm, "feature", shownFeature(secureFeature(sender)))
+	dm, _ = sjson.Set(dm, "text", text)
+	if encrypted != "" {
+		dm, _ = sjson.SetRaw(dm, "encrypted", encrypted)
+	}
+	idmu.Lock()
+	_, local := clientConnM[targetID]
+	idmu.Unlock()
+	deliver([]string{targetID}, dm)
+	if local {
+		return "delivered"
+	}
+	return "relayed"
+}
+
+// nearbyTarget finds the person of a secure id amongst the people within the
+// roaming distance of the person of a connection. It returns the clientID and
+// the stored feature of the sender with the clientID of the target, or a
+// status of "unknown" or "faraway" as deliverDirect does.
+func nearbyTarget(connID, target string) (clientID, sender, targetID, status string) {
+	idmu.Lock()
+	clientID = connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		return "", "", "", "unknown"
+	}
+
+	// Use the senders stored position rather than trusting the payload
+	ns := connNamespace(connID)
+	floor := clientFloor(clientID)
+	sender, err := geo.GetFeature(floorKey(peopleKey(ns), floor), clientID)
+	if err != nil {
+		return "", "", "", "unknown"
+	}
+	lat := gjson.Get(sender, "geometry.coordinates.1").Float()
+	lng := gjson.Get(sender, "geometry.coordinates.0").Float()
+
+	// Find the target amongst the people within the roaming distance
+	nearby, err := nearbyIDs(ns, floor, lat, lng, live().RoamDist)
+	if err != nil {
+		return "", "", "", "unknown"
+	}
+	for _, id := range nearby {
+		if id != clientID && secureClientID(id) == target {
+			return clientID, sender, id, ""
+		}
+	}
+	return "", "", "", "faraway"
+}
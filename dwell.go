@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// transition is an enter or exit of a room that waits for the fence dwell
+type transition struct {
+	detect string      // enter or exit
+	msg    string      // latest notification of the person for the room
+	timer  *time.Timer // relays the transition after the dwell
+}
+
+var (
+	dwellmu sync.Mutex                        // guard dwellM
+	dwellM  map[string]map[string]*transition // clientID -> roomID -> transition
+)
+
+// holdTransition holds back the room notifications of people crossing the
+// fence of a room until they have stayed on the other side for the fence
+// dwell. A person who crosses back within the dwell never entered or left,
+// so that walking along the boundary does not flood the audience, the
+// webhooks and the integrations with enter and exit events. Returns true when
+// the notification was held or dropped, false when it is handled right away.
+func holdTransition(roomID, msg string) bool {
+	if cfg.FenceDwell <= 0 {
+		return false
+	}
+	clientID := gjson.Get(msg, "object.id").String()
+	detect := gjson.Get(msg, "detect").String()
+	dwellmu.Lock()
+	defer dwellmu.Unlock()
+	t := dwellM[clientID][roomID]
+	switch detect {
+	case "enter", "inside":
+		switch {
+		case t != nil && t.detect == "enter":
+			// keep the latest position for when the enter is relayed
+			t.msg, _ = sjson.Set(msg, "detect", "enter")
+			return true
+		case t != nil:
+			// back inside before the exit was relayed
+			cancelTransition(clientID, roomID)
+			return false
+		case detect == "enter" && !isInside(clientID, roomID):
+			startTransition(clientID, roomID, detect, msg)
+			return true
+		}
+	case "exit":
+		switch {
+		case t != nil && t.detect == "exit":
+			t.msg = msg
+			return true
+		case t != nil:
+			// back outside before the enter was relayed
+			cancelTransition(clientID, roomID)
+			return true
+		case gjson.Get(msg, "command").String() == "del" || !isInside(clientID, roomID):
+			// the person is gone and will not cross back, or was not
+			// known to be inside
+			return false
+		}
+		startTransition(clientID, roomID, detect, msg)
+		return true
+	}
+	return false
+}
+
+// startTransition holds a transition of a person for the fence dwell. The
+// caller holds dwellmu.
+func startTransition(clientID, roomID, detect, msg string) {
+	t := &transition{detect: detect, msg: msg}
+	t.timer = time.AfterFunc(cfg.FenceDwell, func() {
+		dwellmu.Lock()
+		if dwellM[clientID][roomID] != t {
+			dwellmu.Unlock()
+			return
+		}
+		msg := t.msg
+		cancelTransition(clientID, roomID)
+		dwellmu.Unlock()
+		if detect == "exit" && !isInside(clientID, roomID) {
+			// the person already left, such as to another floor
+			return
+		}
+		roomNotification(roomID, msg)
+	})
+	if dwellM[clientID] == nil {
+		dwellM[clientID] = make(map[string]*transition)
+	}
+	dwellM[clientID][roomID] = t
+}
+
+// cancelTransition drops a held transition of a person. The caller holds
+// dwellmu.
+func cancelTransition(clientID, roomID string) {
+	if t, ok := dwellM[clientID][roomID]; ok {
+		t.timer.Stop()
+		delete(dwellM[clientID], roomID)
+		if len(dwellM[clientID]) == 0 {
+			delete(dwellM, clientID)
+		}
+	}
+}
+
+// forgetTransitions drops the held transitions of a person, who changed
+// floors or left
+func forgetTransitions(clientID string) {
+	dwellmu.Lock()
+	for roomID := range dwellM[clientID] {
+		cancelTransition(clientID, roomID)
+	}
+	dwellmu.Unlock()
+}
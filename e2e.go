@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on end-to-end encryption
+const (
+	maxPublicKeyLen = 1024     // bytes of a decoded public key
+	maxEncryptedLen = 64 << 10 // bytes of an encrypted payload
+)
+
+var (
+	keymu sync.Mutex        // guard keyM
+	keyM  map[string]string // connID -> base64 public key
+)
+
+// publicKeyMessage is a websocket message handler that registers the public
+// key of a connection. The key is shown as the "publicKey" property of the
+// feature of the person, so that the people around them can encrypt chat
+// messages for them.
+func publicKeyMessage(connID, msg string) {
+	var pk protocol.PublicKey
+	if err := protocol.Decode(msg, &pk); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(pk.Key)
+	if err != nil || len(key) == 0 || len(key) > maxPublicKeyLen {
+		sendError(connID, "invalid_key", "Public key must be base64 of at most 1024 bytes")
+		return
+	}
+	keymu.Lock()
+	keyM[connID] = pk.Key
+	keymu.Unlock()
+	sessionKey(connID, pk.Key)
+
+	// Update the stored feature so that everyone sees the new key without
+	// waiting for the next Feature message
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID != "" {
+		people := personKey(clientID)
+		feature, err := geo.GetFeature(people, clientID)
+		if err == nil {
+			geo.SetFeature(people, clientID, attachKey(connID, feature), live().PeopleTTL)
+		}
+	}
+	reply, _ := protocol.Encode(protocol.PublicKey{
+		Envelope: protocol.Envelope{Type: protocol.TypePublicKey},
+		ID:       secureClientID(clientID),
+		Key:      pk.Key,
+	})
+	send(connID, reply)
+}
+
+// attachKey sets the public key of a connection as the "publicKey" property
+// of its feature
+func attachKey(connID, feature string) string {
+	keymu.Lock()
+	key, ok := keyM[connID]
+	keymu.Unlock()
+	if !ok {
+		return feature
+	}
+	feature, _ = sjson.Set(feature, "properties.publicKey", key)
+	return feature
+}
+
+// forgetKey removes the public key of a closed connection
+func forgetKey(connID string) {
+	keymu.Lock()
+	delete(keyM, connID)
+	keymu.Unlock()
+}
+
+// validateEncrypted checks an encrypted payload. The server cannot read it,
+// so it only has to be JSON of a bounded size, and it cannot be sent along
+// with plain text.
+func validateEncrypted(payload json.RawMessage, text string) *validationError {
+	if len(payload) > maxEncryptedLen {
+		return invalid("message_too_long", "Encrypted payload is too large")
+	}
+	if text != "" {
+		return invalid("invalid_message", "Encrypted messages have no text")
+	}
+	if !gjson.ValidBytes(payload) {
+		return invalid("invalid_message", "Encrypted payload must be JSON")
+	}
+	return nil
+}
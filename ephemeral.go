@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The disappearing message settings
+const (
+	maxMessageTTL  = 7 * 24 * time.Hour // how long a disappearing message can last
+	expiringKey    = "expiring"         // sorted set of expiring messages -> expiry in Unix ms
+	expiryInterval = time.Second        // time between sweeps of expired messages
+	expiryBatch    = 100                // expired messages handled per sweep
+)
+
+// expiring is a chat message with a TTL that waits in the expiring set for
+// its deletion
+type expiring struct {
+	ID    string   `json:"id"`
+	Rooms []string `json:"rooms,omitempty"` // rooms whose history has the message
+	To    []string `json:"to,omitempty"`    // clientIDs of the sender and recipients
+}
+
+// validateTTL checks the TTL of a disappearing chat message
+func validateTTL(ttl int) *validationError {
+	if ttl < 0 || time.Duration(ttl)*time.Second > maxMessageTTL {
+		return invalid("invalid_ttl", "Message ttl must be 1 to 604800 seconds")
+	}
+	return nil
+}
+
+// expireMessage schedules the deletion of a disappearing chat message from
+// the history of its rooms, and the MessageExpired for the people it was
+// sent to
+func expireMessage(msgID string, expires int64, roomIDs, clientIDs []string) {
+	e, _ := json.Marshal(expiring{ID: msgID, Rooms: roomIDs, To: clientIDs})
+	if _, err := storeDo("ZADD", expiringKey, expires, e); err != nil {
+		lg.Error("message expiry failed", "msg", msgID, "err", err)
+	}
+}
+
+// expired returns true when a frame is a chat message with a TTL that ran out
+func expired(msg string, now time.Time) bool {
+	if gjson.Get(msg, "type").String() != protocol.TypeMessage {
+		return false
+	}
+	expires := gjson.Get(msg, "expires").Int()
+	return expires != 0 && expires <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// unexpired returns the frames that are not expired chat messages, so that
+// messages that wait for the next sweep are never replayed or exported
+func unexpired(msgs []string) []string {
+	now := time.Now()
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		if !expired(msg, now) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// runExpiry deletes the disappearing chat messages that expired, once per
+// expiry interval. Every instance sweeps, and the one that removes a message
+// from the expiring set deletes it.
+func runExpiry() {
+	for {
+		if isDraining() {
+			return
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		entries, err := redis.Strings(storeDo("ZRANGEBYSCORE", expiringKey,
+			"-inf", now, "LIMIT", 0, expiryBatch))
+		if err != nil {
+			lg.Error("message expiry sweep failed", "err", err)
+		}
+		for _, entry := range entries {
+			if n, err := redis.Int(storeDo("ZREM", expiringKey, entry)); err != nil || n == 0 {
+				// another instance took it
+				continue
+			}
+			var e expiring
+			if json.Unmarshal([]byte(entry), &e) == nil {
+				deleteExpired(e)
+			}
+		}
+		time.Sleep(expiryInterval)
+	}
+}
+
+// deleteExpired deletes an expired chat message from the history of its
+// rooms and tells the people it was sent to, and those in its rooms now,
+// that it expired
+func deleteExpired(e expiring) {
+	to := make(map[string]bool, len(e.To))
+	for _, clientID := range e.To {
+		to[clientID] = true
+	}
+	for _, roomID := range e.Rooms {
+		msgs, err := redis.Strings(storeDo("LRANGE", historyKey(roomID), 0, -1))
+		if err != nil {
+			lg.Error("message expiry failed", "msg", e.ID, "room", roomID, "err", err)
+		}
+		for _, msg := range msgs {
+			if gjson.Get(msg, "id").String() == e.ID {
+				storeDo("LREM", historyKey(roomID), 0, msg)
+			}
+		}
+		for _, clientID := range roomMembers(roomID) {
+			to[clientID] = true
+		}
+	}
+	clientIDs := make([]string, 0, len(to))
+	for clientID := range to {
+		clientIDs = append(clientIDs, clientID)
+	}
+	msg, _ := protocol.Encode(protocol.MessageExpired{
+		Envelope: protocol.Envelope{Type: protocol.TypeMessageExpired},
+		ID:       e.ID,
+	})
+	deliver(clientIDs, msg)
+	lg.Debug("message expired", "msg", e.ID, "rooms", len(e.Rooms))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/auth"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// userOnly wraps an HTTP handler of a person's own data so that it requires
+// their token, like a websocket upgrade, and passes the clientID that the
+// token was issued for. The API is disabled on anonymous servers, where
+// nobody can prove who they are.
+func userOnly(fn func(w http.ResponseWriter, r *http.Request, clientID string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if verifier == nil {
+			http.NotFound(w, r)
+			return
+		}
+		token, err := auth.TokenFromRequest(r)
+		if err == nil {
+			var clientID string
+			if clientID, err = verifier.Verify(token); err == nil {
+				fn(w, r, userClientID(clientID))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// export is the archive of the data stored about a person
+type export struct {
+	ID       string            `json:"id"`
+	Exported time.Time         `json:"exported"`
+	Profile  json.RawMessage   `json:"profile"`
+	Trail    json.RawMessage   `json:"trail"`    // GeoJSON FeatureCollection, oldest first
+	Messages []json.RawMessage `json:"messages"` // chat messages in room histories, newest first
+}
+
+// meAPI is an HTTP handler for people's own data: a download of everything
+// stored about them, and deleting it
+//
+//	GET    /api/me/export  the profile, trail and messages as JSON
+//	DELETE /api/me         delete the profile, trail and messages
+func meAPI(w http.ResponseWriter, r *http.Request, clientID string) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet && path == "api/me/export":
+		e, err := exportPerson(clientID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="proximity-chat-export.json"`)
+		json.NewEncoder(w).Encode(e)
+	case r.Method == http.MethodDelete && path == "api/me":
+		if err := purgePerson(clientID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "api/me/export":
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case path == "api/me":
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// exportPerson assembles the profile, trail and chat messages of a person
+func exportPerson(clientID string) (*export, error) {
+	secureID := secureClientID(clientID)
+	e := &export{ID: secureID, Exported: time.Now().UTC(), Profile: json.RawMessage("null")}
+	profile, err := redis.String(storeDo("GET", profileKey(secureID)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if profile != "" {
+		e.Profile = json.RawMessage(profile)
+	}
+
+	points, err := redis.Strings(storeDo("LRANGE", trailKey(clientID), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	features := make([]string, 0, len(points))
+	for i := len(points) - 1; i >= 0; i-- {
+		var p protocol.TrailPoint
+		if json.Unmarshal([]byte(points[i]), &p) != nil {
+			continue
+		}
+		feature, _ := json.Marshal(map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": "Point", "coordinates": []float64{p.Lng, p.Lat}},
+			"properties": map[string]interface{}{"time": p.Time},
+		})
+		features = append(features, string(feature))
+	}
+	e.Trail = json.RawMessage(`{"type":"FeatureCollection","features":[` + strings.Join(features, ",") + `]}`)
+
+	history, err := personHistory(secureID)
+	if err != nil {
+		return nil, err
+	}
+	e.Messages = []json.RawMessage{}
+	for _, msgs := range history {
+		for _, m := range unexpired(msgs) {
+			e.Messages = append(e.Messages, json.RawMessage(m))
+		}
+	}
+	return e, nil
+}
+
+// personHistory returns the chat messages of a person in the history of
+// every room, by room. The histories are found in Redis, so that rooms of
+// other instances and rooms that closed are included.
+func personHistory(secureID string) (map[string][]string, error) {
+	keys, err := scanKeys(historyKey("*"))
+	if err != nil {
+		return nil, err
+	}
+	roomIDs := make([]string, len(keys))
+	for i, key := range keys {
+		roomIDs[i] = strings.TrimPrefix(key, historyKey(""))
+	}
+	history := make(map[string][]string)
+	if len(roomIDs) == 0 {
+		return history, nil
+	}
+	b := newBatch(store)
+	defer b.Close()
+	for _, roomID := range roomIDs {
+		b.Send("LRANGE", historyKey(roomID), 0, -1)
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		return nil, err
+	}
+	for i, roomID := range roomIDs {
+		msgs, _ := redis.Strings(replies[i], nil)
+		for _, m := range msgs {
+			if gjson.Get(m, "feature.id").String() == secureID {
+				history[roomID] = append(history[roomID], m)
+			}
+		}
+	}
+	return history, nil
+}
+
+// scanKeys returns the Redis keys that match a pattern, without blocking
+// Redis like KEYS does
+func scanKeys(pattern string) ([]string, error) {
+	conn := store.Get()
+	defer conn.Close()
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) != 2 {
+			return nil, redis.Error("ERR unexpected SCAN reply")
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		batch, _ := redis.Strings(reply[1], nil)
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// purgePerson deletes the profile, trail and chat messages of a person, and
+// their position when they are on the map
+func purgePerson(clientID string) error {
+	secureID := secureClientID(clientID)
+	history, err := personHistory(secureID)
+	if err != nil {
+		return err
+	}
+	profile, err := redis.String(storeDo("GET", profileKey(secureID)))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if username := gjson.Get(profile, "username").String(); username != "" {
+		releaseUsername(secureID, username)
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("DEL", profileKey(secureID))
+	b.Send("DEL", trailKey(clientID))
+	b.Send("DEL", followersKey(secureID))
+	b.Send("DEL", followableKey(secureID))
+	for roomID, msgs := range history {
+		for _, m := range msgs {
+			b.Send("LREM", historyKey(roomID), 0, m)
+		}
+	}
+	if _, err := b.Flush(); err != nil {
+		return err
+	}
+	for _, ns := range allNamespaces() {
+		key, _, err := findPerson(ns, clientID)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := geo.DelFeature(key, clientID); err != nil {
+			return err
+		}
+	}
+	profilemu.Lock()
+	delete(profileM, clientID)
+	profilemu.Unlock()
+	lg.Info("person data deleted", "client", secureID, "rooms", len(history))
+	return nil
+}
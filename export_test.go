@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPurgePerson(t *testing.T) {
+	a := testID(1)
+	joinTest(t, a, 39.7425, -104.9965)
+	secureID := secureClientID(a)
+	// a room that this instance does not know, such as one of another
+	// instance or one that closed
+	gone := testID(2) + "-gone"
+	mine := fmt.Sprintf(`{"type":"Message","id":%q,"feature":{"id":%q},"text":"mine"}`, testID(3), secureID)
+	other := fmt.Sprintf(`{"type":"Message","id":%q,"feature":{"id":"someone"},"text":"other"}`, testID(4))
+	recordHistory([]string{gone}, mine)
+	recordHistory([]string{gone}, other)
+
+	e, err := exportPerson(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Messages) != 1 || string(e.Messages[0]) != mine {
+		t.Fatalf("export: got %s", e.Messages)
+	}
+	if err := purgePerson(a); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := personHistory(secureID); len(history) != 0 {
+		t.Fatalf("history after the purge: got %v", history)
+	}
+	if n, _ := storeDo("LLEN", historyKey(gone)); n != int64(1) {
+		t.Fatalf("the messages of others must be kept, got %v", n)
+	}
+	if _, _, err := findPerson("", a); err != ErrNotFound {
+		t.Fatalf("feature after the purge: got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// maxFenceSize is the largest GeoJSON fence accepted by the fences API
+const maxFenceSize = 1 << 20
+
+// validFenceID matches the IDs that can be used for fences
+var validFenceID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// fencesAPI is an HTTP handler for managing room fences at runtime. Fences
+// of a namespace are managed at /api/fences/{namespace}/{id}. A ttl creates a
+// pop-up room, which closes once the ttl has passed.
+//
+//	POST   /api/fences/{id}?ttl=30m  create a fence from a GeoJSON feature
+//	PUT    /api/fences/{id}?ttl=30m  create or replace a fence
+//	DELETE /api/fences/{id}          delete a fence
+func fencesAPI(w http.ResponseWriter, r *http.Request) {
+	fenceID := strings.TrimPrefix(r.URL.Path, "/api/fences/")
+	var ns string
+	if i := strings.IndexByte(fenceID, '/'); i >= 0 {
+		ns, fenceID = fenceID[:i], fenceID[i+1:]
+		if ns == "" || !knownNamespace(ns) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if !validFenceID.MatchString(fenceID) {
+		http.Error(w, "invalid fence id", http.StatusBadRequest)
+		return
+	}
+	id := namespaceRoom(ns, fenceID)
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFenceSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		object := string(data)
+		if msg := checkFence(object); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost && roomExists(id) {
+			http.Error(w, "fence already exists", http.StatusConflict)
+			return
+		}
+		// the path is authoritative for the fence id
+		object, _ = sjson.Set(object, "properties.id", fenceID)
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl <= 0 || ttl > maxRoomTTL {
+				http.Error(w, "invalid ttl", http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(ttl).UTC().Format(time.RFC3339)
+			object, _ = sjson.Set(object, "properties.expires", expires)
+		}
+		room := newNamespaceRoom(ns, fenceID, object)
+		if err := setRoomFence(room.ID, room.Object); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		created := putRoom(room)
+		broadcastFence(room.ID, room.Object)
+		change, _ := sjson.Set(`{}`, "id", room.ID)
+		change, _ = sjson.SetRaw(change, "fence", room.Object)
+		auditRequest(r, "fence_set", change)
+
+		w.Header().Set("Content-Type", "application/json")
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(room)
+	case http.MethodDelete:
+		if !deleteRoom(id) {
+			http.NotFound(w, r)
+			return
+		}
+		if err := delRoomFence(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		broadcastFence(id, "")
+		change, _ := sjson.Set(`{}`, "id", id)
+		auditRequest(r, "fence_delete", change)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkFence returns a description of the problem when the object cannot be
+// used as a fence, or an empty string when it can
+func checkFence(object string) string {
+	if !json.Valid([]byte(object)) {
+		return "invalid json"
+	}
+	if gjson.Get(object, "type").String() != "Feature" {
+		return "fence must be a GeoJSON Feature"
+	}
+	if parent := gjson.Get(object, "properties.parent"); parent.Exists() &&
+		!validFenceID.MatchString(parent.String()) {
+		return "fence parent must be a fence id"
+	}
+	switch gjson.Get(object, "geometry.type").String() {
+	case "Polygon", "MultiPolygon":
+		return ""
+	}
+	return "fence geometry must be a Polygon or MultiPolygon"
+}
+
+// broadcastFence lets the connected clients of the namespace of a room and
+// the other instances know that its fence was created, updated or, when the
+// object is empty, deleted
+func broadcastFence(roomID, object string) {
+	ns := sendFence(roomID, object)
+	env, _ := sjson.Set(`{"kind":"fence"}`, "ns", ns)
+	publish(env, fenceMessage(roomID, object))
+}
+
+// sendFence lets the connected clients of the namespace of a room on this
+// instance know that its fence changed. Returns the namespace.
+func sendFence(roomID, object string) string {
+	ns, _ := splitRoom(roomID)
+	broadcastNamespace(ns, fenceMessage(roomID, object))
+	return ns
+}
+
+// fenceMessage encodes a FenceUpdated message for a room
+func fenceMessage(roomID, object string) string {
+	msg := `{"type":"` + protocol.TypeFenceUpdated + `"}`
+	msg, _ = sjson.Set(msg, "id", localRoom(roomID))
+	if object == "" {
+		msg, _ = sjson.Set(msg, "deleted", true)
+	} else {
+		msg, _ = sjson.SetRaw(msg, "feature", object)
+	}
+	return msg
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// fenceFetchTimeout is the timeout of fetching the fences URL
+const fenceFetchTimeout = 10 * time.Second
+
+// readFences reads the room fences from the fences URL when configured, or
+// from the fences directory, or else from the fences of the static site
+func readFences() (map[string]*Room, error) {
+	switch {
+	case cfg.FencesURL != "":
+		return fetchFences(cfg.FencesURL)
+	case cfg.FencesDir != "":
+		return readFenceDir(os.DirFS(cfg.FencesDir))
+	}
+	fences, err := fs.Sub(staticFS(), "fences")
+	if err != nil {
+		return nil, err
+	}
+	return readFenceDir(fences)
+}
+
+// readFenceDir reads a room for every GeoJSON file in the directory, and for
+// every file in the subdirectory of each namespace
+func readFenceDir(dir fs.FS) (map[string]*Room, error) {
+	loaded := make(map[string]*Room)
+	for _, ns := range allNamespaces() {
+		paths, err := fs.Glob(dir, path.Join(ns, "*.geojson"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			data, err := fs.ReadFile(dir, p)
+			if err != nil {
+				return nil, err
+			}
+			object := string(data)
+			if msg := checkFence(object); msg != "" {
+				return nil, fmt.Errorf("%s: %s", p, msg)
+			}
+			id := strings.TrimSuffix(path.Base(p), ".geojson")
+			room := newNamespaceRoom(ns, id, object)
+			loaded[room.ID] = room
+		}
+	}
+	return loaded, nil
+}
+
+// fetchFences reads a room for every feature of a GeoJSON FeatureCollection
+// at the URL. Features need an "id" property, and a "namespace" property for
+// rooms outside of the default namespace.
+func fetchFences(url string) (map[string]*Room, error) {
+	client := &http.Client{Timeout: fenceFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch fences: unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if gjson.GetBytes(data, "type").String() != "FeatureCollection" {
+		return nil, fmt.Errorf("fetch fences: not a FeatureCollection")
+	}
+	loaded := make(map[string]*Room)
+	for i, feature := range gjson.GetBytes(data, "features").Array() {
+		object := feature.Raw
+		if msg := checkFence(object); msg != "" {
+			return nil, fmt.Errorf("fetch fences: feature %d: %s", i, msg)
+		}
+		id := feature.Get("properties.id").String()
+		ns := feature.Get("properties.namespace").String()
+		if !validFenceID.MatchString(id) || !knownNamespace(ns) {
+			return nil, fmt.Errorf("fetch fences: feature %d: invalid id or namespace", i)
+		}
+		room := newNamespaceRoom(ns, id, object)
+		loaded[room.ID] = room
+	}
+	return loaded, nil
+}
+
+// loadRooms registers the rooms of the fence source
+func loadRooms() error {
+	loaded, err := readFences()
+	if err != nil {
+		return err
+	}
+	roommu.Lock()
+	rooms = make(map[string]*Room)
+	roommu.Unlock()
+	for _, room := range loaded {
+		room.loaded = true
+		putRoom(room)
+	}
+	return nil
+}
+
+// reloadFences reads the fence source again and applies the differences:
+// rooms that are new or changed get their fence set, and rooms that are gone
+// are deleted. Rooms created or changed through the fences API are left
+// alone, even when the source has a room of the same ID, so that they keep
+// their fence, expiry and open polls. Every instance reloads on its own, so
+// changes are only sent to local clients.
+func reloadFences() error {
+	loaded, err := readFences()
+	if err != nil {
+		return err
+	}
+	var changed, removed []*Room
+	roommu.Lock()
+	for id, room := range loaded {
+		prev, ok := rooms[id]
+		if ok && !prev.loaded {
+			continue // a room of the fences API
+		}
+		if !ok || prev.Object != room.Object {
+			changed = append(changed, room)
+		}
+	}
+	for id, room := range rooms {
+		if _, ok := loaded[id]; !ok && room.loaded {
+			removed = append(removed, room)
+		}
+	}
+	roommu.Unlock()
+
+	for _, room := range changed {
+		if err := setRoomFence(room.ID, room.Object); err == errRoomExpired {
+			continue
+		} else if err != nil {
+			return err
+		}
+		room.loaded = true
+		putRoom(room)
+		sendFence(room.ID, room.Object)
+	}
+	for _, room := range removed {
+		if err := delRoomFence(room.ID); err != nil {
+			return err
+		}
+		deleteRoom(room.ID)
+		sendFence(room.ID, "")
+	}
+	if len(changed) > 0 || len(removed) > 0 {
+		lg.Info("fences reloaded", "changed", len(changed), "removed", len(removed))
+	}
+	return nil
+}
+
+// watchFences reloads the fences at the reload interval
+func watchFences() {
+	if cfg.FencesReload <= 0 {
+		return
+	}
+	for range time.NewTicker(cfg.FencesReload).C {
+		if err := reloadFences(); err != nil {
+			lg.Error("fence reload failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReloadFencesKeepsAPIRooms(t *testing.T) {
+	testServer(t)
+	var id string
+	roommu.Lock()
+	for roomID, room := range rooms {
+		if room.loaded {
+			id = roomID
+			break
+		}
+	}
+	roommu.Unlock()
+	if id == "" {
+		t.Fatal("no room read from the fences")
+	}
+	object := `{"type":"Feature","properties":{"name":"Pop-up"},"geometry":{"type":"Polygon",` +
+		`"coordinates":[[[-105,39.7],[-104.9,39.7],[-104.9,39.8],[-105,39.8],[-105,39.7]]]}}`
+	room := newNamespaceRoom("", id, object)
+	putRoom(room)
+	t.Cleanup(func() {
+		roommu.Lock()
+		rooms[id].loaded = true
+		roommu.Unlock()
+		reloadFences()
+	})
+
+	if err := reloadFences(); err != nil {
+		t.Fatal(err)
+	}
+	roommu.Lock()
+	got := rooms[id]
+	roommu.Unlock()
+	if got != room {
+		t.Fatalf("got room %+v, want the one of the fences API", got)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// messageFilter checks the text of a chat message from a person and returns
+// an error when the message must be rejected
+type messageFilter func(clientID, text string) *validationError
+
+// messageFilters is the filter chain that every chat message passes through,
+// in order
+var messageFilters []messageFilter
+
+// linkPattern matches the links in a chat message
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// lastMessage is the previous chat message of a person
+type lastMessage struct {
+	text string
+	at   time.Time
+}
+
+var (
+	repeatmu     sync.Mutex             // guard lastMessageM
+	lastMessageM map[string]lastMessage // clientID -> previous message
+)
+
+// setupFilters builds the filter chain from the config
+func setupFilters() error {
+	messageFilters = append(messageFilters[:0], emptyFilter)
+	if cfg.MaxMessageLen > 0 {
+		messageFilters = append(messageFilters, lengthFilter(cfg.MaxMessageLen))
+	}
+	if cfg.WordList != "" {
+		words, err := readWordList(cfg.WordList)
+		if err != nil {
+			return err
+		}
+		messageFilters = append(messageFilters, wordFilter(words))
+	}
+	if !cfg.AllowLinks || len(cfg.LinkHosts) > 0 {
+		messageFilters = append(messageFilters, linkFilter(cfg.AllowLinks, cfg.LinkHosts))
+	}
+	if cfg.RepeatWindow > 0 {
+		messageFilters = append(messageFilters, repeatFilter(cfg.RepeatWindow))
+	}
+	return nil
+}
+
+// filterMessage runs a chat message through the filter chain
+func filterMessage(clientID, text string) *validationError {
+	for _, filter := range messageFilters {
+		if err := filter(clientID, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyFilter rejects messages without any text
+func emptyFilter(clientID, text string) *validationError {
+	if strings.TrimSpace(text) == "" {
+		return invalid("empty_message", "Message is empty")
+	}
+	return nil
+}
+
+// lengthFilter rejects messages longer than max characters
+func lengthFilter(max int) messageFilter {
+	return func(clientID, text string) *validationError {
+		if utf8.RuneCountInString(text) > max {
+			return invalid("message_too_long", "Message is too long")
+		}
+		return nil
+	}
+}
+
+// readWordList reads a file with one word per line. Blank lines and lines
+// starting with # are skipped.
+func readWordList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	words := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		word := strings.ToLower(strings.TrimSpace(s.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	return words, s.Err()
+}
+
+// wordFilter rejects messages that contain any of the words, ignoring case
+func wordFilter(words map[string]bool) messageFilter {
+	return func(clientID, text string) *validationError {
+		fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, field := range fields {
+			if words[field] {
+				return invalid("blocked_word", "Message contains a blocked word")
+			}
+		}
+		return nil
+	}
+}
+
+// linkFilter rejects messages with links, unless links are allowed and they
+// point to one of the hosts or their subdomains. An empty list of hosts
+// allows all hosts.
+func linkFilter(allow bool, hosts []string) messageFilter {
+	return func(clientID, text string) *validationError {
+		for _, link := range linkPattern.FindAllString(text, -1) {
+			if !allow {
+				return invalid("link_not_allowed", "Links are not allowed")
+			}
+			if !strings.Contains(link, "://") {
+				link = "http://" + link
+			}
+			u, err := url.Parse(link)
+			if err != nil || !allowedHost(strings.ToLower(u.Hostname()), hosts) {
+				return invalid("link_not_allowed", "Links to this site are not allowed")
+			}
+		}
+		return nil
+	}
+}
+
+// allowedHost returns true when host is one of hosts or a subdomain of one
+func allowedHost(host string, hosts []string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// repeatFilter rejects a message that repeats the previous message of the
+// same person within the window, ignoring case and surrounding space
+func repeatFilter(window time.Duration) messageFilter {
+	return func(clientID, text string) *validationError {
+		text = strings.ToLower(strings.TrimSpace(text))
+		now := time.Now()
+		repeatmu.Lock()
+		defer repeatmu.Unlock()
+		last, ok := lastMessageM[clientID]
+		lastMessageM[clientID] = lastMessage{text: text, at: now}
+		if ok && last.text == text && now.Sub(last.at) < window {
+			return invalid("repeated_message", "Message was just sent")
+		}
+		return nil
+	}
+}
+
+// forgetMessages drops the previous message of a person
+func forgetMessages(clientID string) {
+	repeatmu.Lock()
+	delete(lastMessageM, clientID)
+	repeatmu.Unlock()
+}
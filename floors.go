@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Floors partition the people of a namespace for indoor positioning. When
+// floors are configured, a person whose feature has a "floor" property, or
+// "z" for short, is stored in the collection of that floor, such as
+// "people:floor:2", and only meets the people and enters the rooms of the
+// same floor. People without a floor stay in the people collection of the
+// namespace. Every floor collection has its own roaming channel, and a room
+// without a floor has a fence channel for every floor.
+
+// floorSep separates the floor from a collection or channel name. Namespaces
+// and fence IDs cannot contain it.
+const floorSep = ":floor:"
+
+var (
+	floormu sync.Mutex        // guard floorM
+	floorM  map[string]string // clientID -> floor, for people on a floor
+)
+
+// floorKey returns the name of a collection or channel for a floor, the name
+// itself when the floor is empty
+func floorKey(key, floor string) string {
+	if floor == "" {
+		return key
+	}
+	return key + floorSep + floor
+}
+
+// splitFloor returns the name and the floor of a collection or channel name
+func splitFloor(key string) (name, floor string) {
+	if i := strings.Index(key, floorSep); i >= 0 {
+		return key[:i], key[i+len(floorSep):]
+	}
+	return key, ""
+}
+
+// floorKeys returns a name for no floor followed by the name for every
+// configured floor
+func floorKeys(key string) []string {
+	keys := []string{key}
+	for _, floor := range cfg.Floors {
+		keys = append(keys, floorKey(key, floor))
+	}
+	return keys
+}
+
+// featureFloor returns the floor of a feature, empty for none or when floors
+// are not configured. Returns false when the floor is not a configured one.
+func featureFloor(feature string) (string, bool) {
+	if len(cfg.Floors) == 0 {
+		return "", true
+	}
+	props := gjson.Get(feature, "properties")
+	v := props.Get("floor")
+	if !v.Exists() {
+		v = props.Get("z")
+	}
+	if !v.Exists() || v.Type == gjson.Null {
+		return "", true
+	}
+	n, err := strconv.ParseFloat(v.String(), 64)
+	if err != nil || n != math.Trunc(n) {
+		return "", false
+	}
+	floor := strconv.Itoa(int(n))
+	for _, f := range cfg.Floors {
+		if f == floor {
+			return floor, true
+		}
+	}
+	return "", false
+}
+
+// parseFloors parses a comma separated list of floor numbers
+func parseFloors(s string) ([]string, error) {
+	var floors []string
+	for _, part := range splitList(s) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		floors = append(floors, strconv.Itoa(n))
+	}
+	return floors, nil
+}
+
+// clientFloor returns the floor of a person, empty for none
+func clientFloor(clientID string) string {
+	floormu.Lock()
+	defer floormu.Unlock()
+	return floorM[clientID]
+}
+
+// personKey returns the people collection that a person of this instance is
+// stored in, or the collection of the kind of an entity
+func personKey(clientID string) string {
+	if kind := clientKind(clientID); kind != "" {
+		return kindKey(clientNamespace(clientID), kind)
+	}
+	return floorKey(peopleKey(clientNamespace(clientID)), clientFloor(clientID))
+}
+
+// connPeopleKey returns the people collection of the floor of the person of a
+// connection, the collection of the namespace before the person is known
+func connPeopleKey(connID string) string {
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	return floorKey(peopleKey(connNamespace(connID)), clientFloor(clientID))
+}
+
+// findPerson returns the people collection and the feature of a person of a
+// namespace, who may be on any floor and connected to any instance
+func findPerson(ns, clientID string) (key, feature string, err error) {
+	key = floorKey(peopleKey(ns), clientFloor(clientID))
+	feature, err = geo.GetFeature(key, clientID)
+	if err != ErrNotFound {
+		return key, feature, err
+	}
+	for _, other := range floorKeys(peopleKey(ns)) {
+		if other == key {
+			continue
+		}
+		feature, err = geo.GetFeature(other, clientID)
+		if err != ErrNotFound {
+			return other, feature, err
+		}
+	}
+	return "", "", ErrNotFound
+}
+
+// setFloor records the floor of a person. A person who changed floors is
+// taken out of the collection of the old floor, telling the people who saw
+// them there that they are faraway, and leaves the rooms that are not on the
+// new floor.
+func setFloor(ns, clientID, floor string) {
+	floormu.Lock()
+	prev := floorM[clientID]
+	if floor == "" {
+		delete(floorM, clientID)
+	} else {
+		floorM[clientID] = floor
+	}
+	floormu.Unlock()
+	if prev == floor {
+		return
+	}
+	forgetTransitions(clientID)
+	key := floorKey(peopleKey(ns), prev)
+	feature, err := geo.GetFeature(key, clientID)
+	if err != nil {
+		return
+	}
+	farawayNearby(ns, prev, clientID, feature)
+	geo.DelFeature(key, clientID)
+	for _, roomID := range fencesInside(clientID) {
+		if !roomOnFloor(roomID, floor) {
+			exit, _ := sjson.Set(`{"command":"del","detect":"exit"}`, "id", clientID)
+			exit, _ = sjson.SetRaw(exit, "object", feature)
+			roomNotification(roomID, exit)
+		}
+	}
+}
+
+// forgetFloor removes the floor of a person
+func forgetFloor(clientID string) {
+	floormu.Lock()
+	delete(floorM, clientID)
+	floormu.Unlock()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// maxFollows is the number of people that a person can follow
+const maxFollows = 50
+
+var (
+	followmu   sync.Mutex                 // guard followersM and followingM
+	followersM map[string][]string        // clientID -> followers of the namespace, for people of this instance
+	followingM map[string]map[string]bool // clientID -> secure ids of the people they follow
+)
+
+// followersKey returns the Redis key of the followers of a person, by
+// clientID with their namespace
+func followersKey(secureID string) string {
+	return "followers:" + secureID
+}
+
+// followableKey returns the Redis key that lets others follow a person, by
+// secure id like their privacy mode
+func followableKey(secureID string) string {
+	return "followable:" + secureID
+}
+
+// storeFollowable lets others follow a person, or stops them
+func storeFollowable(secureID string, followable bool) error {
+	if followable {
+		_, err := storeDo("SET", followableKey(secureID), 1)
+		return err
+	}
+	_, err := storeDo("DEL", followableKey(secureID))
+	return err
+}
+
+// isFollowable returns true when a person lets others follow them
+func isFollowable(secureID string) bool {
+	ok, err := redis.Bool(storeDo("EXISTS", followableKey(secureID)))
+	if err != nil {
+		lg.Error("followable lookup failed", "client", secureID, "err", err)
+	}
+	return ok
+}
+
+// followMessage is a websocket message handler that follows a person, by
+// their secure id, when they made themselves followable. The follower gets a
+// Moved with the feature of the person every time they move, wherever they
+// are, as their privacy mode allows, and right away when the person is
+// connected. The person gets a Followed with the id of the new follower.
+func followMessage(connID, msg string) {
+	var f protocol.Follow
+	if err := protocol.Decode(msg, &f); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	clientID, ok := followClient(connID, f.ID)
+	if !ok {
+		return
+	}
+	if !isFollowable(f.ID) {
+		sendError(connID, "not_followable", "The person cannot be followed")
+		return
+	}
+	followmu.Lock()
+	following := followingM[clientID]
+	if following == nil {
+		following = make(map[string]bool)
+		followingM[clientID] = following
+	}
+	if !following[f.ID] && len(following) >= maxFollows {
+		followmu.Unlock()
+		sendError(connID, "too_many_follows", "Only 50 people can be followed")
+		return
+	}
+	following[f.ID] = true
+	followmu.Unlock()
+	n, err := redis.Int(storeDo("HSET", followersKey(f.ID), clientID, connNamespace(connID)))
+	if err != nil {
+		lg.Error("follow failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Follow could not be stored")
+		return
+	}
+	added := n == 1
+	followChanged(f.ID, clientID, added)
+	env, _ := sjson.Set(`{"kind":"follow"}`, "id", f.ID)
+	env, _ = sjson.Set(env, "follower", clientID)
+	env, _ = sjson.Set(env, "added", added)
+	publish(env, msg)
+}
+
+// unfollowMessage is a websocket message handler that stops following a
+// person
+func unfollowMessage(connID, msg string) {
+	var f protocol.Follow
+	if err := protocol.Decode(msg, &f); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	clientID, ok := followClient(connID, f.ID)
+	if !ok {
+		return
+	}
+	followmu.Lock()
+	delete(followingM[clientID], f.ID)
+	followmu.Unlock()
+	if err := unfollow(clientID, f.ID); err != nil {
+		lg.Error("unfollow failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Follow could not be removed")
+	}
+}
+
+// followClient checks the target of a Follow or Unfollow from a connection
+// and returns the clientID of the connection
+func followClient(connID, target string) (string, bool) {
+	if !validClientID(target) {
+		sendError(connID, "invalid_id", "Id must be 24 hex characters")
+		return "", false
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Follow")
+		return "", false
+	}
+	if secureClientID(clientID) == target {
+		sendError(connID, "invalid_id", "People cannot follow themselves")
+		return "", false
+	}
+	return clientID, true
+}
+
+// unfollow removes a follower of a person and lets the instances know
+func unfollow(clientID, secureID string) error {
+	if _, err := storeDo("HDEL", followersKey(secureID), clientID); err != nil {
+		return err
+	}
+	followChanged(secureID, "", false)
+	env, _ := sjson.Set(`{"kind":"follow"}`, "id", secureID)
+	publish(env, `{}`)
+	return nil
+}
+
+// followChanged drops the cached followers of a person of this instance
+// whose followers changed, and sends a follower their feature. The person is
+// told about a follower that was added.
+func followChanged(secureID, follower string, added bool) {
+	idmu.Lock()
+	clientID := secureM[secureID]
+	connID := clientConnM[clientID]
+	idmu.Unlock()
+	if clientID == "" {
+		return
+	}
+	followmu.Lock()
+	delete(followersM, clientID)
+	followmu.Unlock()
+	if follower == "" {
+		return
+	}
+	if added {
+		followed, _ := protocol.Encode(protocol.Followed{
+			Envelope: protocol.Envelope{Type: protocol.TypeFollowed},
+			ID:       secureClientID(follower),
+		})
+		send(connID, followed)
+	}
+	feature, err := geo.GetFeature(personKey(clientID), clientID)
+	if err != nil || isHidden(feature) {
+		return
+	}
+	for _, id := range loadFollowers(clientID) {
+		if id == follower {
+			deliver([]string{follower}, notification(protocol.TypeMoved, secureFeature(feature), "", false))
+			return
+		}
+	}
+}
+
+// followFeature sends the stored feature of a person of this instance to
+// their followers. Hidden people are not followed.
+func followFeature(clientID, feature string) {
+	if isHidden(feature) {
+		return
+	}
+	if followers := loadFollowers(clientID); len(followers) > 0 {
+		deliver(followers, notification(protocol.TypeMoved, secureFeature(feature), "", false))
+	}
+}
+
+// loadFollowers returns the followers of a person of this instance in their
+// namespace that they did not block, reading them from Redis the first time
+func loadFollowers(clientID string) []string {
+	followmu.Lock()
+	followers, ok := followersM[clientID]
+	followmu.Unlock()
+	if !ok {
+		all, err := redis.StringMap(storeDo("HGETALL", followersKey(secureClientID(clientID))))
+		if err != nil {
+			lg.Error("followers lookup failed", "client", clientID, "err", err)
+			return nil
+		}
+		ns := clientNamespace(clientID)
+		for follower, followerNS := range all {
+			if followerNS == ns {
+				followers = append(followers, follower)
+			}
+		}
+		followmu.Lock()
+		followersM[clientID] = followers
+		followmu.Unlock()
+	}
+	return allowedFollowers(clientID, followers)
+}
+
+// allowedFollowers returns the followers that a person did not block
+func allowedFollowers(clientID string, followers []string) []string {
+	blocks := loadBlocks(clientID)
+	blockmu.Lock()
+	defer blockmu.Unlock()
+	var allowed []string
+	for _, follower := range followers {
+		if mode, ok := blocks[secureClientID(follower)]; !ok || mode == modeMute {
+			allowed = append(allowed, follower)
+		}
+	}
+	return allowed
+}
+
+// forgetFollows stops a person from following anyone and drops their cached
+// followers
+func forgetFollows(clientID string) {
+	followmu.Lock()
+	following := followingM[clientID]
+	delete(followingM, clientID)
+	delete(followersM, clientID)
+	followmu.Unlock()
+	for secureID := range following {
+		if err := unfollow(clientID, secureID); err != nil {
+			lg.Error("unfollow failed", "client", clientID, "err", err)
+		}
+	}
+}
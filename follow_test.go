@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestFollowOptIn(t *testing.T) {
+	a, b := testID(1), testID(2)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	cb := joinTest(t, b, 39.7525, -104.9965)
+	follow := fmt.Sprintf(`{"type":"Follow","id":%q}`, secureClientID(a))
+
+	cb.send(follow)
+	if e := cb.expect("Error"); gjson.Get(e, "code").String() != "not_followable" {
+		t.Fatalf("follow before the opt-in: got %s", e)
+	}
+
+	ca.send(`{"type":"Privacy","followable":true}`)
+	if p := ca.expect("Privacy"); !gjson.Get(p, "followable").Bool() || gjson.Get(p, "mode").String() != privacyExact {
+		t.Fatalf("privacy: got %s", p)
+	}
+	cb.send(follow)
+	if f := ca.expect("Followed"); gjson.Get(f, "id").String() != secureClientID(b) {
+		t.Fatalf("followed: got %s", f)
+	}
+	moved := cb.expect("Moved")
+	if gjson.Get(moved, "feature.id").String() != secureClientID(a) {
+		t.Fatalf("moved: got %s", moved)
+	}
+
+	// following again does not tell the person again
+	cb.send(follow)
+	cb.expect("Moved")
+	ca.none("Followed", 100*time.Millisecond)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "math"
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371e3
+
+// distance returns the great circle distance between two points in meters
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	φ1, φ2 := lat1*math.Pi/180, lat2*math.Pi/180
+	Δφ := (lat2 - lat1) * math.Pi / 180
+	Δλ := (lng2 - lng1) * math.Pi / 180
+	a := math.Sin(Δφ/2)*math.Sin(Δφ/2) +
+		math.Cos(φ1)*math.Cos(φ2)*math.Sin(Δλ/2)*math.Sin(Δλ/2)
+	return earthRadius * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// bearing returns the initial bearing from one point to another in degrees
+// clockwise from north
+func bearing(lat1, lng1, lat2, lng2 float64) float64 {
+	φ1, φ2 := lat1*math.Pi/180, lat2*math.Pi/180
+	Δλ := (lng2 - lng1) * math.Pi / 180
+	y := math.Sin(Δλ) * math.Cos(φ2)
+	x := math.Cos(φ1)*math.Sin(φ2) - math.Sin(φ1)*math.Cos(φ2)*math.Cos(Δλ)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+)
+
+// The reverse geocoding settings
+const (
+	geocodeCell     = 0.01                // size in degrees of the areas that share a locality, about a kilometer
+	geocodeInterval = time.Second         // time between lookups, the Nominatim usage policy allows one a second
+	geocodeQueue    = 256                 // areas waiting for a lookup
+	geocodeCacheTTL = 30 * 24 * time.Hour // how long a locality is kept in Redis
+	geocodeCacheMax = 10000               // localities kept in memory
+	geocodeTimeout  = 10 * time.Second    // timeout of a single lookup
+)
+
+var (
+	geocodemu      sync.Mutex        // guard localityM and geocodePending
+	localityM      map[string]string // area -> locality, "" for none
+	geocodePending map[string]bool   // areas waiting for a lookup
+	geocodeJobs    chan string       // areas waiting for a lookup
+	geocodeClient  = &http.Client{Timeout: geocodeTimeout}
+)
+
+// localityKey returns the Redis key of the locality of an area
+func localityKey(cell string) string {
+	return "locality:" + cell
+}
+
+// geocodeArea returns the area that a position is in, as "lat,lng" of its
+// corner
+func geocodeArea(lat, lng float64) string {
+	return strconv.FormatFloat(math.Floor(lat/geocodeCell)*geocodeCell, 'f', 2, 64) + "," +
+		strconv.FormatFloat(math.Floor(lng/geocodeCell)*geocodeCell, 'f', 2, 64)
+}
+
+// startGeocoder starts the lookup worker when a geocoding URL is configured
+func startGeocoder() {
+	if cfg.GeocodeURL == "" {
+		return
+	}
+	localityM = make(map[string]string)
+	geocodePending = make(map[string]bool)
+	geocodeJobs = make(chan string, geocodeQueue)
+	go func() {
+		tick := time.NewTicker(geocodeInterval)
+		defer tick.Stop()
+		for cell := range geocodeJobs {
+			lookupLocality(cell)
+			<-tick.C
+		}
+	}()
+}
+
+// locality returns the name of the locality that a position is in, or "" when
+// it is not known yet. Unknown areas are looked up in the background, so that
+// later notifications in the area carry the name.
+func locality(lat, lng float64) string {
+	if geocodeJobs == nil {
+		return ""
+	}
+	cell := geocodeArea(lat, lng)
+	geocodemu.Lock()
+	name, ok := localityM[cell]
+	pending := geocodePending[cell]
+	if !ok && !pending {
+		geocodePending[cell] = true
+	}
+	geocodemu.Unlock()
+	if ok || pending {
+		return name
+	}
+	go func() {
+		// other instances may have looked the area up already
+		name, err := redis.String(storeDo("GET", localityKey(cell)))
+		if err == nil {
+			cacheLocality(cell, name)
+			return
+		}
+		select {
+		case geocodeJobs <- cell:
+		default:
+			geocodemu.Lock()
+			delete(geocodePending, cell)
+			geocodemu.Unlock()
+		}
+	}()
+	return ""
+}
+
+// lookupLocality asks the geocoding provider for the locality of an area and
+// caches it, including when the provider knows no name for it
+func lookupLocality(cell string) {
+	name, err := reverseGeocode(cell)
+	if err != nil {
+		lg.Warn("geocoding failed", "area", cell, "err", err)
+		geocodemu.Lock()
+		delete(geocodePending, cell)
+		geocodemu.Unlock()
+		return
+	}
+	storeDo("SET", localityKey(cell), name, "EX", int(geocodeCacheTTL/time.Second))
+	cacheLocality(cell, name)
+}
+
+// cacheLocality keeps the locality of an area in memory
+func cacheLocality(cell, name string) {
+	geocodemu.Lock()
+	if len(localityM) >= geocodeCacheMax {
+		localityM = make(map[string]string)
+	}
+	localityM[cell] = name
+	delete(geocodePending, cell)
+	geocodemu.Unlock()
+}
+
+// reverseGeocode requests the geocoding URL for the center of an area, with
+// {lat} and {lng} replaced, and returns the first of the geocode paths that
+// is in the JSON response
+func reverseGeocode(cell string) (string, error) {
+	i := strings.IndexByte(cell, ',')
+	lat, _ := strconv.ParseFloat(cell[:i], 64)
+	lng, _ := strconv.ParseFloat(cell[i+1:], 64)
+	url := strings.NewReplacer(
+		"{lat}", strconv.FormatFloat(lat+geocodeCell/2, 'f', 5, 64),
+		"{lng}", strconv.FormatFloat(lng+geocodeCell/2, 'f', 5, 64),
+	).Replace(cfg.GeocodeURL)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "proximity-chat")
+	req.Header.Set("Accept", "application/json")
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	for _, path := range cfg.GeocodePaths {
+		if name := gjson.GetBytes(body, path).String(); name != "" {
+			return name, nil
+		}
+	}
+	return "", nil
+}
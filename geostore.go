@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// ErrNotFound is returned by a GeoStore for objects that do not exist
+var ErrNotFound = errors.New("geostore: not found")
+
+// GeoStore is the geospatial database that holds the people, rooms and
+// shouts, and watches the geofences of rooms and roaming people. Objects are
+// GeoJSON strings kept in collections by id.
+type GeoStore interface {
+	// SetFeature stores an object, expiring after ttl when it is greater
+	// than zero
+	SetFeature(key, id, object string, ttl time.Duration) error
+	// GetFeature returns an object, or ErrNotFound
+	GetFeature(key, id string) (string, error)
+	// DelFeature deletes an object
+	DelFeature(key, id string) error
+	// Expire sets the ttl of an object, or returns ErrNotFound
+	Expire(key, id string, ttl time.Duration) error
+
+	// SetFence creates or replaces the geofence that publishes notifications
+	// on the named channel
+	SetFence(name string, fence Fence) error
+	// DelFence deletes a geofence
+	DelFence(name string) error
+	// Channels returns the names of the geofence channels matching a
+	// pattern
+	Channels(pattern string) ([]string, error)
+
+	// Nearby returns the objects of a collection within meters of a point,
+	// closest first
+	Nearby(key string, lat, lng, meters float64, opts Search) ([]Object, error)
+	// Intersects returns the objects of a collection that intersect an area
+	Intersects(key string, area Area, opts Search) ([]Object, error)
+
+	// Subscribe opens a subscription to geofence channels and patterns
+	Subscribe(channels, patterns []string) (Subscription, error)
+
+	// Ping checks that the store answers
+	Ping() error
+	// Close releases the connections of the store
+	Close() error
+}
+
+// Object is an object returned by a search. Object is empty for searches for
+// ids only.
+type Object struct {
+	ID     string
+	Object string
+}
+
+// Search holds the options of a search. Limit is the most objects returned,
+// 0 returns all. IDs searches for ids only.
+type Search struct {
+	Limit int
+	IDs   bool
+}
+
+// Area is the area of an Intersects search: either Bounds or a GeoJSON
+// Object
+type Area struct {
+	Bounds *protocol.Bounds
+	Object string
+}
+
+// Fence is a geofence on a collection. A fence with a Roam distance notifies
+// when objects of the collection come within the distance of each other, or
+// of the objects of the Target collection when it is set. A fence with a
+// Center notifies when objects enter or exit the circle of Radius meters
+// around it. Otherwise it notifies when objects enter, are inside of or exit
+// the GeoJSON Object. A fence with a TTL expires.
+type Fence struct {
+	Key    string
+	Object string
+	Roam   float64
+	Target string
+	Center *protocol.LatLng
+	Radius float64
+	TTL    time.Duration
+}
+
+// target returns the collection that a roaming fence looks for nearby
+// objects in
+func (f Fence) target() string {
+	if f.Target == "" {
+		return f.Key
+	}
+	return f.Target
+}
+
+// objectIDs returns the ids of objects
+func objectIDs(objs []Object) []string {
+	ids := make([]string, len(objs))
+	for i, obj := range objs {
+		ids[i] = obj.ID
+	}
+	return ids
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on groups
+const (
+	maxGroupNameLen = 32  // characters of a group name
+	maxGroups       = 20  // groups a person can be a member of
+	maxGroupMembers = 100 // members of a group
+)
+
+// groupCell is the size in degrees of the areas that group members see each
+// other in, about a kilometer
+const groupCell = 0.01
+
+var (
+	groupmu    sync.Mutex        // guard groupCellM
+	groupCellM map[string]string // clientID -> area last shown to its groups
+)
+
+// groupKey returns the Redis key of the name and owner of a group
+func groupKey(groupID string) string {
+	return "group:" + groupID
+}
+
+// groupMembersKey returns the Redis key of the members of a group. Members
+// are kept by clientID, along with their namespace.
+func groupMembersKey(groupID string) string {
+	return "group:" + groupID + ":members"
+}
+
+// groupInvitesKey returns the Redis key of the secure ids of the people
+// invited to a group
+func groupInvitesKey(groupID string) string {
+	return "group:" + groupID + ":invites"
+}
+
+// memberGroupsKey returns the Redis key of the groups of a person
+func memberGroupsKey(clientID string) string {
+	return "groups:" + clientID
+}
+
+// invitesKey returns the Redis key of the groups a person is invited to, by
+// the secure id that the inviters know them by
+func invitesKey(secureID string) string {
+	return "invites:" + secureID
+}
+
+// errGroupsUnavailable is returned when the groups could not be read or
+// stored
+var errGroupsUnavailable = invalid("unavailable", "Groups are unavailable")
+
+// groupMessage is a websocket message handler that creates, joins and leaves
+// groups, and invites people to them. Every action is answered with the
+// groups of the person.
+func groupMessage(connID, msg string) {
+	var g protocol.Group
+	if err := protocol.Decode(msg, &g); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Group")
+		return
+	}
+	var err *validationError
+	switch g.Action {
+	case "create":
+		err = createGroup(clientID, connNamespace(connID), g.Name)
+	case "invite":
+		err = inviteGroup(clientID, g.Group, g.ID)
+	case "join":
+		err = joinGroup(clientID, connNamespace(connID), g.Group)
+	case "leave":
+		err = leaveGroup(clientID, g.Group)
+	case "list":
+	default:
+		err = invalid("invalid_group", "Action must be create, invite, join, leave or list")
+	}
+	if err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	sendGroups(connID, clientID)
+}
+
+// createGroup creates a group with the person as its owner and only member
+func createGroup(clientID, ns, name string) *validationError {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLen {
+		return invalid("invalid_group", "Name must be 1 to 32 characters")
+	}
+	n, err := redis.Int(storeDo("SCARD", memberGroupsKey(clientID)))
+	if err != nil {
+		lg.Error("group create failed", "client", clientID, "err", err)
+		return errGroupsUnavailable
+	}
+	if n >= maxGroups {
+		return invalid("too_many_groups", "Too many groups")
+	}
+	groupID := newMessageID()
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HMSET", groupKey(groupID), "name", name, "owner", clientID)
+	b.Send("HSET", groupMembersKey(groupID), clientID, ns)
+	b.Send("SADD", memberGroupsKey(clientID), groupID)
+	if _, err := b.Flush(); err != nil {
+		lg.Error("group create failed", "client", clientID, "err", err)
+		return errGroupsUnavailable
+	}
+	return nil
+}
+
+// inviteGroup invites a person to a group, by their secure id. Only members
+// can invite, and the invite is sent right away when the person is online.
+func inviteGroup(clientID, groupID, target string) *validationError {
+	if target == "" {
+		return invalid("invalid_group", "Invite needs the id of a person")
+	}
+	members, err := groupMembers(groupID)
+	if err != nil {
+		lg.Error("group invite failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	if _, ok := members[clientID]; !ok {
+		return invalid("not_in_group", "Only members can invite to a group")
+	}
+	if len(members) >= maxGroupMembers {
+		return invalid("group_full", "The group is full")
+	}
+	name, err := redis.String(storeDo("HGET", groupKey(groupID), "name"))
+	if err != nil {
+		lg.Error("group invite failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("SADD", groupInvitesKey(groupID), target)
+	b.Send("SADD", invitesKey(target), groupID)
+	if _, err := b.Flush(); err != nil {
+		lg.Error("group invite failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	invite, _ := protocol.Encode(protocol.GroupInvite{
+		Envelope: protocol.Envelope{Type: protocol.TypeGroupInvite},
+		Group:    groupID,
+		Name:     name,
+		From:     secureClientID(clientID),
+	})
+	deliverSecure(target, invite)
+	return nil
+}
+
+// joinGroup accepts an invite to a group and lets the members know. The
+// invite is kept when the person cannot join, to accept once there is room.
+func joinGroup(clientID, ns, groupID string) *validationError {
+	secureID := secureClientID(clientID)
+	invited, err := redis.Bool(storeDo("SISMEMBER", invitesKey(secureID), groupID))
+	if err != nil {
+		lg.Error("group join failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	if !invited {
+		return invalid("not_invited", "Not invited to the group")
+	}
+	members, err := groupMembers(groupID)
+	if err != nil {
+		lg.Error("group join failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	if len(members) == 0 {
+		storeDo("SREM", invitesKey(secureID), groupID)
+		return invalid("unknown_group", "The group no longer exists")
+	}
+	if len(members) >= maxGroupMembers {
+		return invalid("group_full", "The group is full")
+	}
+	n, err := redis.Int(storeDo("SCARD", memberGroupsKey(clientID)))
+	if err != nil {
+		lg.Error("group join failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	if n >= maxGroups {
+		return invalid("too_many_groups", "Too many groups")
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HSET", groupMembersKey(groupID), clientID, ns)
+	b.Send("SADD", memberGroupsKey(clientID), groupID)
+	b.Send("SREM", invitesKey(secureID), groupID)
+	b.Send("SREM", groupInvitesKey(groupID), secureID)
+	if _, err := b.Flush(); err != nil {
+		lg.Error("group join failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	pushGroupPresence(clientID, []string{groupID}, memberPresence(clientID, ns), false)
+	return nil
+}
+
+// leaveGroup removes the person from a group and lets the remaining members
+// know. The group is deleted when the last member leaves.
+func leaveGroup(clientID, groupID string) *validationError {
+	removed, err := redis.Int(storeDo("HDEL", groupMembersKey(groupID), clientID))
+	if err != nil {
+		lg.Error("group leave failed", "group", groupID, "err", err)
+		return errGroupsUnavailable
+	}
+	if removed == 0 {
+		return invalid("not_in_group", "Not a member of the group")
+	}
+	storeDo("SREM", memberGroupsKey(clientID), groupID)
+	left, err := redis.Int(storeDo("HLEN", groupMembersKey(groupID)))
+	if err == nil && left == 0 {
+		storeDo("DEL", groupKey(groupID), groupMembersKey(groupID), groupInvitesKey(groupID))
+		return nil
+	}
+	pushGroupPresence(clientID, []string{groupID},
+		protocol.GroupMember{ID: secureClientID(clientID)}, true)
+	return nil
+}
+
+// groupMembers returns the clientIDs of the members of a group along with
+// their namespace
+func groupMembers(groupID string) (map[string]string, error) {
+	return redis.StringMap(storeDo("HGETALL", groupMembersKey(groupID)))
+}
+
+// memberPresence returns whether a member of a group is online and roughly
+// where they are
+func memberPresence(clientID, ns string) protocol.GroupMember {
+	member := protocol.GroupMember{ID: secureClientID(clientID)}
+	_, feature, err := findPerson(ns, clientID)
+	if err != nil {
+		return member
+	}
+	member.Online = true
+	if isHidden(feature) {
+		return member
+	}
+	feature = fuzzFeature(feature)
+	member.Position = roughPosition(
+		gjson.Get(feature, "geometry.coordinates.1").Float(),
+		gjson.Get(feature, "geometry.coordinates.0").Float())
+	return member
+}
+
+// roughPosition rounds a position to the group cell
+func roughPosition(lat, lng float64) *protocol.LatLng {
+	return &protocol.LatLng{
+		Lat: math.Round(lat/groupCell) * groupCell,
+		Lng: math.Round(lng/groupCell) * groupCell,
+	}
+}
+
+// sendGroups sends the groups of a person, with their members, and the
+// invites the person did not accept yet
+func sendGroups(connID, clientID string) {
+	reply := protocol.Groups{
+		Envelope: protocol.Envelope{Type: protocol.TypeGroups},
+		Groups:   []protocol.GroupInfo{},
+	}
+	groupIDs, err := redis.Strings(storeDo("SMEMBERS", memberGroupsKey(clientID)))
+	if err != nil {
+		lg.Error("group list failed", "client", clientID, "err", err)
+		sendError(connID, errGroupsUnavailable.Code, errGroupsUnavailable.Message)
+		return
+	}
+	for _, groupID := range groupIDs {
+		group, err := redis.StringMap(storeDo("HGETALL", groupKey(groupID)))
+		if err != nil || len(group) == 0 {
+			continue
+		}
+		members, err := groupMembers(groupID)
+		if err != nil {
+			continue
+		}
+		info := protocol.GroupInfo{
+			ID:    groupID,
+			Name:  group["name"],
+			Owner: secureClientID(group["owner"]),
+		}
+		for member, ns := range members {
+			info.Members = append(info.Members, memberPresence(member, ns))
+		}
+		reply.Groups = append(reply.Groups, info)
+	}
+	invites, _ := redis.Strings(storeDo("SMEMBERS", invitesKey(secureClientID(clientID))))
+	for _, groupID := range invites {
+		name, err := redis.String(storeDo("HGET", groupKey(groupID), "name"))
+		if err != nil {
+			continue
+		}
+		reply.Invites = append(reply.Invites, protocol.GroupInvite{
+			Envelope: protocol.Envelope{Type: protocol.TypeGroupInvite},
+			Group:    groupID,
+			Name:     name,
+		})
+	}
+	msg, _ := protocol.Encode(reply)
+	send(connID, msg)
+}
+
+// groupChat is a websocket message handler that sends a chat message to the
+// members of a group, wherever they are
+func groupChat(connID, msg string) {
+	var gm protocol.GroupMessage
+	if err := protocol.Decode(msg, &gm); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a GroupMessage")
+		return
+	}
+	if err := filterMessage(clientID, gm.Text); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	members, err := groupMembers(gm.Group)
+	if err != nil {
+		lg.Error("group message failed", "group", gm.Group, "err", err)
+		sendError(connID, errGroupsUnavailable.Code, errGroupsUnavailable.Message)
+		return
+	}
+	if _, ok := members[clientID]; !ok {
+		sendError(connID, "not_in_group", "Not a member of the group")
+		return
+	}
+	out, _ := protocol.Encode(protocol.GroupMessage{
+		Envelope: protocol.Envelope{Type: protocol.TypeGroupMessage},
+		ID:       newMessageID(),
+		Group:    gm.Group,
+		From:     secureClientID(clientID),
+		Text:     gm.Text,
+	})
+	if shadowBanned(clientID) {
+		// only the shadow banned sender sees their message
+		send(connID, out)
+		return
+	}
+	var recipients []string
+	for member := range members {
+		if member != clientID {
+			recipients = append(recipients, member)
+		}
+	}
+	deliver(recipients, out)
+	send(connID, out)
+	pushOffline(members, clientID, gm.Group, gm.Text)
+}
+
+// groupFeature lets the groups of a person know when they came online or
+// moved to another area
+func groupFeature(clientID string, lat, lng float64) {
+	mode := loadPrivacy(clientID)
+	if mode == privacyFuzzy {
+		lat, lng = snapToGrid(lat, lng, cfg.FuzzyGrid)
+	}
+	pos := roughPosition(lat, lng)
+	cell := strconv.FormatFloat(pos.Lat, 'f', 2, 64) + "," +
+		strconv.FormatFloat(pos.Lng, 'f', 2, 64)
+	if mode == privacyHidden {
+		pos, cell = nil, privacyHidden
+	}
+	groupmu.Lock()
+	prev := groupCellM[clientID]
+	groupCellM[clientID] = cell
+	groupmu.Unlock()
+	if cell == prev {
+		return
+	}
+	groupIDs, err := redis.Strings(storeDo("SMEMBERS", memberGroupsKey(clientID)))
+	if err != nil || len(groupIDs) == 0 {
+		return
+	}
+	pushGroupPresence(clientID, groupIDs, protocol.GroupMember{
+		ID:       secureClientID(clientID),
+		Online:   true,
+		Position: pos,
+	}, false)
+}
+
+// forgetGroups lets the groups of a person know that they went offline
+func forgetGroups(clientID string) {
+	groupmu.Lock()
+	_, online := groupCellM[clientID]
+	delete(groupCellM, clientID)
+	groupmu.Unlock()
+	if !online {
+		return
+	}
+	groupIDs, err := redis.Strings(storeDo("SMEMBERS", memberGroupsKey(clientID)))
+	if err != nil || len(groupIDs) == 0 {
+		return
+	}
+	pushGroupPresence(clientID, groupIDs,
+		protocol.GroupMember{ID: secureClientID(clientID)}, false)
+}
+
+// pushGroupPresence sends the presence of a member to the other members of
+// groups
+func pushGroupPresence(clientID string, groupIDs []string, member protocol.GroupMember, left bool) {
+	for _, groupID := range groupIDs {
+		members, err := groupMembers(groupID)
+		if err != nil {
+			lg.Error("group presence failed", "group", groupID, "err", err)
+			continue
+		}
+		var recipients []string
+		for other := range members {
+			if other != clientID {
+				recipients = append(recipients, other)
+			}
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+		msg, _ := protocol.Encode(protocol.GroupPresence{
+			Envelope:    protocol.Envelope{Type: protocol.TypeGroupPresence},
+			Group:       groupID,
+			GroupMember: member,
+			Left:        left,
+		})
+		deliver(recipients, msg)
+	}
+}
+
+// deliverSecure sends a message to a person by their secure id. People who
+// are not connected to this instance are looked up by the other instances.
+func deliverSecure(secureID, msg string) {
+	if sendSecure(secureID, msg) {
+		return
+	}
+	env, _ := sjson.Set(`{"kind":"secure"}`, "to", secureID)
+	publish(env, msg)
+}
+
+// sendSecure sends a message to the person with a secure id if they are
+// connected to this instance
+func sendSecure(secureID, msg string) bool {
+	idmu.Lock()
+	connID := clientConnM[secureM[secureID]]
+	idmu.Unlock()
+	if connID == "" {
+		return false
+	}
+	if !hiddenConn(connID, msg) {
+		send(connID, msg)
+	}
+	return true
+}
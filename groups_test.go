@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// testGroup creates a group owned by a person and returns its ID
+func testGroup(t *testing.T, owner string) string {
+	t.Helper()
+	if err := createGroup(owner, "", "Hikers"); err != nil {
+		t.Fatal(err.Message)
+	}
+	groupIDs, _ := redis.Strings(storeDo("SMEMBERS", memberGroupsKey(owner)))
+	if len(groupIDs) == 0 {
+		t.Fatal("no group")
+	}
+	return groupIDs[len(groupIDs)-1]
+}
+
+func TestJoinGroupKeepsInvite(t *testing.T) {
+	testServer(t)
+	a, b := testID(1), testID(2)
+	groupID := testGroup(t, a)
+	if err := inviteGroup(a, groupID, secureClientID(b)); err != nil {
+		t.Fatal(err.Message)
+	}
+	for i := 0; i < maxGroups; i++ {
+		createGroup(b, "", "Mine")
+	}
+	if err := joinGroup(b, "", groupID); err == nil || err.Code != "too_many_groups" {
+		t.Fatalf("join with too many groups: got %v", err)
+	}
+	if invited, _ := redis.Bool(storeDo("SISMEMBER", invitesKey(secureClientID(b)), groupID)); !invited {
+		t.Fatal("a join that failed must keep the invite")
+	}
+
+	groupIDs, _ := redis.Strings(storeDo("SMEMBERS", memberGroupsKey(b)))
+	if err := leaveGroup(b, groupIDs[0]); err != nil {
+		t.Fatal(err.Message)
+	}
+	if err := joinGroup(b, "", groupID); err != nil {
+		t.Fatal(err.Message)
+	}
+	if members, _ := groupMembers(groupID); len(members) != 2 {
+		t.Fatalf("got members %v", members)
+	}
+	if invited, _ := redis.Bool(storeDo("SISMEMBER", invitesKey(secureClientID(b)), groupID)); invited {
+		t.Fatal("joining must use up the invite")
+	}
+	if err := joinGroup(b, "", groupID); err == nil || err.Code != "not_invited" {
+		t.Fatalf("second join: got %v", err)
+	}
+}
+
+func TestSendSecure(t *testing.T) {
+	a := testID(1)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	if !sendSecure(secureClientID(a), `{"type":"GroupInvite","group":"g"}`) {
+		t.Fatal("want the person connected to this instance")
+	}
+	ca.expect("GroupInvite")
+	if sendSecure(secureClientID(testID(2)), `{"type":"GroupInvite","group":"g"}`) {
+		t.Fatal("want nobody connected for an unknown secure id")
+	}
+}
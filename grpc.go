@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/chatpb"
+	"github.com/tile38/proximity-chat/protocol"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The limits of the gRPC API
+const (
+	maxFeatureTTL = time.Hour // longest ttl of a published feature
+	streamBuffer  = 1024      // events waiting to be sent on a stream
+)
+
+var (
+	grpcServer *grpc.Server // the gRPC server, nil when disabled
+
+	streammu sync.Mutex                // guard streams
+	streams  map[*eventStream]struct{} // open StreamNotifications calls
+)
+
+// eventStream is a StreamNotifications call and the events it selected
+type eventStream struct {
+	ns     string
+	rooms  map[string]bool // fence IDs, nil for all
+	ids    map[string]bool // clientIDs, nil for all
+	events chan *chatpb.Notification
+}
+
+// startGRPC starts the gRPC server when a listen address is configured. It
+// uses the TLS certificate of the HTTP server when there is one.
+func startGRPC() error {
+	if cfg.GRPCAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", cfg.GRPCAddr)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpcUnaryAuth),
+		grpc.StreamInterceptor(grpcStreamAuth),
+	}
+	if cfg.TLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	streams = make(map[*eventStream]struct{})
+	grpcServer = grpc.NewServer(opts...)
+	chatpb.RegisterChatServer(grpcServer, chatServer{})
+	lg.Info("grpc listening", "addr", cfg.GRPCAddr)
+	go func() {
+		if err := grpcServer.Serve(ln); err != nil {
+			lg.Fatal("grpc listen failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// stopGRPC stops the gRPC server, waiting for calls in flight up to the
+// shutdown timeout
+func stopGRPC() {
+	if grpcServer == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		grpcServer.Stop()
+	}
+}
+
+// grpcAuthorize checks the admin token of a call
+func grpcAuthorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		token = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	return nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if err := grpcAuthorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	if err := grpcAuthorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// chatServer implements the gRPC API
+type chatServer struct{}
+
+// PublishFeature stores the feature of a person like a websocket Feature
+// does, for as long as its ttl
+func (chatServer) PublishFeature(ctx context.Context, f *chatpb.Feature) (*chatpb.PublishReply, error) {
+	if !knownNamespace(f.Namespace) {
+		return nil, status.Error(codes.NotFound, "unknown namespace")
+	}
+	ttl := live().PeopleTTL
+	if f.TtlSeconds < 0 || time.Duration(f.TtlSeconds)*time.Second > maxFeatureTTL {
+		return nil, status.Error(codes.InvalidArgument, "ttl must be up to an hour")
+	} else if f.TtlSeconds > 0 {
+		ttl = time.Duration(f.TtlSeconds) * time.Second
+	}
+	point := `{"type":"Point","coordinates":[` +
+		strconv.FormatFloat(f.Lng, 'f', -1, 64) + `,` +
+		strconv.FormatFloat(f.Lat, 'f', -1, 64) + `]}`
+	feature := `{"type":"Feature","geometry":` + point + `}`
+	feature, _ = sjson.Set(feature, "id", f.Id)
+	if f.Properties != "" {
+		if !gjson.Valid(f.Properties) || !gjson.Parse(f.Properties).IsObject() {
+			return nil, status.Error(codes.InvalidArgument, "properties must be a JSON object")
+		}
+		feature, _ = sjson.SetRaw(feature, "properties", f.Properties)
+	}
+	if err := validatePoint(feature); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Message)
+	}
+	floor, ok := featureFloor(feature)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "floor must be one of the configured floors")
+	}
+	idmu.Lock()
+	_, connected := clientConnM[f.Id]
+	idmu.Unlock()
+	if connected {
+		return nil, status.Error(codes.AlreadyExists, "id belongs to a websocket connection")
+	}
+	if banned(f.Id) {
+		return nil, status.Error(codes.PermissionDenied, "banned")
+	}
+
+	setFloor(f.Namespace, f.Id, floor)
+	err := geo.SetFeature(floorKey(peopleKey(f.Namespace), floor), f.Id,
+		privateFeature(f.Id, attachProfile(f.Id, feature)), ttl)
+	if err != nil {
+		lg.Error("grpc publish failed", "client", f.Id, "err", err)
+		return nil, status.Error(codes.Unavailable, "store unavailable")
+	}
+	rooms, err := geo.Intersects(roomsKey(f.Namespace), Area{Object: point}, Search{IDs: true})
+	if err != nil {
+		lg.Error("grpc rooms query failed", "client", f.Id, "err", err)
+		return nil, status.Error(codes.Unavailable, "store unavailable")
+	}
+	reply := &chatpb.PublishReply{}
+	for _, room := range rooms {
+		if roomOnFloor(namespaceRoom(f.Namespace, room.ID), floor) {
+			reply.Rooms = append(reply.Rooms, room.ID)
+		}
+	}
+	return reply, nil
+}
+
+// RemoveFeature deletes the feature of a person
+func (chatServer) RemoveFeature(ctx context.Context, r *chatpb.RemoveRequest) (*chatpb.RemoveReply, error) {
+	if !knownNamespace(r.Namespace) {
+		return nil, status.Error(codes.NotFound, "unknown namespace")
+	}
+	if !validClientID(r.Id) {
+		return nil, status.Error(codes.InvalidArgument, "id must be 24 hex characters")
+	}
+	key, _, err := findPerson(r.Namespace, r.Id)
+	if err == ErrNotFound {
+		return &chatpb.RemoveReply{}, nil
+	}
+	forgetFloor(r.Id)
+	if err := geo.DelFeature(key, r.Id); err != nil {
+		lg.Error("grpc remove failed", "client", r.Id, "err", err)
+		return nil, status.Error(codes.Unavailable, "store unavailable")
+	}
+	return &chatpb.RemoveReply{Removed: true}, nil
+}
+
+// SendMessage sends a chat message from a published person like a websocket
+// Message does
+func (chatServer) SendMessage(ctx context.Context, m *chatpb.ChatMessage) (*chatpb.SendReply, error) {
+	if !knownNamespace(m.Namespace) {
+		return nil, status.Error(codes.NotFound, "unknown namespace")
+	}
+	if !validClientID(m.Id) {
+		return nil, status.Error(codes.InvalidArgument, "id must be 24 hex characters")
+	}
+	key, sender, err := findPerson(m.Namespace, m.Id)
+	if err == ErrNotFound {
+		return nil, status.Error(codes.NotFound, "publish a feature before a message")
+	} else if err != nil {
+		return nil, status.Error(codes.Unavailable, "store unavailable")
+	}
+	if err := filterMessage(m.Id, m.Text); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Message)
+	}
+
+	msgID := newMessageID()
+	nmsg, _ := protocol.Encode(protocol.ChatMessage{
+		Envelope: protocol.Envelope{Type: protocol.TypeMessage},
+		ID:       msgID,
+		Feature:  []byte(shownFeature(secureFeature(sender))),
+		Text:     m.Text,
+	})
+	lat := gjson.Get(sender, "geometry.coordinates.1").Float()
+	lng := gjson.Get(sender, "geometry.coordinates.0").Float()
+	_, floor := splitFloor(key)
+	clientIDs, roomIDs, err := QueryNearbyAndPlaces(m.Namespace, floor, lat, lng, live().RoamDist)
+	if err != nil {
+		lg.Error("nearby query failed", "client", m.Id, "err", err)
+		return nil, status.Error(codes.Unavailable, "store unavailable")
+	}
+	recordHistory(roomIDs, nmsg)
+	recipients := clientIDs[:0]
+	for _, recipient := range clientIDs {
+		if recipient != m.Id {
+			recipients = append(recipients, recipient)
+		}
+	}
+	trackMessage(msgID, m.Id, len(recipients))
+	delivered := deliverTracked(msgID, recipients, nmsg)
+	countDelivered(msgID, delivered)
+	return &chatpb.SendReply{
+		Id:         msgID,
+		Recipients: int32(len(recipients)),
+		Delivered:  int32(delivered),
+	}, nil
+}
+
+// StreamNotifications sends the geofence events of a namespace until the
+// call is canceled. Events are dropped while the stream falls behind.
+func (chatServer) StreamNotifications(r *chatpb.StreamRequest, ss chatpb.Chat_StreamNotificationsServer) error {
+	if !knownNamespace(r.Namespace) {
+		return status.Error(codes.NotFound, "unknown namespace")
+	}
+	s := &eventStream{ns: r.Namespace, events: make(chan *chatpb.Notification, streamBuffer)}
+	if len(r.Rooms) > 0 {
+		s.rooms = make(map[string]bool, len(r.Rooms))
+		for _, id := range r.Rooms {
+			s.rooms[id] = true
+		}
+	}
+	if len(r.Ids) > 0 {
+		s.ids = make(map[string]bool, len(r.Ids))
+		for _, id := range r.Ids {
+			s.ids[id] = true
+		}
+	}
+	streammu.Lock()
+	streams[s] = struct{}{}
+	streammu.Unlock()
+	defer func() {
+		streammu.Lock()
+		delete(streams, s)
+		streammu.Unlock()
+	}()
+	for {
+		select {
+		case <-ss.Context().Done():
+			return nil
+		case n := <-s.events:
+			if err := ss.Send(n); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// streamEvent sends a geofence event to the streams that selected it
+func streamEvent(typ, ns, room, msg string) {
+	if grpcServer == nil {
+		return
+	}
+	n := &chatpb.Notification{
+		Type:      typ,
+		Namespace: ns,
+		Id:        gjson.Get(msg, "id").String(),
+		Room:      room,
+		Feature:   fuzzFeature(gjson.Get(msg, "object").Raw),
+	}
+	if t, err := time.Parse(time.RFC3339Nano, gjson.Get(msg, "time").String()); err == nil {
+		n.Time = t.UnixNano() / int64(time.Millisecond)
+	}
+	if room == "" {
+		other := gjson.Get(msg, "nearby")
+		if !other.Exists() {
+			other = gjson.Get(msg, "faraway")
+		}
+		n.NearbyId = other.Get("id").String()
+	}
+	streammu.Lock()
+	defer streammu.Unlock()
+	for s := range streams {
+		if s.ns != ns || (s.rooms != nil && room != "" && !s.rooms[room]) ||
+			(s.ids != nil && !s.ids[n.Id] && !s.ids[n.NearbyId]) {
+			continue
+		}
+		select {
+		case s.events <- n:
+		default:
+		}
+	}
+}
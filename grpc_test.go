@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tile38/proximity-chat/chatpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublishFeatureProperties(t *testing.T) {
+	testServer(t)
+	for props, want := range map[string]codes.Code{
+		``:                 codes.OK,
+		`{"color":"#fff"}`: codes.OK,
+		`[1,2]`:            codes.InvalidArgument,
+		`"text"`:           codes.InvalidArgument,
+		`42`:               codes.InvalidArgument,
+		`{"color":`:        codes.InvalidArgument,
+	} {
+		_, err := chatServer{}.PublishFeature(context.Background(), &chatpb.Feature{
+			Id: testID(1), Lat: 39.7425, Lng: -104.9965, Properties: props,
+		})
+		if got := status.Code(err); got != want {
+			t.Errorf("%q: got %v, want %v", props, got, want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// pingTimeout bounds how long a readiness check waits for a dependency
+const pingTimeout = 2 * time.Second
+
+// check is the status of a single dependency
+type check struct {
+	Status string           `json:"status"`
+	Error  string           `json:"error,omitempty"`
+	Stats  *SubscriberStats `json:"stats,omitempty"`
+}
+
+// healthz is an HTTP handler for liveness probes. The server is alive as long
+// as it can answer.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, "ok", nil)
+}
+
+// readyz is an HTTP handler for readiness probes. The server is ready when
+// Tile38 and Redis answer a PING, the pub/sub subscribers are running and the
+// server is not shutting down.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]check{
+		"tile38":    pingCheck(geo.Ping),
+		"redis":     pingCheck(func() error { return pingPool(store) }),
+		"geofences": subscriberCheck(geofenceSub),
+		"bus":       subscriberCheck(busSub),
+	}
+	if cfg.BusChannel == "" {
+		checks["bus"] = check{Status: "disabled"}
+	}
+	if isDraining() {
+		checks["server"] = check{Status: "error", Error: "shutting down"}
+	}
+	code, status := http.StatusOK, "ok"
+	for _, c := range checks {
+		if c.Status == "error" {
+			code, status = http.StatusServiceUnavailable, "unavailable"
+		}
+	}
+	writeHealth(w, code, status, checks)
+}
+
+// pingCheck checks that a server answers a ping in time
+func pingCheck(ping func() error) check {
+	done := make(chan error, 1)
+	go func() {
+		done <- ping()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return check{Status: "error", Error: err.Error()}
+		}
+		return check{Status: "ok"}
+	case <-time.After(pingTimeout):
+		return check{Status: "error", Error: "timeout"}
+	}
+}
+
+// subscriberCheck checks that a subscriber is subscribed
+func subscriberCheck(s *Subscriber) check {
+	stats := s.Stats()
+	if s.Healthy() {
+		return check{Status: "ok", Stats: &stats}
+	}
+	return check{Status: "error", Error: "not subscribed", Stats: &stats}
+}
+
+func writeHealth(w http.ResponseWriter, code int, status string, checks map[string]check) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string           `json:"status"`
+		Checks map[string]check `json:"checks,omitempty"`
+	}{status, checks})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+var (
+	versionmu    sync.Mutex     // guard connVersionM
+	connVersionM map[string]int // connID -> negotiated protocol version
+)
+
+// hello is a websocket message handler that negotiates the protocol version
+// of a connection. Connections that never say hello use version 1.
+func hello(connID, msg string) {
+	// Hello is decoded without a version check, it may come from a newer
+	// client that the server must downgrade
+	var req protocol.Hello
+	if err := json.Unmarshal([]byte(msg), &req); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	version := protocol.Negotiate(req.Version)
+	if version == 0 {
+		sendError(connID, "unsupported_version", "Unsupported protocol version")
+		return
+	}
+	versionmu.Lock()
+	connVersionM[connID] = version
+	versionmu.Unlock()
+
+	reply, _ := protocol.Encode(protocol.Hello{
+		Envelope:   protocol.Envelope{Type: protocol.TypeHello, Version: version},
+		MinVersion: protocol.MinVersion,
+	})
+	send(connID, reply)
+}
+
+// connVersion returns the negotiated protocol version of a connection
+func connVersion(connID string) int {
+	versionmu.Lock()
+	defer versionmu.Unlock()
+	if version, ok := connVersionM[connID]; ok {
+		return version
+	}
+	return 1
+}
+
+// forgetVersion removes the negotiated protocol version of a connection
+func forgetVersion(connID string) {
+	versionmu.Lock()
+	delete(connVersionM, connID)
+	versionmu.Unlock()
+}
+
+// notification encodes a notification frame about a feature
+func notification(typ, feature, room string, me bool) string {
+	msg, _ := protocol.Encode(protocol.Notification{
+		Envelope: protocol.Envelope{Type: typ},
+		Feature:  []byte(feature),
+		Room:     room,
+		Me:       me,
+	})
+	return msg
+}
+
+// placeNotification is notification for an Inside or Outside of a room, with
+// the rooms it is nested in as via
+func placeNotification(typ, feature, room string, via []string, me bool) string {
+	msg, _ := protocol.Encode(protocol.Notification{
+		Envelope: protocol.Envelope{Type: typ},
+		Feature:  []byte(feature),
+		Room:     room,
+		Via:      via,
+		Me:       me,
+	})
+	return msg
+}
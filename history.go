@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+)
+
+// historyKey returns the Redis key of the chat history for a fence
+func historyKey(fenceID string) string {
+	return "history:" + fenceID
+}
+
+// recordHistory appends a chat message to the history of every fence the
+// sender is inside of, keeping only the most recent messages. The updates of
+// all fences are pipelined on one connection.
+func recordHistory(fenceIDs []string, msg string) {
+	if cfg.HistorySize <= 0 || len(fenceIDs) == 0 {
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	for _, fenceID := range fenceIDs {
+		b.Send("MULTI")
+		b.Send("LPUSH", historyKey(fenceID), msg)
+		b.Send("LTRIM", historyKey(fenceID), 0, cfg.HistorySize-1)
+		b.Send("EXEC")
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("history record failed", "err", err)
+		return
+	}
+	for i, fenceID := range fenceIDs {
+		if err, ok := replies[i*4+3].(redis.Error); ok {
+			lg.Error("history record failed", "room", fenceID, "err", err)
+		}
+	}
+}
+
+// replayHistory sends the most recent chat messages of a fence to the
+// connection, oldest first. Replayed messages are flagged with "history" and
+// carry the number of people who read them and their reactions.
+func replayHistory(connID, fenceID string) {
+	if cfg.HistorySize <= 0 {
+		return
+	}
+	msgs, err := redis.Strings(storeDo(
+		"LRANGE", historyKey(fenceID), 0, cfg.HistorySize-1,
+	))
+	if err != nil {
+		lg.Error("history replay failed", "conn", connID, "room", fenceID,
+			"err", err)
+		return
+	}
+	msgs = unexpired(msgs)
+	attachReads(msgs)
+	attachReactions(msgs)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		msg, _ := sjson.Set(msgs[i], "history", true)
+		send(connID, msg)
+	}
+}
+
+// storeDo executes a redis command on the Redis store and returns the response
+func storeDo(cmd string, args ...interface{}) (interface{}, error) {
+	span := storeSpan(cmd)
+	conn := store.Get()
+	defer conn.Close()
+	reply, err := conn.Do(cmd, args...)
+	endStoreSpan(span, err)
+	return reply, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/auth"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// nanoAlphabet is the URL safe alphabet of nanoids
+const nanoAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// newIDProvider returns the connection id provider of a name: hex for the
+// random hex ids of the socket package, uuid, nanoid or token
+func newIDProvider(name string) (socket.IDProvider, error) {
+	switch name {
+	case "hex":
+		return nil, nil
+	case "uuid":
+		return uuidIDs{}, nil
+	case "nanoid":
+		return nanoIDs{}, nil
+	case "token":
+		return tokenIDs{}, nil
+	}
+	return nil, fmt.Errorf("unknown id provider %q", name)
+}
+
+// uuidIDs generates random version 4 UUIDs
+type uuidIDs struct{}
+
+func (uuidIDs) NewID(*http.Request) string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// nanoIDs generates random nanoids of 21 characters
+type nanoIDs struct{}
+
+func (nanoIDs) NewID(*http.Request) string {
+	var b [21]byte
+	rand.Read(b[:])
+	for i := range b {
+		b[i] = nanoAlphabet[b[i]&63]
+	}
+	return string(b[:])
+}
+
+// tokenIDs names connections after the authenticated person of their auth
+// token, whose user id is also the key of their feature: their reserved
+// username, or else the preferred_username or name claim or the user id,
+// followed by a random suffix, like "alice.3f9a2c". Connections that were not
+// authenticated get random hex ids.
+type tokenIDs struct{}
+
+func (tokenIDs) NewID(r *http.Request) string {
+	// only a token that authenticate verified names the connection
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok || userID == "" {
+		return ""
+	}
+	profile, _ := redis.String(storeDo("GET", profileKey(secureClientID(userID))))
+	name := gjson.Get(profile, "username").String()
+	if name == "" {
+		token, _ := auth.TokenFromRequest(r)
+		name = auth.Claim(token, "preferred_username")
+		if name == "" {
+			name = auth.Claim(token, "name")
+		}
+		if name == "" {
+			name = userID
+		}
+	}
+	name = idSlug(name)
+	if name == "" {
+		return ""
+	}
+	var b [3]byte
+	rand.Read(b[:])
+	return name + "." + hex.EncodeToString(b[:])
+}
+
+// idSlug returns a name in lower case letters, digits, underscores and
+// dashes, of up to 32 characters
+func idSlug(name string) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r == ' ', r == '.':
+			return '-'
+		}
+		return -1
+	}, name)
+	if len(slug) > 32 {
+		slug = slug[:32]
+	}
+	return strings.Trim(slug, "-")
+}
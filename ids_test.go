@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tile38/proximity-chat/auth"
+)
+
+// testToken returns a JWT with claims, unsigned, for a test verifier
+func testToken(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(claims)) + ".sig"
+}
+
+// tokenRequest returns an upgrade request with a token, authenticated as a
+// user when userID is not empty
+func tokenRequest(token, userID string) *http.Request {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if userID != "" {
+		r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	}
+	return r
+}
+
+func TestTokenIDs(t *testing.T) {
+	testServer(t)
+	token := testToken(`{"sub":"x","name":"Ann Smith","preferred_username":"Ann.S"}`)
+	if id := (tokenIDs{}).NewID(tokenRequest(token, "")); id != "" {
+		t.Fatalf("unverified token: got %q, want a random id", id)
+	}
+
+	userID := testID(1)
+	if id := (tokenIDs{}).NewID(tokenRequest(token, userID)); !strings.HasPrefix(id, "ann-s.") {
+		t.Fatalf("preferred username: got %q", id)
+	}
+	if id := (tokenIDs{}).NewID(tokenRequest(testToken(`{}`), userID)); !strings.HasPrefix(id, userID+".") {
+		t.Fatalf("user id: got %q", id)
+	}
+
+	storeDo("SET", profileKey(secureClientID(userID)), `{"username":"annie"}`)
+	defer storeDo("DEL", profileKey(secureClientID(userID)))
+	if id := (tokenIDs{}).NewID(tokenRequest(token, userID)); !strings.HasPrefix(id, "annie.") {
+		t.Fatalf("reserved username: got %q", id)
+	}
+}
+
+func TestTokenIDsConnection(t *testing.T) {
+	testServer(t)
+	userID := testID(2)
+	prevVerifier, prevIDs := verifier, h.IDs
+	verifier = auth.VerifierFunc(func(token string) (string, error) { return userID, nil })
+	h.IDs = tokenIDs{}
+	defer func() { verifier, h.IDs = prevVerifier, prevIDs }()
+
+	header := http.Header{"Authorization": {"Bearer " + testToken(`{"name":"Ann Smith"}`)}}
+	c := dialTest(t, "/ws", header)
+	c.expect("Session")
+	c.send(testFeature(userID, 39.7425, -104.9965))
+	waitFor(t, func() bool {
+		_, err := geo.GetFeature(peopleKey(""), userID)
+		return err == nil
+	})
+	idmu.Lock()
+	connID := clientConnM[userID]
+	idmu.Unlock()
+	if !strings.HasPrefix(connID, "ann-smith.") {
+		t.Fatalf("got connection %q", connID)
+	}
+}
+
+func TestIDSlug(t *testing.T) {
+	for name, want := range map[string]string{
+		"Ann Smith":             "ann-smith",
+		"bob.jones":             "bob-jones",
+		"  émile  ":             "mile",
+		strings.Repeat("a", 40): strings.Repeat("a", 32),
+	} {
+		if got := idSlug(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
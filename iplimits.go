@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+// ipState holds the connection limit state of an address
+type ipState struct {
+	conns       int       // open connections
+	tokens      float64   // connection attempts left in the bucket
+	last        time.Time // last connection attempt
+	strikes     int       // rejected attempts in the current window
+	strikeStart time.Time // start of the current window
+	bannedUntil time.Time // end of a temporary ban
+}
+
+// ipRejection is why an upgrade request from an address was rejected
+type ipRejection struct {
+	status int           // HTTP status of the response
+	reason string        // body of the response
+	retry  time.Duration // when the client can try again, 0 for never
+}
+
+var (
+	ipmu sync.Mutex          // guard ipM
+	ipM  map[string]*ipState // address -> limit state
+)
+
+// parseIPNets parses a comma separated list of addresses and CIDR ranges
+func parseIPNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range splitList(s) {
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: part}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP returns true when an address is in one of the ranges
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request. Behind a trusted
+// proxy it is the last address of the X-Forwarded-For header, which is the
+// one the proxy added.
+func clientIP(r *http.Request) net.IP {
+	if live().TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// admitIP checks an upgrade request from an address against the deny list,
+// temporary bans, the connection attempt rate and the connection cap.
+// Returns nil when the connection is admitted, and counted until releaseIP.
+// Addresses on the allow list skip the limits. Rejected attempts count as
+// strikes, and an address with too many strikes in a minute is banned for a
+// while.
+func admitIP(ip net.IP) *ipRejection {
+	if ip == nil {
+		return &ipRejection{http.StatusBadRequest, "unknown client address", 0}
+	}
+	c := live()
+	if containsIP(c.DenyIPs, ip) {
+		return &ipRejection{http.StatusForbidden, "address not allowed", 0}
+	}
+	allowed := containsIP(c.AllowIPs, ip)
+	now := time.Now()
+	addr := ip.String()
+	ipmu.Lock()
+	defer ipmu.Unlock()
+	s, ok := ipM[addr]
+	if !ok {
+		s = &ipState{tokens: c.ConnectRate.Burst, last: now}
+		ipM[addr] = s
+	}
+	if allowed {
+		s.conns++
+		return nil
+	}
+	if now.Before(s.bannedUntil) {
+		return &ipRejection{http.StatusForbidden, "address banned", s.bannedUntil.Sub(now)}
+	}
+	var rej *ipRejection
+	if limit := c.ConnectRate; limit.Rate > 0 {
+		s.tokens += now.Sub(s.last).Seconds() * limit.Rate
+		if s.tokens > limit.Burst {
+			s.tokens = limit.Burst
+		}
+		s.last = now
+		if s.tokens >= 1 {
+			s.tokens--
+		} else {
+			rej = &ipRejection{http.StatusTooManyRequests, "too many connection attempts", time.Second}
+		}
+	}
+	if rej == nil && c.MaxIPConns > 0 && s.conns >= c.MaxIPConns {
+		rej = &ipRejection{http.StatusTooManyRequests, "too many connections", time.Second}
+	}
+	if rej == nil {
+		s.conns++
+		return nil
+	}
+	if now.Sub(s.strikeStart) > strikeWindow {
+		s.strikes = 0
+		s.strikeStart = now
+	}
+	s.strikes++
+	if c.BanStrikes > 0 && s.strikes >= c.BanStrikes && c.BanTime > 0 {
+		s.bannedUntil = now.Add(c.BanTime)
+		s.strikes = 0
+		lg.Warn("address banned", "ip", addr, "until", s.bannedUntil.Format(time.RFC3339))
+		ban, _ := sjson.Set(`{}`, "until", s.bannedUntil.UTC().Format(time.RFC3339))
+		audit(auditServer, addr, "ban", ban)
+	}
+	return rej
+}
+
+// releaseIP counts a connection of an address as closed
+func releaseIP(ip net.IP) {
+	ipmu.Lock()
+	if s, ok := ipM[ip.String()]; ok && s.conns > 0 {
+		s.conns--
+	}
+	ipmu.Unlock()
+}
+
+// expireIPs drops the state of addresses without connections, bans or recent
+// attempts, once per strike window
+func expireIPs() {
+	for range time.Tick(strikeWindow) {
+		now := time.Now()
+		ipmu.Lock()
+		for addr, s := range ipM {
+			if s.conns == 0 && now.After(s.bannedUntil) && now.Sub(s.last) > strikeWindow &&
+				now.Sub(s.strikeStart) > strikeWindow {
+				delete(ipM, addr)
+			}
+		}
+		ipmu.Unlock()
+	}
+}
+
+// write writes the response to a rejected upgrade request, telling clients
+// that are rate limited or banned when to try again
+func (rej *ipRejection) write(w http.ResponseWriter) {
+	if rej.retry > 0 {
+		secs := int((rej.retry + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	http.Error(w, rej.reason, rej.status)
+}
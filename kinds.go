@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Entity kinds are things other than people that clients put on the map,
+// like shuttles or booths. A Feature with an "entityType" member of a
+// configured kind is stored in the collection of that kind, such as
+// "shuttles:expo", instead of the people collection, with the icon of the
+// kind as its "icon" property. People get Nearby and Faraway notifications
+// about the entities of every kind, and see them in their viewports, but
+// entities do not meet each other or people. A connection is bound to the
+// kind of its first feature.
+
+// kindSep separates the kind from a roaming channel name. Namespaces and kind
+// names cannot contain it.
+const kindSep = ":kind:"
+
+// movingSuffix marks the roaming channels on which entities come near people,
+// rather than people near entities
+const movingSuffix = ":moving"
+
+// validKind matches the names that can be used for kinds
+var validKind = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	kindmu sync.Mutex        // guard kindM
+	kindM  map[string]string // clientID -> kind, for entities
+)
+
+// kindKey returns the collection of the entities of a kind in a namespace
+func kindKey(ns, kind string) string {
+	if ns == "" {
+		return kind
+	}
+	return kind + ":" + ns
+}
+
+// kindKeys returns the collections of the entities of every kind in a
+// namespace
+func kindKeys(ns string) []string {
+	var keys []string
+	for kind := range cfg.Kinds {
+		keys = append(keys, kindKey(ns, kind))
+	}
+	return keys
+}
+
+// kindChannel returns the roaming channel of a namespace on which people
+// come near the entities of a kind, or with moving, on which the entities
+// come near people
+func kindChannel(ns, kind string, moving bool) string {
+	channel := roamChannel(ns) + kindSep + kind
+	if moving {
+		channel += movingSuffix
+	}
+	return channel
+}
+
+// splitKind returns the roaming channel name, the kind and whether entities
+// move on a channel name without a floor. The kind is empty for the roaming
+// channels of people.
+func splitKind(channel string) (name, kind string, moving bool) {
+	i := strings.Index(channel, kindSep)
+	if i < 0 {
+		return channel, "", false
+	}
+	kind = channel[i+len(kindSep):]
+	moving = strings.HasSuffix(kind, movingSuffix)
+	return channel[:i], strings.TrimSuffix(kind, movingSuffix), moving
+}
+
+// kindFences returns the roaming fences between the people of every floor
+// of a namespace and the entities of every kind, by channel
+func kindFences(ns string) map[string]Fence {
+	fences := make(map[string]Fence)
+	for kind := range cfg.Kinds {
+		entities := kindKey(ns, kind)
+		for _, people := range floorKeys(peopleKey(ns)) {
+			_, floor := splitFloor(people)
+			fences[floorKey(kindChannel(ns, kind, false), floor)] = Fence{
+				Key: people, Roam: live().RoamDist, Target: entities}
+			fences[floorKey(kindChannel(ns, kind, true), floor)] = Fence{
+				Key: entities, Roam: live().RoamDist, Target: people}
+		}
+	}
+	return fences
+}
+
+// parseKinds parses a comma separated list of kinds, each with an optional
+// icon after an equals sign, like shuttles=/icons/bus.png,booths
+func parseKinds(s string) (map[string]string, error) {
+	kinds := make(map[string]string)
+	for _, part := range splitList(s) {
+		kind, icon := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			kind, icon = strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		}
+		if !validKind.MatchString(kind) {
+			return nil, fmt.Errorf("invalid kind %q", kind)
+		}
+		switch kind {
+		case "people", "rooms", "shouts":
+			return nil, fmt.Errorf("kind %q is reserved", kind)
+		}
+		kinds[kind] = icon
+	}
+	return kinds, nil
+}
+
+// featureKind returns the kind of the entity of a feature, empty for people
+func featureKind(feature string) string {
+	kind := gjson.Get(feature, "entityType").String()
+	if kind == "people" {
+		return ""
+	}
+	return kind
+}
+
+// validateKind checks that the kind of a feature is configured and is the
+// kind of the client, for clients that sent a feature before
+func validateKind(clientID, kind string, bound bool) *validationError {
+	if _, ok := cfg.Kinds[kind]; kind != "" && !ok {
+		return invalid("invalid_entity", "Unknown entity type")
+	}
+	if bound && clientKind(clientID) != kind {
+		return invalid("invalid_entity", "Entity type cannot change")
+	}
+	return nil
+}
+
+// clientKind returns the kind of an entity, empty for people
+func clientKind(clientID string) string {
+	kindmu.Lock()
+	defer kindmu.Unlock()
+	return kindM[clientID]
+}
+
+// forgetKind removes the kind of an entity
+func forgetKind(clientID string) {
+	kindmu.Lock()
+	delete(kindM, clientID)
+	kindmu.Unlock()
+}
+
+// storeEntity stores the feature of an entity in the collection of its kind,
+// with the icon of the kind
+func storeEntity(connID, clientID, kind, msg string) {
+	kindmu.Lock()
+	kindM[clientID] = kind
+	kindmu.Unlock()
+	feature, _ := sjson.Set(msg, "entityType", kind)
+	if icon := cfg.Kinds[kind]; icon != "" {
+		feature, _ = sjson.Set(feature, "properties.icon", icon)
+	}
+	geo.SetFeature(kindKey(connNamespace(connID), kind), clientID, feature, live().PeopleTTL)
+	followFeature(clientID, feature)
+}
+
+// entityRoam turns a roaming notification of an entity that came near a
+// person, or moved away from them, into one of the person with the entity
+// nearby or faraway
+func entityRoam(msg string) string {
+	member := "nearby"
+	if !gjson.Get(msg, member).Exists() {
+		member = "faraway"
+	}
+	other := gjson.Get(msg, member)
+	if !other.Exists() {
+		return msg
+	}
+	object := gjson.Get(msg, "object")
+	msg, _ = sjson.SetRaw(msg, member+".object", object.Raw)
+	msg, _ = sjson.Set(msg, member+".id", gjson.Get(msg, "id").String())
+	msg, _ = sjson.Set(msg, member+".key", gjson.Get(msg, "key").String())
+	msg, _ = sjson.SetRaw(msg, "object", other.Get("object").Raw)
+	msg, _ = sjson.Set(msg, "id", other.Get("id").String())
+	msg, _ = sjson.Set(msg, "key", other.Get("key").String())
+	return msg
+}
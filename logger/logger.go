@@ -0,0 +1,203 @@
+// Package logger is a small leveled, structured logger. Entries carry a
+// message and a list of key/value fields, written either as text or as one
+// JSON object per line for log aggregation.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// The log levels, from most to least verbose
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (lv Level) String() string {
+	if lv < Debug || lv > Error {
+		return "level(" + strconv.Itoa(int(lv)) + ")"
+	}
+	return levelNames[lv]
+}
+
+// ParseLevel returns the level for a name such as "info"
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", name)
+}
+
+// output is shared by a logger and all loggers derived from it. The level
+// and format are read atomically so that Set can change them while logging.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level int32
+	json  int32
+}
+
+// Logger writes structured log entries. A Logger is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{} // key/value pairs added to every entry
+}
+
+// New returns a Logger that writes entries at or above the level to w, as
+// JSON when json is true, otherwise as text
+func New(w io.Writer, level Level, json bool) *Logger {
+	l := &Logger{out: &output{w: w}}
+	l.Set(level, json)
+	return l
+}
+
+// Set changes the level and format of the logger and of all loggers derived
+// from it
+func (l *Logger) Set(level Level, json bool) {
+	var j int32
+	if json {
+		j = 1
+	}
+	atomic.StoreInt32(&l.out.level, int32(level))
+	atomic.StoreInt32(&l.out.json, j)
+}
+
+// Default returns a text Logger at the Info level writing to stderr
+func Default() *Logger {
+	return New(os.Stderr, Info, false)
+}
+
+// With returns a Logger that adds the key/value pairs to every entry
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled returns true when entries at the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return int32(level) >= atomic.LoadInt32(&l.out.level)
+}
+
+// Debug writes an entry at the Debug level
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+
+// Info writes an entry at the Info level
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(Info, msg, kv) }
+
+// Warn writes an entry at the Warn level
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(Warn, msg, kv) }
+
+// Error writes an entry at the Error level
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+// Fatal writes an entry at the Error level and exits the process
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(Error, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(l.fields[:len(l.fields):len(l.fields)], kv...)
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var buf []byte
+	if atomic.LoadInt32(&l.out.json) == 1 {
+		buf = appendJSON(buf, ts, level, msg, fields)
+	} else {
+		buf = appendText(buf, ts, level, msg, fields)
+	}
+	l.out.mu.Lock()
+	l.out.w.Write(buf)
+	l.out.mu.Unlock()
+}
+
+// appendText appends a text entry such as
+//
+//	2018-08-26T18:37:34Z INFO listening addr=:8000
+func appendText(buf []byte, ts string, level Level, msg string, fields []interface{}) []byte {
+	buf = append(buf, ts...)
+	buf = append(buf, ' ')
+	buf = append(buf, strings.ToUpper(level.String())...)
+	buf = append(buf, ' ')
+	buf = append(buf, msg...)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ' ')
+		buf = append(buf, key(fields, i)...)
+		buf = append(buf, '=')
+		s := fmt.Sprint(value(fields, i))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		buf = append(buf, s...)
+	}
+	return append(buf, '\n')
+}
+
+// appendJSON appends a JSON entry such as
+//
+//	{"time":"2018-08-26T18:37:34Z","level":"info","msg":"listening","addr":":8000"}
+func appendJSON(buf []byte, ts string, level Level, msg string, fields []interface{}) []byte {
+	buf = append(buf, `{"time":`...)
+	buf = strconv.AppendQuote(buf, ts)
+	buf = append(buf, `,"level":`...)
+	buf = strconv.AppendQuote(buf, level.String())
+	buf = append(buf, `,"msg":`...)
+	buf = strconv.AppendQuote(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ',')
+		buf = strconv.AppendQuote(buf, key(fields, i))
+		buf = append(buf, ':')
+		v := value(fields, i)
+		switch v := v.(type) {
+		case error:
+			buf = strconv.AppendQuote(buf, v.Error())
+		case time.Duration:
+			buf = strconv.AppendQuote(buf, v.String())
+		case fmt.Stringer:
+			buf = strconv.AppendQuote(buf, v.String())
+		default:
+			data, err := json.Marshal(v)
+			if err != nil {
+				data = []byte(strconv.Quote(fmt.Sprint(v)))
+			}
+			buf = append(buf, data...)
+		}
+	}
+	return append(buf, "}\n"...)
+}
+
+func key(fields []interface{}, i int) string {
+	if s, ok := fields[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(fields[i])
+}
+
+func value(fields []interface{}, i int) interface{} {
+	if i+1 < len(fields) {
+		return fields[i+1]
+	}
+	return "(missing)"
+}
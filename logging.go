@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/logger"
+	"github.com/tile38/proximity-chat/protocol"
+	"github.com/tile38/proximity-chat/socket"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// request is the message that a connection is being handled for
+type request struct {
+	typ string
+	ref string
+	ctx context.Context // holds the span of the handler
+}
+
+var (
+	requestmu sync.Mutex         // guard requestM
+	requestM  map[string]request // connID -> message being handled
+)
+
+// lg is the server logger. Its level and format are set once the config is
+// loaded, and again by a reload.
+var lg = logger.Default()
+
+// setupLogger sets the level and format of the server logger from the config
+func setupLogger(c config) error {
+	level, err := logger.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	lg.Set(level, c.LogFormat == "json")
+	return nil
+}
+
+// handle registers a websocket message handler that is rate limited and that
+// logs every message it handles along with the connection, handler name and
+// latency. Errors sent while the message is handled carry its type and ref,
+// and every message is traced in a span of its own.
+func handle(name string, fn func(connID, msg string)) {
+	rate := countHandled(name)
+	h.Handle(name, func(connID, msg string) {
+		record(connID, recordIn, msg)
+		ctx, span := tracer.Start(context.Background(), "ws "+name)
+		span.SetAttributes(attribute.String("conn", connID))
+		beginRequest(ctx, connID, name, msg)
+		defer func() {
+			endRequest(connID)
+			span.End()
+		}()
+		if ok, disconnect := allow(connID, name); !ok {
+			sendError(connID, "rate_limited", "Rate limited")
+			if disconnect {
+				lg.Warn("disconnecting abusive client", "conn", connID,
+					"handler", name)
+				h.Close(connID)
+			}
+			return
+		}
+		if !spectatorAllowed(connID, name) {
+			sendError(connID, "spectator", "Spectators cannot send "+name)
+			return
+		}
+		rate.Incr(1)
+		if name != protocol.TypeViewport {
+			markActive(connID)
+		}
+		start := time.Now()
+		fn(connID, msg)
+		if lg.Enabled(logger.Debug) {
+			lg.Debug("handled", "conn", connID, "handler", name,
+				"latency", time.Since(start))
+		}
+	})
+}
+
+// beginRequest records the message that a connection is handled for
+func beginRequest(ctx context.Context, connID, typ, msg string) {
+	ref := gjson.Get(msg, "ref").String()
+	if len(ref) > socket.MaxRefLen {
+		ref = ""
+	}
+	requestmu.Lock()
+	requestM[connID] = request{typ: typ, ref: ref, ctx: ctx}
+	requestmu.Unlock()
+}
+
+// endRequest forgets the message that a connection was handled for
+func endRequest(connID string) {
+	requestmu.Lock()
+	delete(requestM, connID)
+	requestmu.Unlock()
+}
+
+// currentRequest returns the message that a connection is handled for, if
+// any
+func currentRequest(connID string) request {
+	requestmu.Lock()
+	defer requestmu.Unlock()
+	return requestM[connID]
+}
@@ -6,9 +6,10 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,71 +17,296 @@ import (
 	"github.com/paulbellamy/ratecounter"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
-	"github.com/tile38/msgkit"
+	"github.com/tile38/proximity-chat/auth"
+	"github.com/tile38/proximity-chat/protocol"
+	"github.com/tile38/proximity-chat/socket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const dist = 500
-
 var (
-	pool        *redis.Pool       // The Tile38 connection pool
-	h           msgkit.Handler    // The websocket server handler
+	geo         GeoStore          // The geospatial database
+	store       *redis.Pool       // The Redis connection pool
+	h           socket.Handler    // The websocket server handler
 	idmu        sync.Mutex        // guard maps
 	connClientM map[string]string // clientID -> connID map
 	clientConnM map[string]string // connID -> clientID map
+	secureM     map[string]string // secure id -> clientID of the people of this instance
 
 )
-var staticGeofenceObject = func() string {
-	data, err := ioutil.ReadFile("web/fences/" + "convention-center.geojson")
-	if err != nil {
-		panic(err)
-	}
-	return string(data)
-}()
 
 func main() {
-	var addr string
-	flag.StringVar(&addr, "tile38", ":9851", "Tile38 Address")
-	flag.BoolVar(&metrics, "metrics", false, "Show message metrics")
-	flag.Parse()
+	var err error
+	if cfg, err = loadConfig(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		lg.Fatal("invalid config", "err", err)
+	}
+	if err := setupLogger(cfg); err != nil {
+		lg.Fatal("invalid config", "err", err)
+	}
+	if err := setupFilters(); err != nil {
+		lg.Fatal("load message filters failed", "err", err)
+	}
 
-	// Create a new pool of connections to Tile38
-	pool = &redis.Pool{
-		MaxIdle:     16,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", addr)
-		}, TestOnBorrow: func(conn redis.Conn, _ time.Time) error {
-			if resp, _ := redis.String(conn.Do("PING")); resp != "PONG" {
-				return errors.New("expected PONG")
+	// Load the room geofences from the fence source
+	if err := loadRooms(); err != nil {
+		lg.Fatal("load rooms failed", "err", err)
+	}
+
+	// Connect to Tile38 and create a new pool of connections to Redis, or
+	// keep both in memory in demo mode
+	var bus PubSub
+	if cfg.Demo {
+		geo = newMemStore()
+		mem := newMemRedis()
+		store, bus = mem.Pool(), mem
+		lg.Info("demo mode, the geo index and the state are kept in memory")
+	} else {
+		geo = newTile38Store(cfg.Tile38Addr)
+		store = newPool(cfg.RedisAddr)
+		bus = redisPubSub{store}
+	}
+	if cfg.ShardPrecision > 0 {
+		shards := newShardStore(geo, cfg.ShardPrecision, isPeopleKey, shardIdle)
+		geo = shards
+		go shards.run()
+	}
+
+	initState()
+
+	// Require JWT authentication when a secret is configured
+	if cfg.AuthSecret != "" {
+		verifier = &auth.JWT{Secret: []byte(cfg.AuthSecret)}
+	}
+
+	setupHandler()
+	setupRoutes()
+
+	// Subscribe to geofence channels and to the other instances
+	subscribeGeofences()
+	if cfg.BusChannel != "" {
+		busSub.Source = bus
+		busSub.Channels = []string{cfg.BusChannel}
+		go busSub.Run()
+	}
+	go expirePresence()
+	go expireIPs()
+	go runAnnouncements()
+	go runCleanup()
+	go runExpiry()
+	go runFlush()
+	go runOverload()
+	startWebhooks()
+	startGeocoder()
+	startTranslator()
+	if err := startGRPC(); err != nil {
+		lg.Fatal("grpc setup failed", "err", err)
+	}
+	if err := startMQTT(); err != nil {
+		lg.Fatal("mqtt setup failed", "err", err)
+	}
+	if err := startRecorder(); err != nil {
+		lg.Fatal("recorder setup failed", "err", err)
+	}
+	if err := startAudit(); err != nil {
+		lg.Fatal("audit log setup failed", "err", err)
+	}
+	if err := startTracing(); err != nil {
+		lg.Fatal("tracing setup failed", "err", err)
+	}
+	if err := startPush(); err != nil {
+		lg.Fatal("push setup failed", "err", err)
+	}
+	go watchFences()
+
+	// Start listening for websocket connections and messages
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: serverHandler()}
+	serve, redirect := setupTLS(srv)
+	lg.Info("listening", "addr", srv.Addr, "tls", srv.TLSConfig != nil || cfg.TLSCert != "")
+	go func() {
+		if err := serve(); err != http.ErrServerClosed {
+			lg.Fatal("listen failed", "err", err)
+		}
+	}()
+	servers := []*http.Server{srv}
+	if redirect != nil {
+		lg.Info("redirecting to https", "addr", redirect.Addr)
+		go func() {
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				lg.Fatal("listen failed", "err", err)
 			}
-			return nil
-		},
+		}()
+		servers = append(servers, redirect)
 	}
 
+	// Wait for a signal and drain all connections
+	go watchReload()
+	waitForShutdown(servers...)
+}
+
+// initState makes the maps that hold the state of the instance
+func initState() {
 	connClientM = make(map[string]string)
 	clientConnM = make(map[string]string)
+	secureM = make(map[string]string)
+	connUserM = make(map[string]string)
+	connLimitM = make(map[string]*connLimits)
+	connVersionM = make(map[string]int)
+	sessionM = make(map[string]*session)
+	connSessionM = make(map[string]*session)
+	clientSessionM = make(map[string]*session)
+	presenceM = make(map[string]*presence)
+	profileM = make(map[string]string)
+	blockM = make(map[string]map[string]string)
+	notifyM = make(map[string]*notifyBuffer)
+	connNSM = make(map[string]string)
+	clientNSM = make(map[string]string)
+	connInfoM = make(map[string]*connInfo)
+	ipM = make(map[string]*ipState)
+	floorM = make(map[string]string)
+	kindM = make(map[string]string)
+	followersM = make(map[string][]string)
+	followingM = make(map[string]map[string]bool)
+	meetM = make(map[[2]string]*time.Timer)
+	viewportM = make(map[string]rect)
+	spectatorM = make(map[string]bool)
+	spoofM = make(map[string]*spoofState)
+	coordM = make(map[string]map[string]time.Time)
+	shadowM = make(map[string]bool)
+	watchM = make(map[string]*watch)
+	clientWatchM = make(map[string]map[string]bool)
+	pendingM = make(map[string]pendingFeature)
+	writtenM = make(map[string]writtenFeature)
+	viewportQueryM = make(map[string]*viewportQuery)
+	activeM = make(map[string]time.Time)
+	dwellM = make(map[string]map[string]*transition)
+	viewFilterM = make(map[string]*viewFilter)
+	requestM = make(map[string]request)
+	keyM = make(map[string]string)
+	lastMessageM = make(map[string]lastMessage)
+	lastPositionM = make(map[string]lastPosition)
+	groupCellM = make(map[string]string)
+	shoutLookupM = make(map[string]shoutLookup)
+	privacyM = make(map[string]string)
+	occupancySubM = make(map[string]map[string]bool)
+}
 
-	// Initialize a new msgkit server
+// setupHandler initializes the websocket server and binds the message handlers
+func setupHandler() {
 	h.OnOpen = onOpen
 	h.OnClose = onClose
-	h.Handle("Feature", feature)
-	h.Handle("Viewport", viewport)
-	h.Handle("Message", message)
+	h.Codecs = map[string]socket.Codec{msgpackProtocol: &msgpackCodec{}}
+	h.PingInterval = cfg.PingInterval
+	h.MaxMissedPongs = cfg.PingMisses
+	h.OnDead = onDead
+	h.OnPong = onPong
+	h.CheckOrigin = checkOrigin
+	h.Compression = cfg.Compression
+	h.CompressionLevel = cfg.CompressLevel
+	h.QueueSize = cfg.SendQueue
+	h.Workers = cfg.SendWorkers
+	h.WriteTimeout = cfg.WriteTimeout
+	h.MaxDropped = cfg.SlowDrops
+	h.IDs, _ = newIDProvider(cfg.IDProvider)
+	handle(protocol.TypeHello, hello)
+	handle(protocol.TypeFeature, feature)
+	handle(protocol.TypeViewport, viewport)
+	handle(protocol.TypeMessage, message)
+	handle(protocol.TypeDirectMessage, directMessage)
+	handle(protocol.TypeRooms, roomsMessage)
+	handle(protocol.TypePresence, presenceMessage)
+	handle(protocol.TypeMessageStatus, messageStatus)
+	handle(protocol.TypeSetProfile, setProfile)
+	handle(protocol.TypeGetProfile, getProfile)
+	handle(protocol.TypeBlock, blockMessage)
+	handle(protocol.TypeUnblock, unblockMessage)
+	handle(protocol.TypeFollow, followMessage)
+	handle(protocol.TypeUnfollow, unfollowMessage)
+	handle(protocol.TypeSetRole, roleMessage)
+	handle(protocol.TypeRTCOffer, rtcMessage)
+	handle(protocol.TypeRTCAnswer, rtcMessage)
+	handle(protocol.TypeRTCCandidate, rtcMessage)
+	handle(protocol.TypeICEServers, iceServersMessage)
+	handle(protocol.TypeWatch, watchMessage)
+	handle(protocol.TypeTrail, trailMessage)
+	handle(protocol.TypePublicKey, publicKeyMessage)
+	handle(protocol.TypeShout, shoutMessage)
+	handle(protocol.TypeSeen, seenMessage)
+	handle(protocol.TypeGroup, groupMessage)
+	handle(protocol.TypeGroupMessage, groupChat)
+	handle(protocol.TypePrivacy, privacyMessage)
+	handle(protocol.TypeOccupancy, occupancyMessage)
+	handle(protocol.TypeReaction, reactionMessage)
+	handle(protocol.TypeUpload, uploadMessage)
+	handle(protocol.TypePushToken, pushTokenMessage)
+	handle(protocol.TypePoll, pollMessage)
+	handle(protocol.TypeVote, voteMessage)
+	handle(protocol.TypeThread, threadMessage)
+	handle(protocol.TypeSnapshot, snapshotMessage)
+}
 
-	// Bind websockets to "/ws" and static site to "/"
-	http.Handle("/ws", &h)
-	http.Handle("/", http.FileServer(http.Dir("web")))
+// setupRoutes binds the websocket server, the static site and the APIs to the
+// default mux
+func setupRoutes() {
+	// Bind websockets to "/ws" and "/ws/<namespace>", and static site to "/"
+	http.HandleFunc("/ws", serveWS)
+	http.HandleFunc("/ws/", serveWS)
+	http.Handle("/", staticHandler())
+
+	// Bind the health checks
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
+
+	// Bind the admin API
+	http.HandleFunc("/api/fences/", withCORS(adminOnly(fencesAPI)))
+	http.HandleFunc("/api/kick/", withCORS(adminOnly(kickAPI)))
+	http.HandleFunc("/api/webhooks/dead", withCORS(adminOnly(deadLettersAPI)))
+	http.HandleFunc("/api/admin/stats", withCORS(adminOnly(statsAPI)))
+	http.HandleFunc("/api/admin/connections", withCORS(adminOnly(connectionsAPI)))
+	http.HandleFunc("/api/admin/audit", withCORS(adminOnly(auditAPI)))
+	http.HandleFunc("/api/admin/suspects", withCORS(adminOnly(suspectsAPI)))
+	http.HandleFunc("/api/admin/suspects/", withCORS(adminOnly(suspectsAPI)))
+	http.HandleFunc("/api/analytics/places/", withCORS(adminOnly(analyticsAPI)))
+	http.HandleFunc("/api/announcements", withCORS(adminOnly(announcementsAPI)))
+	http.HandleFunc("/api/announcements/", withCORS(adminOnly(announcementsAPI)))
+	http.HandleFunc("/api/polls", withCORS(adminOnly(pollsAPI)))
+	http.HandleFunc("/api/polls/", withCORS(adminOnly(pollsAPI)))
+	http.HandleFunc("/api/roles/", withCORS(adminOnly(rolesAPI)))
+	http.HandleFunc("/api/me", withCORS(userOnly(meAPI)))
+	http.HandleFunc("/api/me/export", withCORS(userOnly(meAPI)))
+}
 
-	// Subscribe to geofence channels
-	go geofenceSubscribe()
+// subscribeGeofences subscribes to the roaming and kind fence channels of
+// every namespace, and to the room and watch fences
+func subscribeGeofences() {
+	geofenceSub.Source = geo
+	for _, ns := range allNamespaces() {
+		geofenceSub.Channels = append(geofenceSub.Channels, floorKeys(roamChannel(ns))...)
+		for channel := range kindFences(ns) {
+			geofenceSub.Channels = append(geofenceSub.Channels, channel)
+		}
+	}
+	go geofenceSub.Run()
+}
 
-	// Start listening for websocket connections and messages
-	srv := &http.Server{Addr: ":8000"}
-	log.Printf("Listening at %s", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+// newPool creates a new pool of connections to a server that speaks the
+// redis protocol
+func newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		}, TestOnBorrow: func(conn redis.Conn, _ time.Time) error {
+			if resp, _ := redis.String(conn.Do("PING")); resp != "PONG" {
+				return errors.New("expected PONG")
+			}
+			return nil
+		},
+	}
 }
 
-var metrics bool
 var msgMu sync.Mutex
 var msgCount int
 var msgSize uint64
@@ -88,7 +314,28 @@ var msgCounter = ratecounter.NewRateCounter(time.Second)
 
 func send(id, msg string) {
 	h.Send(id, msg)
-	if metrics {
+	countSent(id, msg)
+}
+
+// sendMessage is send for a message that is sent to many connections, which
+// is encoded and compressed once for all of them
+func sendMessage(id string, m *socket.Message) {
+	h.SendMessage(id, m)
+	countSent(id, m.String())
+}
+
+// sendConn is sendMessage for a connection passed by h.Range, which saves
+// looking it up by id
+func sendConn(c *socket.Conn, m *socket.Message) {
+	c.SendMessage(m)
+	countSent(c.ID(), m.String())
+}
+
+// countSent records and counts a message sent to a connection
+func countSent(id, msg string) {
+	record(id, recordOut, msg)
+	sentRate.Incr(1)
+	if cfg.Metrics {
 		msgMu.Lock()
 		msgCounter.Incr(1)
 		msgCount++
@@ -99,102 +346,167 @@ func send(id, msg string) {
 	}
 }
 
-// geofenceSubscribe listens on geofence channels notifications, piping them out
+// sendError sends an error frame with a machine readable code to a connection
+func sendError(id, code, message string) {
+	req := currentRequest(id)
+	failSpan(id, code)
+	msg, _ := protocol.Encode(protocol.Error{
+		Envelope: protocol.Envelope{Type: protocol.TypeError},
+		Code:     code,
+		Message:  message,
+		Request:  req.typ,
+		Ref:      req.ref,
+	})
+	send(id, msg)
+}
+
+// geofenceSub listens on geofence channels notifications, piping them out
 // to all connected websocket clients who can see the changes
-func geofenceSubscribe() {
-	fn := func() error {
-		// Ensure that the roaming geofence channel exists
-		if _, err := tile38Do(
-			"SETCHAN", "roam-chan",
-			"NEARBY", "people", "ROAM", "people", "*", dist,
-		); err != nil {
-			return err
-		}
+var geofenceSub = &Subscriber{
+	Name:     "geofences",
+	Patterns: []string{roomChannel("*"), watchChannel("*")},
+	Setup:    geofenceSetup,
+	Handle:   geofenceNotification,
+}
 
-		if _, err := tile38Do(
-			"SETCHAN", "static-chan",
-			"WITHIN", "people", "DETECT", "enter,inside,exit", "OBJECT", staticGeofenceObject,
-		); err != nil {
-			return err
+// geofenceSetup ensures that the roaming channels of all namespaces, their
+// floors and entity kinds and the room geofence channels exist
+func geofenceSetup() error {
+	for _, ns := range allNamespaces() {
+		for _, key := range floorKeys(peopleKey(ns)) {
+			_, floor := splitFloor(key)
+			fence := Fence{Key: key, Roam: live().RoamDist}
+			if err := geo.SetFence(floorKey(roamChannel(ns), floor), fence); err != nil {
+				return err
+			}
 		}
+		for channel, fence := range kindFences(ns) {
+			if err := geo.SetFence(channel, fence); err != nil {
+				return err
+			}
+		}
+	}
+	return roomFences()
+}
 
-		// Subscribe to the channel
-		psc := redis.PubSubConn{Conn: pool.Get()}
-		defer psc.Close()
-		if err := psc.Subscribe("roam-chan", "static-chan"); err != nil {
-			return err
+// geofenceNotification handles a notification from a geofence channel
+func geofenceNotification(channel string, data []byte) bool {
+	if strings.HasPrefix(channel, roomChannel("")) {
+		// Received a room geofence notification, of any floor
+		roomID, _ := splitFloor(strings.TrimPrefix(channel, roomChannel("")))
+		if holdTransition(roomID, string(data)) {
+			return true
 		}
+		return roomNotification(roomID, string(data))
+	}
+	if strings.HasPrefix(channel, watchChannel("")) {
+		watchNotification(channel, string(data))
+		return true
+	}
+	channel, _ = splitFloor(channel)
+	channel, kind, moving := splitKind(channel)
+	if channel != roamChannel("") && !strings.HasPrefix(channel, roamChannel("")+":") {
+		return false
+	}
 
-		// for each pub/sub message
-		for {
-			switch v := psc.Receive().(type) {
-			case redis.Message:
-				// Received a geofence notification
-				msg := string(v.Data)
-				clientID := gjson.Get(msg, "object.id").String()
-				idmu.Lock()
-				connID := clientConnM[clientID] // get the connection from the id
-				idmu.Unlock()
-
-				switch v.Channel {
-				case "static-chan":
-					var outMsg string
-					switch gjson.Get(msg, "detect").String() {
-					case "enter", "inside":
-						outMsg = `{"type":"Inside","feature":` +
-							secureFeature(gjson.Get(msg, "object").Raw) + `}`
-					case "exit":
-						outMsg = `{"type":"Outside","feature":` +
-							secureFeature(gjson.Get(msg, "object").Raw) + `}`
-					default:
-						continue
-					}
-
-					h.Range(func(id string) bool {
-						if id == connID {
-							send(id, outMsg[:len(outMsg)-1]+`,"me":true}`)
-						} else {
-							send(id, outMsg)
-						}
-						return true
-					})
-
-				case "roam-chan":
-					nearby := gjson.Get(msg, "nearby")
-					if nearby.Exists() {
-						// an object is nearby, notify the target connection
-						send(connID, `{"type":"Nearby",`+
-							`"feature":`+secureFeature(nearby.Get("object").Raw)+`}`)
-						continue
-					}
-					faraway := gjson.Get(msg, "faraway")
-					if faraway.Exists() {
-						// an object is faraway, notify the target connection
-						send(connID, `{"type":"Faraway",`+
-							`"feature":`+secureFeature(faraway.Get("object").Raw)+`}`)
-						continue
-					}
-				}
-			case error:
-				return v
-			}
+	// Received a roaming geofence notification
+	msg := string(data)
+	if moving {
+		// an entity came near a person, which the person hears about as
+		// if they came near the entity
+		msg = entityRoam(msg)
+	}
+	clientID := gjson.Get(msg, "object.id").String()
+	nearby := gjson.Get(msg, "nearby")
+	if isHidden(nearby.Get("object").Raw) || isHidden(gjson.Get(msg, "faraway.object").Raw) {
+		// hidden people are not shown, they were sent faraway when they hid
+		return true
+	}
+	ns := strings.TrimPrefix(strings.TrimPrefix(channel, roamChannel("")), ":")
+	if nearby.Exists() {
+		geofenceEvent(protocol.TypeNearby, ns, "", msg)
+		// an object is nearby, notify the target connection with how far
+		// and which way the object is and the name of the place they met at
+		object := nearby.Get("object")
+		if kind == "" {
+			meetNearby(clientID, gjson.Get(msg, "object"), object)
 		}
+		msg, _ := protocol.Encode(protocol.Notification{
+			Envelope: protocol.Envelope{Type: protocol.TypeNearby},
+			Feature:  []byte(secureFeature(relativeFeature(gjson.Get(msg, "object"), object))),
+			Locality: locality(
+				object.Get("geometry.coordinates.1").Float(),
+				object.Get("geometry.coordinates.0").Float()),
+		})
+		notifyClient(clientID, msg)
+		return true
 	}
-	for {
-		err := fn()
-		log.Printf("psubscribe: %v", err)
-		time.Sleep(time.Second)
+	faraway := gjson.Get(msg, "faraway")
+	if faraway.Exists() {
+		geofenceEvent(protocol.TypeFaraway, ns, "", msg)
+		meetFaraway(clientID, faraway.Get("id").String())
+		// an object is faraway, notify the target connection
+		notifyClient(clientID, notification(protocol.TypeFaraway,
+			secureFeature(faraway.Get("object").Raw), "", false))
+		return true
 	}
+	return false
+}
+
+// geofenceEvent hands a roaming or room geofence event to the integrations
+// that republish them. typ is the websocket notification type, and room is
+// empty for roaming events.
+func geofenceEvent(typ, ns, room, msg string) {
+	streamEvent(typ, ns, room, msg)
+	mqttEvent(typ, ns, room, msg)
 }
 
 var connected int32
 
-func onOpen(connID string) {
+// onOpen binds the authenticated user and a session to a new connection
+func onOpen(connID string, r *http.Request) {
 	//	println("open", connID, atomic.AddInt32(&connected, 1))
+	if shedConn(connID, r.URL.Query().Get("session")) {
+		return
+	}
+	record(connID, recordOpen, r.URL.RawQuery)
+	bindUser(connID, r)
+	bindNamespace(connID, r)
+	bindSpectator(connID, r)
+	trackConn(connID, r)
+	if r.URL.Query().Get("compress") == "false" {
+		// the client opted out of compression, such as to save CPU
+		h.SetCompression(connID, false)
+	}
+	openSession(connID, r)
+}
 
+// onDead is called when a connection stopped answering pings. Its session is
+// dropped so that the person is removed right away when it closes, instead of
+// lingering until the session or their people object expires.
+func onDead(connID string) {
+	lg.Info("dead peer", "conn", connID)
+	dropSession(connID)
 }
 
-// onClose deletes the clients point in the people collection on a disconnect
+// onPong keeps the feature of a person who answers pings, so that a client
+// standing still does not have to send its Feature again. The feature is kept
+// until a pong is overdue by the people ttl.
+func onPong(connID string) {
+	idmu.Lock()
+	clientID, ok := connClientM[connID]
+	idmu.Unlock()
+	if !ok {
+		return
+	}
+	err := geo.Expire(personKey(clientID), clientID, cfg.PingInterval+live().PeopleTTL)
+	if err != nil && err != ErrNotFound {
+		lg.Error("keep alive failed", "conn", connID, "err", err)
+	}
+}
+
+// onClose deletes the clients point in the people collection on a disconnect,
+// unless the client may still resume its session
 func onClose(connID string) {
 	// println("close", connID, atomic.AddInt32(&connected, -1))
 	idmu.Lock()
@@ -202,36 +514,192 @@ func onClose(connID string) {
 	if ok {
 		delete(connClientM, connID)
 		delete(clientConnM, clientID)
+		delete(secureM, secureClientID(clientID))
 	}
 	idmu.Unlock()
+	record(connID, recordClose, "")
+	unbindUser(connID)
+	forgetLimits(connID)
+	forgetVersion(connID)
+	forgetNotifications(connID)
+	forgetOccupancy(connID)
+	forgetKey(connID)
+	forgetNamespace(connID)
+	forgetViewport(connID)
+	forgetViewportQuery(connID)
+	forgetSpectator(connID)
+	forgetActive(connID)
+	setViewFilter(connID, nil)
+	forgetConn(connID)
+	if suspendSession(connID) {
+		return
+	}
 	if ok {
-		tile38Do("DEL", "people", clientID)
+		removePerson(clientID)
+	}
+}
+
+// removePerson removes a person from all rooms and the people collection
+func removePerson(clientID string) {
+	followers := loadFollowers(clientID)
+	forgetPresence(clientID)
+	forgetProfile(clientID)
+	forgetBlocks(clientID)
+	forgetMessages(clientID)
+	forgetSpeed(clientID)
+	forgetSpoofing(clientID)
+	forgetWatches(clientID)
+	forgetShouts(clientID)
+	forgetPending(clientID)
+	forgetClient(clientID)
+	forgetGroups(clientID)
+	forgetPrivacy(clientID)
+	forgetMeets(clientID)
+	unregisterClient(clientID)
+	ns := clientNamespace(clientID)
+	key := personKey(clientID)
+	feature, err := geo.GetFeature(key, clientID)
+	geo.DelFeature(key, clientID)
+	forgetClientNamespace(clientID)
+	forgetFloor(clientID)
+	forgetKind(clientID)
+	if err == nil && !isHidden(feature) {
+		msg := notification(protocol.TypeGone, secureFeature(feature), "", false)
+		tombstone(ns, msg)
+		env, _ := sjson.Set(`{"kind":"gone"}`, "ns", ns)
+		publish(env, msg)
+		deliver(followers, msg)
+	}
+	forgetFollows(clientID)
+}
+
+// tombstone sends a Gone notification to the connections of a namespace on
+// this instance whose viewport shows the person, so that their marker is
+// removed right away instead of on the next viewport
+func tombstone(ns, msg string) {
+	lat := gjson.Get(msg, "feature.geometry.coordinates.1").Float()
+	lng := gjson.Get(msg, "feature.geometry.coordinates.0").Float()
+	at := rect{lat, lng, lat, lng}
+	var viewers []string
+	viewportmu.Lock()
+	for connID, r := range viewportM {
+		if r.intersects(at) {
+			viewers = append(viewers, connID)
+		}
+	}
+	viewportmu.Unlock()
+	feature := gjson.Get(msg, "feature").Raw
+	for _, connID := range viewers {
+		if connNamespace(connID) == ns && connViewFilter(connID).match(feature) {
+			send(connID, msg)
+		}
 	}
 }
 
 // feature is a websocket message handler that creates/updates a persons
-// position in Tile38
+// position in the GeoStore
 func feature(connID, msg string) {
+	if isDraining() {
+		return
+	}
+	if err := validateFeature(connID, msg); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
 	clientID := gjson.Get(msg, "id").String()
-	if len(clientID) != 24 {
+
+	// Banned people are turned away on every feature, so that a ban also
+	// reaches connections that missed the kick
+	idmu.Lock()
+	_, bound := connClientM[connID]
+	idmu.Unlock()
+	if banned(clientID) {
+		sendError(connID, "banned", "Banned by a moderator")
+		h.Close(connID)
+		return
+	}
+	kind := featureKind(msg)
+	if err := validateKind(clientID, kind, bound); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+
+	ns := connNamespace(connID)
+	if !bound && !bindClientNamespace(clientID, ns) {
+		sendError(connID, "namespace_conflict", "Id is in use in another namespace")
+		return
+	}
+	if !bound {
+		registerClient(clientID, ns)
+		loadShadow(clientID)
+	}
+	lat := gjson.Get(msg, "geometry.coordinates.1").Float()
+	lng := gjson.Get(msg, "geometry.coordinates.0").Float()
+	if err := checkSpeed(clientID, ns, lat, lng); err != nil {
+		sendError(connID, err.Code, err.Message)
 		return
 	}
+	checkSpoofing(clientID, ns, lat, lng)
 
 	// Track all connID <-> clientID
 	idmu.Lock()
 	clientConnM[clientID] = connID
 	connClientM[connID] = clientID
+	secureM[secureClientID(clientID)] = clientID
 	idmu.Unlock()
+	sessionFeature(connID, clientID, msg)
+	if kind != "" {
+		storeEntity(connID, clientID, kind, msg)
+		return
+	}
 
 	// fmt.Printf("A: connID: %v, clientID: %v\n", connID, clientID)
 
 	// Update the position in the database
-	tile38Do("SET", "people", clientID, "EX", 10, "OBJECT", msg)
+	span := startSpan(connID, "tile38 set")
+	storeFeature(connID, clientID, msg)
+	span.End()
+	if loadPrivacy(clientID) == privacyExact {
+		recordTrail(clientID, msg)
+	}
+	nearbyShouts(connID, clientID, lat, lng)
+	groupFeature(clientID, lat, lng)
+	locality(lat, lng) // look the area up before the person meets someone
+}
+
+// storeFeature stores the feature of a person in the people collection of
+// their floor, with their profile and public key, as their privacy mode allows
+func storeFeature(connID, clientID, msg string) {
+	ns := connNamespace(connID)
+	floor, _ := featureFloor(msg)
+	setFloor(ns, clientID, floor)
+	feature := privateFeature(clientID, attachKey(connID, attachProfile(clientID, msg)))
+	writeFeature(clientID, floorKey(peopleKey(ns), floor), feature)
+	followFeature(clientID, feature)
+}
+
+// relativeFeature sets the distance in meters and the bearing in degrees from
+// a person to the feature of someone nearby as properties of the feature
+func relativeFeature(person, nearby gjson.Result) string {
+	nearby = gjson.Parse(fuzzFeature(nearby.Raw))
+	lat1 := person.Get("geometry.coordinates.1").Float()
+	lng1 := person.Get("geometry.coordinates.0").Float()
+	lat2 := nearby.Get("geometry.coordinates.1").Float()
+	lng2 := nearby.Get("geometry.coordinates.0").Float()
+	meters := distance(lat1, lng1, lat2, lng2)
+	feature, _ := sjson.Set(nearby.Raw, "properties.distance", math.Round(meters))
+	feature, _ = sjson.Set(feature, "properties.bearing",
+		math.Mod(math.Round(bearing(lat1, lng1, lat2, lng2)), 360))
+	if zone := zoneAt(meters); zone != "" {
+		feature, _ = sjson.Set(feature, "properties.zone", zone)
+	}
+	return feature
 }
 
-// secureFeature re-hashes the clientID to avoid spoofing
+// secureFeature re-hashes the clientID to avoid spoofing, and fuzzes the
+// position of fuzzy people
 func secureFeature(feature string) string {
-	feature, _ = sjson.Set(feature, "id",
+	feature, _ = sjson.Set(fuzzFeature(feature), "id",
 		secureClientID(gjson.Get(feature, "id").String()))
 	return feature
 }
@@ -242,96 +710,254 @@ func secureClientID(clientID string) string {
 	return hex.EncodeToString(b[:12])
 }
 
-// viewport is a websocket message handler that queries Tile38 for all people
-// currently in a clients viewport
+// viewport is a websocket message handler that queries the GeoStore for all
+// people currently in a clients viewport
 func viewport(id, msg string) {
+	var vp protocol.Viewport
+	if err := protocol.Decode(msg, &vp); err != nil {
+		sendError(id, "invalid_message", err.Error())
+		return
+	}
+	if err := validateViewport(&vp); err != nil {
+		sendError(id, err.Code, err.Message)
+		return
+	}
+	if shedViewport(id) || !admitViewport(id, msg, &vp) {
+		return
+	}
+	sessionViewport(id, msg)
+	trackViewport(id, &vp)
+	filter := newViewFilter(vp.Filter)
+	setViewFilter(id, filter)
+	viewportShouts(id, &vp)
+
+	// Query for all people in the viewport
+	span := startSpan(id, "tile38 viewport")
+	people, err := viewportSearch(connPeopleKey(id), &vp, Search{})
+	if err == nil {
+		var entities []Object
+		entities, err = entitySearch(connNamespace(id), &vp, Search{})
+		people = append(people, entities...)
+	}
+	span.SetAttributes(attribute.Int("people", len(people)))
+	span.End()
+	if err != nil {
+		lg.Error("viewport query failed", "conn", id, "err", err)
+		sendError(id, "unavailable", "People are unavailable")
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[id]
+	idmu.Unlock()
 
-	swLat := gjson.Get(msg, "bounds._sw.lat").Float()
-	swLng := gjson.Get(msg, "bounds._sw.lng").Float()
-	neLat := gjson.Get(msg, "bounds._ne.lat").Float()
-	neLng := gjson.Get(msg, "bounds._ne.lng").Float()
-
-	var cursor int64
-	for {
-		// Query for all people in the viewport bounds
-		people, _ := redis.Values(tile38Do(
-			"INTERSECTS", "people",
-			"CURSOR", cursor,
-			"BOUNDS", swLat, swLng, neLat, neLng,
-		))
-		if len(people) < 2 {
-			return
-		}
-		cursor, _ = redis.Int64(people[0], nil)
-
-		idmu.Lock()
-		clientID := connClientM[id]
-		idmu.Unlock()
-
-		// Send all people in the viewport to the messager
-		var features []byte
-		var idx int
-		features = append(features, `{"type":"Update","features":[`...)
-		ps, _ := redis.Values(people[1], nil)
-		for _, p := range ps {
-			strs, _ := redis.Strings(p, nil)
-			if len(strs) > 1 && strs[0] != clientID {
-				feature := secureFeature(strs[1])
-				if idx > 0 {
-					features = append(features, ',')
-				}
-				features = append(features, feature...)
-				idx++
-			}
-		}
+	// At low zoom levels all people are collected and sent as clusters
+	clustered := vp.Zoom > 0 && vp.Zoom < cfg.ClusterZoom
+	var all []string
+
+	// Send all people in the viewport to the messager, in pages
+	var features []byte
+	var idx int
+	flush := func() {
 		features = append(features, `]}`...)
 		send(id, string(features))
-
-		if cursor == 0 {
-			break
+		features, idx = features[:0], 0
+	}
+	features = append(features, `{"type":"`+protocol.TypeUpdate+`","features":[`...)
+	for _, p := range people {
+		if p.ID == clientID || isHidden(p.Object) {
+			continue
+		}
+		feature := secureFeature(p.Object)
+		if clientID != "" && hidden(clientID, feature) || !filter.match(feature) {
+			continue
+		}
+		if clustered {
+			all = append(all, feature)
+			continue
+		}
+		if idx == viewportPage {
+			flush()
+			features = append(features, `{"type":"`+protocol.TypeUpdate+`","features":[`...)
 		}
+		if idx > 0 {
+			features = append(features, ',')
+		}
+		features = append(features, feature...)
+		idx++
+	}
+	if clustered {
+		send(id, clusterUpdate(all, vp.Zoom))
+	} else {
+		flush()
 	}
 }
 
-// message is a websocket message handler that queries Tile38 for other users
+// message is a websocket message handler that queries the GeoStore for other users
 // located in the messagers geofence and broadcasts a chat message to them
 func message(id, msg string) {
-	// create a new message
-	nmsg := `{"type":"Message"}`
-	nmsg, _ = sjson.SetRaw(nmsg, "feature", secureFeature(gjson.Get(msg, "feature").String()))
-	nmsg, _ = sjson.Set(nmsg, "text", gjson.Get(msg, "text").String())
+	var cm protocol.ChatMessage
+	if err := protocol.Decode(msg, &cm); err != nil {
+		sendError(id, "invalid_message", err.Error())
+		return
+	}
+	feature := string(cm.Feature)
+	if err := validateFeature(id, feature); err != nil {
+		sendError(id, err.Code, err.Message)
+		return
+	}
+	clientID := gjson.Get(feature, "id").String()
+	var room string // room of the message replied to
+	if cm.ReplyTo != "" {
+		if err := validateReply(clientID, connNamespace(id), &cm); err != nil {
+			sendError(id, err.Code, err.Message)
+			return
+		}
+		room = cm.Room
+	}
+	if !validScope(cm.Scope) {
+		sendError(id, "invalid_scope", "Scope must be nearby, specific or broadest")
+		return
+	} else if cm.ReplyTo != "" && cm.Scope != "" && cm.Scope != scopeNearby {
+		sendError(id, "invalid_scope", "Replies go to the room of the message replied to")
+		return
+	}
+	if err := validateTTL(cm.TTL); err != nil {
+		sendError(id, err.Code, err.Message)
+		return
+	}
+	if len(cm.Encrypted) > 0 {
+		if err := validateEncrypted(cm.Encrypted, cm.Text); err != nil {
+			sendError(id, err.Code, err.Message)
+			return
+		}
+	} else if cm.Attachment == nil || cm.Text != "" {
+		if err := filterMessage(clientID, cm.Text); err != nil {
+			sendError(id, err.Code, err.Message)
+			return
+		}
+	}
+	if cm.Attachment != nil {
+		if err := resolveAttachment(clientID, cm.Attachment); err != nil {
+			sendError(id, err.Code, err.Message)
+			return
+		}
+	}
 
-	// Query all nearby people from Tile38
-	lat := gjson.Get(msg, "feature.geometry.coordinates.1").Float()
-	lng := gjson.Get(msg, "feature.geometry.coordinates.0").Float()
-	var cursor int64
-	for {
-		people, _ := redis.Values(
-			tile38Do(
-				"NEARBY", "people", "CURSOR", 0, "IDS", "POINT", lat, lng, dist,
-			),
-		)
-		if len(people) < 2 {
+	// create a new message, showing the sender as their privacy mode allows
+	msgID := newMessageID()
+	sender := privateFeature(clientID, attachKey(id, attachProfile(clientID, feature)))
+	var expires int64
+	if cm.TTL > 0 {
+		expires = time.Now().Add(time.Duration(cm.TTL)*time.Second).UnixNano() / int64(time.Millisecond)
+	}
+	nmsg, _ := protocol.Encode(protocol.ChatMessage{
+		Envelope:   protocol.Envelope{Type: protocol.TypeMessage},
+		ID:         msgID,
+		Feature:    []byte(shownFeature(secureFeature(sender))),
+		Text:       cm.Text,
+		Encrypted:  cm.Encrypted,
+		Attachment: cm.Attachment,
+		Room:       room,
+		ReplyTo:    cm.ReplyTo,
+		Trace:      traceParent(id),
+		Expires:    expires,
+	})
+
+	// Query all nearby people and the rooms of the sender, record
+	// the message in the history of the rooms and deliver it to the people
+	lat := gjson.Get(feature, "geometry.coordinates.1").Float()
+	lng := gjson.Get(feature, "geometry.coordinates.0").Float()
+	span := startSpan(id, "tile38 nearby and places")
+	clientIDs, roomIDs, err := QueryNearbyAndPlaces(connNamespace(id), clientFloor(clientID),
+		lat, lng, live().RoamDist)
+	span.End()
+	if err != nil {
+		lg.Error("nearby query failed", "conn", id, "err", err)
+		sendError(id, "unavailable", "Message could not be sent")
+		return
+	}
+	if err := checkSpeaker(clientID, roomIDs); err != nil {
+		sendError(id, err.Code, err.Message)
+		return
+	}
+	if cm.Scope == scopeSpecific || cm.Scope == scopeBroadest {
+		// send to the people inside of the room rather than those nearby
+		scoped := scopeRoom(cm.Scope, roomIDs)
+		if scoped == "" {
+			sendError(id, "not_in_room", "Scoped messages are sent from inside of a room")
 			return
 		}
-		cursor, _ = redis.Int64(people[0], nil)
-		ps, _ := redis.Values(people[1], nil)
-		for _, p := range ps {
-			clientID, _ := redis.String(p, nil)
-			idmu.Lock()
-			connID := clientConnM[clientID]
-			idmu.Unlock()
-			send(connID, nmsg)
+		clientIDs, roomIDs = roomMembers(scoped), []string{scoped}
+		if !isInside(clientID, scoped) {
+			// the sender is in the fence before the enter is relayed
+			clientIDs = append(clientIDs, clientID)
 		}
-		if cursor == 0 {
-			break
+		if via := roomParents(scoped); len(via) > 0 {
+			nmsg, _ = sjson.Set(nmsg, "via", localRooms(via))
 		}
+		nmsg, _ = sjson.Set(nmsg, "room", localRoom(scoped))
 	}
+	if shadowBanned(clientID) {
+		// the message only seems to go out to the shadow banned sender
+		recipients := len(clientIDs)
+		for _, recipient := range clientIDs {
+			if recipient == clientID {
+				recipients--
+			}
+		}
+		shadowMessage(id, msgID, cm.Ref, nmsg, recipients)
+		return
+	}
+	if translator != nil && cm.Text != "" {
+		span = startSpan(id, "translate")
+		if translations := translateMessage(clientID, clientIDs, cm.Text); len(translations) > 0 {
+			nmsg, _ = sjson.Set(nmsg, "translations", translations)
+		}
+		span.End()
+	}
+	span = startSpan(id, "redis history", attribute.Int("rooms", len(roomIDs)))
+	recordHistory(roomIDs, nmsg)
+	span.End()
+
+	// Deliver the message to everyone else, track its delivery and let the
+	// sender know how far it got
+	recipients := clientIDs[:0]
+	for _, recipient := range clientIDs {
+		if recipient == clientID {
+			send(id, nmsg)
+		} else {
+			recipients = append(recipients, recipient)
+		}
+	}
+	span = startSpan(id, "deliver", attribute.Int("recipients", len(recipients)))
+	trackMessage(msgID, clientID, len(recipients))
+	delivered := deliverTracked(msgID, recipients, nmsg)
+	countDelivered(msgID, delivered)
+	span.SetAttributes(attribute.Int("delivered", delivered))
+	span.End()
+	if expires != 0 {
+		expireMessage(msgID, expires, roomIDs, append([]string{clientID}, recipients...))
+	} else {
+		// disappearing messages are kept from spectators, who are not
+		// told when they expire
+		spectateMessage(connNamespace(id), nmsg)
+	}
+	ack, _ := protocol.Encode(protocol.MessageAck{
+		Envelope:   protocol.Envelope{Type: protocol.TypeMessageAck},
+		ID:         msgID,
+		Ref:        cm.Ref,
+		Recipients: len(recipients),
+		Delivered:  delivered,
+	})
+	send(id, ack)
 }
 
-// tile38Do executes a redis command on a new connection and returns the response
-func tile38Do(cmd string, args ...interface{}) (interface{}, error) {
-	conn := pool.Get()
-	defer conn.Close()
-	return conn.Do(cmd, args...)
+// nearbyIDs returns the clientIDs of all people of a namespace and floor
+// within meters of a point
+func nearbyIDs(ns, floor string, lat, lng, meters float64) ([]string, error) {
+	objs, err := geo.Nearby(floorKey(peopleKey(ns), floor), lat, lng, meters, Search{IDs: true})
+	if err != nil {
+		return nil, err
+	}
+	return objectIDs(objs), nil
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+// testWait is how long a test waits for a frame
+const testWait = 2 * time.Second
+
+var (
+	testOnce  sync.Once
+	testURL   string    // base URL of the test server
+	testRedis *memRedis // the Redis of the test server
+)
+
+// testServer starts the server once for the tests of the package, in demo
+// mode with everything in memory, and returns its base URL
+func testServer(t testing.TB) string {
+	testOnce.Do(func() {
+		var err error
+		if cfg, err = loadConfig([]string{"-demo", "-log-level", "error", "-namespaces", "campus"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := setupLogger(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadRooms(); err != nil {
+			t.Fatal(err)
+		}
+		geo = newMemStore()
+		testRedis = newMemRedis()
+		store = testRedis.Pool()
+		initState()
+		setupHandler()
+		setupRoutes()
+		subscribeGeofences()
+		testURL = httptest.NewServer(serverHandler()).URL
+	})
+	return testURL
+}
+
+// testID returns a client id of 24 hex characters unique to a test
+func testID(n int) string {
+	return fmt.Sprintf("%016x%08x", time.Now().UnixNano(), n)
+}
+
+// testFeature returns the Feature frame of a person at a point
+func testFeature(id string, lat, lng float64) string {
+	return fmt.Sprintf(`{"type":"Feature","id":%q,"properties":{},`+
+		`"geometry":{"type":"Point","coordinates":[%v,%v]}}`, id, lng, lat)
+}
+
+// testConn is a websocket connection to the test server that queues the
+// frames it receives
+type testConn struct {
+	t      testing.TB
+	ws     *websocket.Conn
+	frames chan string
+}
+
+// dialTest connects to a path of the test server, such as "/ws"
+func dialTest(t testing.TB, path string, header http.Header) *testConn {
+	url := "ws" + strings.TrimPrefix(testServer(t), "http") + path
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testConn{t: t, ws: ws, frames: make(chan string, 1024)}
+	go func() {
+		defer close(c.frames)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.frames <- string(data)
+		}
+	}()
+	t.Cleanup(func() { ws.Close() })
+	return c
+}
+
+// send writes a frame
+func (c *testConn) send(frame string) {
+	c.t.Helper()
+	if err := c.ws.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect returns the next frame of a type, skipping the frames of other
+// types
+func (c *testConn) expect(typ string) string {
+	c.t.Helper()
+	frame, ok := c.next(typ, testWait)
+	if !ok {
+		c.t.Fatalf("no %s frame", typ)
+	}
+	return frame
+}
+
+// none fails when a frame of a type arrives within d
+func (c *testConn) none(typ string, d time.Duration) {
+	c.t.Helper()
+	if frame, ok := c.next(typ, d); ok {
+		c.t.Fatalf("unexpected frame %s", frame)
+	}
+}
+
+// next waits up to d for the next frame of a type
+func (c *testConn) next(typ string, d time.Duration) (string, bool) {
+	timeout := time.After(d)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				return "", false
+			}
+			if gjson.Get(frame, "type").String() == typ {
+				return frame, true
+			}
+		case <-timeout:
+			return "", false
+		}
+	}
+}
+
+// joinTest connects a person to the test server at a point, and waits for
+// the position to be stored
+func joinTest(t testing.TB, id string, lat, lng float64) *testConn {
+	t.Helper()
+	c := dialTest(t, "/ws", nil)
+	c.expect("Session")
+	c.send(testFeature(id, lat, lng))
+	waitFor(t, func() bool {
+		_, err := geo.GetFeature(peopleKey(""), id)
+		return err == nil
+	})
+	return c
+}
+
+// waitFor waits until cond is true
+func waitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(testWait); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+// testMessage returns the chat Message frame of a person at a point
+func testMessage(id string, lat, lng float64, text string) string {
+	return fmt.Sprintf(`{"type":"Message","feature":%s,"text":%q}`, testFeature(id, lat, lng), text)
+}
+
+func TestDemoMessage(t *testing.T) {
+	a, b := testID(1), testID(2)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	cb := joinTest(t, b, 39.7426, -104.9965)
+	ca.send(testMessage(a, 39.7425, -104.9965, "hello"))
+	ca.expect("MessageAck")
+	msg := cb.expect("Message")
+	if gjson.Get(msg, "text").String() != "hello" ||
+		gjson.Get(msg, "feature.id").String() != secureClientID(a) {
+		t.Fatalf("got %s", msg)
+	}
+}
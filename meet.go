@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// meetTTL is how long two people are not introduced again after an
+// introduction
+const meetTTL = 24 * time.Hour
+
+var (
+	meetmu sync.Mutex                // guard meetM
+	meetM  map[[2]string]*time.Timer // clientID and nearby clientID -> introduction timer
+)
+
+// meetKey returns the Redis key that marks two people as introduced, by
+// their secure ids in either order
+func meetKey(a, b string) string {
+	ids := []string{secureClientID(a), secureClientID(b)}
+	sort.Strings(ids)
+	return "meet:" + ids[0] + ":" + ids[1]
+}
+
+// inMeetMode returns true for the feature of a person who opted in to be
+// introduced to the people they stay near, with a "meet": true property
+func inMeetMode(feature string) bool {
+	return gjson.Get(feature, "properties.meet").Bool() && !isHidden(feature)
+}
+
+// meetNearby starts the introduction timer of a person of this instance and
+// someone nearby when both are in meet mode. They are introduced when they
+// are still near each other after the meet delay.
+func meetNearby(clientID string, person, nearby gjson.Result) {
+	if cfg.MeetAfter <= 0 || !inMeetMode(person.Raw) || !inMeetMode(nearby.Raw) {
+		meetFaraway(clientID, nearby.Get("id").String())
+		return
+	}
+	idmu.Lock()
+	_, local := clientConnM[clientID]
+	idmu.Unlock()
+	if !local {
+		return
+	}
+	pair := [2]string{clientID, nearby.Get("id").String()}
+	meetmu.Lock()
+	defer meetmu.Unlock()
+	if _, ok := meetM[pair]; ok {
+		return
+	}
+	meetM[pair] = time.AfterFunc(cfg.MeetAfter, func() {
+		meetmu.Lock()
+		delete(meetM, pair)
+		meetmu.Unlock()
+		introduce(pair[0], pair[1])
+	})
+}
+
+// meetFaraway stops the introduction timer of a person and someone who is no
+// longer nearby
+func meetFaraway(clientID, otherID string) {
+	pair := [2]string{clientID, otherID}
+	meetmu.Lock()
+	if timer, ok := meetM[pair]; ok {
+		timer.Stop()
+		delete(meetM, pair)
+	}
+	meetmu.Unlock()
+}
+
+// forgetMeets stops the introduction timers of a person
+func forgetMeets(clientID string) {
+	meetmu.Lock()
+	for pair, timer := range meetM {
+		if pair[0] == clientID {
+			timer.Stop()
+			delete(meetM, pair)
+		}
+	}
+	meetmu.Unlock()
+}
+
+// introduce sends two people who are still near each other and in meet mode
+// an Introduction to the other, unless they were introduced before. The
+// instance that marks them as introduced sends both.
+func introduce(clientID, otherID string) {
+	ns := clientNamespace(clientID)
+	feature, err := geo.GetFeature(personKey(clientID), clientID)
+	if err != nil || !inMeetMode(feature) {
+		return
+	}
+	_, other, err := findPerson(ns, otherID)
+	if err != nil || !inMeetMode(other) {
+		return
+	}
+	if distance(
+		gjson.Get(feature, "geometry.coordinates.1").Float(),
+		gjson.Get(feature, "geometry.coordinates.0").Float(),
+		gjson.Get(other, "geometry.coordinates.1").Float(),
+		gjson.Get(other, "geometry.coordinates.0").Float()) > live().RoamDist {
+		return
+	}
+	_, err = redis.String(storeDo("SET", meetKey(clientID, otherID), 1, "EX", int(meetTTL/time.Second), "NX"))
+	if err == redis.ErrNil {
+		// introduced before, or by another instance
+		return
+	} else if err != nil {
+		lg.Error("introduction failed", "client", clientID, "err", err)
+		return
+	}
+	deliver([]string{clientID}, introduction(other))
+	deliver([]string{otherID}, introduction(feature))
+	lg.Info("people introduced", "ns", ns)
+}
+
+// introduction returns the Introduction message to a person about the stored
+// feature of someone they met
+func introduction(feature string) string {
+	feature = secureFeature(feature)
+	profile := gjson.Get(feature, "properties.profile")
+	text := "Hi!"
+	if name := profile.Get("name").String(); name != "" {
+		text = "Hi " + name + "!"
+	}
+	intro := protocol.Introduction{
+		Envelope: protocol.Envelope{Type: protocol.TypeIntroduction},
+		Feature:  []byte(feature),
+		Target:   gjson.Get(feature, "id").String(),
+		Text:     text,
+	}
+	if profile.IsObject() {
+		intro.Profile = []byte(profile.Raw)
+	}
+	msg, _ := protocol.Encode(intro)
+	return msg
+}
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/match"
+)
+
+// errMemNoReply is returned by Receive on a memConn without pending replies
+var errMemNoReply = errors.New("memredis: no pending reply")
+
+// errWrongType is the error of Redis for a command on a key of another type
+var errWrongType = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// memRedis keeps the subset of Redis that the server uses in memory, so that
+// demo mode and tests run without a Redis server. Like the in-memory geo
+// index, it lives in a single server process. Values are strings, hashes
+// (map[string]string), lists ([]string), sets (map[string]bool), sorted sets
+// (map[string]float64) and streams (*memStream).
+type memRedis struct {
+	mu      sync.Mutex
+	data    map[string]interface{}
+	expires map[string]time.Time
+	hub     *memStore // delivers the published messages to subscriptions
+}
+
+// memStream is a stream of entries, oldest first
+type memStream struct {
+	entries []memStreamEntry
+	last    [2]int64 // id of the last entry
+}
+
+// memStreamEntry is an entry of a stream
+type memStreamEntry struct {
+	id     [2]int64
+	fields []string
+}
+
+// memConn is a connection to a memRedis
+type memConn struct {
+	r       *memRedis
+	pending []interface{} // replies of the sent commands, errors included
+	multi   [][]string    // commands queued by MULTI, nil outside of one
+}
+
+// newMemRedis returns an empty in-memory Redis
+func newMemRedis() *memRedis {
+	return &memRedis{
+		data:    make(map[string]interface{}),
+		expires: make(map[string]time.Time),
+		hub:     newMemStore(),
+	}
+}
+
+// Pool returns a pool of connections to the in-memory Redis
+func (r *memRedis) Pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle: 16,
+		Dial: func() (redis.Conn, error) {
+			return &memConn{r: r}, nil
+		},
+	}
+}
+
+// Subscribe opens a subscription to the channels and patterns of PUBLISH
+func (r *memRedis) Subscribe(channels, patterns []string) (Subscription, error) {
+	return r.hub.Subscribe(channels, patterns)
+}
+
+func (c *memConn) Close() error { return nil }
+func (c *memConn) Err() error   { return nil }
+func (c *memConn) Flush() error { return nil }
+
+func (c *memConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		var reply interface{}
+		var err error
+		for len(c.pending) > 0 {
+			reply, err = c.Receive()
+		}
+		return reply, err
+	}
+	c.pending = nil
+	return c.exec(cmd, args)
+}
+
+func (c *memConn) Send(cmd string, args ...interface{}) error {
+	reply, err := c.exec(cmd, args)
+	if err != nil {
+		reply = err
+	}
+	c.pending = append(c.pending, reply)
+	return nil
+}
+
+func (c *memConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, errMemNoReply
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// exec runs a command, or queues it inside of a MULTI
+func (c *memConn) exec(cmd string, args []interface{}) (interface{}, error) {
+	argv := make([]string, 0, len(args)+1)
+	argv = append(argv, strings.ToUpper(cmd))
+	for _, arg := range (redis.Args{}).AddFlat(args) {
+		argv = append(argv, memArg(arg))
+	}
+	switch {
+	case argv[0] == "MULTI":
+		c.multi = [][]string{}
+		return "OK", nil
+	case argv[0] == "DISCARD":
+		c.multi = nil
+		return "OK", nil
+	case argv[0] == "EXEC":
+		cmds := c.multi
+		if cmds == nil {
+			return nil, redis.Error("ERR EXEC without MULTI")
+		}
+		c.multi = nil
+		c.r.mu.Lock()
+		defer c.r.mu.Unlock()
+		replies := make([]interface{}, len(cmds))
+		for i, argv := range cmds {
+			reply, err := c.r.run(argv)
+			if err != nil {
+				reply = err
+			}
+			replies[i] = reply
+		}
+		return replies, nil
+	case c.multi != nil:
+		c.multi = append(c.multi, argv)
+		return "QUEUED", nil
+	case argv[0] == "PUBLISH" && len(argv) == 3:
+		c.r.hub.publish([][2]string{{argv[1], argv[2]}})
+		return int64(0), nil
+	}
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	return c.r.run(argv)
+}
+
+// memArg formats an argument the way redigo writes it
+func memArg(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case nil:
+		return ""
+	case redis.Argument:
+		return memArg(v.RedisArg())
+	}
+	return fmt.Sprint(arg)
+}
+
+// get returns the value of a key, deleting it when it expired
+func (r *memRedis) get(key string) (interface{}, bool) {
+	if t, ok := r.expires[key]; ok && time.Now().After(t) {
+		delete(r.data, key)
+		delete(r.expires, key)
+	}
+	v, ok := r.data[key]
+	return v, ok
+}
+
+// del deletes a key
+func (r *memRedis) del(key string) bool {
+	_, ok := r.get(key)
+	delete(r.data, key)
+	delete(r.expires, key)
+	return ok
+}
+
+// drop deletes a collection that became empty, as Redis does
+func (r *memRedis) drop(key string, n int) {
+	if n == 0 {
+		r.del(key)
+	}
+}
+
+// hash returns the hash of a key, created when create is set
+func (r *memRedis) hash(key string, create bool) (map[string]string, error) {
+	v, ok := r.get(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		h := make(map[string]string)
+		r.data[key] = h
+		return h, nil
+	}
+	h, ok := v.(map[string]string)
+	if !ok {
+		return nil, errWrongType
+	}
+	return h, nil
+}
+
+// list returns the list of a key
+func (r *memRedis) list(key string) ([]string, error) {
+	v, ok := r.get(key)
+	if !ok {
+		return nil, nil
+	}
+	l, ok := v.([]string)
+	if !ok {
+		return nil, errWrongType
+	}
+	return l, nil
+}
+
+// set returns the set of a key, created when create is set
+func (r *memRedis) set(key string, create bool) (map[string]bool, error) {
+	v, ok := r.get(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		s := make(map[string]bool)
+		r.data[key] = s
+		return s, nil
+	}
+	s, ok := v.(map[string]bool)
+	if !ok {
+		return nil, errWrongType
+	}
+	return s, nil
+}
+
+// zset returns the sorted set of a key, created when create is set
+func (r *memRedis) zset(key string, create bool) (map[string]float64, error) {
+	v, ok := r.get(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		z := make(map[string]float64)
+		r.data[key] = z
+		return z, nil
+	}
+	z, ok := v.(map[string]float64)
+	if !ok {
+		return nil, errWrongType
+	}
+	return z, nil
+}
+
+// sorted returns the members of a sorted set by score, then by member
+func sorted(z map[string]float64) []string {
+	members := make([]string, 0, len(z))
+	for m := range z {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// scoreRange parses a score bound such as 10, (10, -inf or +inf
+func scoreRange(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	s = strings.TrimPrefix(s, "(")
+	switch s {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, exclusive, err
+}
+
+// inScore returns true for scores between two bounds
+func inScore(score float64, min, max string) (bool, error) {
+	lo, loEx, err := scoreRange(min)
+	if err != nil {
+		return false, err
+	}
+	hi, hiEx, err := scoreRange(max)
+	if err != nil {
+		return false, err
+	}
+	return (score > lo || !loEx && score == lo) && (score < hi || !hiEx && score == hi), nil
+}
+
+// indexRange resolves the start and stop indexes of LRANGE, LTRIM and
+// ZREVRANGE for a length, returning an empty range as start > stop
+func indexRange(startArg, stopArg string, n int) (int, int, error) {
+	start, err := strconv.Atoi(startArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	stop, err := strconv.Atoi(stopArg)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, nil
+}
+
+// bulks returns strings as the bulk replies of redis
+func bulks(strs []string) []interface{} {
+	reply := make([]interface{}, len(strs))
+	for i, s := range strs {
+		reply[i] = []byte(s)
+	}
+	return reply
+}
+
+// parseStreamID parses the id of a stream entry, with the sequence missing
+// as seq
+func parseStreamID(s string, seq int64) ([2]int64, error) {
+	switch s {
+	case "-":
+		return [2]int64{0, 0}, nil
+	case "+":
+		return [2]int64{math.MaxInt64, math.MaxInt64}, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return [2]int64{}, err
+	}
+	if len(parts) == 2 {
+		if seq, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return [2]int64{}, err
+		}
+	}
+	return [2]int64{ms, seq}, nil
+}
+
+// less compares the ids of stream entries
+func streamLess(a, b [2]int64) bool {
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
+
+// memArity is the number of arguments that the commands need at least
+var memArity = map[string]int{
+	"GET": 1, "SET": 2, "MGET": 1, "DEL": 1, "EXISTS": 1, "EXPIRE": 2, "TTL": 1,
+	"HSET": 3, "HMSET": 3, "HGET": 2, "HGETALL": 1, "HDEL": 2, "HINCRBY": 3,
+	"HEXISTS": 2, "HLEN": 1, "HMGET": 2, "LPUSH": 2, "RPUSH": 2, "LRANGE": 3,
+	"LTRIM": 3, "LREM": 3, "RPOP": 1, "LLEN": 1, "SADD": 2, "SREM": 2,
+	"SMEMBERS": 1, "SCARD": 1, "SISMEMBER": 2, "ZADD": 3, "ZREM": 2,
+	"ZRANGEBYSCORE": 3, "ZREVRANGE": 3, "ZREMRANGEBYSCORE": 3, "ZSCORE": 2,
+	"ZCARD": 1, "XADD": 4, "XREVRANGE": 3, "SCAN": 1, "KEYS": 1, "ECHO": 1,
+}
+
+// run executes a command on the data, with the lock held
+func (r *memRedis) run(argv []string) (interface{}, error) {
+	cmd, args := argv[0], argv[1:]
+	if n, ok := memArity[cmd]; ok && len(args) < n {
+		return nil, redis.Error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+	}
+	switch cmd {
+	case "PING":
+		return "PONG", nil
+	case "ECHO":
+		return []byte(args[0]), nil
+	case "GET":
+		v, ok := r.get(args[0])
+		if !ok {
+			return nil, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, errWrongType
+		}
+		return []byte(s), nil
+	case "SET":
+		var ttl time.Duration
+		var nx, xx bool
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "EX", "PX":
+				if i+1 == len(args) {
+					return nil, redis.Error("ERR syntax error")
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					return nil, redis.Error("ERR invalid expire time in set")
+				}
+				if ttl = time.Duration(n) * time.Millisecond; strings.ToUpper(args[i]) == "EX" {
+					ttl = time.Duration(n) * time.Second
+				}
+				i++
+			default:
+				return nil, redis.Error("ERR syntax error")
+			}
+		}
+		_, exists := r.get(args[0])
+		if nx && exists || xx && !exists {
+			return nil, nil
+		}
+		r.data[args[0]] = args[1]
+		delete(r.expires, args[0])
+		if ttl > 0 {
+			r.expires[args[0]] = time.Now().Add(ttl)
+		}
+		return "OK", nil
+	case "MGET":
+		reply := make([]interface{}, len(args))
+		for i, key := range args {
+			if v, ok := r.get(key); ok {
+				if s, ok := v.(string); ok {
+					reply[i] = []byte(s)
+				}
+			}
+		}
+		return reply, nil
+	case "DEL", "EXISTS":
+		var n int64
+		for _, key := range args {
+			if cmd == "DEL" && r.del(key) {
+				n++
+			} else if _, ok := r.get(key); cmd == "EXISTS" && ok {
+				n++
+			}
+		}
+		return n, nil
+	case "EXPIRE":
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		if _, ok := r.get(args[0]); !ok {
+			return int64(0), nil
+		}
+		if secs <= 0 {
+			r.del(args[0])
+		} else {
+			r.expires[args[0]] = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+		return int64(1), nil
+	case "TTL":
+		if _, ok := r.get(args[0]); !ok {
+			return int64(-2), nil
+		}
+		t, ok := r.expires[args[0]]
+		if !ok {
+			return int64(-1), nil
+		}
+		return int64(math.Ceil(time.Until(t).Seconds())), nil
+
+	case "HSET", "HMSET":
+		if len(args)%2 == 0 {
+			return nil, redis.Error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+		}
+		h, err := r.hash(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		if cmd == "HMSET" {
+			return "OK", nil
+		}
+		return n, nil
+	case "HGET":
+		h, err := r.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := h[args[1]]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "HMGET":
+		h, err := r.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		reply := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if v, ok := h[field]; ok {
+				reply[i] = []byte(v)
+			}
+		}
+		return reply, nil
+	case "HGETALL":
+		h, err := r.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		reply := make([]interface{}, 0, 2*len(h))
+		for _, field := range fields {
+			reply = append(reply, []byte(field), []byte(h[field]))
+		}
+		return reply, nil
+	case "HDEL":
+		h, err := r.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, field := range args[1:] {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				n++
+			}
+		}
+		r.drop(args[0], len(h))
+		return n, nil
+	case "HINCRBY":
+		h, err := r.hash(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		by, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		n, _ := strconv.ParseInt(h[args[1]], 10, 64)
+		n += by
+		h[args[1]] = strconv.FormatInt(n, 10)
+		return n, nil
+	case "HEXISTS":
+		h, err := r.hash(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := h[args[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "HLEN":
+		h, err := r.hash(args[0], false)
+		return int64(len(h)), err
+
+	case "LPUSH", "RPUSH":
+		l, err := r.list(args[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range args[1:] {
+			if cmd == "LPUSH" {
+				l = append([]string{v}, l...)
+			} else {
+				l = append(l, v)
+			}
+		}
+		r.data[args[0]] = l
+		return int64(len(l)), nil
+	case "LRANGE":
+		l, err := r.list(args[0])
+		if err != nil {
+			return nil, err
+		}
+		start, stop, err := indexRange(args[1], args[2], len(l))
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		if start > stop {
+			return []interface{}{}, nil
+		}
+		return bulks(l[start : stop+1]), nil
+	case "LTRIM":
+		l, err := r.list(args[0])
+		if err != nil {
+			return nil, err
+		}
+		start, stop, err := indexRange(args[1], args[2], len(l))
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		if start > stop {
+			r.del(args[0])
+			return "OK", nil
+		}
+		r.data[args[0]] = append([]string(nil), l[start:stop+1]...)
+		return "OK", nil
+	case "LREM":
+		l, err := r.list(args[0])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		var kept []string
+		var n int64
+		if count < 0 {
+			// remove from the tail
+			for i := len(l) - 1; i >= 0; i-- {
+				if l[i] == args[2] && (n < int64(-count)) {
+					n++
+					continue
+				}
+				kept = append([]string{l[i]}, kept...)
+			}
+		} else {
+			for _, v := range l {
+				if v == args[2] && (count == 0 || n < int64(count)) {
+					n++
+					continue
+				}
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			r.del(args[0])
+		} else {
+			r.data[args[0]] = kept
+		}
+		return n, nil
+	case "RPOP":
+		l, err := r.list(args[0])
+		if err != nil || len(l) == 0 {
+			return nil, err
+		}
+		v := l[len(l)-1]
+		r.data[args[0]] = l[:len(l)-1]
+		r.drop(args[0], len(l)-1)
+		return []byte(v), nil
+	case "LLEN":
+		l, err := r.list(args[0])
+		return int64(len(l)), err
+
+	case "SADD":
+		s, err := r.set(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if !s[m] {
+				s[m] = true
+				n++
+			}
+		}
+		return n, nil
+	case "SREM":
+		s, err := r.set(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if s[m] {
+				delete(s, m)
+				n++
+			}
+		}
+		r.drop(args[0], len(s))
+		return n, nil
+	case "SMEMBERS":
+		s, err := r.set(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		members := make([]string, 0, len(s))
+		for m := range s {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		return bulks(members), nil
+	case "SCARD":
+		s, err := r.set(args[0], false)
+		return int64(len(s)), err
+	case "SISMEMBER":
+		s, err := r.set(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		if s[args[1]] {
+			return int64(1), nil
+		}
+		return int64(0), nil
+
+	case "ZADD":
+		if len(args)%2 == 0 {
+			return nil, redis.Error("ERR syntax error")
+		}
+		z, err := r.zset(args[0], true)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return nil, redis.Error("ERR value is not a valid float")
+			}
+			if _, ok := z[args[i+1]]; !ok {
+				n++
+			}
+			z[args[i+1]] = score
+		}
+		return n, nil
+	case "ZREM":
+		z, err := r.zset(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if _, ok := z[m]; ok {
+				delete(z, m)
+				n++
+			}
+		}
+		r.drop(args[0], len(z))
+		return n, nil
+	case "ZSCORE":
+		z, err := r.zset(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		if score, ok := z[args[1]]; ok {
+			return []byte(strconv.FormatFloat(score, 'g', -1, 64)), nil
+		}
+		return nil, nil
+	case "ZCARD":
+		z, err := r.zset(args[0], false)
+		return int64(len(z)), err
+	case "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		z, err := r.zset(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		offset, count, scores := 0, -1, false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "WITHSCORES":
+				scores = true
+			case "LIMIT":
+				if i+2 >= len(args) {
+					return nil, redis.Error("ERR syntax error")
+				}
+				offset, _ = strconv.Atoi(args[i+1])
+				count, _ = strconv.Atoi(args[i+2])
+				i += 2
+			}
+		}
+		var members []string
+		for _, m := range sorted(z) {
+			ok, err := inScore(z[m], args[1], args[2])
+			if err != nil {
+				return nil, redis.Error("ERR min or max is not a float")
+			}
+			if ok {
+				members = append(members, m)
+			}
+		}
+		if cmd == "ZREMRANGEBYSCORE" {
+			for _, m := range members {
+				delete(z, m)
+			}
+			r.drop(args[0], len(z))
+			return int64(len(members)), nil
+		}
+		if offset >= len(members) {
+			members = nil
+		} else {
+			members = members[offset:]
+		}
+		if count >= 0 && count < len(members) {
+			members = members[:count]
+		}
+		reply := make([]interface{}, 0, len(members))
+		for _, m := range members {
+			reply = append(reply, []byte(m))
+			if scores {
+				reply = append(reply, []byte(strconv.FormatFloat(z[m], 'g', -1, 64)))
+			}
+		}
+		return reply, nil
+	case "ZREVRANGE":
+		z, err := r.zset(args[0], false)
+		if err != nil {
+			return nil, err
+		}
+		members := sorted(z)
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+		start, stop, err := indexRange(args[1], args[2], len(members))
+		if err != nil {
+			return nil, redis.Error("ERR value is not an integer or out of range")
+		}
+		reply := []interface{}{}
+		for i := start; i <= stop; i++ {
+			reply = append(reply, []byte(members[i]))
+			if len(args) > 3 && strings.ToUpper(args[3]) == "WITHSCORES" {
+				reply = append(reply, []byte(strconv.FormatFloat(z[members[i]], 'g', -1, 64)))
+			}
+		}
+		return reply, nil
+
+	case "XADD":
+		v, ok := r.get(args[0])
+		if !ok {
+			v = &memStream{}
+			r.data[args[0]] = v
+		}
+		st, ok := v.(*memStream)
+		if !ok {
+			return nil, errWrongType
+		}
+		i, maxLen := 1, -1
+		if strings.ToUpper(args[i]) == "MAXLEN" {
+			if i++; args[i] == "~" || args[i] == "=" {
+				i++
+			}
+			if i >= len(args) {
+				return nil, redis.Error("ERR syntax error")
+			}
+			maxLen, _ = strconv.Atoi(args[i])
+			i++
+		}
+		if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+			return nil, redis.Error("ERR wrong number of arguments for 'xadd' command")
+		}
+		id := [2]int64{time.Now().UnixNano() / int64(time.Millisecond), 0}
+		if args[i] != "*" {
+			var err error
+			if id, err = parseStreamID(args[i], 0); err != nil {
+				return nil, redis.Error("ERR Invalid stream ID specified as stream command argument")
+			}
+		}
+		if !streamLess(st.last, id) {
+			if args[i] != "*" {
+				return nil, redis.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+			}
+			id = [2]int64{st.last[0], st.last[1] + 1}
+		}
+		st.last = id
+		st.entries = append(st.entries, memStreamEntry{id, append([]string(nil), args[i+1:]...)})
+		if maxLen >= 0 && len(st.entries) > maxLen {
+			st.entries = st.entries[len(st.entries)-maxLen:]
+		}
+		return []byte(fmt.Sprintf("%d-%d", id[0], id[1])), nil
+	case "XREVRANGE":
+		v, ok := r.get(args[0])
+		if !ok {
+			return []interface{}{}, nil
+		}
+		st, ok := v.(*memStream)
+		if !ok {
+			return nil, errWrongType
+		}
+		end, err := parseStreamID(args[1], math.MaxInt64)
+		if err != nil {
+			return nil, redis.Error("ERR Invalid stream ID specified as stream command argument")
+		}
+		start, err := parseStreamID(args[2], 0)
+		if err != nil {
+			return nil, redis.Error("ERR Invalid stream ID specified as stream command argument")
+		}
+		count := -1
+		if len(args) > 4 && strings.ToUpper(args[3]) == "COUNT" {
+			count, _ = strconv.Atoi(args[4])
+		}
+		reply := []interface{}{}
+		for i := len(st.entries) - 1; i >= 0 && count != 0; i-- {
+			e := st.entries[i]
+			if streamLess(end, e.id) || streamLess(e.id, start) {
+				continue
+			}
+			reply = append(reply, []interface{}{
+				[]byte(fmt.Sprintf("%d-%d", e.id[0], e.id[1])), bulks(e.fields),
+			})
+			count--
+		}
+		return reply, nil
+
+	case "SCAN", "KEYS":
+		pattern := "*"
+		if cmd == "KEYS" {
+			pattern = args[0]
+		}
+		for i := 1; cmd == "SCAN" && i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range r.data {
+			if _, ok := r.get(key); ok && match.Match(key, pattern) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if cmd == "KEYS" {
+			return bulks(keys), nil
+		}
+		// every key is returned by the first call
+		return []interface{}{[]byte("0"), bulks(keys)}, nil
+	}
+	return nil, redis.Error("ERR unknown command '" + strings.ToLower(cmd) + "'")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestMemRedisStrings(t *testing.T) {
+	p := newMemRedis().Pool()
+	conn := p.Get()
+	defer conn.Close()
+	if s, err := redis.String(conn.Do("PING")); err != nil || s != "PONG" {
+		t.Fatalf("ping: got %q, %v", s, err)
+	}
+	conn.Do("SET", "a", 1)
+	if s, _ := redis.String(conn.Do("GET", "a")); s != "1" {
+		t.Fatalf("get: got %q", s)
+	}
+	if _, err := redis.String(conn.Do("SET", "a", 2, "NX")); err != redis.ErrNil {
+		t.Fatalf("set nx of an existing key: got %v", err)
+	}
+	if _, err := redis.String(conn.Do("GET", "missing")); err != redis.ErrNil {
+		t.Fatalf("get of a missing key: got %v", err)
+	}
+	if vals, _ := redis.Strings(conn.Do("MGET", "a", "missing")); !reflect.DeepEqual(vals, []string{"1", ""}) {
+		t.Fatalf("mget: got %q", vals)
+	}
+	if n, _ := redis.Int(conn.Do("DEL", "a", "missing")); n != 1 {
+		t.Fatalf("del: got %d", n)
+	}
+	conn.Do("HSET", "h", "f", "v")
+	if _, err := conn.Do("GET", "h"); err == nil {
+		t.Fatal("get of a hash: want a wrong type error")
+	}
+}
+
+func TestMemRedisExpire(t *testing.T) {
+	p := newMemRedis().Pool()
+	conn := p.Get()
+	defer conn.Close()
+	conn.Do("SET", "a", 1, "PX", 1)
+	conn.Do("SADD", "s", "x")
+	if n, _ := redis.Int(conn.Do("EXPIRE", "s", 10)); n != 1 {
+		t.Fatalf("expire: got %d", n)
+	}
+	if n, _ := redis.Int(conn.Do("EXPIRE", "missing", 10)); n != 0 {
+		t.Fatalf("expire of a missing key: got %d", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if n, _ := redis.Int(conn.Do("EXISTS", "a", "s")); n != 1 {
+		t.Fatalf("exists after expiry: got %d", n)
+	}
+}
+
+func TestMemRedisCollections(t *testing.T) {
+	p := newMemRedis().Pool()
+	conn := p.Get()
+	defer conn.Close()
+
+	conn.Do("HSET", "h", "a", 1, "b", 2)
+	conn.Do("HINCRBY", "h", "a", 5)
+	if m, _ := redis.StringMap(conn.Do("HGETALL", "h")); !reflect.DeepEqual(m, map[string]string{"a": "6", "b": "2"}) {
+		t.Fatalf("hgetall: got %v", m)
+	}
+	conn.Do("HDEL", "h", "a", "b")
+	if n, _ := redis.Int(conn.Do("EXISTS", "h")); n != 0 {
+		t.Fatal("an empty hash must be deleted")
+	}
+
+	for _, v := range []string{"a", "b", "c", "b"} {
+		conn.Do("LPUSH", "l", v)
+	}
+	conn.Do("LTRIM", "l", 0, 2)
+	if l, _ := redis.Strings(conn.Do("LRANGE", "l", 0, -1)); !reflect.DeepEqual(l, []string{"b", "c", "b"}) {
+		t.Fatalf("lrange: got %v", l)
+	}
+	conn.Do("LREM", "l", 0, "b")
+	if s, _ := redis.String(conn.Do("RPOP", "l")); s != "c" {
+		t.Fatalf("rpop: got %q", s)
+	}
+
+	conn.Do("SADD", "s", "b", "a", "b")
+	if m, _ := redis.Strings(conn.Do("SMEMBERS", "s")); !reflect.DeepEqual(m, []string{"a", "b"}) {
+		t.Fatalf("smembers: got %v", m)
+	}
+
+	conn.Do("ZADD", "z", 3, "c", 1, "a", 2, "b")
+	if m, _ := redis.Strings(conn.Do("ZRANGEBYSCORE", "z", "(1", "+inf", "LIMIT", 0, 1)); !reflect.DeepEqual(m, []string{"b"}) {
+		t.Fatalf("zrangebyscore: got %v", m)
+	}
+	if m, _ := redis.StringMap(conn.Do("ZREVRANGE", "z", 0, 0, "WITHSCORES")); !reflect.DeepEqual(m, map[string]string{"c": "3"}) {
+		t.Fatalf("zrevrange: got %v", m)
+	}
+	if n, _ := redis.Int(conn.Do("ZREMRANGEBYSCORE", "z", "-inf", 2)); n != 2 {
+		t.Fatalf("zremrangebyscore: got %d", n)
+	}
+
+	if keys, _ := redis.Strings(conn.Do("KEYS", "*")); !reflect.DeepEqual(keys, []string{"s", "z"}) {
+		t.Fatalf("keys: got %v", keys)
+	}
+}
+
+func TestMemRedisStream(t *testing.T) {
+	p := newMemRedis().Pool()
+	conn := p.Get()
+	defer conn.Close()
+	for _, v := range []string{"1", "2", "3"} {
+		conn.Do("XADD", "x", "MAXLEN", "~", 2, "*", "n", v)
+	}
+	values, err := redis.Values(conn.Do("XREVRANGE", "x", "+", "-", "COUNT", 5))
+	if err != nil || len(values) != 2 {
+		t.Fatalf("xrevrange: got %v, %v", values, err)
+	}
+	entry, _ := redis.Values(values[0], nil)
+	if fields, _ := redis.StringMap(entry[1], nil); fields["n"] != "3" {
+		t.Fatalf("newest entry: got %v", fields)
+	}
+}
+
+func TestMemRedisBatch(t *testing.T) {
+	p := newMemRedis().Pool()
+	b := newBatch(p)
+	defer b.Close()
+	b.Send("MULTI")
+	b.Send("LPUSH", "l", "a")
+	b.Send("LTRIM", "l", 0, 0)
+	b.Send("EXEC")
+	b.Send("GET", "l")
+	replies, err := b.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 5 {
+		t.Fatalf("got %d replies", len(replies))
+	}
+	if exec, _ := redis.Values(replies[3], nil); len(exec) != 2 {
+		t.Fatalf("exec: got %v", replies[3])
+	}
+	if _, ok := replies[4].(redis.Error); !ok {
+		t.Fatalf("get of a list: got %v, want an error", replies[4])
+	}
+}
+
+func TestMemRedisPublish(t *testing.T) {
+	r := newMemRedis()
+	sub, err := r.Subscribe([]string{"bus"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	conn := r.Pool().Get()
+	defer conn.Close()
+	conn.Do("PUBLISH", "bus", "hello")
+	if channel, data := receiveTest(t, sub); channel != "bus" || data != "hello" {
+		t.Fatalf("got %s %s", channel, data)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/tile38/pkg/geojson"
+)
+
+// The grid of the in-memory index
+const (
+	memCellSize = 0.01 // degrees per cell, about a kilometer
+	memMaxCells = 64   // cells an object may cover before it is kept aside
+	memMaxScan  = 4096 // cells a search may visit before it scans everything
+)
+
+// errSubscriptionClosed is returned by Receive on a closed memSubscription
+var errSubscriptionClosed = errors.New("geostore: subscription closed")
+
+// memStore is a GeoStore that keeps everything in memory, for development
+// and tests without a Tile38 server. It supports the subset of Tile38 that
+// the server uses, including fence and roaming notifications in the same
+// format as Tile38.
+type memStore struct {
+	mu     sync.Mutex
+	colls  map[string]*memCollection
+	fences map[string]*memFence
+	subs   map[*memSubscription]bool
+	done   chan struct{}
+}
+
+// memCollection is a collection of objects with a grid index
+type memCollection struct {
+	objs map[string]*memObject
+	grid map[[2]int]map[string]*memObject
+	wide map[string]*memObject // objects covering too many cells
+}
+
+// memObject is an object of a collection
+type memObject struct {
+	id      string
+	raw     string
+	obj     geojson.Object
+	cells   [][2]int
+	expires time.Time // zero for objects that do not expire
+}
+
+// memFence is a geofence channel
+type memFence struct {
+	Fence
+	obj     geojson.Object             // fence area of object fences
+	inside  map[string]bool            // ids inside of an object fence
+	nearby  map[string]map[string]bool // ids near each other for roaming fences
+	expires time.Time
+}
+
+// memSubscription is a subscription to channels of a memStore
+type memSubscription struct {
+	s        *memStore
+	mu       sync.Mutex
+	channels map[string]bool
+	patterns []string
+	msgs     chan [2]string
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// newMemStore returns an empty in-memory GeoStore
+func newMemStore() *memStore {
+	s := &memStore{
+		colls:  make(map[string]*memCollection),
+		fences: make(map[string]*memFence),
+		subs:   make(map[*memSubscription]bool),
+		done:   make(chan struct{}),
+	}
+	go s.expire()
+	return s
+}
+
+// cellsOf returns the grid cells covered by a bounding box, or nil when they
+// are more than max
+func cellsOf(b geojson.BBox, max int) [][2]int {
+	x0, y0 := int(math.Floor(b.Min.X/memCellSize)), int(math.Floor(b.Min.Y/memCellSize))
+	x1, y1 := int(math.Floor(b.Max.X/memCellSize)), int(math.Floor(b.Max.Y/memCellSize))
+	if (x1-x0+1)*(y1-y0+1) > max {
+		return nil
+	}
+	var cells [][2]int
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			cells = append(cells, [2]int{x, y})
+		}
+	}
+	return cells
+}
+
+// coll returns a collection, creating it when needed
+func (s *memStore) coll(key string) *memCollection {
+	c, ok := s.colls[key]
+	if !ok {
+		c = &memCollection{
+			objs: make(map[string]*memObject),
+			grid: make(map[[2]int]map[string]*memObject),
+			wide: make(map[string]*memObject),
+		}
+		s.colls[key] = c
+	}
+	return c
+}
+
+// remove takes an object out of the collection and its index
+func (c *memCollection) remove(o *memObject) {
+	delete(c.objs, o.id)
+	if o.cells == nil {
+		delete(c.wide, o.id)
+	}
+	for _, cell := range o.cells {
+		delete(c.grid[cell], o.id)
+		if len(c.grid[cell]) == 0 {
+			delete(c.grid, cell)
+		}
+	}
+}
+
+// insert adds an object to the collection and its index
+func (c *memCollection) insert(o *memObject) {
+	c.objs[o.id] = o
+	if o.cells = cellsOf(o.obj.CalculatedBBox(), memMaxCells); o.cells == nil {
+		c.wide[o.id] = o
+	}
+	for _, cell := range o.cells {
+		if c.grid[cell] == nil {
+			c.grid[cell] = make(map[string]*memObject)
+		}
+		c.grid[cell][o.id] = o
+	}
+}
+
+// candidates returns the objects that may intersect a bounding box
+func (c *memCollection) candidates(b geojson.BBox) []*memObject {
+	cells := cellsOf(b, memMaxScan)
+	var objs []*memObject
+	if cells == nil {
+		for _, o := range c.objs {
+			objs = append(objs, o)
+		}
+		return objs
+	}
+	seen := make(map[string]bool)
+	for _, cell := range cells {
+		for id, o := range c.grid[cell] {
+			if !seen[id] {
+				seen[id] = true
+				objs = append(objs, o)
+			}
+		}
+	}
+	for _, o := range c.wide {
+		objs = append(objs, o)
+	}
+	return objs
+}
+
+func (s *memStore) SetFeature(key, id, object string, ttl time.Duration) error {
+	obj, err := geojson.ObjectJSON(object)
+	if err != nil {
+		return err
+	}
+	o := &memObject{id: id, raw: object, obj: obj}
+	if ttl > 0 {
+		o.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	c := s.coll(key)
+	if prev, ok := c.objs[id]; ok {
+		c.remove(prev)
+	}
+	c.insert(o)
+	msgs := s.detect("set", key, o)
+	s.mu.Unlock()
+	s.publish(msgs)
+	return nil
+}
+
+func (s *memStore) GetFeature(key, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.colls[key]; ok {
+		if o, ok := c.objs[id]; ok {
+			return o.raw, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (s *memStore) DelFeature(key, id string) error {
+	s.mu.Lock()
+	msgs := s.del(key, id)
+	s.mu.Unlock()
+	s.publish(msgs)
+	return nil
+}
+
+func (s *memStore) Expire(key, id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.colls[key]; ok {
+		if o, ok := c.objs[id]; ok {
+			o.expires = time.Now().Add(ttl)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// del deletes an object and returns the exit notifications of the fences it
+// was inside of
+func (s *memStore) del(key, id string) [][2]string {
+	c, ok := s.colls[key]
+	if !ok {
+		return nil
+	}
+	o, ok := c.objs[id]
+	if !ok {
+		return nil
+	}
+	c.remove(o)
+	var msgs [][2]string
+	for name, f := range s.fences {
+		if f.Key != key {
+			continue
+		}
+		if f.inside[id] {
+			delete(f.inside, id)
+			msgs = append(msgs, [2]string{name, memNotification(name, "del", "exit", key, o, nil)})
+		}
+		for other := range f.nearby[id] {
+			delete(f.nearby[other], id)
+		}
+		delete(f.nearby, id)
+	}
+	return msgs
+}
+
+// detect evaluates the fences on a collection for an object that was set
+// and returns their notifications as channel and message pairs
+func (s *memStore) detect(command, key string, o *memObject) [][2]string {
+	var msgs [][2]string
+	for name, f := range s.fences {
+		if f.Key != key {
+			continue
+		}
+		if f.Roam > 0 {
+			msgs = append(msgs, s.roam(name, f, o)...)
+			continue
+		}
+		var inside bool
+		if f.Center != nil {
+			inside = o.obj.Nearby(geojson.Position{X: f.Center.Lng, Y: f.Center.Lat}, f.Radius)
+		} else {
+			inside = o.obj.Within(f.obj)
+		}
+		var detect string
+		switch {
+		case inside && !f.inside[o.id]:
+			detect = "enter"
+		case inside && f.Center != nil:
+			continue
+		case inside:
+			detect = "inside"
+		case f.inside[o.id]:
+			detect = "exit"
+		default:
+			continue
+		}
+		if inside {
+			f.inside[o.id] = true
+		} else {
+			delete(f.inside, o.id)
+		}
+		msgs = append(msgs, [2]string{name, memNotification(name, command, detect, key, o, nil)})
+	}
+	return msgs
+}
+
+// roam returns the notifications of a roaming fence for an object that was
+// set: one for every object nearby, and one for every object that it moved
+// away from
+func (s *memStore) roam(name string, f *memFence, o *memObject) [][2]string {
+	var msgs [][2]string
+	target := f.target()
+	c := s.coll(target)
+	center := o.obj.CalculatedPoint()
+	near := make(map[string]bool)
+	box := geojson.BBoxesFromCenter(center.Y, center.X, f.Roam)
+	for _, other := range c.candidates(box) {
+		if other.id == o.id || !other.obj.Nearby(center, f.Roam) {
+			continue
+		}
+		near[other.id] = true
+		meters := center.DistanceTo(other.obj.CalculatedPoint())
+		msgs = append(msgs, [2]string{name, memNotification(name, "set", "roam", f.Key, o,
+			map[string]interface{}{"nearby": roamObject(target, other, meters)})})
+	}
+	for id := range f.nearby[o.id] {
+		if near[id] {
+			continue
+		}
+		delete(f.nearby[id], o.id)
+		if other, ok := c.objs[id]; ok {
+			meters := center.DistanceTo(other.obj.CalculatedPoint())
+			msgs = append(msgs, [2]string{name, memNotification(name, "set", "roam", f.Key, o,
+				map[string]interface{}{"faraway": roamObject(target, other, meters)})})
+		}
+	}
+	f.nearby[o.id] = near
+	if target != f.Key {
+		// objects of the target collection are not tracked, they do not
+		// roam this fence
+		return msgs
+	}
+	for id := range near {
+		if f.nearby[id] == nil {
+			f.nearby[id] = make(map[string]bool)
+		}
+		f.nearby[id][o.id] = true
+	}
+	return msgs
+}
+
+// roamObject returns the nearby or faraway member of a roaming notification
+func roamObject(key string, o *memObject, meters float64) map[string]interface{} {
+	return map[string]interface{}{
+		"key":    key,
+		"id":     o.id,
+		"object": json.RawMessage(o.raw),
+		"meters": meters,
+	}
+}
+
+// memNotification encodes a notification the way Tile38 does
+func memNotification(hook, command, detect, key string, o *memObject, extra map[string]interface{}) string {
+	msg := map[string]interface{}{
+		"command": command,
+		"detect":  detect,
+		"hook":    hook,
+		"key":     key,
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"id":      o.id,
+		"object":  json.RawMessage(o.raw),
+	}
+	for k, v := range extra {
+		msg[k] = v
+	}
+	data, _ := json.Marshal(msg)
+	return string(data)
+}
+
+func (s *memStore) SetFence(name string, fence Fence) error {
+	f := &memFence{
+		Fence:  fence,
+		inside: make(map[string]bool),
+		nearby: make(map[string]map[string]bool),
+	}
+	if fence.Roam <= 0 && fence.Center == nil {
+		obj, err := geojson.ObjectJSON(fence.Object)
+		if err != nil {
+			return err
+		}
+		f.obj = obj
+	}
+	if fence.TTL > 0 {
+		f.expires = time.Now().Add(fence.TTL)
+	}
+	s.mu.Lock()
+	if prev, ok := s.fences[name]; ok && prev.Key == fence.Key {
+		// keep the state so that replacing a fence does not repeat enters
+		f.inside, f.nearby = prev.inside, prev.nearby
+	}
+	s.fences[name] = f
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) DelFence(name string) error {
+	s.mu.Lock()
+	delete(s.fences, name)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) Channels(pattern string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.fences {
+		if match.Match(name, pattern) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s *memStore) Nearby(key string, lat, lng, meters float64, opts Search) ([]Object, error) {
+	center := geojson.Position{X: lng, Y: lat}
+	box := geojson.BBoxesFromCenter(lat, lng, meters)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.colls[key]
+	if !ok {
+		return nil, nil
+	}
+	type hit struct {
+		o *memObject
+		d float64
+	}
+	var hits []hit
+	for _, o := range c.candidates(box) {
+		if o.obj.Nearby(center, meters) {
+			hits = append(hits, hit{o, center.DistanceTo(o.obj.CalculatedPoint())})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].d < hits[j].d })
+	objs := make([]*memObject, len(hits))
+	for i, h := range hits {
+		objs[i] = h.o
+	}
+	return results(objs, opts), nil
+}
+
+func (s *memStore) Intersects(key string, area Area, opts Search) ([]Object, error) {
+	var test func(o geojson.Object) bool
+	var box geojson.BBox
+	if b := area.Bounds; b != nil {
+		box = geojson.New2DBBox(b.SW.Lng, b.SW.Lat, b.NE.Lng, b.NE.Lat)
+		test = func(o geojson.Object) bool { return o.IntersectsBBox(box) }
+	} else {
+		obj, err := geojson.ObjectJSON(area.Object)
+		if err != nil {
+			return nil, err
+		}
+		box = obj.CalculatedBBox()
+		test = func(o geojson.Object) bool { return o.Intersects(obj) }
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.colls[key]
+	if !ok {
+		return nil, nil
+	}
+	var objs []*memObject
+	for _, o := range c.candidates(box) {
+		if test(o.obj) {
+			objs = append(objs, o)
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].id < objs[j].id })
+	return results(objs, opts), nil
+}
+
+// results returns the search results of objects
+func results(objs []*memObject, opts Search) []Object {
+	if opts.Limit > 0 && len(objs) > opts.Limit {
+		objs = objs[:opts.Limit]
+	}
+	out := make([]Object, len(objs))
+	for i, o := range objs {
+		out[i].ID = o.id
+		if !opts.IDs {
+			out[i].Object = o.raw
+		}
+	}
+	return out
+}
+
+// expire deletes expired objects and fences until the store is closed
+func (s *memStore) expire() {
+	ticker := time.NewTicker(time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			var msgs [][2]string
+			s.mu.Lock()
+			for key, c := range s.colls {
+				for id, o := range c.objs {
+					if !o.expires.IsZero() && now.After(o.expires) {
+						msgs = append(msgs, s.del(key, id)...)
+					}
+				}
+			}
+			for name, f := range s.fences {
+				if !f.expires.IsZero() && now.After(f.expires) {
+					delete(s.fences, name)
+				}
+			}
+			s.mu.Unlock()
+			s.publish(msgs)
+		}
+	}
+}
+
+// publish sends notifications to the matching subscriptions. Notifications
+// for a subscription that is not keeping up are dropped.
+func (s *memStore) publish(msgs [][2]string) {
+	if len(msgs) == 0 {
+		return
+	}
+	s.mu.Lock()
+	subs := make([]*memSubscription, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+	for _, msg := range msgs {
+		for _, sub := range subs {
+			if sub.matches(msg[0]) {
+				select {
+				case sub.msgs <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (s *memStore) Subscribe(channels, patterns []string) (Subscription, error) {
+	sub := &memSubscription{
+		s:        s,
+		channels: make(map[string]bool),
+		patterns: patterns,
+		msgs:     make(chan [2]string, 1024),
+		closed:   make(chan struct{}),
+	}
+	for _, channel := range channels {
+		sub.channels[channel] = true
+	}
+	s.mu.Lock()
+	s.subs[sub] = true
+	s.mu.Unlock()
+	return sub, nil
+}
+
+func (s *memStore) Ping() error {
+	return nil
+}
+
+func (s *memStore) Close() error {
+	close(s.done)
+	return nil
+}
+
+// matches returns true when the subscription receives a channel
+func (sub *memSubscription) matches(channel string) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.channels[channel] {
+		return true
+	}
+	for _, pattern := range sub.patterns {
+		if match.Match(channel, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sub *memSubscription) Subscribe(channels ...string) error {
+	sub.mu.Lock()
+	for _, channel := range channels {
+		sub.channels[channel] = true
+	}
+	sub.mu.Unlock()
+	return nil
+}
+
+func (sub *memSubscription) Unsubscribe(channels ...string) error {
+	sub.mu.Lock()
+	for _, channel := range channels {
+		delete(sub.channels, channel)
+	}
+	sub.mu.Unlock()
+	return nil
+}
+
+func (sub *memSubscription) Receive() (channel string, data []byte, err error) {
+	select {
+	case msg := <-sub.msgs:
+		return msg[0], []byte(msg[1]), nil
+	case <-sub.closed:
+		return "", nil, errSubscriptionClosed
+	}
+}
+
+func (sub *memSubscription) Close() error {
+	sub.once.Do(func() {
+		sub.s.mu.Lock()
+		delete(sub.s.subs, sub)
+		sub.s.mu.Unlock()
+		close(sub.closed)
+	})
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// point returns the feature of an object at a point
+func point(id string, lat, lng float64) string {
+	return testFeature(id, lat, lng)
+}
+
+// receiveTest returns the next notification of a subscription
+func receiveTest(t *testing.T, sub Subscription) (string, string) {
+	t.Helper()
+	type msg struct {
+		channel string
+		data    []byte
+		err     error
+	}
+	c := make(chan msg, 1)
+	go func() {
+		channel, data, err := sub.Receive()
+		c <- msg{channel, data, err}
+	}()
+	select {
+	case m := <-c:
+		if m.err != nil {
+			t.Fatal(m.err)
+		}
+		return m.channel, string(m.data)
+	case <-time.After(testWait):
+		t.Fatal("no notification")
+	}
+	return "", ""
+}
+
+func TestMemStoreFeatures(t *testing.T) {
+	var s GeoStore = newMemStore()
+	defer s.Close()
+	if err := s.SetFeature("people", "a", point("a", 39.74, -104.99), 0); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := s.GetFeature("people", "a"); err != nil || gjson.Get(obj, "id").String() != "a" {
+		t.Fatalf("got %q, %v", obj, err)
+	}
+	if _, err := s.GetFeature("people", "b"); err != ErrNotFound {
+		t.Fatalf("missing object: got %v", err)
+	}
+	if err := s.Expire("people", "b", time.Second); err != ErrNotFound {
+		t.Fatalf("expire of a missing object: got %v", err)
+	}
+	if err := s.DelFeature("people", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetFeature("people", "a"); err != ErrNotFound {
+		t.Fatalf("deleted object: got %v", err)
+	}
+}
+
+func TestMemStoreTTL(t *testing.T) {
+	var s GeoStore = newMemStore()
+	defer s.Close()
+	s.SetFeature("people", "a", point("a", 39.74, -104.99), time.Millisecond)
+	s.SetFeature("people", "b", point("b", 39.74, -104.99), 0)
+	s.Expire("people", "b", time.Millisecond)
+	waitFor(t, func() bool {
+		_, errA := s.GetFeature("people", "a")
+		_, errB := s.GetFeature("people", "b")
+		return errA == ErrNotFound && errB == ErrNotFound
+	})
+}
+
+func TestMemStoreSearches(t *testing.T) {
+	var s GeoStore = newMemStore()
+	defer s.Close()
+	s.SetFeature("people", "far", point("far", 39.75, -104.99), 0)
+	s.SetFeature("people", "near", point("near", 39.7401, -104.99), 0)
+	s.SetFeature("people", "away", point("away", 40.5, -104.99), 0)
+	objs, err := s.Nearby("people", 39.74, -104.99, 2000, Search{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := objectIDs(objs); len(ids) != 2 || ids[0] != "near" || ids[1] != "far" {
+		t.Fatalf("nearby: got %v, want closest first", ids)
+	}
+	if objs[0].Object == "" {
+		t.Fatal("nearby: missing object")
+	}
+	objs, _ = s.Nearby("people", 39.74, -104.99, 2000, Search{Limit: 1, IDs: true})
+	if len(objs) != 1 || objs[0].ID != "near" || objs[0].Object != "" {
+		t.Fatalf("limited ids: got %v", objs)
+	}
+	if objs, err := s.Nearby("nobody", 39.74, -104.99, 2000, Search{}); err != nil || len(objs) != 0 {
+		t.Fatalf("missing collection: got %v, %v", objs, err)
+	}
+
+	bounds := &protocol.Bounds{
+		SW: protocol.LatLng{Lat: 39.7, Lng: -105},
+		NE: protocol.LatLng{Lat: 39.8, Lng: -104.9},
+	}
+	objs, _ = s.Intersects("people", Area{Bounds: bounds}, Search{IDs: true})
+	if ids := objectIDs(objs); len(ids) != 2 || ids[0] != "far" || ids[1] != "near" {
+		t.Fatalf("intersects bounds: got %v", ids)
+	}
+	area := `{"type":"Polygon","coordinates":[[[-105,39.745],[-104.9,39.745],[-104.9,39.8],[-105,39.8],[-105,39.745]]]}`
+	objs, _ = s.Intersects("people", Area{Object: area}, Search{IDs: true})
+	if ids := objectIDs(objs); len(ids) != 1 || ids[0] != "far" {
+		t.Fatalf("intersects object: got %v", ids)
+	}
+}
+
+func TestMemStoreObjectFence(t *testing.T) {
+	s := newMemStore()
+	defer s.Close()
+	area := `{"type":"Polygon","coordinates":[[[-105,39.7],[-104.9,39.7],[-104.9,39.8],[-105,39.8],[-105,39.7]]]}`
+	if err := s.SetFence("room-chan:test", Fence{Key: "people", Object: area}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := s.Subscribe(nil, []string{"room-chan:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for _, want := range []struct {
+		lat    float64
+		detect string
+	}{{39.75, "enter"}, {39.76, "inside"}, {39.9, "exit"}, {39.75, "enter"}} {
+		s.SetFeature("people", "a", point("a", want.lat, -104.95), 0)
+		channel, data := receiveTest(t, sub)
+		if channel != "room-chan:test" || gjson.Get(data, "detect").String() != want.detect {
+			t.Fatalf("at %v: got %s %s, want %s", want.lat, channel, data, want.detect)
+		}
+	}
+	s.DelFeature("people", "a")
+	_, data := receiveTest(t, sub)
+	if gjson.Get(data, "command").String() != "del" || gjson.Get(data, "detect").String() != "exit" {
+		t.Fatalf("delete: got %s", data)
+	}
+
+	if names, _ := s.Channels("room-chan:*"); len(names) != 1 || names[0] != "room-chan:test" {
+		t.Fatalf("channels: got %v", names)
+	}
+	s.DelFence("room-chan:test")
+	if names, _ := s.Channels("*"); len(names) != 0 {
+		t.Fatalf("channels after delete: got %v", names)
+	}
+}
+
+func TestMemStoreCircleFence(t *testing.T) {
+	s := newMemStore()
+	defer s.Close()
+	center := &protocol.LatLng{Lat: 39.74, Lng: -104.99}
+	s.SetFence("watch:test", Fence{Key: "people", Center: center, Radius: 100})
+	sub, _ := s.Subscribe([]string{"watch:test"}, nil)
+	defer sub.Close()
+	s.SetFeature("people", "a", point("a", 39.7401, -104.99), 0)
+	if _, data := receiveTest(t, sub); gjson.Get(data, "detect").String() != "enter" {
+		t.Fatalf("got %s, want enter", data)
+	}
+	// circle fences do not notify inside
+	s.SetFeature("people", "a", point("a", 39.7402, -104.99), 0)
+	s.SetFeature("people", "a", point("a", 39.75, -104.99), 0)
+	if _, data := receiveTest(t, sub); gjson.Get(data, "detect").String() != "exit" {
+		t.Fatalf("got %s, want exit", data)
+	}
+}
+
+func TestMemStoreRoamFence(t *testing.T) {
+	s := newMemStore()
+	defer s.Close()
+	s.SetFence("roam-chan", Fence{Key: "people", Roam: 100})
+	sub, _ := s.Subscribe([]string{"roam-chan"}, nil)
+	defer sub.Close()
+	s.SetFeature("people", "a", point("a", 39.74, -104.99), 0)
+	s.SetFeature("people", "b", point("b", 39.7401, -104.99), 0)
+	_, data := receiveTest(t, sub)
+	if gjson.Get(data, "id").String() != "b" || gjson.Get(data, "nearby.id").String() != "a" {
+		t.Fatalf("got %s, want b nearby a", data)
+	}
+	if m := gjson.Get(data, "nearby.meters").Float(); m < 10 || m > 12 {
+		t.Fatalf("got %v meters", m)
+	}
+	s.SetFeature("people", "b", point("b", 39.75, -104.99), 0)
+	_, data = receiveTest(t, sub)
+	if gjson.Get(data, "id").String() != "b" || gjson.Get(data, "faraway.id").String() != "a" {
+		t.Fatalf("got %s, want b faraway from a", data)
+	}
+}
+
+func TestMemStoreSubscription(t *testing.T) {
+	s := newMemStore()
+	defer s.Close()
+	sub, _ := s.Subscribe(nil, nil)
+	if err := sub.Subscribe("roam-chan"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetFence("roam-chan", Fence{Key: "people", Roam: 100})
+	s.SetFence("other", Fence{Key: "people", Roam: 100})
+	s.SetFeature("people", "a", point("a", 39.74, -104.99), 0)
+	s.SetFeature("people", "b", point("b", 39.7401, -104.99), 0)
+	if channel, _ := receiveTest(t, sub); channel != "roam-chan" {
+		t.Fatalf("got %s", channel)
+	}
+	sub.Close()
+	if _, _, err := sub.Receive(); err != errSubscriptionClosed {
+		t.Fatalf("receive on a closed subscription: got %v", err)
+	}
+}
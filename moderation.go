@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// defaultBan is how long a kicked person is banned when the kick API is not
+// given a ban duration
+const defaultBan = 10 * time.Minute
+
+// The block modes. A blocked person is hidden entirely, a muted person only
+// has their chat messages hidden.
+const (
+	modeBlock = "block"
+	modeMute  = "mute"
+)
+
+var (
+	blockmu sync.Mutex                   // guard blockM
+	blockM  map[string]map[string]string // clientID -> secure id -> mode
+)
+
+// blocksKey returns the Redis key of the block list of a person
+func blocksKey(clientID string) string {
+	return "blocks:" + clientID
+}
+
+// banKey returns the Redis key of the ban of a person
+func banKey(clientID string) string {
+	return "ban:" + clientID
+}
+
+// blockMessage is a websocket message handler that blocks or mutes a person
+// for the sender. Block lists are kept in Redis and survive reconnects.
+func blockMessage(connID, msg string) {
+	var b protocol.Block
+	if err := protocol.Decode(msg, &b); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	clientID, ok := blockClient(connID, b.ID)
+	if !ok {
+		return
+	}
+	mode := modeBlock
+	if b.Mute {
+		mode = modeMute
+	}
+	if _, err := storeDo("HSET", blocksKey(clientID), b.ID, mode); err != nil {
+		lg.Error("block failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Block could not be stored")
+		return
+	}
+	if blocks := loadBlocks(clientID); blocks != nil {
+		blockmu.Lock()
+		blocks[b.ID] = mode
+		blockmu.Unlock()
+	}
+}
+
+// unblockMessage is a websocket message handler that removes a person from
+// the block list of the sender
+func unblockMessage(connID, msg string) {
+	var b protocol.Block
+	if err := protocol.Decode(msg, &b); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	clientID, ok := blockClient(connID, b.ID)
+	if !ok {
+		return
+	}
+	if _, err := storeDo("HDEL", blocksKey(clientID), b.ID); err != nil {
+		lg.Error("unblock failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Block could not be removed")
+		return
+	}
+	blocks := loadBlocks(clientID)
+	blockmu.Lock()
+	delete(blocks, b.ID)
+	blockmu.Unlock()
+}
+
+// blockClient returns the clientID of a connection that sent a Block or
+// Unblock for the target, or sends an error to the connection
+func blockClient(connID, target string) (string, bool) {
+	if !validClientID(target) {
+		sendError(connID, "invalid_id", "Id must be 24 hex characters")
+		return "", false
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Block")
+		return "", false
+	}
+	return clientID, true
+}
+
+// loadBlocks returns the block list of a person, reading it from Redis the
+// first time
+func loadBlocks(clientID string) map[string]string {
+	blockmu.Lock()
+	blocks, ok := blockM[clientID]
+	blockmu.Unlock()
+	if ok {
+		return blocks
+	}
+	blocks, err := redis.StringMap(storeDo("HGETALL", blocksKey(clientID)))
+	if err != nil {
+		lg.Error("block list lookup failed", "client", clientID, "err", err)
+		return nil
+	}
+	blockmu.Lock()
+	if cached, ok := blockM[clientID]; ok {
+		blocks = cached
+	} else {
+		blockM[clientID] = blocks
+	}
+	blockmu.Unlock()
+	return blocks
+}
+
+// hidden returns true when a frame must not be delivered to a person because
+// it shows someone on their block list
+func hidden(clientID, msg string) bool {
+	sender := gjson.Get(msg, "feature.id")
+	if !sender.Exists() {
+		sender = gjson.Get(msg, "from")
+	}
+	if !sender.Exists() {
+		sender = gjson.Get(msg, "id")
+	}
+	if sender.String() == "" {
+		return false
+	}
+	blocks := loadBlocks(clientID)
+	blockmu.Lock()
+	mode, ok := blocks[sender.String()]
+	blockmu.Unlock()
+	if !ok {
+		return false
+	}
+	if mode == modeMute {
+		switch gjson.Get(msg, "type").String() {
+		case protocol.TypeMessage, protocol.TypeDirectMessage, protocol.TypeGroupMessage, protocol.TypeRTCOffer:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// hiddenConn is hidden for the person of a connection
+func hiddenConn(connID, msg string) bool {
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	return clientID != "" && hidden(clientID, msg)
+}
+
+// forgetBlocks drops the cached block list of a person
+func forgetBlocks(clientID string) {
+	blockmu.Lock()
+	delete(blockM, clientID)
+	blockmu.Unlock()
+}
+
+// banned returns true while a person is banned
+func banned(clientID string) bool {
+	n, err := redis.Int(storeDo("EXISTS", banKey(clientID)))
+	if err != nil {
+		lg.Error("ban lookup failed", "client", clientID, "err", err)
+		return false
+	}
+	return n > 0
+}
+
+// kickClient closes the connection of a person on this instance and ends
+// their session. Returns false when the person is not known to this instance.
+func kickClient(clientID string) bool {
+	idmu.Lock()
+	connID, connected := clientConnM[clientID]
+	idmu.Unlock()
+	suspended := endSession(clientID)
+	if connected {
+		sendError(connID, "kicked", "Removed by a moderator")
+		h.Close(connID)
+	} else if suspended {
+		removePerson(clientID)
+	}
+	return connected || suspended
+}
+
+// kickAPI is an HTTP handler that removes a person from the chat on every
+// instance and bans them for a while.
+//
+//	POST /api/kick/{id}?ban=10m  kick a person, ban=0 kicks without a ban
+func kickAPI(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.TrimPrefix(r.URL.Path, "/api/kick/")
+	if !validClientID(clientID) {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ban := defaultBan
+	if s := r.URL.Query().Get("ban"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid ban duration", http.StatusBadRequest)
+			return
+		}
+		ban = d
+	}
+	if ban >= time.Second {
+		_, err := storeDo("SET", banKey(clientID), 1, "EX", int(ban/time.Second))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	kickClient(clientID)
+	msg, _ := sjson.Set(`{}`, "id", clientID)
+	publish(`{"kind":"kick"}`, msg)
+	kick, _ := sjson.Set(msg, "ban", ban.String())
+	auditRequest(r, "kick", kick)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestBannedConnection(t *testing.T) {
+	a := testID(1)
+	c := joinTest(t, a, 39.7425, -104.9965)
+	if _, err := storeDo("SET", banKey(a), 1, "EX", 60); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storeDo("DEL", banKey(a)) })
+	c.send(testFeature(a, 39.7426, -104.9965))
+	if e := c.expect("Error"); gjson.Get(e, "code").String() != "banned" {
+		t.Fatalf("got %s, want the connection turned away", e)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// The MQTT bridge settings
+const (
+	deviceTTL      = 5 * time.Minute  // how long the position of a device is kept without an update
+	mqttTimeout    = 10 * time.Second // timeout of connecting to the broker
+	maxPayloadSize = 4096             // bytes of a position payload
+)
+
+var mqttClient mqtt.Client // the MQTT client, nil when the bridge is disabled
+
+// deviceClientID returns the clientID of a device, which is derived from its
+// name so that devices cannot take the ids of people
+func deviceClientID(name string) string {
+	b := md5.Sum([]byte("device:" + name))
+	return hex.EncodeToString(b[:12])
+}
+
+// startMQTT connects to the MQTT broker when one is configured and subscribes
+// to the position topic. Each connect subscribes again, so that the bridge
+// keeps working after the broker restarts.
+func startMQTT() error {
+	if cfg.MQTTBroker == "" {
+		return nil
+	}
+	broker, _ := url.Parse(cfg.MQTTBroker)
+	opts := mqtt.NewClientOptions().
+		SetClientID("proximity-chat-" + instanceID).
+		SetAutoReconnect(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			lg.Warn("mqtt connection lost", "err", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			token := c.Subscribe(cfg.MQTTTopic, 0, devicePosition)
+			if token.WaitTimeout(mqttTimeout) && token.Error() != nil {
+				lg.Error("mqtt subscribe failed", "topic", cfg.MQTTTopic, "err", token.Error())
+			}
+		})
+	if user := broker.User; user != nil {
+		opts.SetUsername(user.Username())
+		if password, ok := user.Password(); ok {
+			opts.SetPassword(password)
+		}
+		broker.User = nil
+	}
+	opts.AddBroker(broker.String())
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("mqtt connect timed out")
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	mqttClient = client
+	lg.Info("mqtt connected", "broker", broker.Host, "topic", cfg.MQTTTopic)
+	return nil
+}
+
+// stopMQTT disconnects from the MQTT broker
+func stopMQTT() {
+	if mqttClient != nil {
+		mqttClient.Disconnect(250)
+	}
+}
+
+// devicePosition is an MQTT message handler that stores the position of a
+// device in the people collection of the default namespace. The device name
+// is the part of the topic at the first + of the topic pattern.
+func devicePosition(_ mqtt.Client, m mqtt.Message) {
+	name := topicDevice(cfg.MQTTTopic, m.Topic())
+	if name == "" || len(m.Payload()) > maxPayloadSize {
+		return
+	}
+	clientID := deviceClientID(name)
+	feature, err := deviceFeature(clientID, name, string(m.Payload()))
+	if err != nil {
+		lg.Debug("invalid device position", "topic", m.Topic(), "err", err)
+		return
+	}
+	if err := geo.SetFeature(peopleKey(""), clientID, feature, deviceTTL); err != nil {
+		lg.Error("device position failed", "device", name, "err", err)
+	}
+}
+
+// topicDevice returns the part of a topic at the first + of a pattern
+func topicDevice(pattern, topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range strings.Split(pattern, "/") {
+		if level == "+" && i < len(levels) {
+			return levels[i]
+		}
+	}
+	return ""
+}
+
+// deviceFeature converts a position payload to the feature of a device. The
+// payload is either a GeoJSON Point feature or an object with "lat" and
+// "lon" or "lng", such as an OwnTracks location. The feature has "device"
+// and "kind" properties to tell devices from people.
+func deviceFeature(clientID, name, payload string) (string, error) {
+	if !gjson.Valid(payload) {
+		return "", errors.New("payload is not JSON")
+	}
+	var feature string
+	if gjson.Get(payload, "type").String() == "Feature" {
+		feature = payload
+	} else {
+		lat := gjson.Get(payload, "lat")
+		lng := gjson.Get(payload, "lon")
+		if !lng.Exists() {
+			lng = gjson.Get(payload, "lng")
+		}
+		if lat.Type != gjson.Number || lng.Type != gjson.Number {
+			return "", errors.New("payload has no lat and lon")
+		}
+		feature = `{"type":"Feature","geometry":{"type":"Point","coordinates":[` +
+			strconv.FormatFloat(lng.Float(), 'f', -1, 64) + `,` +
+			strconv.FormatFloat(lat.Float(), 'f', -1, 64) + `]}}`
+	}
+	feature, _ = sjson.Set(feature, "id", clientID)
+	feature, _ = sjson.Set(feature, "properties.device", name)
+	feature, _ = sjson.Set(feature, "properties.kind", "device")
+	if err := validatePoint(feature); err != nil {
+		return "", err
+	}
+	return feature, nil
+}
+
+// mqttEvent republishes a geofence event of a device to the events topic, as
+// <events>/<device>/<type>: the device entering or leaving a room, and people
+// or other devices coming near it or going away. All instances see the same
+// Tile38 notification, so the event is claimed in Redis and only published
+// by the first instance to claim it.
+func mqttEvent(typ, ns, room, msg string) {
+	if mqttClient == nil || cfg.MQTTEvents == "" {
+		return
+	}
+	device := gjson.Get(msg, "object.properties.device").String()
+	if device == "" {
+		return
+	}
+	other := gjson.Get(msg, "nearby")
+	if !other.Exists() {
+		other = gjson.Get(msg, "faraway")
+	}
+	if isHidden(other.Get("object").Raw) {
+		return
+	}
+	if _, ok := claimRoomEvent("mqtt", typ, namespaceRoom(ns, room)+"\x00"+other.Get("id").String(), msg); !ok {
+		return
+	}
+
+	event := `{}`
+	event, _ = sjson.Set(event, "type", typ)
+	event, _ = sjson.Set(event, "device", device)
+	event, _ = sjson.Set(event, "time", gjson.Get(msg, "time").String())
+	if room != "" {
+		event, _ = sjson.Set(event, "room", room)
+	} else {
+		// the person or device that came near or went away
+		event, _ = sjson.Set(event, "nearby", secureClientID(other.Get("id").String()))
+		event, _ = sjson.SetRaw(event, "feature", secureFeature(other.Get("object").Raw))
+	}
+	mqttClient.Publish(cfg.MQTTEvents+"/"+device+"/"+typ, 0, false, event)
+}
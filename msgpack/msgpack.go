@@ -0,0 +1,290 @@
+// Package msgpack transcodes between JSON and MessagePack. It covers the
+// subset of MessagePack that JSON values map to, which is all that the chat
+// protocol needs, so that binary clients exchange the same messages as JSON
+// clients in a more compact form.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ErrShort is returned when decoding data that ends in the middle of a value
+var ErrShort = errors.New("msgpack: unexpected end of data")
+
+// FromJSON transcodes a JSON value to MessagePack. Integers are encoded as
+// integers, all other numbers as 64 bit floats. Object keys are sorted.
+func FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return appendValue(nil, v)
+}
+
+// ToJSON transcodes a MessagePack value to JSON. Binary values become base64
+// strings and map keys that are not strings are formatted as strings.
+func ToJSON(data []byte) ([]byte, error) {
+	v, rest, err := readValue(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return json.Marshal(v)
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendInt(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(f)), nil
+	case string:
+		return appendString(b, v), nil
+	case []interface{}:
+		b = appendHeader(b, len(v), 0x90, 15, 0xdc)
+		var err error
+		for _, item := range v {
+			if b, err = appendValue(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = appendHeader(b, len(v), 0x80, 15, 0xde)
+		var err error
+		for _, key := range keys {
+			b = appendString(b, key)
+			if b, err = appendValue(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+// appendHeader appends the header of an array or map. Small lengths are
+// packed into the fix byte, others use the 16 bit code or the 32 bit code
+// that follows it.
+func appendHeader(b []byte, n int, fix byte, fixMax int, code16 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, code16, byte(n>>8), byte(n))
+	}
+	return appendUint32(append(b, code16+1), uint32(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = appendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 127:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return append(b, 0xd1, byte(n>>8), byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return appendUint32(append(b, 0xd2), uint32(n))
+	}
+	return appendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], n)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[:]...)
+}
+
+// readValue reads a single value and returns it with the data that follows
+func readValue(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrShort
+	}
+	c, b := b[0], b[1:]
+	switch {
+	case c <= 0x7f:
+		return int64(c), b, nil
+	case c >= 0xe0:
+		return int64(int8(c)), b, nil
+	case c >= 0x80 && c <= 0x8f:
+		return readMap(b, int(c&0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return readArray(b, int(c&0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		return readString(b, int(c&0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, b, err := readLength(b, c-0xc4)
+		if err != nil || len(b) < n {
+			return nil, nil, ErrShort
+		}
+		return append([]byte(nil), b[:n]...), b[n:], nil
+	case 0xca:
+		if len(b) < 4 {
+			return nil, nil, ErrShort
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+	case 0xcb:
+		if len(b) < 8 {
+			return nil, nil, ErrShort
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		size := 1 << (c - 0xcc)
+		if len(b) < size {
+			return nil, nil, ErrShort
+		}
+		var n uint64
+		for _, x := range b[:size] {
+			n = n<<8 | uint64(x)
+		}
+		return n, b[size:], nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		if len(b) < size {
+			return nil, nil, ErrShort
+		}
+		var n uint64
+		for _, x := range b[:size] {
+			n = n<<8 | uint64(x)
+		}
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, b[size:], nil
+	case 0xd9, 0xda, 0xdb:
+		n, b, err := readLength(b, c-0xd9)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readString(b, n)
+	case 0xdc, 0xdd:
+		n, b, err := readLength(b, c-0xdc+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readArray(b, n)
+	case 0xde, 0xdf:
+		n, b, err := readLength(b, c-0xde+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMap(b, n)
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported code 0x%02x", c)
+}
+
+// readLength reads a big endian length of 1, 2 or 4 bytes, for a size of 0,
+// 1 or 2
+func readLength(b []byte, size byte) (int, []byte, error) {
+	n := 1 << size
+	if len(b) < n {
+		return 0, nil, ErrShort
+	}
+	var length int
+	for _, x := range b[:n] {
+		length = length<<8 | int(x)
+	}
+	return length, b[n:], nil
+}
+
+func readString(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, ErrShort
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func readArray(b []byte, n int) (interface{}, []byte, error) {
+	if n > len(b) {
+		return nil, nil, ErrShort // every item takes at least a byte
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		if items[i], b, err = readValue(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return items, b, nil
+}
+
+func readMap(b []byte, n int) (interface{}, []byte, error) {
+	if 2*n > len(b) {
+		return nil, nil, ErrShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, rest, err := readValue(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		val, rest, err := readValue(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = rest
+		if s, ok := key.(string); ok {
+			m[s] = val
+		} else {
+			m[fmt.Sprint(key)] = val
+		}
+	}
+	return m, b, nil
+}
@@ -0,0 +1,36 @@
+package msgpack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, v := range []string{
+		`{"geometry":{"coordinates":[-104.9965,39.7425],"type":"Point"},"id":"a","type":"Feature"}`,
+		`{"big":4294967296,"min":-129,"neg":-1,"null":null,"ok":true}`,
+		`["` + strings.Repeat("x", 300) + `",1.5]`,
+	} {
+		b, err := FromJSON([]byte(v))
+		if err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+		got, err := ToJSON(b)
+		if err != nil {
+			t.Fatalf("%s: %v", v, err)
+		}
+		if string(got) != v {
+			t.Errorf("got %s, want %s", got, v)
+		}
+	}
+}
+
+func TestShort(t *testing.T) {
+	b, _ := FromJSON([]byte(`{"text":"hello"}`))
+	if _, err := ToJSON(b[:len(b)-1]); err != ErrShort {
+		t.Fatalf("got %v, want ErrShort", err)
+	}
+	if _, err := ToJSON(append(b, 0xc0)); err == nil {
+		t.Fatal("want an error for trailing data")
+	}
+}
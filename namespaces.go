@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tile38/proximity-chat/auth"
+)
+
+// Namespaces are independent chat worlds served by the same process. Each
+// namespace has its own people and rooms collections and fence channels in
+// Tile38, and its own fences directory. The default namespace is the empty
+// string and uses the original, unprefixed keys.
+
+// validNamespace matches the names that can be used for namespaces
+var validNamespace = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// errNamespace is returned when a connection asks for an unknown namespace or
+// one that its token is not bound to
+var errNamespace = errors.New("unknown namespace")
+
+var (
+	nsmu      sync.Mutex        // guard connNSM and clientNSM
+	connNSM   map[string]string // connID -> namespace
+	clientNSM map[string]string // clientID -> namespace
+)
+
+// peopleKey returns the Tile38 collection of the people of a namespace
+func peopleKey(ns string) string {
+	if ns == "" {
+		return "people"
+	}
+	return "people:" + ns
+}
+
+// roomsKey returns the Tile38 collection of the room fences of a namespace
+func roomsKey(ns string) string {
+	if ns == "" {
+		return "rooms"
+	}
+	return "rooms:" + ns
+}
+
+// roamChannel returns the Tile38 roaming channel of a namespace
+func roamChannel(ns string) string {
+	if ns == "" {
+		return "roam-chan"
+	}
+	return "roam-chan:" + ns
+}
+
+// namespaceRoom returns the room ID that is used internally for the fence ID
+// of a room in a namespace
+func namespaceRoom(ns, fenceID string) string {
+	if ns == "" {
+		return fenceID
+	}
+	return ns + "/" + fenceID
+}
+
+// splitRoom returns the namespace and the fence ID of an internal room ID
+func splitRoom(roomID string) (ns, fenceID string) {
+	if i := strings.IndexByte(roomID, '/'); i >= 0 {
+		return roomID[:i], roomID[i+1:]
+	}
+	return "", roomID
+}
+
+// localRoom returns the fence ID of an internal room ID, which is how clients
+// in the namespace know the room
+func localRoom(roomID string) string {
+	_, fenceID := splitRoom(roomID)
+	return fenceID
+}
+
+// localRooms returns the fence IDs of internal room IDs
+func localRooms(roomIDs []string) []string {
+	fenceIDs := make([]string, len(roomIDs))
+	for i, roomID := range roomIDs {
+		fenceIDs[i] = localRoom(roomID)
+	}
+	return fenceIDs
+}
+
+// knownNamespace returns true for the default and the configured namespaces
+func knownNamespace(ns string) bool {
+	if ns == "" {
+		return true
+	}
+	for _, name := range cfg.Namespaces {
+		if name == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// allNamespaces returns the default namespace followed by all configured
+// namespaces
+func allNamespaces() []string {
+	return append([]string{""}, cfg.Namespaces...)
+}
+
+// requestNamespace returns the namespace of a websocket upgrade request, taken
+// from the path after /ws/ or from the "ns" claim of the token. When both are
+// given they must match.
+func requestNamespace(r *http.Request) (string, error) {
+	ns := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws"), "/")
+	if verifier != nil {
+		if token, err := auth.TokenFromRequest(r); err == nil {
+			if claim := auth.Claim(token, "ns"); claim != "" {
+				if ns != "" && ns != claim {
+					return "", errNamespace
+				}
+				ns = claim
+			}
+		}
+	}
+	if !knownNamespace(ns) {
+		return "", errNamespace
+	}
+	return ns, nil
+}
+
+// bindNamespace binds the namespace of the upgrade request to a connection
+func bindNamespace(connID string, r *http.Request) {
+	ns, _ := requestNamespace(r)
+	if ns == "" {
+		return
+	}
+	nsmu.Lock()
+	connNSM[connID] = ns
+	nsmu.Unlock()
+}
+
+// connNamespace returns the namespace of a connection
+func connNamespace(connID string) string {
+	nsmu.Lock()
+	defer nsmu.Unlock()
+	return connNSM[connID]
+}
+
+// clientNamespace returns the namespace of a person
+func clientNamespace(clientID string) string {
+	nsmu.Lock()
+	defer nsmu.Unlock()
+	return clientNSM[clientID]
+}
+
+// bindClientNamespace records the namespace of a person. Returns false when
+// the person is already present in another namespace.
+func bindClientNamespace(clientID, ns string) bool {
+	nsmu.Lock()
+	defer nsmu.Unlock()
+	if prev, ok := clientNSM[clientID]; ok && prev != ns {
+		return false
+	}
+	clientNSM[clientID] = ns
+	return true
+}
+
+// forgetNamespace removes the namespace of a connection
+func forgetNamespace(connID string) {
+	nsmu.Lock()
+	delete(connNSM, connID)
+	nsmu.Unlock()
+}
+
+// forgetClientNamespace removes the namespace of a person
+func forgetClientNamespace(clientID string) {
+	nsmu.Lock()
+	delete(clientNSM, clientID)
+	nsmu.Unlock()
+}
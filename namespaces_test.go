@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNamespacePath(t *testing.T) {
+	id := testID(1)
+	c := dialTest(t, "/ws/campus", nil)
+	c.expect("Session")
+	c.send(testFeature(id, 39.7425, -104.9965))
+	waitFor(t, func() bool {
+		_, err := geo.GetFeature(peopleKey("campus"), id)
+		return err == nil
+	})
+	if _, err := geo.GetFeature(peopleKey(""), id); err != ErrNotFound {
+		t.Fatalf("person of the namespace in the default one: got %v", err)
+	}
+}
+
+func TestUnknownNamespacePath(t *testing.T) {
+	url := "ws" + strings.TrimPrefix(testServer(t), "http") + "/ws/nowhere"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("dial of an unknown namespace succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %v, want 404", resp)
+	}
+}
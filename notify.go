@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// batchVersion is the first protocol version that receives notifications in
+// FeatureCollection batches
+const batchVersion = 2
+
+// notifyBuffer holds the notifications of a connection that wait for the end
+// of the batch window. A later notification about the same feature replaces
+// the earlier one in its place.
+type notifyBuffer struct {
+	msgs  []string
+	index map[string]int // coalescing key -> position in msgs
+	timer *time.Timer
+}
+
+var (
+	notifymu sync.Mutex               // guard notifyM
+	notifyM  map[string]*notifyBuffer // connID -> pending notifications
+)
+
+// sendNotification sends a notification to a connection, batched with the
+// other notifications of the window when the connection supports batches
+func sendNotification(connID, msg string) {
+	if live().NotifyWindow <= 0 || connVersion(connID) < batchVersion {
+		send(connID, msg)
+		return
+	}
+	key := gjson.Get(msg, "room").String() + ":" + gjson.Get(msg, "feature.id").String()
+	notifymu.Lock()
+	defer notifymu.Unlock()
+	buf, ok := notifyM[connID]
+	if !ok {
+		buf = &notifyBuffer{index: make(map[string]int)}
+		buf.timer = time.AfterFunc(notifyWindow(), func() { flushNotifications(connID) })
+		notifyM[connID] = buf
+	}
+	if i, ok := buf.index[key]; ok {
+		buf.msgs[i] = msg
+		return
+	}
+	buf.index[key] = len(buf.msgs)
+	buf.msgs = append(buf.msgs, msg)
+}
+
+// notifyClient is sendClient for notifications
+func notifyClient(clientID, msg string) bool {
+	idmu.Lock()
+	connID, connected := clientConnM[clientID]
+	idmu.Unlock()
+	if !connected {
+		return sendClient(clientID, msg)
+	}
+	if !hidden(clientID, msg) {
+		sendNotification(connID, msg)
+	}
+	return true
+}
+
+// flushNotifications sends the pending notifications of a connection as a
+// single frame
+func flushNotifications(connID string) {
+	notifymu.Lock()
+	buf, ok := notifyM[connID]
+	delete(notifyM, connID)
+	notifymu.Unlock()
+	if !ok || len(buf.msgs) == 0 {
+		return
+	}
+	if len(buf.msgs) == 1 {
+		send(connID, buf.msgs[0])
+		return
+	}
+	fc := protocol.FeatureCollection{
+		Envelope:      protocol.Envelope{Type: protocol.TypeFeatureCollection},
+		Notifications: make([]json.RawMessage, len(buf.msgs)),
+	}
+	for i, msg := range buf.msgs {
+		fc.Notifications[i] = json.RawMessage(msg)
+	}
+	msg, _ := protocol.Encode(fc)
+	send(connID, msg)
+}
+
+// forgetNotifications drops the pending notifications of a connection
+func forgetNotifications(connID string) {
+	notifymu.Lock()
+	if buf, ok := notifyM[connID]; ok {
+		buf.timer.Stop()
+		delete(notifyM, connID)
+	}
+	notifymu.Unlock()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// rect is a bounding box on the map
+type rect struct {
+	minLat, minLng, maxLat, maxLng float64
+}
+
+// intersects returns true when the boxes overlap
+func (r rect) intersects(o rect) bool {
+	return r.minLat <= o.maxLat && o.minLat <= r.maxLat &&
+		r.minLng <= o.maxLng && o.minLng <= r.maxLng
+}
+
+var (
+	viewportmu sync.Mutex      // guard viewportM
+	viewportM  map[string]rect // connID -> bounding box of its viewport
+)
+
+// metersPerDegree is the length of a degree of latitude
+const metersPerDegree = 111320
+
+// viewportRect returns the bounding box of a viewport
+func viewportRect(vp *protocol.Viewport) rect {
+	switch {
+	case vp.Polygon != nil:
+		var rings [][][]float64
+		json.Unmarshal(vp.Polygon.Coordinates, &rings)
+		r := emptyRect()
+		for _, pt := range rings[0] {
+			if len(pt) >= 2 {
+				r = r.extend(pt[1], pt[0])
+			}
+		}
+		return r
+	case vp.Center != nil:
+		dlat := vp.Radius / metersPerDegree
+		dlng := 180.0
+		if cos := math.Cos(vp.Center.Lat * math.Pi / 180); cos > 0.01 {
+			dlng = math.Min(dlat/cos, 180)
+		}
+		return rect{
+			vp.Center.Lat - dlat, vp.Center.Lng - dlng,
+			vp.Center.Lat + dlat, vp.Center.Lng + dlng,
+		}
+	}
+	b := vp.Bounds
+	return rect{b.SW.Lat, b.SW.Lng, b.NE.Lat, b.NE.Lng}
+}
+
+// fenceRect returns the bounding box of a GeoJSON fence object
+func fenceRect(object string) rect {
+	r := emptyRect()
+	var walk func(v gjson.Result)
+	walk = func(v gjson.Result) {
+		arr := v.Array()
+		if len(arr) >= 2 && arr[0].Type == gjson.Number {
+			r = r.extend(arr[1].Float(), arr[0].Float())
+			return
+		}
+		for _, c := range arr {
+			walk(c)
+		}
+	}
+	walk(gjson.Get(object, "geometry.coordinates"))
+	return r
+}
+
+// emptyRect returns a box that intersects nothing until it is extended
+func emptyRect() rect {
+	return rect{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+// extend returns the box grown to contain a point
+func (r rect) extend(lat, lng float64) rect {
+	return rect{
+		math.Min(r.minLat, lat), math.Min(r.minLng, lng),
+		math.Max(r.maxLat, lat), math.Max(r.maxLng, lng),
+	}
+}
+
+// trackViewport records the viewport of a connection
+func trackViewport(connID string, vp *protocol.Viewport) {
+	viewportmu.Lock()
+	viewportM[connID] = viewportRect(vp)
+	viewportmu.Unlock()
+}
+
+// forgetViewport removes the viewport of a closed connection
+func forgetViewport(connID string) {
+	viewportmu.Lock()
+	delete(viewportM, connID)
+	viewportmu.Unlock()
+}
+
+// roomAudience returns the connections that are told about changes to a room:
+// the members inside of it and the connections of the namespace of the room
+// whose viewport intersects its fence
+func roomAudience(roomID string) []string {
+	roommu.Lock()
+	room, ok := rooms[roomID]
+	if !ok {
+		roommu.Unlock()
+		return nil
+	}
+	bbox := room.bbox
+	members := make([]string, 0, len(room.members))
+	for clientID := range room.members {
+		members = append(members, clientID)
+	}
+	roommu.Unlock()
+
+	audience := make(map[string]bool)
+	idmu.Lock()
+	for _, clientID := range members {
+		if connID, ok := clientConnM[clientID]; ok {
+			audience[connID] = true
+		}
+	}
+	idmu.Unlock()
+	var viewers []string
+	viewportmu.Lock()
+	for connID, r := range viewportM {
+		if !audience[connID] && r.intersects(bbox) {
+			viewers = append(viewers, connID)
+		}
+	}
+	viewportmu.Unlock()
+	ns, _ := splitRoom(roomID)
+	for _, connID := range viewers {
+		if connNamespace(connID) == ns {
+			audience[connID] = true
+		}
+	}
+
+	connIDs := make([]string, 0, len(audience))
+	for connID := range audience {
+		connIDs = append(connIDs, connID)
+	}
+	return connIDs
+}
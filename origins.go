@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The CORS settings of the REST endpoints
+const (
+	corsMethods = "GET, POST, PUT, DELETE"
+	corsHeaders = "Authorization, Content-Type"
+	corsMaxAge  = "600"
+)
+
+// sameOrigin returns true when an origin is the host of the request itself
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// originAllowed returns true when an origin is on the allowed origins. An
+// allowed origin is "*" for all, an origin such as "https://example.com", or
+// an origin with a wildcard subdomain such as "https://*.example.com". Demo
+// servers allow every origin.
+func originAllowed(origin string) bool {
+	if cfg.Demo {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range live().AllowOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if i := strings.Index(allowed, "://*."); i >= 0 {
+			scheme, domain := allowed[:i+3], allowed[i+4:]
+			if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) &&
+				len(origin) > len(scheme)+len(domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkOrigin is the origin check of the websocket upgrade. Clients that send
+// no origin are not browsers and are let through, browsers must connect from
+// the site of the server or an allowed origin.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(r, origin) || originAllowed(origin) {
+		return true
+	}
+	lg.Debug("origin rejected", "origin", origin, "remote", r.RemoteAddr)
+	return false
+}
+
+// withCORS wraps a REST endpoint so that browsers on allowed origins can call
+// it. Preflight requests are answered here, and cross-site requests from
+// other origins are rejected.
+func withCORS(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			fn(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !originAllowed(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fn(w, r)
+	}
+}
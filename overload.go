@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The overload controller settings
+const (
+	overloadInterval = time.Second      // time between checks of the load
+	overloadCooldown = 10 * time.Second // time the load must stay normal before the overload ends
+	overloadWiden    = 4                // factor the batch windows of notifications grow by
+	overloadIdle     = time.Minute      // time without messages after which a connection is idle
+	overloadRetry    = 30 * time.Second // time rejected connections are told to wait
+)
+
+var overloaded int32 // set to 1 while the server sheds load
+
+var (
+	activemu sync.Mutex           // guard activeM
+	activeM  map[string]time.Time // connID -> time of the last message other than a Viewport
+)
+
+// isOverloaded returns true while the server sheds load
+func isOverloaded() bool {
+	return atomic.LoadInt32(&overloaded) == 1
+}
+
+// overloadEnabled returns true when a threshold of the overload controller
+// is configured
+func overloadEnabled() bool {
+	return cfg.OverloadQueue > 0 || cfg.OverloadPing > 0
+}
+
+// runOverload watches the send queues and the latency of Tile38. While the
+// queues hold more frames per connection than the queue threshold, or Tile38
+// answers a ping slower than the latency threshold, the server sheds load:
+// notification batch windows are widened, the viewports of idle connections
+// are dropped, and new connections are turned away with a retry time.
+func runOverload() {
+	if !overloadEnabled() {
+		return
+	}
+	var calm time.Time // since when the load is normal
+	for range time.Tick(overloadInterval) {
+		queue, latency := measureLoad()
+		high := cfg.OverloadQueue > 0 && queue > cfg.OverloadQueue ||
+			cfg.OverloadPing > 0 && latency > cfg.OverloadPing
+		switch {
+		case high:
+			calm = time.Time{}
+			if atomic.CompareAndSwapInt32(&overloaded, 0, 1) {
+				lg.Warn("overloaded, shedding load", "queue", queue, "latency", latency)
+			}
+		case isOverloaded() && calm.IsZero():
+			calm = time.Now()
+		case isOverloaded() && time.Since(calm) >= overloadCooldown:
+			atomic.StoreInt32(&overloaded, 0)
+			lg.Info("load is back to normal", "queue", queue, "latency", latency)
+		}
+	}
+}
+
+// measureLoad returns the average number of frames in the send queues of the
+// connections and how long Tile38 takes to answer a ping, the ping timeout
+// when it fails
+func measureLoad() (queue float64, latency time.Duration) {
+	if frames, conns := h.Queued(); conns > 0 {
+		queue = float64(frames) / float64(conns)
+	}
+	if cfg.OverloadPing > 0 {
+		start := time.Now()
+		if pingCheck(geo.Ping).Status != "ok" {
+			return queue, pingTimeout
+		}
+		latency = time.Since(start)
+	}
+	return queue, latency
+}
+
+// notifyWindow returns the window in which notifications are batched, wider
+// while the server sheds load
+func notifyWindow() time.Duration {
+	if isOverloaded() {
+		return live().NotifyWindow * overloadWiden
+	}
+	return live().NotifyWindow
+}
+
+// markActive records that a connection sent a message other than a Viewport
+func markActive(connID string) {
+	if !overloadEnabled() {
+		return
+	}
+	activemu.Lock()
+	activeM[connID] = time.Now()
+	activemu.Unlock()
+}
+
+// shedViewport returns true when the viewport of a connection is dropped,
+// which happens to connections that are idle while the server sheds load
+func shedViewport(connID string) bool {
+	if !isOverloaded() {
+		return false
+	}
+	activemu.Lock()
+	active, ok := activeM[connID]
+	activemu.Unlock()
+	return !ok || time.Since(active) > overloadIdle
+}
+
+// forgetActive removes the activity of a closed connection
+func forgetActive(connID string) {
+	activemu.Lock()
+	delete(activeM, connID)
+	activemu.Unlock()
+}
+
+// shedConn turns a new connection away while the server sheds load, with an
+// overloaded error that tells the client when to try again. Connections that
+// resume a session are let in. Returns true when the connection is closed.
+func shedConn(connID, token string) bool {
+	if !isOverloaded() || suspendedSession(token) {
+		return false
+	}
+	msg, _ := protocol.Encode(protocol.Error{
+		Envelope:   protocol.Envelope{Type: protocol.TypeError},
+		Code:       "overloaded",
+		Message:    "Server is overloaded, try again later",
+		RetryAfter: int(overloadRetry / time.Second),
+	})
+	send(connID, msg)
+	h.Close(connID)
+	return true
+}
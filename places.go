@@ -0,0 +1,90 @@
+package main
+
+// maxPlaceDepth is the number of fences a room can be nested in
+const maxPlaceDepth = 8
+
+// The scopes of chat messages
+const (
+	scopeNearby   = "nearby"   // the people within the roaming distance, the default
+	scopeSpecific = "specific" // the people inside the most specific room of the sender
+	scopeBroadest = "broadest" // the people inside the broadest room of the sender
+)
+
+// validScope returns true for the scopes of chat messages
+func validScope(scope string) bool {
+	switch scope {
+	case "", scopeNearby, scopeSpecific, scopeBroadest:
+		return true
+	}
+	return false
+}
+
+// roomParents returns the rooms that a room is nested in, from its parent to
+// the broadest one, by the "parent" property of their fences. A parent that
+// is not a room, or that is the room itself or one of its children, ends the
+// hierarchy.
+func roomParents(roomID string) []string {
+	ns, _ := splitRoom(roomID)
+	roommu.Lock()
+	defer roommu.Unlock()
+	var parents []string
+	seen := map[string]bool{roomID: true}
+	room, ok := rooms[roomID]
+	for ok && room.Parent != "" && len(parents) < maxPlaceDepth {
+		parentID := namespaceRoom(ns, room.Parent)
+		if seen[parentID] {
+			break
+		}
+		if room, ok = rooms[parentID]; ok {
+			seen[parentID] = true
+			parents = append(parents, parentID)
+		}
+	}
+	return parents
+}
+
+// scopeRoom returns the room of the rooms of a sender that a chat message of
+// a scope goes to. The most specific room is the one nested the deepest, or
+// the smallest of overlapping rooms that are not, and the broadest is the
+// broadest room of its hierarchy that the sender is inside of. Returns empty
+// when the sender is in no room.
+func scopeRoom(scope string, roomIDs []string) string {
+	var specific string
+	var depth int
+	var area float64
+	for _, roomID := range roomIDs {
+		d := len(roomParents(roomID))
+		a := rectArea(roomRect(roomID))
+		if specific == "" || d > depth || d == depth && a < area {
+			specific, depth, area = roomID, d, a
+		}
+	}
+	if scope != scopeBroadest || specific == "" {
+		return specific
+	}
+	broadest := specific
+	for _, parentID := range roomParents(specific) {
+		for _, roomID := range roomIDs {
+			if roomID == parentID {
+				broadest = parentID
+			}
+		}
+	}
+	return broadest
+}
+
+// roomRect returns the bounding box of the fence of a room
+func roomRect(roomID string) rect {
+	roommu.Lock()
+	defer roommu.Unlock()
+	if room, ok := rooms[roomID]; ok {
+		return room.bbox
+	}
+	return rect{}
+}
+
+// rectArea returns the area of a bounding box in square degrees, which is
+// enough to tell which of two overlapping fences is smaller
+func rectArea(r rect) float64 {
+	return (r.maxLat - r.minLat) * (r.maxLng - r.minLng)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on polls
+const (
+	defaultPollTTL = 10 * time.Minute // how long a poll is open without a ttl
+	maxPollTTL     = 24 * time.Hour   // longest time a poll is open
+	pollGrace      = time.Minute      // time the results are kept after a poll closes
+	maxPollOptions = 10               // options of a poll
+	maxPollOption  = 100              // characters of an option
+	maxPollSize    = 16 << 10         // bytes of a poll created with the polls API
+)
+
+// pollKey returns the Redis key of a poll, holding the Poll message and the
+// internal ID of its room
+func pollKey(pollID string) string {
+	return "poll:" + pollID
+}
+
+// pollVotesKey returns the Redis key of the votes of a poll, by clientID
+func pollVotesKey(pollID string) string {
+	return "poll:" + pollID + ":votes"
+}
+
+// roomPollsKey returns the Redis key of the polls of a room, by when they
+// close
+func roomPollsKey(roomID string) string {
+	return "polls:" + roomID
+}
+
+// pollMessage is a websocket message handler for new polls. Members of a room
+// ask the room a question, and all members get the poll.
+func pollMessage(connID, msg string) {
+	var p protocol.Poll
+	if err := protocol.Decode(msg, &p); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	roomID := namespaceRoom(connNamespace(connID), p.Room)
+	if clientID == "" || !isInside(clientID, roomID) {
+		sendError(connID, "not_in_room", "Only members of the room can ask it")
+		return
+	}
+	if err := validatePoll(&p); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	if err := filterMessage(clientID, p.Question); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	p.From = secureClientID(clientID)
+	if shadowBanned(clientID) {
+		// only the shadow banned asker sees their poll
+		newPoll(roomID, &p)
+		msg, _ := protocol.Encode(p)
+		send(connID, msg)
+		return
+	}
+	if _, err := openPoll(roomID, &p); err != nil {
+		lg.Error("poll failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Poll could not be created")
+	}
+}
+
+// validatePoll checks the options and ttl of a poll
+func validatePoll(p *protocol.Poll) *validationError {
+	if strings.TrimSpace(p.Question) == "" {
+		return invalid("invalid_poll", "Poll needs a question")
+	}
+	if len(p.Options) < 2 || len(p.Options) > maxPollOptions {
+		return invalid("invalid_poll", "Poll needs 2 to 10 options")
+	}
+	seen := make(map[string]bool, len(p.Options))
+	for _, option := range p.Options {
+		key := strings.ToLower(strings.TrimSpace(option))
+		if key == "" || utf8.RuneCountInString(option) > maxPollOption {
+			return invalid("invalid_poll", "Options must be 1 to 100 characters")
+		}
+		if seen[key] {
+			return invalid("invalid_poll", "Options must be different")
+		}
+		seen[key] = true
+	}
+	if p.TTL < 0 || time.Duration(p.TTL)*time.Second > maxPollTTL {
+		return invalid("invalid_poll", "Poll ttl must be up to a day")
+	}
+	return nil
+}
+
+// newPoll sets the id, room and expiry of a new poll of a room, and returns
+// how long it is open
+func newPoll(roomID string, p *protocol.Poll) time.Duration {
+	ttl := time.Duration(p.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultPollTTL
+	}
+	p.Envelope = protocol.Envelope{Type: protocol.TypePoll}
+	p.ID = newMessageID()
+	p.Room = localRoom(roomID)
+	p.TTL = 0
+	p.Expires = time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	return ttl
+}
+
+// openPoll stores a poll of a room, sends it to the members and closes it
+// once its ttl has passed. Returns the poll message.
+func openPoll(roomID string, p *protocol.Poll) (string, error) {
+	ttl := newPoll(roomID, p)
+	msg, _ := protocol.Encode(p)
+
+	keep := int((ttl + pollGrace) / time.Second)
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HMSET", pollKey(p.ID), "poll", msg, "room", roomID)
+	b.Send("EXPIRE", pollKey(p.ID), keep)
+	b.Send("ZADD", roomPollsKey(roomID), p.Expires, p.ID)
+	b.Send("ZREMRANGEBYSCORE", roomPollsKey(roomID), "-inf", time.Now().UnixNano()/int64(time.Millisecond))
+	b.Send("EXPIRE", roomPollsKey(roomID), keep)
+	if _, err := b.Flush(); err != nil {
+		return "", err
+	}
+	deliver(roomMembers(roomID), msg)
+	time.AfterFunc(ttl, func() { closePoll(p.ID) })
+	return msg, nil
+}
+
+// voteMessage is a websocket message handler for votes. Members of the room
+// of an open poll vote for one of its options, or change their vote, and all
+// members get the new results.
+func voteMessage(connID, msg string) {
+	var v protocol.Vote
+	if err := protocol.Decode(msg, &v); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	poll, roomID, err := loadPoll(v.Poll)
+	if err == redis.ErrNil {
+		sendError(connID, "unknown_poll", "Unknown poll")
+		return
+	} else if err != nil {
+		lg.Error("vote failed", "poll", v.Poll, "err", err)
+		sendError(connID, "unavailable", "Polls are unavailable")
+		return
+	}
+	if ns, _ := splitRoom(roomID); ns != connNamespace(connID) {
+		sendError(connID, "unknown_poll", "Unknown poll")
+		return
+	}
+	if clientID == "" || !isInside(clientID, roomID) {
+		sendError(connID, "not_in_room", "Only members of the room can vote")
+		return
+	}
+	if gjson.Get(poll, "expires").Int() <= time.Now().UnixNano()/int64(time.Millisecond) {
+		sendError(connID, "poll_closed", "Poll is closed")
+		return
+	}
+	if v.Option < 0 || v.Option >= int(gjson.Get(poll, "options.#").Int()) {
+		sendError(connID, "invalid_vote", "Unknown option")
+		return
+	}
+	if shadowBanned(clientID) {
+		shadowVote(connID, clientID, v, poll)
+		return
+	}
+	prev, err := redis.Int(storeDo("HGET", pollVotesKey(v.Poll), clientID))
+	if err == nil && prev == v.Option {
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HSET", pollVotesKey(v.Poll), clientID, v.Option)
+	b.Send("EXPIRE", pollVotesKey(v.Poll), pollKeep(poll))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("vote failed", "poll", v.Poll, "err", err)
+		sendError(connID, "unavailable", "Polls are unavailable")
+		return
+	}
+	results, err := pollResults(v.Poll, poll, false)
+	if err != nil {
+		lg.Error("poll results failed", "poll", v.Poll, "err", err)
+		return
+	}
+	deliver(roomMembers(roomID), results)
+}
+
+// shadowVote answers the vote of a shadow banned person with the results as
+// if it was counted, while only the person receives them. A vote from before
+// the ban moves to the new option.
+func shadowVote(connID, clientID string, v protocol.Vote, poll string) {
+	results, err := pollResults(v.Poll, poll, false)
+	if err != nil {
+		lg.Error("poll results failed", "poll", v.Poll, "err", err)
+		return
+	}
+	if prev, err := redis.Int(storeDo("HGET", pollVotesKey(v.Poll), clientID)); err == nil {
+		if prev == v.Option {
+			return
+		}
+		path := "counts." + strconv.Itoa(prev)
+		results, _ = sjson.Set(results, path, gjson.Get(results, path).Int()-1)
+	}
+	path := "counts." + strconv.Itoa(v.Option)
+	results, _ = sjson.Set(results, path, gjson.Get(results, path).Int()+1)
+	send(connID, results)
+}
+
+// loadPoll returns the Poll message of a poll and the internal ID of its room
+func loadPoll(pollID string) (poll, roomID string, err error) {
+	vals, err := redis.Strings(storeDo("HMGET", pollKey(pollID), "poll", "room"))
+	if err != nil {
+		return "", "", err
+	}
+	if vals[0] == "" {
+		return "", "", redis.ErrNil
+	}
+	return vals[0], vals[1], nil
+}
+
+// pollKeep returns the seconds that the keys of a poll are kept, until a
+// while after it closes
+func pollKeep(poll string) int {
+	expires := time.Unix(0, gjson.Get(poll, "expires").Int()*int64(time.Millisecond))
+	return int((time.Until(expires) + pollGrace) / time.Second)
+}
+
+// pollResults tallies the votes of a poll into a PollResults message
+func pollResults(pollID, poll string, closed bool) (string, error) {
+	votes, err := redis.IntMap(storeDo("HGETALL", pollVotesKey(pollID)))
+	if err != nil {
+		return "", err
+	}
+	counts := make([]int, gjson.Get(poll, "options.#").Int())
+	for _, option := range votes {
+		if option >= 0 && option < len(counts) {
+			counts[option]++
+		}
+	}
+	msg, _ := protocol.Encode(protocol.PollResults{
+		Envelope: protocol.Envelope{Type: protocol.TypePollResults},
+		Poll:     pollID,
+		Room:     gjson.Get(poll, "room").String(),
+		Counts:   counts,
+		Closed:   closed,
+	})
+	return msg, nil
+}
+
+// closePoll sends the final results of a poll to the members of its room
+func closePoll(pollID string) {
+	poll, roomID, err := loadPoll(pollID)
+	if err != nil {
+		return
+	}
+	results, err := pollResults(pollID, poll, true)
+	if err != nil {
+		lg.Error("poll results failed", "poll", pollID, "err", err)
+		return
+	}
+	deliver(roomMembers(roomID), results)
+}
+
+// sendPolls sends a person who entered a room its open polls, each followed
+// by its results so far
+func sendPolls(connID, roomID string) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	pollIDs, err := redis.Strings(storeDo("ZRANGEBYSCORE", roomPollsKey(roomID), "("+strconv.FormatInt(now, 10), "+inf"))
+	if err != nil {
+		return
+	}
+	for _, pollID := range pollIDs {
+		poll, _, err := loadPoll(pollID)
+		if err != nil {
+			continue
+		}
+		send(connID, poll)
+		if results, err := pollResults(pollID, poll, false); err == nil {
+			send(connID, results)
+		}
+	}
+}
+
+// pollsAPI is an HTTP handler for the polls of the operators. The body is
+// a Poll with the room, question, options and ttl, and the namespace of the
+// room.
+//
+//	POST   /api/polls       ask a room
+//	GET    /api/polls/{id}  the poll and its results
+func pollsAPI(w http.ResponseWriter, r *http.Request) {
+	pollID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/polls"), "/")
+	switch {
+	case r.Method == http.MethodPost && pollID == "":
+		var p struct {
+			protocol.Poll
+			Namespace string `json:"namespace"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPollSize)).Decode(&p); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		roomID := namespaceRoom(p.Namespace, p.Room)
+		if !knownNamespace(p.Namespace) || !roomExists(roomID) {
+			http.Error(w, "unknown room", http.StatusNotFound)
+			return
+		}
+		if err := validatePoll(&p.Poll); err != nil {
+			http.Error(w, err.Message, http.StatusBadRequest)
+			return
+		}
+		msg, err := openPoll(roomID, &p.Poll)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(msg))
+	case r.Method == http.MethodGet && pollID != "":
+		poll, _, err := loadPoll(pollID)
+		if err == redis.ErrNil {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		closed := gjson.Get(poll, "expires").Int() <= time.Now().UnixNano()/int64(time.Millisecond)
+		results, err := pollResults(pollID, poll, closed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"poll":` + poll + `,"results":` + results + `}`))
+	case pollID == "":
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
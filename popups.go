@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// maxRoomTTL is the longest time a pop-up room can stay open
+const maxRoomTTL = 7 * 24 * time.Hour
+
+// errRoomExpired is returned when setting the fence of a pop-up room that has
+// already expired
+var errRoomExpired = errors.New("room expired")
+
+// roomExpires returns when the room of a fence object closes, as given by
+// the "expires" property. ok is false for rooms that do not expire.
+func roomExpires(object string) (t time.Time, ok bool) {
+	v := gjson.Get(object, "properties.expires").String()
+	if v == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+// closeRoom closes an expired pop-up room. Its fence and chat history are
+// deleted and its members are told that the room closed. Every instance
+// closes the room on its own, so deleting the fence and history is
+// idempotent.
+func closeRoom(room *Room) {
+	roommu.Lock()
+	if rooms[room.ID] != room {
+		// replaced or deleted in the meantime
+		roommu.Unlock()
+		return
+	}
+	delete(rooms, room.ID)
+	members := make([]string, 0, len(room.members))
+	for clientID := range room.members {
+		members = append(members, clientID)
+	}
+	roommu.Unlock()
+
+	if err := delRoomFence(room.ID); err != nil {
+		lg.Error("room close failed", "room", room.ID, "err", err)
+	}
+	if _, err := storeDo("DEL", historyKey(room.ID), rolesKey(room.ID)); err != nil {
+		lg.Error("room close failed", "room", room.ID, "err", err)
+	}
+	msg, _ := protocol.Encode(protocol.RoomClosed{
+		Envelope: protocol.Envelope{Type: protocol.TypeRoomClosed},
+		Room:     localRoom(room.ID),
+	})
+	for _, clientID := range members {
+		sendClient(clientID, msg)
+	}
+	sendFence(room.ID, "")
+	lg.Info("room closed", "room", room.ID, "members", len(members))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+	_ "net/http/pprof" // registers the profile handlers on the default mux
+	"strings"
+)
+
+// pprofPath is the path prefix of the runtime profiles
+const pprofPath = "/debug/pprof/"
+
+// serverHandler returns the handler of the HTTP server. Importing
+// net/http/pprof registers its handlers on the default mux, so the profiles
+// are only served with the pprof setting, to operators with the admin token.
+func serverHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, pprofPath) {
+			if !cfg.Pprof {
+				http.NotFound(w, r)
+				return
+			}
+			adminOnly(http.DefaultServeMux.ServeHTTP)(w, r)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// typingTTL is how long a typing status lasts without being refreshed
+const typingTTL = 5 * time.Second
+
+// presence is the published status of a person
+type presence struct {
+	status  string
+	expires time.Time
+}
+
+var (
+	presencemu sync.Mutex           // guard presenceM
+	presenceM  map[string]*presence // clientID -> presence
+)
+
+// presenceMessage is a websocket message handler that publishes the status
+// of a person to everyone in the same rooms
+func presenceMessage(connID, msg string) {
+	status := gjson.Get(msg, "status").String()
+	ttl := live().PresenceTTL
+	switch status {
+	case "typing":
+		ttl = typingTTL
+	case "away", "active":
+	default:
+		sendError(connID, "invalid_status", "Status must be typing, away or active")
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Presence")
+		return
+	}
+
+	presencemu.Lock()
+	presenceM[clientID] = &presence{status: status, expires: time.Now().Add(ttl)}
+	presencemu.Unlock()
+	publishPresence(clientID, status, false)
+}
+
+// publishPresence sends the status of a person to everyone else in the rooms
+// that they are inside of
+func publishPresence(clientID, status string, expired bool) {
+	rooms := fencesInside(clientID)
+	if len(rooms) == 0 {
+		return
+	}
+	seen := map[string]bool{clientID: true}
+	var recipients []string
+	for _, roomID := range rooms {
+		for _, member := range roomMembers(roomID) {
+			if !seen[member] {
+				seen[member] = true
+				recipients = append(recipients, member)
+			}
+		}
+	}
+	msg, _ := protocol.Encode(protocol.Presence{
+		Envelope: protocol.Envelope{Type: protocol.TypePresence},
+		ID:       secureClientID(clientID),
+		Status:   status,
+		Rooms:    localRooms(rooms),
+		Expired:  expired,
+	})
+	deliver(recipients, msg)
+}
+
+// expirePresence periodically removes stale statuses, letting the rooms know
+// that the status expired
+func expirePresence() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		var expired []string
+		statuses := make(map[string]string)
+		presencemu.Lock()
+		for clientID, p := range presenceM {
+			if now.After(p.expires) {
+				expired = append(expired, clientID)
+				statuses[clientID] = p.status
+				delete(presenceM, clientID)
+			}
+		}
+		presencemu.Unlock()
+		sort.Strings(expired)
+		for _, clientID := range expired {
+			publishPresence(clientID, statuses[clientID], true)
+		}
+	}
+}
+
+// forgetPresence removes the status of a person
+func forgetPresence(clientID string) {
+	presencemu.Lock()
+	delete(presenceM, clientID)
+	presencemu.Unlock()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The privacy modes of a person
+const (
+	privacyExact  = "exact"  // others see the position as sent
+	privacyFuzzy  = "fuzzy"  // others see the position snapped to the fuzzy grid
+	privacyHidden = "hidden" // others do not see the person on the map
+)
+
+var (
+	privacymu sync.Mutex        // guard privacyM
+	privacyM  map[string]string // clientID -> privacy mode
+)
+
+// privacyKey returns the Redis key of the privacy mode of a person, by secure
+// id like their profile
+func privacyKey(secureID string) string {
+	return "privacy:" + secureID
+}
+
+// privacyMessage is a websocket message handler that sets the privacy mode of
+// a person, and whether they can be followed. Their feature is stored again
+// right away in the new mode, and people nearby are told that a person who
+// turned hidden is gone.
+func privacyMessage(connID, msg string) {
+	var p protocol.Privacy
+	if err := protocol.Decode(msg, &p); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	switch p.Mode {
+	case privacyExact, privacyFuzzy, privacyHidden:
+	default:
+		if p.Mode != "" || p.Followable == nil {
+			sendError(connID, "invalid_privacy", "Mode must be exact, fuzzy or hidden")
+			return
+		}
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Privacy")
+		return
+	}
+	secureID := secureClientID(clientID)
+	if p.Followable != nil {
+		if err := storeFollowable(secureID, *p.Followable); err != nil {
+			lg.Error("privacy store failed", "conn", connID, "err", err)
+			sendError(connID, "unavailable", "Privacy could not be stored")
+			return
+		}
+	}
+	if p.Mode != "" {
+		if !setPrivacy(connID, clientID, p.Mode) {
+			return
+		}
+	}
+
+	followable := isFollowable(secureID)
+	reply, _ := protocol.Encode(protocol.Privacy{
+		Envelope:   protocol.Envelope{Type: protocol.TypePrivacy},
+		Mode:       loadPrivacy(clientID),
+		Followable: &followable,
+	})
+	send(connID, reply)
+}
+
+// setPrivacy sets the privacy mode of a person and stores their feature again
+// in the new mode. Returns false when the mode could not be stored.
+func setPrivacy(connID, clientID, mode string) bool {
+	if _, err := storeDo("SET", privacyKey(secureClientID(clientID)), mode); err != nil {
+		lg.Error("privacy store failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Privacy could not be stored")
+		return false
+	}
+	prev := loadPrivacy(clientID)
+	privacymu.Lock()
+	privacyM[clientID] = mode
+	privacymu.Unlock()
+	if mode != privacyExact {
+		storeDo("DEL", trailKey(clientID))
+	}
+
+	ns := connNamespace(connID)
+	if mode == privacyHidden && prev != privacyHidden {
+		hidePerson(ns, clientID)
+	}
+	if feature := sessionLastFeature(connID); feature != "" {
+		storeFeature(connID, clientID, feature)
+	}
+	return true
+}
+
+// loadPrivacy returns the privacy mode of a person, reading it from Redis the
+// first time
+func loadPrivacy(clientID string) string {
+	privacymu.Lock()
+	mode, ok := privacyM[clientID]
+	privacymu.Unlock()
+	if ok {
+		return mode
+	}
+	mode, err := redis.String(storeDo("GET", privacyKey(secureClientID(clientID))))
+	if err != nil && err != redis.ErrNil {
+		lg.Error("privacy lookup failed", "client", clientID, "err", err)
+	}
+	if mode == "" {
+		mode = privacyExact
+	}
+	if err == nil || err == redis.ErrNil {
+		privacymu.Lock()
+		privacyM[clientID] = mode
+		privacymu.Unlock()
+	}
+	return mode
+}
+
+// forgetPrivacy drops the cached privacy mode of a person
+func forgetPrivacy(clientID string) {
+	privacymu.Lock()
+	delete(privacyM, clientID)
+	privacymu.Unlock()
+}
+
+// privateFeature returns the feature of a person as it is stored in the
+// people collection for their privacy mode. Fuzzy people keep their position,
+// so that rooms, geofences and proximity are detected where they are, and get
+// a "fuzzy" property for fuzzFeature. Hidden people get a "hidden" property.
+func privateFeature(clientID, feature string) string {
+	switch loadPrivacy(clientID) {
+	case privacyFuzzy:
+		feature, _ = sjson.Set(feature, "properties.fuzzy", true)
+	case privacyHidden:
+		feature, _ = sjson.Set(feature, "properties.hidden", true)
+	}
+	return feature
+}
+
+// fuzzFeature returns a stored feature as it may be sent to others. The
+// positions of fuzzy people are snapped to the fuzzy grid.
+func fuzzFeature(feature string) string {
+	if !gjson.Get(feature, "properties.fuzzy").Bool() {
+		return feature
+	}
+	lat, lng := snapToGrid(
+		gjson.Get(feature, "geometry.coordinates.1").Float(),
+		gjson.Get(feature, "geometry.coordinates.0").Float(),
+		cfg.FuzzyGrid)
+	feature, _ = sjson.Set(feature, "geometry.coordinates", []float64{lng, lat})
+	return feature
+}
+
+// isHidden returns true for the stored feature of a hidden person
+func isHidden(feature string) bool {
+	return gjson.Get(feature, "properties.hidden").Bool()
+}
+
+// shownFeature returns a private feature as it may be shown in chat frames.
+// Hidden people are shown without a geometry.
+func shownFeature(feature string) string {
+	if isHidden(feature) {
+		feature, _ = sjson.SetRaw(feature, "geometry", "null")
+	}
+	return feature
+}
+
+// snapToGrid returns the center of the cell of a grid of meters that a
+// position is in
+func snapToGrid(lat, lng, meters float64) (float64, float64) {
+	step := meters / metersPerDegree
+	lat = (math.Floor(lat/step) + 0.5) * step
+	step /= math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	lng = (math.Floor(lng/step) + 0.5) * step
+	return lat, lng
+}
+
+// hidePerson tells the people near a person that turned hidden that they are
+// faraway, so that they are taken off the map
+func hidePerson(ns, clientID string) {
+	floor := clientFloor(clientID)
+	feature, err := geo.GetFeature(floorKey(peopleKey(ns), floor), clientID)
+	if err != nil {
+		return
+	}
+	farawayNearby(ns, floor, clientID, feature)
+}
+
+// farawayNearby tells the people of a floor near the feature of a person that
+// the person is faraway, unless they were hidden already
+func farawayNearby(ns, floor, clientID, feature string) {
+	if isHidden(feature) {
+		return
+	}
+	nearby, err := nearbyIDs(ns, floor,
+		gjson.Get(feature, "geometry.coordinates.1").Float(),
+		gjson.Get(feature, "geometry.coordinates.0").Float(),
+		live().RoamDist)
+	if err != nil {
+		lg.Error("nearby query failed", "client", clientID, "err", err)
+		return
+	}
+	msg := notification(protocol.TypeFaraway, secureFeature(feature), "", false)
+	for _, id := range nearby {
+		if id != clientID {
+			notifyClient(id, msg)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestFuzzyPrivacy(t *testing.T) {
+	a := testID(1)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	ca.send(`{"type":"Privacy","mode":"fuzzy"}`)
+	ca.expect("Privacy")
+	var stored string
+	waitFor(t, func() bool {
+		stored, _ = geo.GetFeature(peopleKey(""), a)
+		return gjson.Get(stored, "properties.fuzzy").Bool()
+	})
+	if lat, lng := gjson.Get(stored, "geometry.coordinates.1").Float(),
+		gjson.Get(stored, "geometry.coordinates.0").Float(); lat != 39.7425 || lng != -104.9965 {
+		t.Fatalf("stored at %v,%v, want the true position for geofences", lat, lng)
+	}
+
+	wantLat, wantLng := snapToGrid(39.7425, -104.9965, cfg.FuzzyGrid)
+	shown := secureFeature(stored)
+	if lat, lng := gjson.Get(shown, "geometry.coordinates.1").Float(),
+		gjson.Get(shown, "geometry.coordinates.0").Float(); lat != wantLat || lng != wantLng {
+		t.Fatalf("shown at %v,%v, want the fuzzy grid %v,%v", lat, lng, wantLat, wantLng)
+	}
+	person := gjson.Parse(testFeature(testID(2), wantLat, wantLng))
+	if d := gjson.Get(relativeFeature(person, gjson.Parse(stored)), "properties.distance").Float(); d != 0 {
+		t.Fatalf("distance: got %v, want it from the fuzzy position", d)
+	}
+	if exact := secureFeature(testFeature(a, 39.7425, -104.9965)); gjson.Get(exact, "geometry.coordinates.1").Float() != 39.7425 {
+		t.Fatalf("exact people must not be fuzzed, got %s", exact)
+	}
+}
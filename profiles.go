@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on profiles
+const (
+	maxNameLen    = 32  // characters of a display name
+	maxAvatarLen  = 512 // bytes of an avatar URL
+	maxProfileIDs = 50  // ids per GetProfile
+)
+
+// validUsername matches the usernames that people can reserve
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// validColor matches #rgb and #rrggbb colors
+var validColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// validLanguage matches the language tags of profiles, like en or pt-BR
+var validLanguage = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})?$`)
+
+var (
+	profilemu sync.Mutex        // guard profileM
+	profileM  map[string]string // clientID -> profile JSON, "" for none
+)
+
+// profileKey returns the Redis key of the profile of a person. Profiles are
+// keyed by the secure id, which is the id that other clients know them by.
+func profileKey(secureID string) string {
+	return "profile:" + secureID
+}
+
+// usernameKey returns the Redis key of a reserved username, holding the
+// secure id of the person who reserved it. Usernames are reserved regardless
+// of case.
+func usernameKey(username string) string {
+	return "username:" + strings.ToLower(username)
+}
+
+// setProfile is a websocket message handler that stores the profile of a
+// person and shows it on their feature right away
+func setProfile(connID, msg string) {
+	var p protocol.Profile
+	if err := protocol.Decode(msg, &p); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if err := validateProfile(&p); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a SetProfile")
+		return
+	}
+
+	p.Envelope = protocol.Envelope{}
+	p.ID = secureClientID(clientID)
+	prev := gjson.Get(loadProfile(clientID), "username").String()
+	if err := reserveUsername(p.ID, p.Username, prev); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	profile, _ := protocol.Encode(p)
+	if _, err := storeDo("SET", profileKey(p.ID), profile); err != nil {
+		// the stored profile keeps the previous username
+		if !strings.EqualFold(p.Username, prev) {
+			if p.Username != "" {
+				releaseUsername(p.ID, p.Username)
+			}
+			reserveUsername(p.ID, prev, "")
+		}
+		lg.Error("profile store failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Profile could not be stored")
+		return
+	}
+	profilemu.Lock()
+	profileM[clientID] = profile
+	profilemu.Unlock()
+
+	// Update the stored feature so that everyone sees the new profile
+	// without waiting for the next Feature message
+	people := personKey(clientID)
+	feature, err := geo.GetFeature(people, clientID)
+	if err == nil {
+		geo.SetFeature(people, clientID, attachProfile(clientID, feature), live().PeopleTTL)
+	}
+
+	reply, _ := sjson.SetRaw(`{"type":"`+protocol.TypeProfile+`"}`,
+		"profiles", "["+profile+"]")
+	send(connID, reply)
+}
+
+// validateProfile checks the fields of a profile
+func validateProfile(p *protocol.Profile) *validationError {
+	if utf8.RuneCountInString(p.Name) > maxNameLen {
+		return invalid("invalid_profile", "Name is too long")
+	}
+	if p.Avatar != "" {
+		u, err := url.Parse(p.Avatar)
+		if err != nil || len(p.Avatar) > maxAvatarLen || u.Host == "" ||
+			(u.Scheme != "https" && u.Scheme != "http") {
+			return invalid("invalid_profile", "Avatar must be an http or https URL")
+		}
+	}
+	if p.Color != "" && !validColor.MatchString(p.Color) {
+		return invalid("invalid_profile", "Color must be #rgb or #rrggbb")
+	}
+	if p.Username != "" && !validUsername.MatchString(p.Username) {
+		return invalid("invalid_profile", "Username must be 3 to 32 letters, digits, _ or -")
+	}
+	if p.Language != "" && !validLanguage.MatchString(p.Language) {
+		return invalid("invalid_profile", "Language must be a language tag like en or pt-BR")
+	}
+	return nil
+}
+
+// reserveUsername reserves the username of a person, unless someone else has
+// it, and releases the username they had before
+func reserveUsername(secureID, username, prev string) *validationError {
+	if username != "" && !strings.EqualFold(username, prev) {
+		ok, err := redis.String(storeDo("SET", usernameKey(username), secureID, "NX"))
+		if err != nil && err != redis.ErrNil {
+			lg.Error("username reserve failed", "username", username, "err", err)
+			return invalid("unavailable", "Username could not be reserved")
+		}
+		if ok != "OK" {
+			if owner, _ := redis.String(storeDo("GET", usernameKey(username))); owner != secureID {
+				return invalid("username_taken", "Username is taken")
+			}
+		}
+	}
+	if prev != "" && !strings.EqualFold(username, prev) {
+		releaseUsername(secureID, prev)
+	}
+	return nil
+}
+
+// releaseUsername frees the username of a person
+func releaseUsername(secureID, username string) {
+	if owner, _ := redis.String(storeDo("GET", usernameKey(username))); owner == secureID {
+		storeDo("DEL", usernameKey(username))
+	}
+}
+
+// getProfile is a websocket message handler that resolves the secure ids of
+// people to their profiles. People without a profile are left out.
+func getProfile(connID, msg string) {
+	var req protocol.GetProfile
+	if err := protocol.Decode(msg, &req); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxProfileIDs {
+		sendError(connID, "invalid_profile", "GetProfile takes 1 to 50 ids")
+		return
+	}
+	args := make([]interface{}, len(req.IDs))
+	for i, id := range req.IDs {
+		args[i] = profileKey(id)
+	}
+	profiles, err := redis.Strings(storeDo("MGET", args...))
+	if err != nil {
+		lg.Error("profile lookup failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Profiles are unavailable")
+		return
+	}
+	reply := `{"type":"` + protocol.TypeProfile + `","profiles":[]}`
+	for _, profile := range profiles {
+		if profile != "" {
+			reply, _ = sjson.SetRaw(reply, "profiles.-1", profile)
+		}
+	}
+	send(connID, reply)
+}
+
+// loadProfile returns the profile of a person, reading it from Redis the
+// first time
+func loadProfile(clientID string) string {
+	profilemu.Lock()
+	profile, ok := profileM[clientID]
+	profilemu.Unlock()
+	if ok {
+		return profile
+	}
+	profile, err := redis.String(storeDo("GET", profileKey(secureClientID(clientID))))
+	if err != nil && err != redis.ErrNil {
+		lg.Error("profile lookup failed", "client", clientID, "err", err)
+		return ""
+	}
+	profilemu.Lock()
+	profileM[clientID] = profile
+	profilemu.Unlock()
+	return profile
+}
+
+// attachProfile sets the profile of a person as the "profile" property of
+// their feature
+func attachProfile(clientID, feature string) string {
+	profile := loadProfile(clientID)
+	if profile == "" {
+		return feature
+	}
+	profile, _ = sjson.Delete(profile, "id")
+	if !gjson.Get(feature, "properties").IsObject() {
+		feature, _ = sjson.SetRaw(feature, "properties", "{}")
+	}
+	feature, _ = sjson.SetRaw(feature, "properties.profile", profile)
+	return feature
+}
+
+// forgetProfile drops the cached profile of a person
+func forgetProfile(clientID string) {
+	profilemu.Lock()
+	delete(profileM, clientID)
+	profilemu.Unlock()
+}
@@ -0,0 +1,750 @@
+// Package protocol defines the messages exchanged between chat clients and
+// the server over the websocket.
+//
+// Every message is a JSON object with a "type" field and an optional
+// "version" field. Messages without a version are version 1, the original
+// protocol. New fields may be added to messages without changing the version,
+// so decoders must ignore fields they do not know about.
+//
+// Any client message may carry a "ref" of the client's choosing. An Error
+// about the message echoes it, so that clients can tell which message
+// failed.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The protocol versions supported by this package
+const (
+	MinVersion = 1 // oldest supported version
+	Version    = 2 // current version
+)
+
+// ErrUnsupportedVersion is returned when decoding a message with a version
+// newer than Version
+var ErrUnsupportedVersion = errors.New("protocol: unsupported version")
+
+// Message types sent by clients
+const (
+	TypeHello         = "Hello"
+	TypeFeature       = "Feature"
+	TypeViewport      = "Viewport"
+	TypeMessage       = "Message"
+	TypeDirectMessage = "DirectMessage"
+	TypeRooms         = "Rooms"
+	TypePresence      = "Presence"
+	TypeMessageStatus = "MessageStatus"
+	TypeSetProfile    = "SetProfile"
+	TypeGetProfile    = "GetProfile"
+	TypeBlock         = "Block"
+	TypeUnblock       = "Unblock"
+	TypeTrail         = "Trail"
+	TypePublicKey     = "PublicKey"
+	TypeShout         = "Shout"
+	TypeSeen          = "Seen"
+	TypeGroup         = "Group"
+	TypeGroupMessage  = "GroupMessage"
+	TypePrivacy       = "Privacy"
+	TypeOccupancy     = "Occupancy"
+	TypeReaction      = "Reaction"
+	TypeUpload        = "Upload"
+	TypePushToken     = "PushToken"
+	TypePoll          = "Poll"
+	TypeVote          = "Vote"
+	TypeThread        = "Thread"
+	TypeSnapshot      = "Snapshot"
+	TypeFollow        = "Follow"
+	TypeUnfollow      = "Unfollow"
+	TypeSetRole       = "SetRole"
+	TypeRTCOffer      = "RTCOffer"
+	TypeRTCAnswer     = "RTCAnswer"
+	TypeRTCCandidate  = "RTCCandidate"
+	TypeICEServers    = "ICEServers"
+	TypeWatch         = "Watch"
+)
+
+// Message types sent by the server
+const (
+	TypeUpdate               = "Update"
+	TypeNearby               = "Nearby"
+	TypeFaraway              = "Faraway"
+	TypeInside               = "Inside"
+	TypeOutside              = "Outside"
+	TypeError                = "Error"
+	TypeShutdown             = "Shutdown"
+	TypeDirectMessageReceipt = "DirectMessageReceipt"
+	TypeFenceUpdated         = "FenceUpdated"
+	TypeSession              = "Session"
+	TypeMessageAck           = "MessageAck"
+	TypeProfile              = "Profile"
+	TypeFeatureCollection    = "FeatureCollection"
+	TypeRoomClosed           = "RoomClosed"
+	TypeMessageExpired       = "MessageExpired"
+	TypeReadReceipt          = "ReadReceipt"
+	TypeGroups               = "Groups"
+	TypeGroupInvite          = "GroupInvite"
+	TypeGroupPresence        = "GroupPresence"
+	TypeOccupants            = "Occupants"
+	TypeGone                 = "Gone"
+	TypeAnnouncement         = "Announcement"
+	TypePollResults          = "PollResults"
+	TypeMoved                = "Moved"
+	TypeIntroduction         = "Introduction"
+	TypeRole                 = "Role"
+	TypeArrival              = "Arrival"
+	TypeFollowed             = "Followed"
+)
+
+// Envelope holds the fields common to all messages
+type Envelope struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+}
+
+// Hello negotiates the protocol version. The client sends the newest version
+// it supports and the server replies with the version that will be used.
+type Hello struct {
+	Envelope
+	MinVersion int `json:"minVersion,omitempty"`
+}
+
+// LatLng is a position on the map
+type LatLng struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Bounds is a rectangle on the map, as produced by mapbox-gl getBounds()
+type Bounds struct {
+	SW LatLng `json:"_sw"`
+	NE LatLng `json:"_ne"`
+}
+
+// Geometry is a GeoJSON geometry
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Feature is a GeoJSON feature describing a person on the map. Properties are
+// kept raw so that unknown properties survive a round trip.
+type Feature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   Geometry        `json:"geometry"`
+	Properties json.RawMessage `json:"properties,omitempty"`
+}
+
+// Viewport is sent by clients with the area of their visible map: either a
+// GeoJSON Polygon, a Center with a Radius in meters, or the Bounds. Zoom is
+// the map zoom level, the server clusters people at low zoom levels. A
+// Filter narrows the people the client is told about.
+type Viewport struct {
+	Envelope
+	Bounds  Bounds    `json:"bounds"`
+	Polygon *Geometry `json:"polygon,omitempty"`
+	Center  *LatLng   `json:"center,omitempty"`
+	Radius  float64   `json:"radius,omitempty"`
+	Zoom    float64   `json:"zoom,omitempty"`
+	Filter  *Filter   `json:"filter,omitempty"`
+}
+
+// Filter narrows the people of a viewport to those that have one of the
+// listed values of every property, such as {"team": ["blue"]}, and to the
+// people listed by their IDs when IDs is set, such as friends. An array
+// property, such as tags, matches when any of its elements does.
+type Filter struct {
+	Properties map[string][]string `json:"properties,omitempty"`
+	IDs        []string            `json:"ids,omitempty"`
+}
+
+// Snapshot is sent by clients with the area of their visible map, like a
+// Viewport, to get everything in it at once. The server answers with a
+// Snapshot holding a GeoJSON FeatureCollection of the people and places in
+// the area, telling them apart by a "kind" property of "person" or "place".
+type Snapshot struct {
+	Viewport
+	Features json.RawMessage `json:"features,omitempty"`
+}
+
+// ChatMessage is a chat message from a person. The server assigns the ID,
+// Ref is chosen by the sender and only echoed back in the MessageAck.
+// End-to-end encrypted messages carry an Encrypted payload instead of Text,
+// which the server relays without reading it. The Feature stays in the clear
+// so that the message can still be routed to the people around the sender.
+// System messages are sent by the server about the person of the Feature,
+// such as them entering the Room. A reply carries the ID of the message it
+// replies to in ReplyTo and the Room of that message. Trace is the W3C
+// traceparent of messages that the server traced, to look up slow
+// deliveries. Translations hold the Text in the languages of the profiles of
+// recipients, by language tag, when the server translates messages. A Scope
+// of specific or broadest sends the message to the people inside the most
+// specific or the broadest room of the sender instead of those nearby, and
+// it arrives with that Room and the rooms it is nested in as Via. A message
+// with a TTL in seconds disappears after it: the server sets Expires, in Unix
+// milliseconds, deletes it from the room histories and sends its recipients
+// a MessageExpired.
+type ChatMessage struct {
+	Envelope
+	ID           string            `json:"id,omitempty"`
+	Ref          string            `json:"ref,omitempty"`
+	Feature      json.RawMessage   `json:"feature"`
+	Text         string            `json:"text"`
+	Encrypted    json.RawMessage   `json:"encrypted,omitempty"`
+	Attachment   *Attachment       `json:"attachment,omitempty"`
+	Room         string            `json:"room,omitempty"`
+	Scope        string            `json:"scope,omitempty"`
+	Via          []string          `json:"via,omitempty"`
+	ReplyTo      string            `json:"replyTo,omitempty"`
+	System       bool              `json:"system,omitempty"`
+	Trace        string            `json:"trace,omitempty"`
+	Translations map[string]string `json:"translations,omitempty"`
+	TTL          int               `json:"ttl,omitempty"`
+	Expires      int64             `json:"expires,omitempty"`
+}
+
+// Attachment is a file of a chat message. Clients set the Key of an Upload.
+// The server fills in the ContentType and Size of the upload and a URL to
+// download the file.
+type Attachment struct {
+	Key         string `json:"key"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	URL         string `json:"url,omitempty"`
+}
+
+// DirectMessage is a chat message to one person within the roaming distance,
+// by their secure id as the Target. The server sends it to the person with
+// the Feature of the sender instead of the Target, and replies to the sender
+// with a DirectMessageReceipt. Like a ChatMessage it can carry an Encrypted
+// payload instead of Text.
+type DirectMessage struct {
+	Envelope
+	Ref       string          `json:"ref,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	Feature   json.RawMessage `json:"feature,omitempty"`
+	Text      string          `json:"text"`
+	Encrypted json.RawMessage `json:"encrypted,omitempty"`
+}
+
+// DirectMessageReceipt is sent by the server to the sender of a
+// DirectMessage with its Status: "delivered" when the target is connected to
+// the same server, "relayed" when it was handed to the other servers,
+// "faraway" when the target is not within the roaming distance, or "unknown"
+type DirectMessageReceipt struct {
+	Envelope
+	Target string `json:"target"`
+	Ref    string `json:"ref,omitempty"`
+	Status string `json:"status"`
+}
+
+// PushToken is sent by clients to register the device token of a push
+// Provider, "fcm" or "apns", so that the person is notified of group messages
+// while they are offline. An empty Token stops the notifications.
+type PushToken struct {
+	Envelope
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+}
+
+// Upload is sent by clients to ask for an upload slot for an attachment of
+// the ContentType and Size. The server replies with an Upload with the Key
+// of the attachment and a URL that takes a PUT of the file until Expires, in
+// milliseconds since the epoch.
+type Upload struct {
+	Envelope
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Key         string `json:"key,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Expires     int64  `json:"expires,omitempty"`
+}
+
+// Seen is sent by the members of a room to acknowledge reading one of its
+// chat messages, by ID
+type Seen struct {
+	Envelope
+	ID   string `json:"id"`
+	Room string `json:"room"`
+}
+
+// Reaction is sent by the members of a room to react to one of its chat
+// messages, by ID, with an Emoji or the :shortcode: of a custom emoji. Remove
+// takes the reaction back. The server sends a Reaction to all members of the
+// room with the secure id of the person From who reacted and the Counts of
+// every emoji on the message.
+type Reaction struct {
+	Envelope
+	ID     string         `json:"id"`
+	Room   string         `json:"room"`
+	Emoji  string         `json:"emoji"`
+	Remove bool           `json:"remove,omitempty"`
+	From   string         `json:"from,omitempty"`
+	Counts map[string]int `json:"counts,omitempty"`
+}
+
+// Thread is sent by the members of a room to ask for the thread of one of
+// its chat messages, by ID. The server answers with a Thread with the ID of
+// the message that started the thread and the Messages of the thread in the
+// history of the room, oldest first.
+type Thread struct {
+	Envelope
+	ID       string            `json:"id"`
+	Room     string            `json:"room"`
+	Messages []json.RawMessage `json:"messages,omitempty"`
+}
+
+// Poll is sent by the members of a room to ask it a Question with 2 to 10
+// Options, open for TTL seconds. The server sends the Poll to all members with
+// its ID, the secure id From of the person who asked and when it Expires in
+// Unix milliseconds, and again to people who enter the room while it is open.
+type Poll struct {
+	Envelope
+	ID       string   `json:"id,omitempty"`
+	Room     string   `json:"room"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	TTL      int      `json:"ttl,omitempty"`
+	From     string   `json:"from,omitempty"`
+	Expires  int64    `json:"expires,omitempty"`
+}
+
+// Vote is sent by the members of the room of an open Poll to vote for the
+// Option at an index. Voting again changes the vote.
+type Vote struct {
+	Envelope
+	Poll   string `json:"poll"`
+	Option int    `json:"option"`
+}
+
+// PollResults is sent by the server to the members of the room of a Poll with
+// the votes for each option, whenever they change and once more, Closed, when
+// the poll expires
+type PollResults struct {
+	Envelope
+	Poll   string `json:"poll"`
+	Room   string `json:"room"`
+	Counts []int  `json:"counts"`
+	Closed bool   `json:"closed,omitempty"`
+}
+
+// ReadReceipt is sent by the server to the sender of a chat message when
+// another member of the room read it. Reads is the number of people who read
+// the message so far.
+type ReadReceipt struct {
+	Envelope
+	ID    string `json:"id"`
+	Room  string `json:"room"`
+	Reads int    `json:"reads"`
+}
+
+// Shout is a chat message that stays at the position of the sender for TTL
+// seconds. It reaches everyone within Radius meters of it, including people
+// who arrive later, and everyone whose viewport covers it. The server assigns
+// the ID and sets Expires, in Unix milliseconds, so clients can show how long
+// it lasts.
+type Shout struct {
+	Envelope
+	ID      string          `json:"id,omitempty"`
+	Feature json.RawMessage `json:"feature"`
+	Text    string          `json:"text"`
+	Radius  float64         `json:"radius"`
+	TTL     int             `json:"ttl,omitempty"`
+	Expires int64           `json:"expires,omitempty"`
+}
+
+// Group is sent by clients to manage their groups. Action is "create" with
+// a Name, "invite" with the secure ID of a person to invite to the Group,
+// "join" to accept an invite to the Group, "leave", or "list". The server
+// replies with a Groups message.
+type Group struct {
+	Envelope
+	Action string `json:"action"`
+	Group  string `json:"group,omitempty"`
+	Name   string `json:"name,omitempty"`
+	ID     string `json:"id,omitempty"`
+}
+
+// Groups is sent by the server with the groups of a person and the invites
+// they did not accept yet
+type Groups struct {
+	Envelope
+	Groups  []GroupInfo   `json:"groups"`
+	Invites []GroupInvite `json:"invites,omitempty"`
+}
+
+// GroupInfo describes a group and its members. Owner is the secure id of the
+// person who created it.
+type GroupInfo struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Owner   string        `json:"owner"`
+	Members []GroupMember `json:"members"`
+}
+
+// GroupMember is a member of a group by secure id. Position is where the
+// member is, rounded to about a kilometer, while they are online.
+type GroupMember struct {
+	ID       string  `json:"id"`
+	Online   bool    `json:"online"`
+	Position *LatLng `json:"position,omitempty"`
+}
+
+// GroupInvite is sent by the server when a person is invited to a group, by
+// the secure id From of a member
+type GroupInvite struct {
+	Envelope
+	Group string `json:"group"`
+	Name  string `json:"name"`
+	From  string `json:"from,omitempty"`
+}
+
+// GroupMessage is a chat message to the members of a group, wherever they
+// are. Clients send the Group and Text, the server adds the ID and the secure
+// id of the sender as From.
+type GroupMessage struct {
+	Envelope
+	ID    string `json:"id,omitempty"`
+	Group string `json:"group"`
+	From  string `json:"from,omitempty"`
+	Text  string `json:"text"`
+}
+
+// GroupPresence is sent by the server to the members of a group when a
+// member comes online, moves to another area, goes offline or leaves the
+// group
+type GroupPresence struct {
+	Envelope
+	Group string `json:"group"`
+	GroupMember
+	Left bool `json:"left,omitempty"`
+}
+
+// Privacy is sent by clients to set how others see their position, and by
+// the server in reply. Mode is "exact", "fuzzy" to show the position snapped
+// to a grid, or "hidden" to chat without being shown on the map. Followable
+// lets others Follow the person, and is off until they turn it on. Either
+// may be left out to keep it as it is.
+type Privacy struct {
+	Envelope
+	Mode       string `json:"mode,omitempty"`
+	Followable *bool  `json:"followable,omitempty"`
+}
+
+// Occupancy is sent by clients, such as dashboards, to watch the occupancy of
+// Rooms by id. An empty list stops watching. The server sends an Occupancy
+// with the Room and its Occupants right away, and again along with the Event,
+// "enter" or "exit", whenever someone enters or exits it.
+type Occupancy struct {
+	Envelope
+	Rooms     []string `json:"rooms,omitempty"`
+	Room      string   `json:"room,omitempty"`
+	Occupants int      `json:"occupants"`
+	Event     string   `json:"event,omitempty"`
+}
+
+// PublicKey is sent by clients to register the base64 public key of their
+// connection for end-to-end encryption. The server replies with the key and
+// the secure id of the person, and shows the key to others as the
+// "publicKey" property of their feature. The key algorithm and the format
+// of encrypted payloads are up to the clients.
+type PublicKey struct {
+	Envelope
+	ID  string `json:"id,omitempty"`
+	Key string `json:"key"`
+}
+
+// MessageAck is sent by the server to the sender of a chat message once it
+// has been handed out. Recipients is the number of people it was sent to,
+// excluding the sender, and Delivered how many of those are connected to the
+// same server. The rest are counted in the MessageStatus as other servers
+// deliver it.
+type MessageAck struct {
+	Envelope
+	ID         string `json:"id"`
+	Ref        string `json:"ref,omitempty"`
+	Recipients int    `json:"recipients"`
+	Delivered  int    `json:"delivered"`
+}
+
+// MessageStatus is sent by clients with the ID of one of their chat messages,
+// and by the server in reply with the delivery counts of the message
+type MessageStatus struct {
+	Envelope
+	ID         string `json:"id"`
+	Recipients int    `json:"recipients"`
+	Delivered  int    `json:"delivered"`
+}
+
+// Notification is sent by the server when a person changes in relation to
+// the client or one of its rooms. Me is set when the feature is the client.
+// A Gone notification tells the clients whose viewport shows a person that
+// the person left the map.
+type Notification struct {
+	Envelope
+	Feature  json.RawMessage `json:"feature"`
+	Room     string          `json:"room,omitempty"`
+	Via      []string        `json:"via,omitempty"` // rooms an Inside or Outside room is nested in, from its parent up
+	Me       bool            `json:"me,omitempty"`
+	Locality string          `json:"locality,omitempty"` // place name of a Nearby, when known
+}
+
+// FeatureCollection is sent by the server to clients of version 2 and up
+// with the notifications of a short window in one frame. Notifications about
+// the same feature are coalesced to the latest one.
+type FeatureCollection struct {
+	Envelope
+	Notifications []json.RawMessage `json:"notifications"`
+}
+
+// MessageExpired is sent by the server to the recipients of a chat message
+// with a TTL, and the members of the rooms it was sent to, when it expired.
+// Clients remove the message with the ID.
+type MessageExpired struct {
+	Envelope
+	ID string `json:"id"`
+}
+
+// RoomClosed is sent by the server to the members of a pop-up room when it
+// expires. A FenceUpdated message deleting its fence follows.
+type RoomClosed struct {
+	Envelope
+	Room string `json:"room"`
+}
+
+// Announcement is sent by the server with a scheduled message of the
+// operators, to the members of a Room or to everyone in the namespace when
+// Room is empty
+type Announcement struct {
+	Envelope
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Room string `json:"room,omitempty"`
+}
+
+// Update is sent by the server with all people in the clients viewport. When
+// Clustered is set, people that are close together at the zoom level of the
+// viewport are sent as cluster features, with "cluster" and "count"
+// properties.
+type Update struct {
+	Envelope
+	Features  []json.RawMessage `json:"features"`
+	Clustered bool              `json:"clustered,omitempty"`
+}
+
+// Occupants is sent by the server to a person who entered a Room, with the
+// Features of the people already inside of it
+type Occupants struct {
+	Envelope
+	Room     string            `json:"room"`
+	Features []json.RawMessage `json:"features"`
+}
+
+// Session is sent by the server when a connection opens. Clients reconnect
+// with the token in the "session" query parameter to resume the session.
+type Session struct {
+	Envelope
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+// Presence is the status of a person: "typing", "away" or "active". Clients
+// send only the status, the server adds the id of the person and the rooms it
+// was fanned out to. Expired is set when a status timed out.
+type Presence struct {
+	Envelope
+	ID      string   `json:"id,omitempty"`
+	Status  string   `json:"status"`
+	Rooms   []string `json:"rooms,omitempty"`
+	Expired bool     `json:"expired,omitempty"`
+}
+
+// Profile describes a person. Clients send their own profile as a SetProfile
+// message, the server adds the secure id of the person. Profiles are shown as
+// the "profile" property of features and sent in Profile messages. A
+// Username is reserved for the person, nobody else can take it.
+type Profile struct {
+	Envelope
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Avatar   string `json:"avatar,omitempty"`
+	Username string `json:"username,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// GetProfile is sent by clients to resolve the ids of people to profiles. The
+// server replies with a Profile message holding a list of "profiles".
+type GetProfile struct {
+	Envelope
+	IDs []string `json:"ids"`
+}
+
+// Block is sent by clients to hide a person, by their secure id, from them.
+// Mute hides only their chat messages. Unblock messages have the same form.
+type Block struct {
+	Envelope
+	ID   string `json:"id"`
+	Mute bool   `json:"mute,omitempty"`
+}
+
+// Signal is a WebRTC signaling message of a voice or video call between two
+// people nearby: an RTCOffer or RTCAnswer with the session description in
+// SDP, or an RTCCandidate with an ICE candidate. Clients send it to the
+// secure id of a person within the roaming distance as the Target, and the
+// person receives it with the secure id of the sender as From instead.
+type Signal struct {
+	Envelope
+	Target    string          `json:"target,omitempty"`
+	From      string          `json:"from,omitempty"`
+	SDP       string          `json:"sdp,omitempty"`
+	Candidate json.RawMessage `json:"candidate,omitempty"`
+}
+
+// ICEServers is sent by clients to get the STUN and TURN servers to set up
+// calls with, and sent back with the servers. TURN servers come with a
+// username and credential that expire after TTL seconds.
+type ICEServers struct {
+	Envelope
+	Servers []ICEServer `json:"iceServers,omitempty"`
+	TTL     int         `json:"ttl,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server in the form of an RTCIceServer
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Follow is sent by clients to get the position of a person, by their
+// secure id, in a Moved notification every time it changes, wherever the
+// person is. Unfollow messages have the same form.
+type Follow struct {
+	Envelope
+	ID string `json:"id"`
+}
+
+// Followed is sent by the server to a person when someone starts following
+// them, with the secure id of the follower
+type Followed struct {
+	Envelope
+	ID string `json:"id"`
+}
+
+// Watch is sent by clients to be alerted when someone arrives at a place: the
+// circle of Radius meters around the Center, with an optional Name. The
+// server replies with the Watch and its ID, and sends an Arrival every time
+// a person enters the circle. A Watch with the ID and Remove stops it.
+type Watch struct {
+	Envelope
+	ID     string  `json:"id,omitempty"`
+	Name   string  `json:"name,omitempty"`
+	Center *LatLng `json:"center,omitempty"`
+	Radius float64 `json:"radius,omitempty"`
+	Remove bool    `json:"remove,omitempty"`
+}
+
+// Arrival is sent by the server to the person of a Watch when someone
+// entered its circle, with the Feature of who arrived
+type Arrival struct {
+	Envelope
+	Watch   string          `json:"watch"`
+	Name    string          `json:"name,omitempty"`
+	Feature json.RawMessage `json:"feature"`
+}
+
+// Introduction is sent to two people in meet mode who stayed near each other,
+// with the feature and profile of the other person. Target and Text prefill
+// a DirectMessage to start the conversation with.
+type Introduction struct {
+	Envelope
+	Feature json.RawMessage `json:"feature"`
+	Profile json.RawMessage `json:"profile,omitempty"`
+	Target  string          `json:"target"`
+	Text    string          `json:"text"`
+}
+
+// Role is sent by the owners and moderators of a room as a SetRole to grant
+// a role to a person, by their secure id, or to take it away with an empty
+// Role. The person and the sender get a Role with the new role.
+type Role struct {
+	Envelope
+	Room string `json:"room"`
+	ID   string `json:"id"`
+	Role string `json:"role"`
+}
+
+// Trail is sent by clients to request the trails of the people in bounds, or
+// in their viewport when no bounds are given. The server replies with a Trail
+// holding the trails.
+type Trail struct {
+	Envelope
+	Bounds *Bounds       `json:"bounds,omitempty"`
+	Trails []PersonTrail `json:"trails"`
+}
+
+// PersonTrail is the recent positions of a person, newest first
+type PersonTrail struct {
+	ID     string       `json:"id"`
+	Points []TrailPoint `json:"points"`
+}
+
+// TrailPoint is a position of a person at a time, in Unix milliseconds
+type TrailPoint struct {
+	LatLng
+	Time int64 `json:"time"`
+}
+
+// Error is sent by the server when a client message could not be handled.
+// Request is the type of the message and Ref its ref, when it had one.
+// RetryAfter is the number of seconds to wait before connecting again, for
+// connections that the server turned away.
+type Error struct {
+	Envelope
+	Code       string `json:"code,omitempty"`
+	Message    string `json:"message"`
+	Request    string `json:"request,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+// Decode unmarshals a message into v, which must embed an Envelope.
+// Messages newer than Version are rejected.
+func Decode(msg string, v interface{}) error {
+	var env Envelope
+	if err := json.Unmarshal([]byte(msg), &env); err != nil {
+		return err
+	}
+	if env.Version > Version {
+		return ErrUnsupportedVersion
+	}
+	return json.Unmarshal([]byte(msg), v)
+}
+
+// Encode marshals a message
+func Encode(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Negotiate returns the version to use with a client that supports versions
+// up to clientVersion, or 0 when the client is too old. Clients that do not
+// state a version use version 1.
+func Negotiate(clientVersion int) int {
+	if clientVersion == 0 {
+		clientVersion = 1
+	}
+	if clientVersion < MinVersion {
+		return 0
+	}
+	if clientVersion > Version {
+		return Version
+	}
+	return clientVersion
+}
@@ -0,0 +1,293 @@
+package protocoltest
+
+import (
+	"encoding/json"
+
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The people and messages of the golden frames
+const (
+	personID = "5f1b2c3d4e5f60718293a4b5"
+	secureID = "9c2e4a6b8d0f1e3a5c7b9d2f"
+	otherID  = "1a2b3c4d5e6f708192a3b4c5"
+	msgID    = "7e8f9a0b1c2d3e4f5a6b7c8d"
+	feature  = `{"type":"Feature","id":"` + personID + `","geometry":{"type":"Point","coordinates":[-104.9965,39.7425]},"properties":{"color":"#ff9f7f"}}`
+	other    = `{"type":"Feature","id":"` + otherID + `","geometry":{"type":"Point","coordinates":[-104.9978,39.7431]},"properties":{"color":"#9fdf7f"}}`
+)
+
+// env returns the envelope of a message type
+func env(typ string) protocol.Envelope {
+	return protocol.Envelope{Type: typ}
+}
+
+// Cases are the golden frames, with the Go values they encode
+var Cases = []Case{
+	// client messages
+	{
+		Name: "hello", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Hello","version":2}`),
+		Value: &protocol.Hello{Envelope: protocol.Envelope{Type: protocol.TypeHello, Version: 2}},
+	},
+	{
+		Name: "feature", Sender: Client,
+		Frame: json.RawMessage(feature),
+		Value: &protocol.Feature{
+			Type: protocol.TypeFeature,
+			ID:   personID,
+			Geometry: protocol.Geometry{
+				Type:        "Point",
+				Coordinates: json.RawMessage(`[-104.9965,39.7425]`),
+			},
+			Properties: json.RawMessage(`{"color":"#ff9f7f"}`),
+		},
+	},
+	{
+		Name: "viewport bounds", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Viewport","bounds":{"_sw":{"lat":39.72,"lng":-105.02},"_ne":{"lat":39.76,"lng":-104.97}},"zoom":15}`),
+		Value: &protocol.Viewport{
+			Envelope: env(protocol.TypeViewport),
+			Bounds: protocol.Bounds{
+				SW: protocol.LatLng{Lat: 39.72, Lng: -105.02},
+				NE: protocol.LatLng{Lat: 39.76, Lng: -104.97},
+			},
+			Zoom: 15,
+		},
+	},
+	{
+		Name: "viewport circle with filter", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Viewport","bounds":{"_sw":{"lat":0,"lng":0},"_ne":{"lat":0,"lng":0}},"center":{"lat":39.7425,"lng":-104.9965},"radius":500,"filter":{"properties":{"team":["blue"]}}}`),
+		Value: &protocol.Viewport{
+			Envelope: env(protocol.TypeViewport),
+			Center:   &protocol.LatLng{Lat: 39.7425, Lng: -104.9965},
+			Radius:   500,
+			Filter:   &protocol.Filter{Properties: map[string][]string{"team": {"blue"}}},
+		},
+	},
+	{
+		Name: "message", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Message","ref":"5f1b2c3d-1","feature":` + feature + `,"text":"hi there"}`),
+		Value: &protocol.ChatMessage{
+			Envelope: env(protocol.TypeMessage),
+			Ref:      "5f1b2c3d-1",
+			Feature:  json.RawMessage(feature),
+			Text:     "hi there",
+		},
+	},
+	{
+		Name: "message reply with ttl", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Message","ref":"5f1b2c3d-2","feature":` + feature + `,"text":"see you there","room":"commons","replyTo":"` + msgID + `","ttl":60}`),
+		Value: &protocol.ChatMessage{
+			Envelope: env(protocol.TypeMessage),
+			Ref:      "5f1b2c3d-2",
+			Feature:  json.RawMessage(feature),
+			Text:     "see you there",
+			Room:     "commons",
+			ReplyTo:  msgID,
+			TTL:      60,
+		},
+	},
+	{
+		Name: "direct message", Sender: Client,
+		Frame: json.RawMessage(`{"type":"DirectMessage","ref":"5f1b2c3d-3","target":"` + secureID + `","text":"over here"}`),
+		Value: &protocol.DirectMessage{
+			Envelope: env(protocol.TypeDirectMessage),
+			Ref:      "5f1b2c3d-3",
+			Target:   secureID,
+			Text:     "over here",
+		},
+	},
+	{
+		Name: "rooms", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Rooms"}`),
+		Value: &protocol.Envelope{Type: protocol.TypeRooms},
+	},
+	{
+		Name: "presence", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Presence","status":"typing"}`),
+		Value: &protocol.Presence{Envelope: env(protocol.TypePresence), Status: "typing"},
+	},
+	{
+		Name: "set profile", Sender: Client,
+		Frame: json.RawMessage(`{"type":"SetProfile","name":"Ann","color":"#ff9f7f","language":"en"}`),
+		Value: &protocol.Profile{
+			Envelope: env(protocol.TypeSetProfile),
+			Name:     "Ann",
+			Color:    "#ff9f7f",
+			Language: "en",
+		},
+	},
+	{
+		Name: "get profile", Sender: Client,
+		Frame: json.RawMessage(`{"type":"GetProfile","ids":["` + secureID + `"]}`),
+		Value: &protocol.GetProfile{Envelope: env(protocol.TypeGetProfile), IDs: []string{secureID}},
+	},
+	{
+		Name: "mute", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Block","id":"` + secureID + `","mute":true}`),
+		Value: &protocol.Block{Envelope: env(protocol.TypeBlock), ID: secureID, Mute: true},
+	},
+	{
+		Name: "shout", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Shout","feature":` + feature + `,"text":"free coffee","radius":200,"ttl":600}`),
+		Value: &protocol.Shout{
+			Envelope: env(protocol.TypeShout),
+			Feature:  json.RawMessage(feature),
+			Text:     "free coffee",
+			Radius:   200,
+			TTL:      600,
+		},
+	},
+	{
+		Name: "reaction", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Reaction","id":"` + msgID + `","room":"commons","emoji":"👍"}`),
+		Value: &protocol.Reaction{Envelope: env(protocol.TypeReaction), ID: msgID, Room: "commons", Emoji: "👍"},
+	},
+	{
+		Name: "poll", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Poll","room":"commons","question":"Lunch?","options":["tacos","pizza"],"ttl":300}`),
+		Value: &protocol.Poll{
+			Envelope: env(protocol.TypePoll),
+			Room:     "commons",
+			Question: "Lunch?",
+			Options:  []string{"tacos", "pizza"},
+			TTL:      300,
+		},
+	},
+	{
+		Name: "vote", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Vote","poll":"` + msgID + `","option":1}`),
+		Value: &protocol.Vote{Envelope: env(protocol.TypeVote), Poll: msgID, Option: 1},
+	},
+	{
+		Name: "rtc candidate", Sender: Client,
+		Frame: json.RawMessage(`{"type":"RTCCandidate","target":"` + secureID + `","candidate":{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host","sdpMid":"0"}}`),
+		Value: &protocol.Signal{
+			Envelope:  env(protocol.TypeRTCCandidate),
+			Target:    secureID,
+			Candidate: json.RawMessage(`{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host","sdpMid":"0"}`),
+		},
+	},
+	{
+		Name: "watch", Sender: Client,
+		Frame: json.RawMessage(`{"type":"Watch","name":"stage","center":{"lat":39.7431,"lng":-104.9978},"radius":50}`),
+		Value: &protocol.Watch{
+			Envelope: env(protocol.TypeWatch),
+			Name:     "stage",
+			Center:   &protocol.LatLng{Lat: 39.7431, Lng: -104.9978},
+			Radius:   50,
+		},
+	},
+
+	// server messages
+	{
+		Name: "session", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Session","token":"c2Vzc2lvbg"}`),
+		Value: &protocol.Session{Envelope: env(protocol.TypeSession), Token: "c2Vzc2lvbg"},
+	},
+	{
+		Name: "hello reply", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Hello","version":2,"minVersion":1}`),
+		Value: &protocol.Hello{
+			Envelope:   protocol.Envelope{Type: protocol.TypeHello, Version: 2},
+			MinVersion: 1,
+		},
+	},
+	{
+		Name: "message ack", Sender: Server,
+		Frame: json.RawMessage(`{"type":"MessageAck","id":"` + msgID + `","ref":"5f1b2c3d-1","recipients":3,"delivered":2}`),
+		Value: &protocol.MessageAck{
+			Envelope:   env(protocol.TypeMessageAck),
+			ID:         msgID,
+			Ref:        "5f1b2c3d-1",
+			Recipients: 3,
+			Delivered:  2,
+		},
+	},
+	{
+		Name: "received message", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Message","id":"` + msgID + `","feature":` + other + `,"text":"hi there","room":"commons","expires":1767225600000}`),
+		Value: &protocol.ChatMessage{
+			Envelope: env(protocol.TypeMessage),
+			ID:       msgID,
+			Feature:  json.RawMessage(other),
+			Text:     "hi there",
+			Room:     "commons",
+			Expires:  1767225600000,
+		},
+	},
+	{
+		Name: "direct message receipt", Sender: Server,
+		Frame: json.RawMessage(`{"type":"DirectMessageReceipt","target":"` + secureID + `","ref":"5f1b2c3d-3","status":"delivered"}`),
+		Value: &protocol.DirectMessageReceipt{
+			Envelope: env(protocol.TypeDirectMessageReceipt),
+			Target:   secureID,
+			Ref:      "5f1b2c3d-3",
+			Status:   "delivered",
+		},
+	},
+	{
+		Name: "nearby", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Nearby","feature":` + other + `,"locality":"Union Station"}`),
+		Value: &protocol.Notification{
+			Envelope: env(protocol.TypeNearby),
+			Feature:  json.RawMessage(other),
+			Locality: "Union Station",
+		},
+	},
+	{
+		Name: "inside nested room", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Inside","feature":` + feature + `,"room":"stage","via":["commons"],"me":true}`),
+		Value: &protocol.Notification{
+			Envelope: env(protocol.TypeInside),
+			Feature:  json.RawMessage(feature),
+			Room:     "stage",
+			Via:      []string{"commons"},
+			Me:       true,
+		},
+	},
+	{
+		Name: "update", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Update","features":[` + feature + `,` + other + `]}`),
+		Value: &protocol.Update{
+			Envelope: env(protocol.TypeUpdate),
+			Features: []json.RawMessage{json.RawMessage(feature), json.RawMessage(other)},
+		},
+	},
+	{
+		Name: "feature collection", Sender: Server,
+		Frame: json.RawMessage(`{"type":"FeatureCollection","version":2,"notifications":[{"type":"Faraway","feature":` + other + `}]}`),
+		Value: &protocol.FeatureCollection{
+			Envelope: protocol.Envelope{Type: protocol.TypeFeatureCollection, Version: 2},
+			Notifications: []json.RawMessage{
+				json.RawMessage(`{"type":"Faraway","feature":` + other + `}`),
+			},
+		},
+	},
+	{
+		Name: "message expired", Sender: Server,
+		Frame: json.RawMessage(`{"type":"MessageExpired","id":"` + msgID + `"}`),
+		Value: &protocol.MessageExpired{Envelope: env(protocol.TypeMessageExpired), ID: msgID},
+	},
+	{
+		Name: "arrival", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Arrival","watch":"` + msgID + `","name":"stage","feature":` + other + `}`),
+		Value: &protocol.Arrival{
+			Envelope: env(protocol.TypeArrival),
+			Watch:    msgID,
+			Name:     "stage",
+			Feature:  json.RawMessage(other),
+		},
+	},
+	{
+		Name: "error", Sender: Server,
+		Frame: json.RawMessage(`{"type":"Error","code":"rate_limited","message":"Rate limited","request":"Message","ref":"5f1b2c3d-1"}`),
+		Value: &protocol.Error{
+			Envelope: env(protocol.TypeError),
+			Code:     "rate_limited",
+			Message:  "Rate limited",
+			Request:  protocol.TypeMessage,
+			Ref:      "5f1b2c3d-1",
+		},
+	},
+}
@@ -0,0 +1,247 @@
+// Package protocoltest is a conformance suite of the chat protocol and a fake
+// server, for implementers of clients in other languages, such as JS and
+// mobile, to check their messages against without running Tile38 or the chat
+// server.
+//
+// Cases are golden frames of the messages of clients and the server. A client
+// passes when it encodes the message of every case as its frame, and its
+// frames pass Check:
+//
+//	errs := protocoltest.Run(func(c protocoltest.Case) (string, error) {
+//		return myEncode(myDecode(c.Frame))
+//	})
+//
+// The cases are printed as JSON by "go run ./cmd/protocoltest -golden" for
+// suites that are not written in Go, and the fake server is run on its own
+// by "go run ./cmd/protocoltest -a :8000".
+package protocoltest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The senders of frames
+const (
+	Client = "client"
+	Server = "server"
+)
+
+// Case is a golden frame of the protocol: the Frame of a message of the
+// Sender and the Value of the protocol package it encodes
+type Case struct {
+	Name   string          `json:"name"`
+	Sender string          `json:"sender"`
+	Frame  json.RawMessage `json:"frame"`
+	Value  interface{}     `json:"-"`
+}
+
+// clientMessages are the messages of clients by type, with the fields that
+// they must have
+var clientMessages = map[string]struct {
+	value    interface{}
+	required []string
+}{
+	protocol.TypeHello:         {protocol.Hello{}, nil},
+	protocol.TypeFeature:       {protocol.Feature{}, []string{"id", "geometry"}},
+	protocol.TypeViewport:      {protocol.Viewport{}, nil},
+	protocol.TypeMessage:       {protocol.ChatMessage{}, []string{"feature"}},
+	protocol.TypeDirectMessage: {protocol.DirectMessage{}, []string{"target"}},
+	protocol.TypeRooms:         {protocol.Envelope{}, nil},
+	protocol.TypePresence:      {protocol.Presence{}, []string{"status"}},
+	protocol.TypeMessageStatus: {protocol.MessageStatus{}, []string{"id"}},
+	protocol.TypeSetProfile:    {protocol.Profile{}, nil},
+	protocol.TypeGetProfile:    {protocol.GetProfile{}, []string{"ids"}},
+	protocol.TypeBlock:         {protocol.Block{}, []string{"id"}},
+	protocol.TypeUnblock:       {protocol.Block{}, []string{"id"}},
+	protocol.TypeTrail:         {protocol.Trail{}, nil},
+	protocol.TypePublicKey:     {protocol.PublicKey{}, []string{"key"}},
+	protocol.TypeShout:         {protocol.Shout{}, []string{"feature", "text", "radius"}},
+	protocol.TypeSeen:          {protocol.Seen{}, []string{"id", "room"}},
+	protocol.TypeGroup:         {protocol.Group{}, []string{"action"}},
+	protocol.TypeGroupMessage:  {protocol.GroupMessage{}, []string{"group", "text"}},
+	protocol.TypePrivacy:       {protocol.Privacy{}, nil},
+	protocol.TypeOccupancy:     {protocol.Occupancy{}, nil},
+	protocol.TypeReaction:      {protocol.Reaction{}, []string{"id", "room", "emoji"}},
+	protocol.TypeUpload:        {protocol.Upload{}, []string{"contentType", "size"}},
+	protocol.TypePushToken:     {protocol.PushToken{}, []string{"provider"}},
+	protocol.TypePoll:          {protocol.Poll{}, []string{"room", "question", "options"}},
+	protocol.TypeVote:          {protocol.Vote{}, []string{"poll"}},
+	protocol.TypeThread:        {protocol.Thread{}, []string{"id", "room"}},
+	protocol.TypeSnapshot:      {protocol.Snapshot{}, nil},
+	protocol.TypeFollow:        {protocol.Follow{}, []string{"id"}},
+	protocol.TypeUnfollow:      {protocol.Follow{}, []string{"id"}},
+	protocol.TypeSetRole:       {protocol.Role{}, []string{"room", "id"}},
+	protocol.TypeRTCOffer:      {protocol.Signal{}, []string{"target", "sdp"}},
+	protocol.TypeRTCAnswer:     {protocol.Signal{}, []string{"target", "sdp"}},
+	protocol.TypeRTCCandidate:  {protocol.Signal{}, []string{"target", "candidate"}},
+	protocol.TypeICEServers:    {protocol.ICEServers{}, nil},
+	protocol.TypeWatch:         {protocol.Watch{}, nil},
+}
+
+// Check checks a frame of a client: it must be a message of a client type
+// and version that the server supports, with the fields that the message
+// must have, and no fields that it does not have. Every message may carry a
+// "ref". The features of Feature, Message and Shout messages must be GeoJSON
+// Point features of the person, with an id of 24 hex characters.
+func Check(frame string) error {
+	if !gjson.Valid(frame) || !gjson.Parse(frame).IsObject() {
+		return errors.New("frame is not a JSON object")
+	}
+	typ := gjson.Get(frame, "type").String()
+	m, ok := clientMessages[typ]
+	if !ok {
+		return fmt.Errorf("unknown client message type %q", typ)
+	}
+	if version := gjson.Get(frame, "version").Int(); version > protocol.Version {
+		return fmt.Errorf("%s: unsupported version %d", typ, version)
+	}
+	for _, field := range m.required {
+		if !gjson.Get(frame, field).Exists() {
+			return fmt.Errorf("%s: missing %q", typ, field)
+		}
+	}
+	stripped, _ := sjson.Delete(frame, "ref")
+	dec := json.NewDecoder(strings.NewReader(stripped))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(reflect.New(reflect.TypeOf(m.value)).Interface()); err != nil {
+		return fmt.Errorf("%s: %v", typ, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	switch typ {
+	case protocol.TypeFeature:
+		return checkFeature(typ, frame)
+	case protocol.TypeMessage, protocol.TypeShout:
+		return checkFeature(typ, gjson.Get(frame, "feature").Raw)
+	}
+	return nil
+}
+
+// checkFeature checks the feature of a person in a message
+func checkFeature(typ, feature string) error {
+	if gjson.Get(feature, "type").String() != "Feature" {
+		return fmt.Errorf("%s: feature type must be Feature", typ)
+	}
+	id := gjson.Get(feature, "id")
+	if id.Type != gjson.String || len(id.String()) != 24 || strings.Trim(id.String(), "0123456789abcdefABCDEF") != "" {
+		return fmt.Errorf("%s: feature id must be 24 hex characters", typ)
+	}
+	if gjson.Get(feature, "geometry.type").String() != "Point" {
+		return fmt.Errorf("%s: geometry must be a Point", typ)
+	}
+	coords := gjson.Get(feature, "geometry.coordinates").Array()
+	if len(coords) < 2 || len(coords) > 3 {
+		return fmt.Errorf("%s: point must have 2 or 3 coordinates", typ)
+	}
+	for _, c := range coords {
+		if c.Type != gjson.Number {
+			return fmt.Errorf("%s: coordinates must be numbers", typ)
+		}
+	}
+	if lng, lat := coords[0].Float(), coords[1].Float(); lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return fmt.Errorf("%s: coordinates out of range", typ)
+	}
+	if props := gjson.Get(feature, "properties"); props.Exists() && !props.IsObject() {
+		return fmt.Errorf("%s: properties must be an object", typ)
+	}
+	return nil
+}
+
+// Compare returns an error telling how a frame differs from a golden frame.
+// The order of fields does not matter, and fields of null, false, 0 or ""
+// are the same as absent ones, as they are to the decoders of the server.
+func Compare(frame, golden string) error {
+	got, err := canonical(frame)
+	if err != nil {
+		return err
+	}
+	want, err := canonical(golden)
+	if err != nil {
+		return fmt.Errorf("golden frame: %v", err)
+	}
+	if got != want {
+		return fmt.Errorf("got %s, want %s", got, want)
+	}
+	return nil
+}
+
+// canonical returns a frame with its object fields sorted and its zero
+// fields dropped
+func canonical(frame string) (string, error) {
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(frame))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(dropZero(v)); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// dropZero removes the null, false, 0 and "" fields of the objects in a value
+func dropZero(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			switch e := e.(type) {
+			case nil:
+				delete(v, k)
+			case bool, string:
+				if e == false || e == "" {
+					delete(v, k)
+				}
+			case json.Number:
+				if f, err := e.Float64(); err == nil && f == 0 {
+					delete(v, k)
+				} else {
+					v[k] = dropZero(e)
+				}
+			default:
+				v[k] = dropZero(e)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = dropZero(e)
+		}
+	case json.Number:
+		// numbers are compared by value, 1.50 is 1.5
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// Run runs the conformance suite. encode is called with every case and
+// returns the frame that the implementation encodes its message as, which
+// must be the frame of the case, and pass Check for the messages of clients.
+// Returns the failures by the name of their case.
+func Run(encode func(c Case) (string, error)) []error {
+	var errs []error
+	for _, c := range Cases {
+		frame, err := encode(c)
+		if err == nil {
+			err = Compare(frame, string(c.Frame))
+		}
+		if err == nil && c.Sender == Client {
+			err = Check(frame)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", c.Name, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,127 @@
+package protocoltest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+func TestGolden(t *testing.T) {
+	errs := Run(func(c Case) (string, error) {
+		return protocol.Encode(c.Value)
+	})
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestGoldenMismatch(t *testing.T) {
+	errs := Run(func(c Case) (string, error) {
+		if c.Name == "hello" {
+			return `{"type":"Hello","version":1}`, nil
+		}
+		return string(c.Frame), nil
+	})
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "hello: ") {
+		t.Fatalf("got %v, want the hello case to fail", errs)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	if err := Compare(`{"b":1.50,"a":"x","c":null,"d":false}`, `{"a":"x","b":1.5}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Compare(`{"a":"x"}`, `{"a":"y"}`); err == nil {
+		t.Fatal("want an error for a different field")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, frame := range []string{
+		`{"type":"Hello","version":2}`,
+		feature,
+	} {
+		if err := Check(frame); err != nil {
+			t.Errorf("%s: %v", frame, err)
+		}
+	}
+	for _, frame := range []string{
+		`not json`,
+		`{"type":"Nope"}`,
+		`{"type":"Feature","id":"a","geometry":{"type":"Point","coordinates":[200,0]}}`,
+		`{"type":"Feature","id":"a","geometry":{"type":"Point","coordinates":[0,0]},"properties":[]}`,
+	} {
+		if err := Check(frame); err == nil {
+			t.Errorf("%s: want an error", frame)
+		}
+	}
+}
+
+// dialFake connects to a fake server and reads its Session
+func dialFake(t *testing.T, s *FakeServer) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if frame := readFake(t, ws); gjson.Get(frame, "type").String() != protocol.TypeSession {
+		t.Fatalf("got %s, want a Session", frame)
+	}
+	return ws
+}
+
+// readFake returns the next frame of a connection to a fake server
+func readFake(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFakeServer(t *testing.T) {
+	s := NewFakeServer()
+	defer s.Close()
+	ws := dialFake(t, s)
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"Nope","ref":"r1"}`))
+	reply := readFake(t, ws)
+	if gjson.Get(reply, "code").String() != "invalid_message" || gjson.Get(reply, "ref").String() != "r1" {
+		t.Fatalf("got %s, want an invalid_message Error", reply)
+	}
+	if frames, failures := s.Frames(), s.Failures(); len(frames) != 1 || len(failures) != 1 {
+		t.Fatalf("got %d frames and %d failures", len(frames), len(failures))
+	}
+	s.Reset()
+	if len(s.Frames()) != 0 || len(s.Failures()) != 0 {
+		t.Fatal("reset must forget the frames and failures")
+	}
+}
+
+func TestFakeServerMaxFrames(t *testing.T) {
+	s := NewFakeServer()
+	defer s.Close()
+	ws := dialFake(t, s)
+	for i := 0; i < maxFrames+10; i++ {
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"Hello","version":2}`))
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"Nope"}`))
+	for deadline := time.Now().Add(2 * time.Second); len(s.Failures()) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+	}
+	frames := s.Frames()
+	if len(frames) != maxFrames {
+		t.Fatalf("got %d frames, want %d", len(frames), maxFrames)
+	}
+	if last := frames[len(frames)-1]; last != `{"type":"Nope"}` {
+		t.Fatalf("last frame: got %s, want the newest one", last)
+	}
+}
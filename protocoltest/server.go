@@ -0,0 +1,274 @@
+package protocoltest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// maxFrames is how many of the frames and failures it received a FakeServer
+// keeps, dropping the oldest ones
+const maxFrames = 1000
+
+// FakeServer is an in-process chat server for testing clients. It speaks the
+// protocol at /ws and /ws/{namespace}, without Tile38 or Redis: it sends a
+// Session when a connection opens, Checks every frame it receives, answers
+// one that fails with an invalid_message Error, and answers the messages
+// that the chat server answers with a reply of the same form, as if nobody
+// else was on the map. The zero FakeServer is an http.Handler to serve on a
+// listener of your own.
+type FakeServer struct {
+	URL string // base URL of the server started by NewFakeServer
+
+	srv      *httptest.Server
+	mu       sync.Mutex
+	conns    map[*fakeConn]bool
+	frames   []string
+	failures []error
+}
+
+// fakeConn is a connection to the fake server
+type fakeConn struct {
+	mu sync.Mutex // guard writes
+	ws *websocket.Conn
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// NewFakeServer starts a fake server on a loopback port. Close it when done.
+func NewFakeServer() *FakeServer {
+	s := &FakeServer{}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close closes the connections and stops the server
+func (s *FakeServer) Close() {
+	s.mu.Lock()
+	for c := range s.conns {
+		c.ws.Close()
+	}
+	s.mu.Unlock()
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+// Frames returns the last frames received, up to 1000, oldest first
+func (s *FakeServer) Frames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.frames...)
+}
+
+// Failures returns the errors of the received frames that failed Check
+func (s *FakeServer) Failures() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.failures...)
+}
+
+// Reset forgets the frames and failures received so far
+func (s *FakeServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames, s.failures = nil, nil
+}
+
+// Send sends a frame of the server, such as a Case, to every connection
+func (s *FakeServer) Send(frame string) error {
+	s.mu.Lock()
+	conns := make([]*fakeConn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	var err error
+	for _, c := range conns {
+		if werr := c.write(frame); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// ServeHTTP upgrades the connections to /ws
+func (s *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ws" && !strings.HasPrefix(r.URL.Path, "/ws/") {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &fakeConn{ws: ws}
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*fakeConn]bool)
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		ws.Close()
+	}()
+
+	session, _ := protocol.Encode(protocol.Session{
+		Envelope: protocol.Envelope{Type: protocol.TypeSession},
+		Token:    newID(),
+	})
+	c.write(session)
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		frame := string(data)
+		s.mu.Lock()
+		if len(s.frames) == maxFrames {
+			s.frames = append(s.frames[:0], s.frames[1:]...)
+		}
+		s.frames = append(s.frames, frame)
+		s.mu.Unlock()
+		if err := Check(frame); err != nil {
+			s.mu.Lock()
+			if len(s.failures) == maxFrames {
+				s.failures = append(s.failures[:0], s.failures[1:]...)
+			}
+			s.failures = append(s.failures, err)
+			s.mu.Unlock()
+			reply, _ := protocol.Encode(protocol.Error{
+				Envelope: protocol.Envelope{Type: protocol.TypeError},
+				Code:     "invalid_message",
+				Message:  err.Error(),
+				Request:  gjson.Get(frame, "type").String(),
+				Ref:      gjson.Get(frame, "ref").String(),
+			})
+			c.write(reply)
+			continue
+		}
+		if reply := fakeReply(frame); reply != "" {
+			c.write(reply)
+		}
+	}
+}
+
+// write sends a frame on a connection
+func (c *fakeConn) write(frame string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(frame))
+}
+
+// fakeReply returns the answer of the chat server to a frame of a client
+// that is alone on the map, or empty for messages without one
+func fakeReply(frame string) string {
+	typ := gjson.Get(frame, "type").String()
+	ref := gjson.Get(frame, "ref").String()
+	var v interface{}
+	switch typ {
+	case protocol.TypeHello:
+		version := protocol.Negotiate(int(gjson.Get(frame, "version").Int()))
+		if version == 0 {
+			v = protocol.Error{
+				Envelope: protocol.Envelope{Type: protocol.TypeError},
+				Code:     "unsupported_version",
+				Message:  "Unsupported protocol version",
+				Request:  typ,
+				Ref:      ref,
+			}
+			break
+		}
+		v = protocol.Hello{
+			Envelope:   protocol.Envelope{Type: protocol.TypeHello, Version: version},
+			MinVersion: protocol.MinVersion,
+		}
+	case protocol.TypeViewport:
+		v = protocol.Update{
+			Envelope: protocol.Envelope{Type: protocol.TypeUpdate},
+			Features: []json.RawMessage{},
+		}
+	case protocol.TypeSnapshot:
+		return `{"type":"` + protocol.TypeSnapshot + `","features":{"type":"FeatureCollection","features":[]}}`
+	case protocol.TypeMessage:
+		v = protocol.MessageAck{
+			Envelope: protocol.Envelope{Type: protocol.TypeMessageAck},
+			ID:       newID(),
+			Ref:      ref,
+		}
+	case protocol.TypeDirectMessage:
+		v = protocol.DirectMessageReceipt{
+			Envelope: protocol.Envelope{Type: protocol.TypeDirectMessageReceipt},
+			Target:   gjson.Get(frame, "target").String(),
+			Ref:      ref,
+			Status:   "faraway",
+		}
+	case protocol.TypeMessageStatus:
+		v = protocol.MessageStatus{
+			Envelope: protocol.Envelope{Type: protocol.TypeMessageStatus},
+			ID:       gjson.Get(frame, "id").String(),
+		}
+	case protocol.TypeSetProfile:
+		profile, _ := sjson.Delete(frame, "type")
+		profile, _ = sjson.Delete(profile, "ref")
+		return `{"type":"` + protocol.TypeProfile + `","profiles":[` + profile + `]}`
+	case protocol.TypeGetProfile:
+		return `{"type":"` + protocol.TypeProfile + `","profiles":[]}`
+	case protocol.TypeTrail:
+		v = protocol.Trail{
+			Envelope: protocol.Envelope{Type: protocol.TypeTrail},
+			Trails:   []protocol.PersonTrail{},
+		}
+	case protocol.TypePrivacy:
+		var p protocol.Privacy
+		protocol.Decode(frame, &p)
+		if p.Mode == "" {
+			p.Mode = "exact"
+		}
+		if p.Followable == nil {
+			followable := false
+			p.Followable = &followable
+		}
+		v = p
+	case protocol.TypePublicKey:
+		v = protocol.PublicKey{
+			Envelope: protocol.Envelope{Type: protocol.TypePublicKey},
+			Key:      gjson.Get(frame, "key").String(),
+		}
+	case protocol.TypeICEServers:
+		v = protocol.ICEServers{Envelope: protocol.Envelope{Type: protocol.TypeICEServers}}
+	case protocol.TypeWatch:
+		var w protocol.Watch
+		protocol.Decode(frame, &w)
+		if w.ID == "" {
+			w.ID = newID()
+		}
+		v = w
+	default:
+		return ""
+	}
+	reply, _ := protocol.Encode(v)
+	return reply
+}
+
+// newID returns a random id of 24 hex characters
+func newID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
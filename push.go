@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The push notification settings
+const (
+	pushWorkers  = 4                   // concurrent deliveries
+	pushQueue    = 1024                // notifications waiting for delivery
+	pushTokenTTL = 30 * 24 * time.Hour // how long a device token is kept without being registered again
+	pushTextLen  = 100                 // characters of the text in a notification
+	apnsTokenTTL = 50 * time.Minute    // how long an APNs provider token is used, Apple allows an hour
+	fcmTokenTTL  = time.Hour           // how long an FCM access token is asked for, the longest Google allows
+	maxTokenLen  = 4096                // bytes of a device token
+)
+
+// The push notification endpoints and the OAuth2 scope of FCM. The FCM URL
+// takes the id of the Firebase project.
+const (
+	fcmTokenURL = "https://oauth2.googleapis.com/token"
+	fcmScope    = "https://www.googleapis.com/auth/firebase.messaging"
+	apnsURL     = "https://api.push.apple.com/3/device/"
+)
+
+// fcmURL is the FCM HTTP v1 send endpoint of a project, a variable so that
+// tests can point it at a server of their own
+var fcmURL = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+
+// apnsDeviceToken matches the hex device tokens of APNs
+var apnsDeviceToken = regexp.MustCompile(`^(?:[0-9a-fA-F]{2})+$`)
+
+// fcmAccount is the service account of the Firebase project that sends FCM
+// messages, as in the JSON key file that Google issues
+type fcmAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+// pushNotification is a notification for the device of a person
+type pushNotification struct {
+	Provider  string `json:"provider"`
+	Token     string `json:"token"`
+	Group     string `json:"group"`
+	GroupName string `json:"groupName"`
+	From      string `json:"from"`             // secure id of the sender
+	Sender    string `json:"sender,omitempty"` // display name of the sender
+	Place     string `json:"place,omitempty"`  // name of the room the sender is in
+	Text      string `json:"text"`
+}
+
+var (
+	pushJobs   chan pushNotification // notifications waiting for delivery
+	pushClient = &http.Client{Timeout: webhookTimeout}
+
+	apnsmu    sync.Mutex        // guard apnsToken and apnsIssue
+	apnsKey   *ecdsa.PrivateKey // key that signs APNs provider tokens
+	apnsToken string            // current APNs provider token
+	apnsIssue time.Time         // when the APNs provider token was issued
+
+	fcmmu      sync.Mutex  // guard fcmToken and fcmExpires
+	fcm        *fcmAccount // service account that sends FCM messages
+	fcmToken   string      // current OAuth2 access token of FCM
+	fcmExpires time.Time   // when the FCM access token must be renewed
+)
+
+// pushKey returns the Redis key of the device token of a person
+func pushKey(clientID string) string {
+	return "push:" + clientID
+}
+
+// pushProvider returns true when notifications of a provider can be sent.
+// A push webhook takes the notifications of every provider.
+func pushProvider(provider string) bool {
+	if cfg.PushWebhook != "" {
+		return provider == "fcm" || provider == "apns"
+	}
+	switch provider {
+	case "fcm":
+		return fcm != nil
+	case "apns":
+		return apnsKey != nil
+	}
+	return false
+}
+
+// startPush loads the FCM service account and the APNs key, and starts the
+// delivery workers when a provider is configured
+func startPush() error {
+	var err error
+	if cfg.FCMAccount != "" {
+		if fcm, err = loadFCMAccount(cfg.FCMAccount); err != nil {
+			return err
+		}
+	}
+	if cfg.APNsKey != "" {
+		if apnsKey, err = loadAPNsKey(cfg.APNsKey); err != nil {
+			return err
+		}
+	}
+	if cfg.PushWebhook == "" && fcm == nil && apnsKey == nil {
+		return nil
+	}
+	pushJobs = make(chan pushNotification, pushQueue)
+	for i := 0; i < pushWorkers; i++ {
+		go func() {
+			for n := range pushJobs {
+				if err := sendPush(n); err != nil {
+					lg.Warn("push delivery failed", "provider", n.Provider, "err", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// pushTokenMessage is a websocket message handler that registers the device
+// token of a person, or drops it when the token is empty
+func pushTokenMessage(connID, msg string) {
+	var p protocol.PushToken
+	if err := protocol.Decode(msg, &p); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a PushToken")
+		return
+	}
+	if p.Token == "" {
+		storeDo("DEL", pushKey(clientID))
+		return
+	}
+	if !pushProvider(p.Provider) {
+		sendError(connID, "invalid_push", "Push notifications are not available for the provider")
+		return
+	}
+	if len(p.Token) > maxTokenLen {
+		sendError(connID, "invalid_push", "Token is too long")
+		return
+	}
+	if p.Provider == "apns" && !apnsDeviceToken.MatchString(p.Token) {
+		sendError(connID, "invalid_push", "APNs tokens must be hex")
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HMSET", pushKey(clientID), "provider", p.Provider, "token", p.Token)
+	b.Send("EXPIRE", pushKey(clientID), int(pushTokenTTL/time.Second))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("push token store failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Push notifications are unavailable")
+	}
+}
+
+// pushOffline queues a notification of a group message for every member that
+// is not online, registered a device token and did not block the sender. The
+// place of the sender is only told when they share their exact position.
+func pushOffline(members map[string]string, senderID, groupID, text string) {
+	if pushJobs == nil {
+		return
+	}
+	var offline []string
+	for member, ns := range members {
+		if member == senderID {
+			continue
+		}
+		if _, _, err := findPerson(ns, member); err == ErrNotFound {
+			offline = append(offline, member)
+		}
+	}
+	if len(offline) == 0 {
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	from := secureClientID(senderID)
+	for _, member := range offline {
+		b.Send("HMGET", pushKey(member), "provider", "token")
+		b.Send("HEXISTS", blocksKey(member), from)
+	}
+	b.Send("HGET", groupKey(groupID), "name")
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("push token lookup failed", "group", groupID, "err", err)
+		return
+	}
+	groupName, _ := redis.String(replies[2*len(offline)], nil)
+	n := pushNotification{
+		Group:     groupID,
+		GroupName: groupName,
+		From:      from,
+		Sender:    profileName(senderID),
+		Text:      truncate(text, pushTextLen),
+	}
+	if loadPrivacy(senderID) == privacyExact {
+		n.Place = placeName(senderID)
+	}
+	for i := range offline {
+		device, _ := redis.Strings(replies[2*i], nil)
+		if len(device) != 2 || device[1] == "" || !pushProvider(device[0]) {
+			continue
+		}
+		if blocked, _ := redis.Bool(replies[2*i+1], nil); blocked {
+			continue
+		}
+		n.Provider, n.Token = device[0], device[1]
+		select {
+		case pushJobs <- n:
+		default:
+			lg.Warn("push queue full", "group", groupID)
+		}
+	}
+}
+
+// profileName returns the display name of a person, if they have a profile
+func profileName(clientID string) string {
+	var p protocol.Profile
+	if profile := loadProfile(clientID); profile != "" {
+		protocol.Decode(profile, &p)
+	}
+	return p.Name
+}
+
+// placeName returns the name of the first room a person is inside of
+func placeName(clientID string) string {
+	roomIDs := fencesInside(clientID)
+	if len(roomIDs) == 0 {
+		return ""
+	}
+	roommu.Lock()
+	defer roommu.Unlock()
+	if room, ok := rooms[roomIDs[0]]; ok {
+		return room.Name
+	}
+	return ""
+}
+
+// truncate shortens a text to n characters, ending it with an ellipsis
+func truncate(text string, n int) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:n-1]) + "…"
+}
+
+// title returns the title of a notification, like "Ann in Hikers"
+func (n pushNotification) title() string {
+	sender := n.Sender
+	if sender == "" {
+		sender = "Someone"
+	}
+	if n.GroupName == "" {
+		return sender
+	}
+	return sender + " in " + n.GroupName
+}
+
+// body returns the body of a notification, with the place of the sender
+func (n pushNotification) body() string {
+	if n.Place == "" {
+		return n.Text
+	}
+	return n.Text + " (" + n.Place + ")"
+}
+
+// sendPush delivers a notification through the push webhook, or through the
+// provider of the device token
+func sendPush(n pushNotification) error {
+	if cfg.PushWebhook != "" {
+		event, _ := json.Marshal(n)
+		return postWebhook(webhookJob{url: cfg.PushWebhook, event: string(event)})
+	}
+	switch n.Provider {
+	case "fcm":
+		return sendFCM(n)
+	case "apns":
+		return sendAPNs(n)
+	}
+	return fmt.Errorf("unknown provider %q", n.Provider)
+}
+
+// sendFCM delivers a notification with the Firebase Cloud Messaging HTTP v1
+// API
+func sendFCM(n pushNotification) error {
+	token, err := fcmAccessToken()
+	if err != nil {
+		return err
+	}
+	body := `{}`
+	body, _ = sjson.Set(body, "message.token", n.Token)
+	body, _ = sjson.Set(body, "message.notification.title", n.title())
+	body, _ = sjson.Set(body, "message.notification.body", n.body())
+	body, _ = sjson.Set(body, "message.data.group", n.Group)
+	body, _ = sjson.Set(body, "message.data.from", n.From)
+	endpoint := fmt.Sprintf(fcmURL, url.PathEscape(fcm.ProjectID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doPush(req)
+}
+
+// sendAPNs delivers a notification with the Apple Push Notification service
+func sendAPNs(n pushNotification) error {
+	if !apnsDeviceToken.MatchString(n.Token) {
+		return errors.New("apns device token is not hex")
+	}
+	token, err := apnsProviderToken()
+	if err != nil {
+		return err
+	}
+	body := `{}`
+	body, _ = sjson.Set(body, "aps.alert.title", n.title())
+	body, _ = sjson.Set(body, "aps.alert.body", n.body())
+	body, _ = sjson.Set(body, "aps.thread-id", n.Group)
+	body, _ = sjson.Set(body, "group", n.Group)
+	body, _ = sjson.Set(body, "from", n.From)
+	req, err := http.NewRequest(http.MethodPost, apnsURL+n.Token, bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("apns-topic", cfg.APNsTopic)
+	req.Header.Set("apns-push-type", "alert")
+	return doPush(req)
+}
+
+// doPush sends a request to a push provider
+func doPush(req *http.Request) error {
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// loadAPNsKey reads the PKCS #8 .p8 key that signs APNs provider tokens
+func loadAPNsKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("apns key: no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns key: not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// apnsProviderToken returns the ES256 JWT that authenticates with APNs,
+// issuing a new one when the current one is getting old
+func apnsProviderToken() (string, error) {
+	apnsmu.Lock()
+	defer apnsmu.Unlock()
+	if apnsToken != "" && time.Since(apnsIssue) < apnsTokenTTL {
+		return apnsToken, nil
+	}
+	enc := base64.RawURLEncoding
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": cfg.APNsKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": cfg.APNsTeamID, "iat": now.Unix()})
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, apnsKey, sum[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	padInt(sig[:32], r)
+	padInt(sig[32:], s)
+	apnsToken = signing + "." + enc.EncodeToString(sig)
+	apnsIssue = now
+	return apnsToken, nil
+}
+
+// padInt writes a big integer into b, left padded with zeros
+func padInt(b []byte, n *big.Int) {
+	bytes := n.Bytes()
+	copy(b[len(b)-len(bytes):], bytes)
+}
+
+// loadFCMAccount reads the service account JSON file of a Firebase project
+func loadFCMAccount(path string) (*fcmAccount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fcm account: %v", err)
+	}
+	var a fcmAccount
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("fcm account: %v", err)
+	}
+	if a.ProjectID == "" || a.ClientEmail == "" {
+		return nil, errors.New("fcm account: project_id and client_email are required")
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = fcmTokenURL
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, errors.New("fcm account: no PEM block in private_key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fcm account: %v", err)
+	}
+	var ok bool
+	if a.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("fcm account: not an RSA key")
+	}
+	return &a, nil
+}
+
+// fcmAccessToken returns the OAuth2 access token that authenticates with
+// FCM, exchanging a JWT signed by the service account for a new one when the
+// current one is about to expire
+func fcmAccessToken() (string, error) {
+	fcmmu.Lock()
+	defer fcmmu.Unlock()
+	if fcmToken != "" && time.Now().Before(fcmExpires) {
+		return fcmToken, nil
+	}
+	enc := base64.RawURLEncoding
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   fcm.ClientEmail,
+		"scope": fcmScope,
+		"aud":   fcm.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(fcmTokenTTL).Unix(),
+	})
+	signing := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, fcm.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signing + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequest(http.MethodPost, fcm.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fcm token: unexpected status %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("fcm token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("fcm token: no access token")
+	}
+	// renew a minute early, so that a token never expires on the way
+	fcmToken = token.AccessToken
+	fcmExpires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return fcmToken, nil
+}
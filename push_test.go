@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// testFCM points FCM at a fake server of Google, and returns the number of
+// access tokens that it issued
+func testFCM(t *testing.T, send http.HandlerFunc) *int32 {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	var issued int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		jwt := strings.Split(r.Form.Get("assertion"), ".")
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(jwt) != 3 {
+			http.Error(w, "bad grant", http.StatusBadRequest)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(jwt[1])
+		if gjson.GetBytes(claims, "iss").String() != "push@example.iam.gserviceaccount.com" ||
+			gjson.GetBytes(claims, "scope").String() != fcmScope {
+			http.Error(w, "bad claims", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&issued, 1)
+		w.Write([]byte(`{"access_token":"access","expires_in":3600,"token_type":"Bearer"}`))
+	})
+	mux.HandleFunc("/v1/projects/chat-app/messages:send", send)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	account, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "chat-app",
+		"client_email": "push@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL + "/token",
+	})
+	path := filepath.Join(t.TempDir(), "account.json")
+	if err := ioutil.WriteFile(path, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if fcm, err = loadFCMAccount(path); err != nil {
+		t.Fatal(err)
+	}
+	prevURL := fcmURL
+	fcmURL = srv.URL + "/v1/projects/%s/messages:send"
+	fcmToken = ""
+	t.Cleanup(func() {
+		fcm, fcmURL, fcmToken = nil, prevURL, ""
+	})
+	return &issued
+}
+
+func TestSendFCM(t *testing.T) {
+	var got string
+	issued := testFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		got = string(body)
+		w.Write([]byte(`{"name":"projects/chat-app/messages/1"}`))
+	})
+	n := pushNotification{Provider: "fcm", Token: "device", Group: "g", From: "f",
+		Sender: "Ann", GroupName: "Hikers", Text: "hi"}
+	for i := 0; i < 2; i++ {
+		if err := sendFCM(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gjson.Get(got, "message.token").String() != "device" ||
+		gjson.Get(got, "message.notification.title").String() != "Ann in Hikers" ||
+		gjson.Get(got, "message.data.group").String() != "g" {
+		t.Fatalf("got %s", got)
+	}
+	if n := atomic.LoadInt32(issued); n != 1 {
+		t.Fatalf("issued %d access tokens, want the first one reused", n)
+	}
+}
+
+func TestSendFCMRejected(t *testing.T) {
+	testFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	if err := sendFCM(pushNotification{Provider: "fcm", Token: "gone"}); err == nil {
+		t.Fatal("want an error for a rejected message")
+	}
+}
+
+func TestLoadFCMAccount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "account.json")
+	ioutil.WriteFile(path, []byte(`{"project_id":"p","client_email":"e","private_key":"none"}`), 0600)
+	if _, err := loadFCMAccount(path); err == nil {
+		t.Fatal("want an error for a key that is not PEM")
+	}
+	if _, err := loadFCMAccount(filepath.Join(os.TempDir(), "missing.json")); err == nil {
+		t.Fatal("want an error for a missing file")
+	}
+}
+
+func TestAPNsDeviceToken(t *testing.T) {
+	for token, want := range map[string]bool{
+		strings.Repeat("ab", 32):        true,
+		strings.Repeat("AB", 50):        true,
+		"":                              false,
+		"abc":                           false,
+		"../../3/device/" + "ab":        false,
+		strings.Repeat("ab", 31) + "zz": false,
+	} {
+		if got := apnsDeviceToken.MatchString(token); got != want {
+			t.Errorf("%q: got %v, want %v", token, got, want)
+		}
+	}
+	if err := sendAPNs(pushNotification{Provider: "apns", Token: "x/../y"}); err == nil {
+		t.Fatal("want an error for a token that is not hex")
+	}
+}
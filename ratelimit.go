@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// strikeWindow is the period in which rate limit violations are counted
+// before a connection is disconnected
+const strikeWindow = time.Minute
+
+// rateLimit is a token bucket limit of messages per second, with bursts of up
+// to Burst messages
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// bucket is the token bucket of a single message type for a connection
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// connLimits holds the rate limit state of a connection
+type connLimits struct {
+	buckets     map[string]*bucket // message type -> bucket
+	strikes     int                // violations in the current window
+	strikeStart time.Time          // start of the current window
+}
+
+var (
+	limitmu    sync.Mutex             // guard connLimitM
+	connLimitM map[string]*connLimits // connID -> rate limit state
+)
+
+// parseRateLimits parses limits in the form "Feature=20:40,Message=2", where
+// each message type has a rate per second and an optional burst, which
+// defaults to the rate
+func parseRateLimits(s string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid rate limit %q", part)
+		}
+		limit, err := parseRateLimit(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate limit %q", part)
+		}
+		limits[kv[0]] = limit
+	}
+	return limits, nil
+}
+
+// parseRateLimit parses a single limit in the form "rate[:burst]"
+func parseRateLimit(s string) (rateLimit, error) {
+	vals := strings.SplitN(s, ":", 2)
+	rate, err := strconv.ParseFloat(vals[0], 64)
+	if err != nil || rate <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	burst := rate
+	if len(vals) == 2 {
+		burst, err = strconv.ParseFloat(vals[1], 64)
+		if err != nil || burst < 1 {
+			return rateLimit{}, fmt.Errorf("invalid rate limit %q", s)
+		}
+	}
+	return rateLimit{Rate: rate, Burst: burst}, nil
+}
+
+// allow takes a token from the bucket of the message type for a connection.
+// Returns false when the connection is over the limit, and disconnect is true
+// when it has been over the limit too many times.
+func allow(connID, msgType string) (ok, disconnect bool) {
+	c := live()
+	limit, limited := c.RateLimits[msgType]
+	if !limited {
+		return true, false
+	}
+	now := time.Now()
+	limitmu.Lock()
+	defer limitmu.Unlock()
+	cl, exists := connLimitM[connID]
+	if !exists {
+		cl = &connLimits{buckets: make(map[string]*bucket)}
+		connLimitM[connID] = cl
+	}
+	b, exists := cl.buckets[msgType]
+	if !exists {
+		b = &bucket{tokens: limit.Burst, last: now}
+		cl.buckets[msgType] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	if now.Sub(cl.strikeStart) > strikeWindow {
+		cl.strikes = 0
+		cl.strikeStart = now
+	}
+	cl.strikes++
+	return false, c.MaxStrikes > 0 && cl.strikes >= c.MaxStrikes
+}
+
+// forgetLimits removes the rate limit state of a connection
+func forgetLimits(connID string) {
+	limitmu.Lock()
+	delete(connLimitM, connID)
+	limitmu.Unlock()
+}
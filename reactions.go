@@ -0,0 +1,225 @@
+package main
+
+import (
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on reactions
+const (
+	reactionTTL      = 7 * 24 * time.Hour // how long the reactions to a message are kept
+	maxReactionKinds = 20                 // different emoji on a message
+	maxEmojiLen      = 8                  // characters of an emoji
+)
+
+// validShortcode matches the :shortcodes: of custom emoji
+var validShortcode = regexp.MustCompile(`^:[A-Za-z0-9_+-]{1,32}:$`)
+
+// reactionsKey returns the Redis key of the emoji counts of a chat message
+func reactionsKey(msgID string) string {
+	return "reactions:" + msgID
+}
+
+// reactedKey returns the Redis key of the people who reacted to a chat
+// message with an emoji
+func reactedKey(msgID, emoji string) string {
+	return "reacted:" + msgID + ":" + emoji
+}
+
+// reactionMessage is a websocket message handler for reactions. Members of a
+// room react to a chat message in the history of the room with an emoji, or
+// take their reaction back, and all members get the new counts. Every person
+// is counted once per emoji.
+func reactionMessage(connID, msg string) {
+	var r protocol.Reaction
+	if err := protocol.Decode(msg, &r); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if err := validateEmoji(r.Emoji); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	roomID := namespaceRoom(connNamespace(connID), r.Room)
+	roommu.Lock()
+	room, ok := rooms[roomID]
+	member := ok && room.members[clientID]
+	roommu.Unlock()
+	if clientID == "" || !member {
+		sendError(connID, "not_in_room", "Only members of the room can react to its messages")
+		return
+	}
+	inRoom, err := inHistory(roomID, r.ID)
+	if err != nil {
+		lg.Error("reaction failed", "msg", r.ID, "err", err)
+		sendError(connID, "unavailable", "Reactions are unavailable")
+		return
+	}
+	if !inRoom {
+		sendError(connID, "unknown_message", "Unknown message")
+		return
+	}
+
+	if shadowBanned(clientID) {
+		shadowReaction(connID, clientID, r)
+		return
+	}
+
+	counts, changed, err := react(r.ID, r.Emoji, clientID, r.Remove)
+	if err != nil {
+		lg.Error("reaction failed", "msg", r.ID, "err", err)
+		sendError(connID, "unavailable", "Reactions are unavailable")
+		return
+	}
+	if counts == nil {
+		sendError(connID, "too_many_reactions", "Too many different reactions")
+		return
+	}
+	if !changed {
+		return
+	}
+	update, _ := protocol.Encode(protocol.Reaction{
+		Envelope: protocol.Envelope{Type: protocol.TypeReaction},
+		ID:       r.ID,
+		Room:     r.Room,
+		Emoji:    r.Emoji,
+		Remove:   r.Remove,
+		From:     secureClientID(clientID),
+		Counts:   counts,
+	})
+	deliver(roomMembers(roomID), update)
+}
+
+// validateEmoji checks that a reaction is a :shortcode: or a short emoji
+func validateEmoji(emoji string) *validationError {
+	if validShortcode.MatchString(emoji) {
+		return nil
+	}
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxEmojiLen {
+		return invalid("invalid_reaction", "Emoji must be an emoji or a :shortcode:")
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf {
+			return invalid("invalid_reaction", "Emoji must be an emoji or a :shortcode:")
+		}
+	}
+	return nil
+}
+
+// inHistory returns true when a chat message is in the history of a room
+func inHistory(roomID, msgID string) (bool, error) {
+	msgs, err := redis.Strings(storeDo("LRANGE", historyKey(roomID), 0, -1))
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range unexpired(msgs) {
+		if gjson.Get(msg, "id").String() == msgID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// react adds or removes the reaction of a person to a chat message and
+// returns the emoji counts of the message. changed is false when the person
+// had already reacted, or not reacted, that way. The counts are nil when the
+// message has too many different emoji for another.
+func react(msgID, emoji, clientID string, remove bool) (counts map[string]int, changed bool, err error) {
+	if !remove {
+		exists, err := redis.Bool(storeDo("HEXISTS", reactionsKey(msgID), emoji))
+		if err != nil {
+			return nil, false, err
+		}
+		kinds, err := redis.Int(storeDo("HLEN", reactionsKey(msgID)))
+		if err != nil {
+			return nil, false, err
+		}
+		if !exists && kinds >= maxReactionKinds {
+			return nil, false, nil
+		}
+	}
+	cmd, delta := "SADD", 1
+	if remove {
+		cmd, delta = "SREM", -1
+	}
+	n, err := redis.Int(storeDo(cmd, reactedKey(msgID, emoji), clientID))
+	if err != nil {
+		return nil, false, err
+	}
+	if n == 1 {
+		b := newBatch(store)
+		defer b.Close()
+		b.Send("HINCRBY", reactionsKey(msgID), emoji, delta)
+		b.Send("EXPIRE", reactionsKey(msgID), int(reactionTTL/time.Second))
+		b.Send("EXPIRE", reactedKey(msgID, emoji), int(reactionTTL/time.Second))
+		replies, err := b.Flush()
+		if err != nil {
+			return nil, false, err
+		}
+		if count, _ := redis.Int(replies[0], nil); count <= 0 {
+			storeDo("HDEL", reactionsKey(msgID), emoji)
+		}
+	}
+	counts, err = redis.IntMap(storeDo("HGETALL", reactionsKey(msgID)))
+	if err != nil {
+		return nil, false, err
+	}
+	return counts, n == 1, nil
+}
+
+// shadowReaction answers the reaction of a shadow banned person with the
+// counts as if it was stored, while only the person receives them
+func shadowReaction(connID, clientID string, r protocol.Reaction) {
+	counts, err := redis.IntMap(storeDo("HGETALL", reactionsKey(r.ID)))
+	if err != nil {
+		lg.Error("reaction failed", "msg", r.ID, "err", err)
+		sendError(connID, "unavailable", "Reactions are unavailable")
+		return
+	}
+	if r.Remove {
+		if counts[r.Emoji]--; counts[r.Emoji] <= 0 {
+			delete(counts, r.Emoji)
+		}
+	} else {
+		counts[r.Emoji]++
+	}
+	update, _ := protocol.Encode(protocol.Reaction{
+		Envelope: protocol.Envelope{Type: protocol.TypeReaction},
+		ID:       r.ID,
+		Room:     r.Room,
+		Emoji:    r.Emoji,
+		Remove:   r.Remove,
+		From:     secureClientID(clientID),
+		Counts:   counts,
+	})
+	send(connID, update)
+}
+
+// attachReactions sets the emoji counts of each chat message as its
+// "reactions" property. Messages without reactions are left as they are.
+func attachReactions(msgs []string) {
+	b := newBatch(store)
+	defer b.Close()
+	for _, msg := range msgs {
+		b.Send("HGETALL", reactionsKey(gjson.Get(msg, "id").String()))
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("reaction lookup failed", "err", err)
+		return
+	}
+	for i := range msgs {
+		if counts, _ := redis.IntMap(replies[i], nil); len(counts) > 0 {
+			msgs[i], _ = sjson.Set(msgs[i], "reactions", counts)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// seenTTL is how long the readers of a chat message are kept
+const seenTTL = 7 * 24 * time.Hour
+
+// seenKey returns the Redis key of the set of people who read a chat message
+func seenKey(msgID string) string {
+	return "seen:" + msgID
+}
+
+// seenMessage is a websocket message handler for read receipts. Members of a
+// room acknowledge reading a chat message of the room, and the sender gets a
+// ReadReceipt with the number of readers. Every reader is counted once.
+func seenMessage(connID, msg string) {
+	var s protocol.Seen
+	if err := protocol.Decode(msg, &s); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	roomID := namespaceRoom(connNamespace(connID), s.Room)
+	roommu.Lock()
+	room, ok := rooms[roomID]
+	member := ok && room.members[clientID]
+	roommu.Unlock()
+	if clientID == "" || !member {
+		sendError(connID, "not_in_room", "Only members of the room can read its messages")
+		return
+	}
+	if err := validateSeen(roomID, s.ID); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+
+	sender, err := redis.String(storeDo("HGET", statusKey(s.ID), "sender"))
+	if err == redis.ErrNil {
+		sendError(connID, "unknown_message", "Unknown message")
+		return
+	} else if err != nil {
+		lg.Error("read receipt failed", "msg", s.ID, "err", err)
+		sendError(connID, "unavailable", "Read receipts are unavailable")
+		return
+	}
+	if sender == clientID {
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("SADD", seenKey(s.ID), clientID)
+	b.Send("EXPIRE", seenKey(s.ID), int(seenTTL/time.Second))
+	b.Send("SCARD", seenKey(s.ID))
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("read receipt failed", "msg", s.ID, "err", err)
+		return
+	}
+	if added, _ := redis.Int(replies[0], nil); added == 0 {
+		return
+	}
+	reads, _ := redis.Int(replies[2], nil)
+	receipt, _ := protocol.Encode(protocol.ReadReceipt{
+		Envelope: protocol.Envelope{Type: protocol.TypeReadReceipt},
+		ID:       s.ID,
+		Room:     s.Room,
+		Reads:    reads,
+	})
+	deliver([]string{sender}, receipt)
+}
+
+// validateSeen checks that a chat message read in a room is in the history
+// of the room, so that members of one room cannot mark the messages of
+// another as read
+func validateSeen(roomID, msgID string) *validationError {
+	inRoom, err := inHistory(roomID, msgID)
+	if err != nil {
+		lg.Error("read receipt failed", "msg", msgID, "err", err)
+		return invalid("unavailable", "Read receipts are unavailable")
+	}
+	if !inRoom {
+		return invalid("not_found", "The message is not in the history of the room")
+	}
+	return nil
+}
+
+// attachReads sets the number of readers of each chat message as its
+// "reads" property. Messages that nobody read are left as they are.
+func attachReads(msgs []string) {
+	b := newBatch(store)
+	defer b.Close()
+	for _, msg := range msgs {
+		b.Send("SCARD", seenKey(gjson.Get(msg, "id").String()))
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("read receipt lookup failed", "err", err)
+		return
+	}
+	for i := range msgs {
+		if reads, _ := redis.Int(replies[i], nil); reads > 0 {
+			msgs[i], _ = sjson.Set(msgs[i], "reads", reads)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// testRoom adds a room with members to the rooms of the test server, without
+// a fence, and returns its ID
+func testRoom(t *testing.T, name string, members ...string) string {
+	testServer(t)
+	id := testID(0) + "-" + name
+	room := &Room{ID: id, Name: name, members: make(map[string]bool)}
+	for _, m := range members {
+		room.members[m] = true
+	}
+	roommu.Lock()
+	rooms[id] = room
+	roommu.Unlock()
+	t.Cleanup(func() {
+		roommu.Lock()
+		delete(rooms, id)
+		roommu.Unlock()
+	})
+	return id
+}
+
+func TestSeen(t *testing.T) {
+	a, b := testID(1), testID(2)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	cb := joinTest(t, b, 39.7426, -104.9965)
+	room := testRoom(t, "lobby", a, b)
+	other := testRoom(t, "hall", a, b)
+	msgID := testID(3)
+	trackMessage(msgID, a, 1)
+	recordHistory([]string{room}, fmt.Sprintf(`{"type":"Message","id":%q,"text":"hi"}`, msgID))
+
+	cb.send(fmt.Sprintf(`{"type":"Seen","id":%q,"room":%q}`, msgID, other))
+	if e := cb.expect("Error"); gjson.Get(e, "code").String() != "not_found" {
+		t.Fatalf("seen in another room: got %s", e)
+	}
+	cb.send(fmt.Sprintf(`{"type":"Seen","id":%q,"room":%q}`, msgID, room))
+	receipt := ca.expect("ReadReceipt")
+	if gjson.Get(receipt, "id").String() != msgID || gjson.Get(receipt, "reads").Int() != 1 {
+		t.Fatalf("got %s", receipt)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// The recorder settings
+const (
+	recordQueue     = 4096    // frames waiting to be written
+	recordStreamLen = 1000000 // frames kept in a Redis stream, about
+)
+
+// The directions of recorded frames
+const (
+	recordOpen  = "open"  // a connection was opened, the frame is the query string
+	recordIn    = "in"    // a frame from the client
+	recordOut   = "out"   // a frame to the client
+	recordClose = "close" // the connection was closed
+)
+
+// secretParams are the parameters of the query strings of connections that
+// are not recorded
+var secretParams = []string{"token", "session"}
+
+// ephemeralFields are the contents of disappearing messages, which are not
+// recorded
+var ephemeralFields = []string{"text", "encrypted", "attachment"}
+
+var (
+	recordFrames  chan string // recorded frames waiting to be written
+	recordDropped int64       // frames dropped while the recorder fell behind
+)
+
+// startRecorder opens the recording when one is configured. A recording is a
+// file of JSON lines, or a Redis stream for "redis:<key>".
+func startRecorder() error {
+	if cfg.Record == "" {
+		return nil
+	}
+	recordFrames = make(chan string, recordQueue)
+	if strings.HasPrefix(cfg.Record, "redis:") {
+		go recordToStream(strings.TrimPrefix(cfg.Record, "redis:"))
+		return nil
+	}
+	f, err := os.OpenFile(cfg.Record, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	go recordToFile(f)
+	return nil
+}
+
+// record adds a frame of a connection to the recording, without the contents
+// of disappearing messages or the secrets of query strings. Frames are
+// dropped rather than holding up the connection when the recorder falls
+// behind.
+func record(connID, dir, frame string) {
+	if recordFrames == nil {
+		return
+	}
+	select {
+	case recordFrames <- recordLine(connID, dir, frame):
+	default:
+		atomic.AddInt64(&recordDropped, 1)
+	}
+}
+
+// recordLine returns the line of the recording of a frame, with its secrets
+// and disappearing contents left out
+func recordLine(connID, dir, frame string) string {
+	switch dir {
+	case recordOpen:
+		frame = redactQuery(frame)
+	case recordIn, recordOut:
+		frame = redactEphemeral(frame)
+	}
+	line := `{}`
+	line, _ = sjson.Set(line, "time", time.Now().UnixNano()/int64(time.Microsecond))
+	line, _ = sjson.Set(line, "conn", connID)
+	line, _ = sjson.Set(line, "dir", dir)
+	if frame != "" {
+		line, _ = sjson.Set(line, "frame", frame)
+	}
+	return line
+}
+
+// redactQuery returns the query string of a connection without its secrets
+func redactQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	for _, p := range secretParams {
+		values.Del(p)
+	}
+	return values.Encode()
+}
+
+// redactEphemeral returns a frame without the contents of the disappearing
+// messages in it, those with a ttl or an expiry: the frame itself, or the
+// messages in its arrays such as a history
+func redactEphemeral(frame string) string {
+	paths := []string{""}
+	gjson.Parse(frame).ForEach(func(key, value gjson.Result) bool {
+		if value.IsArray() {
+			for i := range value.Array() {
+				paths = append(paths, key.String()+"."+strconv.Itoa(i)+".")
+			}
+		}
+		return true
+	})
+	for _, path := range paths {
+		if gjson.Get(frame, path+"ttl").Int() == 0 && gjson.Get(frame, path+"expires").Int() == 0 {
+			continue
+		}
+		redacted := false
+		for _, field := range ephemeralFields {
+			if gjson.Get(frame, path+field).Exists() {
+				frame, _ = sjson.Delete(frame, path+field)
+				redacted = true
+			}
+		}
+		if redacted {
+			frame, _ = sjson.Set(frame, path+"redacted", true)
+		}
+	}
+	return frame
+}
+
+// recordToFile writes the recording to a file, flushing it whenever the
+// recorder caught up
+func recordToFile(f *os.File) {
+	w := bufio.NewWriter(f)
+	for line := range recordFrames {
+		w.WriteString(line)
+		w.WriteByte('\n')
+		if len(recordFrames) == 0 {
+			if err := w.Flush(); err != nil {
+				lg.Error("recording failed", "file", f.Name(), "err", err)
+			}
+		}
+	}
+}
+
+// recordToStream adds the recording to a Redis stream, trimmed to about the
+// last million frames
+func recordToStream(key string) {
+	for line := range recordFrames {
+		_, err := storeDo("XADD", key, "MAXLEN", "~", recordStreamLen, "*", "frame", line)
+		if err != nil {
+			lg.Error("recording failed", "stream", key, "err", err)
+		}
+	}
+}
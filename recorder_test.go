@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRedactEphemeral(t *testing.T) {
+	frame := redactEphemeral(`{"type":"Message","text":"gone soon","ttl":60,"feature":{"id":"a"}}`)
+	if gjson.Get(frame, "text").Exists() || !gjson.Get(frame, "redacted").Bool() ||
+		gjson.Get(frame, "feature.id").String() != "a" {
+		t.Fatalf("message with a ttl: got %s", frame)
+	}
+	frame = redactEphemeral(`{"type":"Rooms","messages":[{"text":"kept"},{"text":"gone","expires":1}]}`)
+	if gjson.Get(frame, "messages.0.text").String() != "kept" ||
+		gjson.Get(frame, "messages.1.text").Exists() || !gjson.Get(frame, "messages.1.redacted").Bool() {
+		t.Fatalf("history: got %s", frame)
+	}
+	for _, kept := range []string{
+		`{"type":"Message","text":"stays"}`,
+		`{"type":"Poll","room":"r","question":"q","ttl":60}`,
+		`{"type":"Upload","key":"k","expires":1}`,
+	} {
+		if frame := redactEphemeral(kept); frame != kept {
+			t.Fatalf("got %s, want %s", frame, kept)
+		}
+	}
+}
+
+func TestRecordLine(t *testing.T) {
+	line := recordLine("c1", recordIn, `{"type":"Message","text":"secret","ttl":5}`)
+	if frame := gjson.Get(line, "frame").String(); gjson.Get(frame, "text").Exists() ||
+		!gjson.Get(frame, "redacted").Bool() || gjson.Get(line, "dir").String() != recordIn {
+		t.Fatalf("got %s", line)
+	}
+	line = recordLine("c1", recordOpen, "session=s3cret&compress=false&token=abc.def.ghi")
+	if gjson.Get(line, "frame").String() != "compress=false" || gjson.Get(line, "conn").String() != "c1" {
+		t.Fatalf("open: got %s", line)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// reloadable are the settings that a reload applies to the running server,
+// by config field. Other changes take a restart.
+var reloadable = map[string]bool{
+	"RateLimits":    true,
+	"MaxStrikes":    true,
+	"RoamDist":      true,
+	"PeopleTTL":     true,
+	"SessionTTL":    true,
+	"PresenceTTL":   true,
+	"NotifyWindow":  true,
+	"ViewDebounce":  true,
+	"ViewportSlack": true,
+	"LogLevel":      true,
+	"LogFormat":     true,
+	"MaxIPConns":    true,
+	"ConnectRate":   true,
+	"AllowIPs":      true,
+	"DenyIPs":       true,
+	"BanStrikes":    true,
+	"BanTime":       true,
+	"TrustProxy":    true,
+	"AllowOrigins":  true,
+}
+
+// watchReload reloads the config whenever a SIGHUP is received
+func watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		reloadConfig()
+	}
+}
+
+// reloadConfig reads the command line, environment and config file again and
+// applies the reloadable settings, keeping every connection open. A config
+// that does not validate is ignored.
+func reloadConfig() {
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		lg.Error("config reload failed", "err", err)
+		return
+	}
+	prev := live()
+	next, restart := applyReload(*prev, c)
+	if next.LogLevel != prev.LogLevel || next.LogFormat != prev.LogFormat {
+		setupLogger(next)
+	}
+	// connections read the settings from a snapshot, so the new config
+	// replaces the old one as a whole
+	liveCfg.Store(&next)
+	if next.RoamDist != prev.RoamDist {
+		// the roaming fences of all namespaces take the new distance
+		if err := geofenceSetup(); err != nil {
+			lg.Error("roam fence update failed", "err", err)
+		}
+	}
+	lg.Info("config reloaded", "file", cfg.ConfigFile)
+	if len(restart) > 0 {
+		lg.Warn("config changes take a restart", "settings", strings.Join(restart, ","))
+	}
+}
+
+// applyReload returns prev with the reloadable settings of c, and the names
+// of the other settings that differ and take a restart
+func applyReload(prev, c config) (config, []string) {
+	var restart []string
+	next, from := reflect.ValueOf(&prev).Elem(), reflect.ValueOf(c)
+	for i := 0; i < next.NumField(); i++ {
+		name := next.Type().Field(i).Name
+		if reloadable[name] {
+			next.Field(i).Set(from.Field(i))
+		} else if !reflect.DeepEqual(next.Field(i).Interface(), from.Field(i).Interface()) {
+			restart = append(restart, name)
+		}
+	}
+	return prev, restart
+}
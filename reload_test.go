@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyReload(t *testing.T) {
+	prev := config{PeopleTTL: time.Minute, MaxStrikes: 3, ListenAddr: ":8000"}
+	c := config{PeopleTTL: 2 * time.Minute, MaxStrikes: 3, ListenAddr: ":9000"}
+	next, restart := applyReload(prev, c)
+	if next.PeopleTTL != 2*time.Minute {
+		t.Fatalf("people ttl: got %v, want the reloaded one", next.PeopleTTL)
+	}
+	if next.ListenAddr != ":8000" {
+		t.Fatalf("addr: got %q, want the one of the running server", next.ListenAddr)
+	}
+	if len(restart) != 1 || restart[0] != "ListenAddr" {
+		t.Fatalf("restart: got %v", restart)
+	}
+	if prev.PeopleTTL != time.Minute {
+		t.Fatal("the previous config must not change")
+	}
+}
+
+// TestReloadConcurrent reloads while connections read the settings, for the
+// race detector
+func TestReloadConcurrent(t *testing.T) {
+	testServer(t)
+	prevArgs := os.Args
+	t.Cleanup(func() {
+		os.Args = prevArgs
+		liveCfg.Store(&cfg)
+		setupLogger(cfg)
+	})
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				allow(testID(0), "Message")
+				notifyWindow()
+				lg.Debug("reading", "ttl", live().PeopleTTL)
+			}
+		}()
+	}
+	for _, ttl := range []string{"2m", "3m"} {
+		os.Args = []string{"chat", "-demo", "-log-level", "error", "-namespaces", "campus",
+			"-people-ttl", ttl, "-max-strikes", "7"}
+		reloadConfig()
+	}
+	close(stop)
+	wg.Wait()
+	if c := live(); c.PeopleTTL != 3*time.Minute || c.MaxStrikes != 7 {
+		t.Fatalf("got people ttl %v, max strikes %d", c.PeopleTTL, c.MaxStrikes)
+	}
+	if cfg.PeopleTTL == 3*time.Minute {
+		t.Fatal("a reload must not write the startup config")
+	}
+}
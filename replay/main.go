@@ -0,0 +1,200 @@
+// Command replay replays a recording of the frames of a server against a
+// server, for debugging and demoing. The connections of the recording are
+// opened and closed, and the frames that their clients sent are sent again,
+// at the recorded pace times the speed. Frames that the server sent are only
+// counted, to compare with what the server sends this time.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+// frame is a recorded frame
+type frame struct {
+	time  int64 // microseconds since the epoch
+	conn  string
+	dir   string
+	frame string
+}
+
+var received int64 // frames received from the server
+
+func main() {
+	addr := flag.String("a", ":8000", "server address")
+	file := flag.String("f", "", "recording file of JSON lines")
+	redisAddr := flag.String("redis", ":6379", "Redis address of a recording stream")
+	stream := flag.String("stream", "", "Redis stream key of the recording, used instead of a file")
+	speed := flag.Float64("speed", 1, "replay speed, 2 replays twice as fast")
+	flag.Parse()
+	if *speed <= 0 {
+		log.Fatal("speed must be greater than zero")
+	}
+
+	var frames []frame
+	var err error
+	switch {
+	case *stream != "":
+		frames, err = readStream(*redisAddr, *stream)
+	case *file != "":
+		frames, err = readFile(*file)
+	default:
+		err = errors.New("a recording file or stream is required")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(frames) == 0 {
+		log.Fatal("the recording is empty")
+	}
+	log.Printf("replaying %d frames at %gx", len(frames), *speed)
+	stats := replay(*addr, frames, *speed)
+	time.Sleep(time.Second) // wait for the last replies
+	log.Printf("connections: %d, sent: %d, received: %d, recorded replies: %d",
+		stats.conns, stats.sent, atomic.LoadInt64(&received), stats.recorded)
+}
+
+// replayStats are the counts of a replay
+type replayStats struct {
+	conns    int
+	sent     int
+	recorded int
+}
+
+// replay replays the frames against the server at addr
+func replay(addr string, frames []frame, speed float64) replayStats {
+	var stats replayStats
+	conns := make(map[string]*websocket.Conn)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, f := range frames {
+		at := time.Duration(float64(time.Duration(f.time-frames[0].time)*time.Microsecond) / speed)
+		time.Sleep(time.Until(start.Add(at)))
+		switch f.dir {
+		case "open":
+			url := "ws://" + addr + "/ws"
+			if f.frame != "" {
+				url += "?" + f.frame
+			}
+			ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{})
+			if err != nil {
+				log.Printf("connect %s: %v", f.conn, err)
+				continue
+			}
+			resp.Body.Close()
+			conns[f.conn] = ws
+			stats.conns++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, _, err := ws.ReadMessage(); err != nil {
+						return
+					}
+					atomic.AddInt64(&received, 1)
+				}
+			}()
+		case "in":
+			if ws, ok := conns[f.conn]; ok {
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(f.frame)); err != nil {
+					log.Printf("send %s: %v", f.conn, err)
+				}
+				stats.sent++
+			}
+		case "out":
+			stats.recorded++
+		case "close":
+			if ws, ok := conns[f.conn]; ok {
+				ws.Close()
+				delete(conns, f.conn)
+			}
+		}
+	}
+	for _, ws := range conns {
+		ws.Close()
+	}
+	wg.Wait()
+	return stats
+}
+
+// parseFrame parses a line of a recording
+func parseFrame(line string) frame {
+	return frame{
+		time:  gjson.Get(line, "time").Int(),
+		conn:  gjson.Get(line, "conn").String(),
+		dir:   gjson.Get(line, "dir").String(),
+		frame: gjson.Get(line, "frame").String(),
+	}
+}
+
+// readFile reads a recording file
+func readFile(path string) ([]frame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var frames []frame
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			frames = append(frames, parseFrame(line))
+		}
+	}
+	return frames, scanner.Err()
+}
+
+// readStream reads a recording from a Redis stream, a thousand entries at a
+// time
+func readStream(addr, key string) ([]frame, error) {
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var frames []frame
+	start := "-"
+	for {
+		entries, err := redis.Values(conn.Do("XRANGE", key, start, "+", "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return frames, nil
+		}
+		var id string
+		for _, entry := range entries {
+			parts, _ := redis.Values(entry, nil)
+			if len(parts) != 2 {
+				continue
+			}
+			id, _ = redis.String(parts[0], nil)
+			fields, _ := redis.Strings(parts[1], nil)
+			if len(fields) == 2 {
+				frames = append(frames, parseFrame(fields[1]))
+			}
+		}
+		start = nextStreamID(id)
+	}
+}
+
+// nextStreamID returns the stream entry id after an id
+func nextStreamID(id string) string {
+	i := strings.IndexByte(id, '-')
+	seq, _ := strconv.ParseUint(id[i+1:], 10, 64)
+	return id[:i] + "-" + strconv.FormatUint(seq+1, 10)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The roles of people in a room. The admin of a room is always its owner.
+const (
+	roleOwner     = "owner"     // grants every role
+	roleModerator = "moderator" // grants the speaker and listener roles
+	roleSpeaker   = "speaker"   // chats on stages
+	roleListener  = "listener"  // does not chat in the room
+)
+
+// maxRoleSize is the largest body accepted by the roles API
+const maxRoleSize = 1 << 10
+
+// rolesKey returns the Redis key of the roles of a room, by secure id
+func rolesKey(roomID string) string {
+	return "roles:" + roomID
+}
+
+// validRole returns true for the roles that can be granted, and for the
+// empty role that takes a role away
+func validRole(role string) bool {
+	switch role {
+	case "", roleOwner, roleModerator, roleSpeaker, roleListener:
+		return true
+	}
+	return false
+}
+
+// roomAccess returns the clientID of the admin of a room and whether it is a
+// stage, where only speakers chat
+func roomAccess(roomID string) (admin string, stage bool) {
+	roommu.Lock()
+	defer roommu.Unlock()
+	if room, ok := rooms[roomID]; ok {
+		return room.Admin, room.Stage
+	}
+	return "", false
+}
+
+// roomRole returns the role of a person in a room, empty for none
+func roomRole(clientID, roomID string) (string, error) {
+	if admin, _ := roomAccess(roomID); admin != "" && admin == clientID {
+		return roleOwner, nil
+	}
+	role, err := redis.String(storeDo("HGET", rolesKey(roomID), secureClientID(clientID)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return role, err
+}
+
+// checkSpeaker checks that a person may chat in every room that their
+// message is sent in. Stages need an owner, moderator or speaker, and
+// listeners do not chat in any room.
+func checkSpeaker(clientID string, roomIDs []string) *validationError {
+	for _, roomID := range roomIDs {
+		role, err := roomRole(clientID, roomID)
+		if err != nil {
+			lg.Error("role lookup failed", "room", roomID, "err", err)
+			return invalid("unavailable", "Message could not be sent")
+		}
+		_, stage := roomAccess(roomID)
+		if role == roleListener || stage && role == "" {
+			return invalid("not_a_speaker", "Only speakers can chat in "+localRoom(roomID))
+		}
+	}
+	return nil
+}
+
+// roleMessage is a websocket message handler for the owners and moderators
+// of a room that grant a role to a person, by their secure id, or take it
+// away with an empty role. Owners grant every role and moderators make people
+// speakers and listeners. The person and the sender get a Role.
+func roleMessage(connID, msg string) {
+	var r protocol.Role
+	if err := protocol.Decode(msg, &r); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if !validRole(r.Role) {
+		sendError(connID, "invalid_role", "Role must be owner, moderator, speaker or listener")
+		return
+	}
+	if !validClientID(r.ID) {
+		sendError(connID, "invalid_id", "Id must be 24 hex characters")
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	roomID := namespaceRoom(connNamespace(connID), r.Room)
+	if clientID == "" || !isInside(clientID, roomID) {
+		sendError(connID, "not_in_room", "Only members of the room can change its roles")
+		return
+	}
+	granter, err := roomRole(clientID, roomID)
+	var target string
+	if err == nil {
+		target, err = redis.String(storeDo("HGET", rolesKey(roomID), r.ID))
+		if err == redis.ErrNil {
+			target, err = "", nil
+		}
+	}
+	if err != nil {
+		lg.Error("role lookup failed", "room", roomID, "err", err)
+		sendError(connID, "unavailable", "Roles are unavailable")
+		return
+	}
+	if !grants(granter, target, r.Role) {
+		sendError(connID, "forbidden", "Only owners and moderators can change roles")
+		return
+	}
+	if admin, _ := roomAccess(roomID); admin != "" && secureClientID(admin) == r.ID {
+		sendError(connID, "forbidden", "The admin of the room is its owner")
+		return
+	}
+	if err := setRole(roomID, r.ID, r.Role); err != nil {
+		lg.Error("role store failed", "room", roomID, "err", err)
+		sendError(connID, "unavailable", "Role could not be stored")
+		return
+	}
+	audit(secureClientID(clientID), "", "role_set", roleChange(roomID, r.ID, r.Role))
+	reply, _ := protocol.Encode(protocol.Role{
+		Envelope: protocol.Envelope{Type: protocol.TypeRole},
+		Room:     r.Room,
+		ID:       r.ID,
+		Role:     r.Role,
+	})
+	send(connID, reply)
+	deliverSecure(r.ID, reply)
+}
+
+// grants returns true when a person with the granter role may change the
+// role of someone from one role to another
+func grants(granter, from, to string) bool {
+	switch granter {
+	case roleOwner:
+		return true
+	case roleModerator:
+		for _, role := range []string{from, to} {
+			if role != "" && role != roleSpeaker && role != roleListener {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// setRole stores the role of a person in a room, by secure id. An empty role
+// takes it away.
+func setRole(roomID, secureID, role string) error {
+	var err error
+	if role == "" {
+		_, err = storeDo("HDEL", rolesKey(roomID), secureID)
+	} else {
+		_, err = storeDo("HSET", rolesKey(roomID), secureID, role)
+	}
+	return err
+}
+
+// roleChange returns the audit payload of a role change
+func roleChange(roomID, secureID, role string) string {
+	change, _ := sjson.Set(`{}`, "room", roomID)
+	change, _ = sjson.Set(change, "id", secureID)
+	change, _ = sjson.Set(change, "role", role)
+	return change
+}
+
+// rolesAPI is an HTTP handler for the roles of a room. Roles of the rooms of
+// a namespace are at /api/roles/{namespace}/{id}. The body is the secure id
+// and the role of a person, an empty role takes it away.
+//
+//	GET /api/roles/{id}  the roles of a room by secure id
+//	PUT /api/roles/{id}  grant a role
+func rolesAPI(w http.ResponseWriter, r *http.Request) {
+	fenceID := strings.TrimPrefix(r.URL.Path, "/api/roles/")
+	var ns string
+	if i := strings.IndexByte(fenceID, '/'); i >= 0 {
+		ns, fenceID = fenceID[:i], fenceID[i+1:]
+		if ns == "" || !knownNamespace(ns) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	roomID := namespaceRoom(ns, fenceID)
+	if !roomExists(roomID) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		roles, err := redis.StringMap(storeDo("HGETALL", rolesKey(roomID)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if admin, _ := roomAccess(roomID); admin != "" {
+			roles[secureClientID(admin)] = roleOwner
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roles)
+	case http.MethodPut:
+		var role struct {
+			ID   string `json:"id"`
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoleSize)).Decode(&role); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if !validClientID(role.ID) || !validRole(role.Role) {
+			http.Error(w, "invalid id or role", http.StatusBadRequest)
+			return
+		}
+		if err := setRole(roomID, role.ID, role.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		auditRequest(r, "role_set", roleChange(roomID, role.ID, role.Role))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// Room is a chat room bound to a geofence. People inside of the fence are the
+// members of the room.
+type Room struct {
+	ID       string     `json:"id"`                 // fence ID, prefixed by the namespace
+	Name     string     `json:"name"`               // display name
+	Capacity int        `json:"capacity,omitempty"` // maximum members, 0 is unlimited
+	Color    string     `json:"color,omitempty"`    // display color
+	Admin    string     `json:"admin,omitempty"`    // clientID of the room admin
+	Expires  *time.Time `json:"expires,omitempty"`  // when a pop-up room closes
+	Floor    string     `json:"floor,omitempty"`    // floor of the room, empty for all floors
+	Stage    bool       `json:"stage,omitempty"`    // only owners, moderators and speakers chat
+	Parent   string     `json:"parent,omitempty"`   // fence ID of the room this room is nested in
+	Object   string     `json:"-"`                  // GeoJSON fence object
+
+	members map[string]bool // clientIDs inside of the fence
+	loaded  bool            // read from the fence source, not the fences API
+	timer   *time.Timer     // closes a pop-up room when it expires
+	bbox    rect            // bounding box of the fence
+}
+
+var (
+	roommu sync.Mutex       // guard rooms and their members
+	rooms  map[string]*Room // fence ID -> room map
+)
+
+// roomChannel returns the name of the Tile38 fence channel for a room
+func roomChannel(roomID string) string {
+	return "room:" + roomID
+}
+
+// newRoom creates a room from a GeoJSON feature. The room metadata is read
+// from the feature properties, the id defaults to defID.
+func newRoom(defID, object string) *Room {
+	props := gjson.Get(object, "properties")
+	room := &Room{
+		ID:       props.Get("id").String(),
+		Name:     props.Get("name").String(),
+		Capacity: int(props.Get("capacity").Int()),
+		Color:    props.Get("color").String(),
+		Admin:    props.Get("admin").String(),
+		Floor:    roomFloor(object),
+		Stage:    props.Get("stage").Bool(),
+		Parent:   props.Get("parent").String(),
+		Object:   object,
+		members:  make(map[string]bool),
+		bbox:     fenceRect(object),
+	}
+	if room.ID == "" {
+		room.ID = defID
+	}
+	if room.Name == "" {
+		room.Name = strings.Title(strings.Replace(room.ID, "-", " ", -1))
+	}
+	if t, ok := roomExpires(object); ok {
+		room.Expires = &t
+	}
+	return room
+}
+
+// newNamespaceRoom creates a room of a namespace from a GeoJSON feature
+func newNamespaceRoom(ns, defID, object string) *Room {
+	room := newRoom(defID, object)
+	room.ID = namespaceRoom(ns, room.ID)
+	return room
+}
+
+// roomFloor returns the floor of a room fence, empty for all floors or when
+// floors are not configured
+func roomFloor(object string) string {
+	floor, _ := featureFloor(object)
+	return floor
+}
+
+// roomOnFloor returns true when a room has members on a floor. Rooms that
+// are not known here are taken to span every floor.
+func roomOnFloor(roomID, floor string) bool {
+	roommu.Lock()
+	defer roommu.Unlock()
+	room, ok := rooms[roomID]
+	return !ok || room.Floor == "" || room.Floor == floor
+}
+
+// roomExists returns true when a room is registered for the fence ID
+func roomExists(roomID string) bool {
+	roommu.Lock()
+	_, ok := rooms[roomID]
+	roommu.Unlock()
+	return ok
+}
+
+// putRoom registers a room, replacing the metadata of an existing room while
+// keeping its members. Returns true when the room is new.
+func putRoom(room *Room) bool {
+	roommu.Lock()
+	defer roommu.Unlock()
+	if room.Expires != nil {
+		room.timer = time.AfterFunc(time.Until(*room.Expires), func() {
+			closeRoom(room)
+		})
+	}
+	if prev, ok := rooms[room.ID]; ok {
+		if prev.timer != nil {
+			prev.timer.Stop()
+		}
+		room.members = prev.members
+		rooms[room.ID] = room
+		return false
+	}
+	rooms[room.ID] = room
+	return true
+}
+
+// deleteRoom unregisters a room. Returns false when the room does not exist.
+func deleteRoom(roomID string) bool {
+	roommu.Lock()
+	defer roommu.Unlock()
+	room, ok := rooms[roomID]
+	if !ok {
+		return false
+	}
+	if room.timer != nil {
+		room.timer.Stop()
+	}
+	delete(rooms, roomID)
+	return true
+}
+
+// roomFences creates the Tile38 fence objects and channels for all rooms
+func roomFences() error {
+	roommu.Lock()
+	var objs [][2]string
+	for _, room := range rooms {
+		objs = append(objs, [2]string{room.ID, room.Object})
+	}
+	roommu.Unlock()
+	for _, obj := range objs {
+		err := setRoomFence(obj[0], obj[1])
+		if err != nil && err != errRoomExpired {
+			return err
+		}
+	}
+	return nil
+}
+
+// setRoomFence stores the fence object in the rooms collection and creates or
+// updates its fence channel. A room on a floor fences the people of that
+// floor, and a room without one has a channel for every floor. The object and
+// channels of a pop-up room expire in the GeoStore along with the room.
+func setRoomFence(roomID, object string) error {
+	ns, fenceID := splitRoom(roomID)
+	var ttl time.Duration
+	if t, ok := roomExpires(object); ok {
+		if ttl = time.Until(t); ttl < time.Second {
+			return errRoomExpired
+		}
+	}
+	if err := geo.SetFeature(roomsKey(ns), fenceID, object, ttl); err != nil {
+		return err
+	}
+	if floor := roomFloor(object); floor != "" {
+		for _, channel := range floorKeys(roomChannel(roomID))[1:] {
+			if err := geo.DelFence(channel); err != nil {
+				return err
+			}
+		}
+		return geo.SetFence(roomChannel(roomID),
+			Fence{Key: floorKey(peopleKey(ns), floor), Object: object, TTL: ttl})
+	}
+	for _, key := range floorKeys(peopleKey(ns)) {
+		_, floor := splitFloor(key)
+		err := geo.SetFence(floorKey(roomChannel(roomID), floor),
+			Fence{Key: key, Object: object, TTL: ttl})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delRoomFence deletes the fence object and fence channels of a room
+func delRoomFence(roomID string) error {
+	for _, channel := range floorKeys(roomChannel(roomID)) {
+		if err := geo.DelFence(channel); err != nil {
+			return err
+		}
+	}
+	ns, fenceID := splitRoom(roomID)
+	return geo.DelFeature(roomsKey(ns), fenceID)
+}
+
+// setInside records whether a client is currently inside of a room fence
+func setInside(clientID, roomID string, inside bool) {
+	roommu.Lock()
+	defer roommu.Unlock()
+	room, ok := rooms[roomID]
+	if !ok {
+		return
+	}
+	if inside {
+		room.members[clientID] = true
+	} else {
+		delete(room.members, clientID)
+	}
+}
+
+// isInside returns true when a client is inside of a room fence
+func isInside(clientID, roomID string) bool {
+	roommu.Lock()
+	defer roommu.Unlock()
+	room, ok := rooms[roomID]
+	return ok && room.members[clientID]
+}
+
+// fencesInside returns the IDs of all room fences that a client is inside of
+func fencesInside(clientID string) []string {
+	roommu.Lock()
+	defer roommu.Unlock()
+	var roomIDs []string
+	for _, room := range rooms {
+		if room.members[clientID] {
+			roomIDs = append(roomIDs, room.ID)
+		}
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+// roomMembers returns the clientIDs of the members of a room
+func roomMembers(roomID string) []string {
+	roommu.Lock()
+	defer roommu.Unlock()
+	room, ok := rooms[roomID]
+	if !ok {
+		return nil
+	}
+	members := make([]string, 0, len(room.members))
+	for clientID := range room.members {
+		members = append(members, clientID)
+	}
+	return members
+}
+
+// forgetClient removes a client from all rooms
+func forgetClient(clientID string) {
+	roommu.Lock()
+	for _, room := range rooms {
+		delete(room.members, clientID)
+	}
+	roommu.Unlock()
+	forgetTransitions(clientID)
+}
+
+// roomsMessage is a websocket message handler that lists the rooms the
+// client is currently in
+func roomsMessage(connID, msg string) {
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+
+	type roomInfo struct {
+		Room
+		Occupants int `json:"occupants"`
+	}
+	list := []roomInfo{}
+	roommu.Lock()
+	for _, room := range rooms {
+		if room.members[clientID] {
+			info := roomInfo{*room, len(room.members)}
+			info.ID = localRoom(room.ID)
+			list = append(list, info)
+		}
+	}
+	roommu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, _ := json.Marshal(list)
+	send(connID, `{"type":"`+protocol.TypeRooms+`","rooms":`+string(data)+`}`)
+}
+
+// roomNotification handles a Tile38 notification for a room fence, tracking
+// its membership and letting the audience of the room know about the change.
+// Returns false when the notification is not understood.
+func roomNotification(roomID, msg string) bool {
+	clientID := gjson.Get(msg, "object.id").String()
+	idmu.Lock()
+	connID := clientConnM[clientID] // get the connection from the id
+	idmu.Unlock()
+
+	// the audience is taken before the membership changes, so that a person
+	// leaving is still counted for the other members
+	audience := roomAudience(roomID)
+
+	var typ string
+	switch detect := gjson.Get(msg, "detect").String(); detect {
+	case "enter", "inside":
+		if detect == "enter" && isInside(clientID, roomID) {
+			// entered the fence of the room on another floor
+			detect = "inside"
+		}
+		setInside(clientID, roomID, true)
+		if detect == "enter" && connID != "" {
+			// catch up on the chat history and open polls of the room
+			go replayHistory(connID, roomID)
+			go sendPolls(connID, roomID)
+		}
+		if detect == "enter" {
+			queueWebhook(detect, roomID, msg)
+			recordOccupancy(detect, roomID, msg)
+			announceMovement(detect, roomID, msg)
+		}
+		typ = protocol.TypeInside
+	case "exit":
+		setInside(clientID, roomID, false)
+		queueWebhook(detect, roomID, msg)
+		recordOccupancy(detect, roomID, msg)
+		announceMovement(detect, roomID, msg)
+		typ = protocol.TypeOutside
+	default:
+		return false
+	}
+	ns, fenceID := splitRoom(roomID)
+	geofenceEvent(typ, ns, fenceID, msg)
+	feature := secureFeature(gjson.Get(msg, "object").Raw)
+	via := localRooms(roomParents(roomID))
+	outMsg := placeNotification(typ, feature, fenceID, via, false)
+
+	if connID != "" {
+		sendNotification(connID, placeNotification(typ, feature, fenceID, via, true))
+	}
+	if isHidden(feature) {
+		return true
+	}
+	for _, id := range audience {
+		if id != connID && !hiddenConn(id, outMsg) {
+			sendNotification(id, outMsg)
+		}
+	}
+	if gjson.Get(msg, "command").String() == "del" {
+		// the person was deleted, such as when their position expired,
+		// rather than removed by this instance. Every instance receives
+		// the notification and tells its own viewers.
+		tombstone(ns, notification(protocol.TypeGone, feature, "", false))
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestRoomDelTombstone(t *testing.T) {
+	a := testID(1)
+	viewer := dialTest(t, "/ws", nil)
+	viewer.expect("Session")
+	viewer.send(`{"type":"Viewport","bounds":{"_sw":{"lat":39.7,"lng":-105.1},"_ne":{"lat":39.8,"lng":-104.9}},"zoom":15}`)
+	waitFor(t, func() bool {
+		viewportmu.Lock()
+		defer viewportmu.Unlock()
+		return len(viewportM) > 0
+	})
+	room := testRoom(t, "lobby", a)
+	object := testFeature(a, 39.7425, -104.9965)
+
+	// an exit of a person who walked out is not a tombstone
+	roomNotification(room, fmt.Sprintf(`{"command":"set","detect":"exit","id":%q,"object":%s}`, a, object))
+	viewer.none("Gone", 100*time.Millisecond)
+
+	setInside(a, room, true)
+	roomNotification(room, fmt.Sprintf(`{"command":"del","detect":"exit","id":%q,"object":%s}`, a, object))
+	if gone := viewer.expect("Gone"); gjson.Get(gone, "feature.id").String() != secureClientID(a) {
+		t.Fatalf("got %s", gone)
+	}
+}
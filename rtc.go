@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The WebRTC signaling limits
+const (
+	maxSDPLen       = 16 * 1024 // bytes of the session description of an offer or answer
+	maxCandidateLen = 1024      // bytes of an ICE candidate
+)
+
+// rtcMessage is a websocket message handler that relays the RTCOffer,
+// RTCAnswer and RTCCandidate messages of a call to a nearby person. The
+// server only checks that the person is within the roaming distance of the
+// sender, the call itself goes peer to peer, or through a TURN server.
+func rtcMessage(connID, msg string) {
+	var sig protocol.Signal
+	if err := protocol.Decode(msg, &sig); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if err := validateSignal(&sig); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	clientID, _, targetID, status := nearbyTarget(connID, sig.Target)
+	switch status {
+	case "unknown":
+		sendError(connID, "no_feature", "Send a Feature before an "+sig.Type)
+		return
+	case "faraway":
+		sendError(connID, "faraway", "Target is not nearby")
+		return
+	}
+	sig.Target, sig.From = "", secureClientID(clientID)
+	relay, _ := protocol.Encode(sig)
+	deliver([]string{targetID}, relay)
+}
+
+// validateSignal checks the target and the payload of a signaling message
+func validateSignal(sig *protocol.Signal) *validationError {
+	if !validClientID(sig.Target) {
+		return invalid("invalid_id", "Target must be 24 hex characters")
+	}
+	if sig.Type == protocol.TypeRTCCandidate {
+		if len(sig.Candidate) == 0 || len(sig.Candidate) > maxCandidateLen {
+			return invalid("invalid_candidate", "Candidate must be an ICE candidate of up to 1024 bytes")
+		}
+		return nil
+	}
+	if sig.SDP == "" || len(sig.SDP) > maxSDPLen {
+		return invalid("invalid_sdp", "SDP must be a session description of up to 16384 bytes")
+	}
+	return nil
+}
+
+// iceServersMessage is a websocket message handler that sends the STUN and
+// TURN servers to the client. With a TURN secret, TURN servers come with
+// time-limited credentials in the form of the TURN REST API, which coturn
+// checks with its static-auth-secret.
+func iceServersMessage(connID, msg string) {
+	if len(cfg.ICEServers) == 0 {
+		sendError(connID, "disabled", "Calls are disabled")
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before ICEServers")
+		return
+	}
+	reply := protocol.ICEServers{Envelope: protocol.Envelope{Type: protocol.TypeICEServers}}
+	var stun, turn []string
+	for _, u := range cfg.ICEServers {
+		if strings.HasPrefix(u, "stun:") || strings.HasPrefix(u, "stuns:") {
+			stun = append(stun, u)
+		} else {
+			turn = append(turn, u)
+		}
+	}
+	if len(stun) > 0 {
+		reply.Servers = append(reply.Servers, protocol.ICEServer{URLs: stun})
+	}
+	if len(turn) > 0 {
+		server := protocol.ICEServer{URLs: turn}
+		if cfg.TURNSecret != "" {
+			server.Username, server.Credential = turnCredentials(clientID)
+			reply.TTL = int(cfg.TURNTTL / time.Second)
+		}
+		reply.Servers = append(reply.Servers, server)
+	}
+	out, _ := protocol.Encode(reply)
+	send(connID, out)
+}
+
+// turnCredentials returns a TURN username that expires after the TURN ttl,
+// and its credential signed with the TURN secret
+func turnCredentials(clientID string) (username, credential string) {
+	expires := time.Now().Add(cfg.TURNTTL).Unix()
+	username = strconv.FormatInt(expires, 10) + ":" + secureClientID(clientID)
+	mac := hmac.New(sha1.New, []byte(cfg.TURNSecret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
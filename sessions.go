@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tile38/proximity-chat/protocol"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// session is the state of a client that survives a reconnect. A session is
+// suspended when its connection closes, and expires when the client does not
+// resume it within the session TTL.
+type session struct {
+	token    string
+	connID   string      // current connection, empty when suspended
+	clientID string      // clientID of the person
+	userID   string      // authenticated user, if any
+	feature  string      // last Feature message
+	viewport string      // last Viewport message
+	key      string      // base64 public key, if any
+	rooms    []string    // rooms the person was inside when suspended
+	buffer   []string    // frames missed while suspended
+	timer    *time.Timer // expires a suspended session
+}
+
+var (
+	sessionmu      sync.Mutex          // guard session maps and sessions
+	sessionM       map[string]*session // token -> session
+	connSessionM   map[string]*session // connID -> session
+	clientSessionM map[string]*session // clientID -> session
+)
+
+// openSession resumes the session named by the "session" query parameter of
+// the upgrade request, or starts a new one, and sends its token to the client
+func openSession(connID string, r *http.Request) {
+	userID, _ := r.Context().Value(userIDKey).(string)
+	if s := resumeSession(connID, userID, r.URL.Query().Get("session")); s != nil {
+		restoreSession(connID, s)
+		return
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	s := &session{token: hex.EncodeToString(b[:]), connID: connID, userID: userID}
+	sessionmu.Lock()
+	sessionM[s.token] = s
+	connSessionM[connID] = s
+	sessionmu.Unlock()
+	sendSession(connID, s.token, false)
+}
+
+// resumeSession attaches a suspended session to a new connection. Returns nil
+// when there is no such session or it belongs to a different user.
+func resumeSession(connID, userID, token string) *session {
+	if token == "" {
+		return nil
+	}
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := sessionM[token]
+	if !ok || s.connID != "" || s.userID != userID {
+		return nil
+	}
+	s.timer.Stop()
+	s.connID = connID
+	connSessionM[connID] = s
+	return s
+}
+
+// suspendedSession returns true when a session can be resumed
+func suspendedSession(token string) bool {
+	if token == "" {
+		return false
+	}
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := sessionM[token]
+	return ok && s.connID == ""
+}
+
+// restoreSession brings a resumed connection back to where it left off: its
+// people entry, room memberships and viewport, followed by the frames it
+// missed
+func restoreSession(connID string, s *session) {
+	sessionmu.Lock()
+	clientID, feature, viewportMsg, key := s.clientID, s.feature, s.viewport, s.key
+	rooms, buffer := s.rooms, s.buffer
+	s.rooms, s.buffer = nil, nil
+	sessionmu.Unlock()
+
+	sendSession(connID, s.token, true)
+	if key != "" {
+		keymu.Lock()
+		keyM[connID] = key
+		keymu.Unlock()
+	}
+	if clientID != "" {
+		idmu.Lock()
+		clientConnM[clientID] = connID
+		connClientM[connID] = clientID
+		secureM[secureClientID(clientID)] = clientID
+		idmu.Unlock()
+		for _, roomID := range rooms {
+			setInside(clientID, roomID, true)
+		}
+		if feature != "" {
+			floor, _ := featureFloor(feature)
+			setFloor(clientNamespace(clientID), clientID, floor)
+			// the restored entry lives for the session TTL, until the client
+			// sends its position again
+			geo.SetFeature(personKey(clientID), clientID,
+				privateFeature(clientID, attachKey(connID, attachProfile(clientID, feature))),
+				live().SessionTTL)
+		}
+	}
+	if viewportMsg != "" {
+		viewport(connID, viewportMsg)
+	}
+	for _, msg := range unexpired(buffer) {
+		send(connID, msg)
+	}
+	lg.Debug("session resumed", "conn", connID, "client", clientID,
+		"missed", len(buffer))
+}
+
+// sendSession sends the session token to a connection
+func sendSession(connID, token string, resumed bool) {
+	msg, _ := protocol.Encode(protocol.Session{
+		Envelope: protocol.Envelope{Type: protocol.TypeSession},
+		Token:    token,
+		Resumed:  resumed,
+	})
+	send(connID, msg)
+}
+
+// sessionFeature records the last feature of a connection in its session
+func sessionFeature(connID, clientID, msg string) {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := connSessionM[connID]
+	if !ok {
+		return
+	}
+	if prev, ok := clientSessionM[clientID]; ok && prev != s && prev.connID == "" {
+		// the person came back without resuming, the old session is stale
+		prev.timer.Stop()
+		delete(sessionM, prev.token)
+	}
+	s.clientID = clientID
+	s.feature = msg
+	clientSessionM[clientID] = s
+}
+
+// sessionLastFeature returns the last Feature message of a connection, or
+// an empty string
+func sessionLastFeature(connID string) string {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	if s, ok := connSessionM[connID]; ok {
+		return s.feature
+	}
+	return ""
+}
+
+// sessionViewport records the last viewport of a connection in its session
+func sessionViewport(connID, msg string) {
+	sessionmu.Lock()
+	if s, ok := connSessionM[connID]; ok {
+		s.viewport = msg
+	}
+	sessionmu.Unlock()
+}
+
+// sessionKey records the public key of a connection in its session
+func sessionKey(connID, key string) {
+	sessionmu.Lock()
+	if s, ok := connSessionM[connID]; ok {
+		s.key = key
+	}
+	sessionmu.Unlock()
+}
+
+// suspendSession keeps the session of a closed connection around for the
+// session TTL. Returns false when the connection has no session to suspend.
+func suspendSession(connID string) bool {
+	ttl := live().SessionTTL
+	sessionmu.Lock()
+	s, ok := connSessionM[connID]
+	delete(connSessionM, connID)
+	if ok && (ttl <= 0 || s.clientID == "") {
+		delete(sessionM, s.token)
+		if clientSessionM[s.clientID] == s {
+			delete(clientSessionM, s.clientID)
+		}
+		ok = false
+	}
+	if !ok {
+		sessionmu.Unlock()
+		return false
+	}
+	s.connID = ""
+	clientID := s.clientID
+	token := s.token
+	s.timer = time.AfterFunc(ttl, func() { expireSession(token) })
+	sessionmu.Unlock()
+
+	rooms := fencesInside(clientID)
+	sessionmu.Lock()
+	s.rooms = rooms
+	sessionmu.Unlock()
+	return true
+}
+
+// dropSession removes the session of a connection so that it is not
+// suspended when the connection closes
+func dropSession(connID string) {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := connSessionM[connID]
+	if !ok {
+		return
+	}
+	delete(connSessionM, connID)
+	delete(sessionM, s.token)
+	if clientSessionM[s.clientID] == s {
+		delete(clientSessionM, s.clientID)
+	}
+}
+
+// expireSession removes a suspended session along with the people entry and
+// room memberships of its person
+func expireSession(token string) {
+	sessionmu.Lock()
+	s, ok := sessionM[token]
+	if !ok || s.connID != "" {
+		sessionmu.Unlock()
+		return
+	}
+	delete(sessionM, token)
+	if clientSessionM[s.clientID] == s {
+		delete(clientSessionM, s.clientID)
+	}
+	clientID := s.clientID
+	sessionmu.Unlock()
+
+	if clientID == "" {
+		return
+	}
+	idmu.Lock()
+	_, reconnected := clientConnM[clientID]
+	idmu.Unlock()
+	if !reconnected {
+		removePerson(clientID)
+	}
+}
+
+// endSession removes the session of a person so that it cannot be resumed.
+// Returns true when the session was suspended.
+func endSession(clientID string) bool {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := clientSessionM[clientID]
+	if !ok {
+		return false
+	}
+	delete(clientSessionM, clientID)
+	delete(sessionM, s.token)
+	if s.connID != "" {
+		delete(connSessionM, s.connID)
+		return false
+	}
+	s.timer.Stop()
+	return true
+}
+
+// bufferMissed stores a frame for a person whose session is suspended.
+// Returns false when the person has no suspended session.
+func bufferMissed(clientID, msg string) bool {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := clientSessionM[clientID]
+	if !ok || s.connID != "" {
+		return false
+	}
+	if len(s.buffer) >= cfg.SessionBuffer {
+		if cfg.SessionBuffer == 0 {
+			return true
+		}
+		s.buffer = append(s.buffer[:0], s.buffer[1:]...)
+	}
+	s.buffer = append(s.buffer, msg)
+	return true
+}
+
+// sendClient sends a frame to the connection of a person on this instance, or
+// buffers it when their session is suspended. Returns false when the person
+// is not known to this instance.
+func sendClient(clientID, msg string) bool {
+	known, _ := sendVisible(clientID, socket.NewMessage(msg))
+	return known
+}
+
+// sendVisible is sendClient that leaves out frames hidden by the block list
+// of the person, for a message that may be sent to many people. sent is false
+// when the frame was hidden.
+func sendVisible(clientID string, m *socket.Message) (known, sent bool) {
+	msg := m.String()
+	idmu.Lock()
+	connID, connected := clientConnM[clientID]
+	idmu.Unlock()
+	if !connected && !suspended(clientID) {
+		return false, false
+	}
+	if hidden(clientID, msg) {
+		return true, false
+	}
+	if connected {
+		sendMessage(connID, m)
+		return true, true
+	}
+	return bufferMissed(clientID, msg), true
+}
+
+// suspended returns true when a person has a suspended session
+func suspended(clientID string) bool {
+	sessionmu.Lock()
+	defer sessionmu.Unlock()
+	s, ok := clientSessionM[clientID]
+	return ok && s.connID == ""
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestResumeKeepsKey(t *testing.T) {
+	a := testID(1)
+	c := dialTest(t, "/ws", nil)
+	token := gjson.Get(c.expect("Session"), "token").String()
+	c.send(testFeature(a, 39.7425, -104.9965))
+	c.send(`{"type":"PublicKey","key":"a2V5"}`)
+	c.expect("PublicKey")
+	c.ws.Close()
+	waitFor(t, func() bool { return suspendedSession(token) })
+
+	r := dialTest(t, "/ws?session="+token, nil)
+	if s := r.expect("Session"); !gjson.Get(s, "resumed").Bool() {
+		t.Fatalf("got %s, want the session resumed", s)
+	}
+	waitFor(t, func() bool {
+		feature, err := geo.GetFeature(peopleKey(""), a)
+		return err == nil && gjson.Get(feature, "properties.publicKey").String() == "a2V5"
+	})
+}
+
+// memExpires returns when an object of the in-memory store of the test
+// server expires
+func memExpires(key, id string) time.Time {
+	s := geo.(*memStore)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.colls[key]; ok {
+		if o, ok := c.objs[id]; ok {
+			return o.expires
+		}
+	}
+	return time.Time{}
+}
+
+func TestResumeSessionTTL(t *testing.T) {
+	testServer(t)
+	reloaded := *live()
+	reloaded.SessionTTL = time.Minute
+	liveCfg.Store(&reloaded)
+	t.Cleanup(func() { liveCfg.Store(&cfg) })
+	a := testID(1)
+	c := dialTest(t, "/ws", nil)
+	token := gjson.Get(c.expect("Session"), "token").String()
+	c.send(testFeature(a, 39.7425, -104.9965))
+	waitFor(t, func() bool {
+		_, err := geo.GetFeature(peopleKey(""), a)
+		return err == nil
+	})
+	c.ws.Close()
+	waitFor(t, func() bool { return suspendedSession(token) })
+
+	r := dialTest(t, "/ws?session="+token, nil)
+	r.expect("Session")
+	waitFor(t, func() bool {
+		return time.Until(memExpires(peopleKey(""), a)) > live().PeopleTTL
+	})
+}
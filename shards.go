@@ -0,0 +1,837 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tidwall/tile38/pkg/geojson"
+	"github.com/tidwall/tile38/pkg/geojson/geohash"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The sharding of the people collections
+const (
+	shardSep      = ":shard:"        // separates a collection or channel name from its shard
+	shardsKey     = "shards"         // sorted set of the shards of people collections in use -> last use
+	shardRefresh  = 10 * time.Second // time between reads of the shards in use
+	maxShardCells = 64               // cells a search or fence covers before only the shards in use are
+)
+
+// shardStore is a GeoStore that shards the people collections by the geohash
+// cell of the position of every person, so that searches and fences only
+// touch the shards of their area. Callers keep using the collection names
+// without shards: objects are stored in the shard of their position and
+// moved when they cross into another one, searches are run on the shards
+// they cover, and fences are set on the shards they cover. Roaming fences
+// are set on every shard in use, against the shard itself and its 8
+// neighbors, so that people meet across the boundaries of shards. The
+// notifications of the fences of shards arrive on the channel of the fence.
+// A shard that nobody stored or kept an object in for longer than the ttl of
+// the objects is empty, and is dropped along with its fences.
+type shardStore struct {
+	GeoStore
+	precision int
+	sharded   func(key string) bool // whether a collection is sharded
+	idle      func() time.Duration  // time without use after which a shard is empty
+
+	mu      sync.Mutex
+	shardM  map[string]shardEntry      // collection and id -> shard the object was stored in
+	known   map[string]map[string]bool // collection -> shards in use
+	touched map[string]time.Time       // collection and shard -> when the use was last published
+	fences  map[string]*shardFence     // channel -> fence on a sharded collection
+	crossed map[string]shardCrossing   // collection and id -> last crossing into another shard
+}
+
+// shardCrossing is an object that crossed from a shard into another, with its
+// positions before and after
+type shardCrossing struct {
+	from, to      string
+	before, after string
+	at            time.Time
+}
+
+// shardEntry is the shard that an object was stored in, until it expires
+type shardEntry struct {
+	shard   string
+	expires time.Time // zero for objects that do not expire
+}
+
+// shardFence is a fence on a sharded collection, that the fences of its
+// shards are made of
+type shardFence struct {
+	Fence
+	obj     geojson.Object // area of object fences
+	expires time.Time      // zero for fences that do not expire
+}
+
+// newShardStore returns a GeoStore that shards the collections of a store
+// for which sharded returns true into geohash cells of a precision. Shards
+// that were not used for idle are dropped.
+func newShardStore(store GeoStore, precision int, sharded func(key string) bool, idle func() time.Duration) *shardStore {
+	return &shardStore{
+		GeoStore:  store,
+		precision: precision,
+		sharded:   sharded,
+		idle:      idle,
+		shardM:    make(map[string]shardEntry),
+		known:     make(map[string]map[string]bool),
+		touched:   make(map[string]time.Time),
+		fences:    make(map[string]*shardFence),
+		crossed:   make(map[string]shardCrossing),
+	}
+}
+
+// shardIdle returns the time without use after which a shard of the people
+// collections is empty, as every person in it expired
+func shardIdle() time.Duration {
+	return live().PeopleTTL + cfg.PingInterval + 2*shardRefresh
+}
+
+// isPeopleKey returns true for the people collections of every namespace and
+// floor
+func isPeopleKey(key string) bool {
+	name, _ := splitFloor(key)
+	return name == peopleKey("") || strings.HasPrefix(name, peopleKey("")+":")
+}
+
+// shardedName returns the name of a collection or channel for a shard
+func shardedName(name, shard string) string {
+	return name + shardSep + shard
+}
+
+// splitShard returns the name and the shard of a collection or channel name
+func splitShard(name string) (string, string) {
+	if i := strings.Index(name, shardSep); i >= 0 {
+		return name[:i], name[i+len(shardSep):]
+	}
+	return name, ""
+}
+
+// shardCellSize returns the height and width in degrees of the geohash cells
+// of a precision
+func shardCellSize(precision int) (dlat, dlng float64) {
+	latBits := 5 * precision / 2
+	lngBits := 5*precision - latBits
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lngBits))
+}
+
+// cell returns the shard of a position
+func (s *shardStore) cell(lat, lng float64) string {
+	cell, _ := geohash.Encode(lat, lng, s.precision)
+	return cell
+}
+
+// cellRect returns the bounding box of a shard
+func cellRect(cell string) rect {
+	swLat, swLng, neLat, neLng, _ := geohash.Bounds(cell)
+	return rect{swLat, swLng, neLat, neLng}
+}
+
+// cells returns the shards that cover a bounding box, or false when there are
+// more than maxShardCells of them
+func (s *shardStore) cells(r rect) ([]string, bool) {
+	dlat, dlng := shardCellSize(s.precision)
+	minLat, maxLat := math.Max(r.minLat, -90), math.Min(r.maxLat, 90)
+	minLng, maxLng := math.Max(r.minLng, -180), math.Min(r.maxLng, 180)
+	if minLat > maxLat || minLng > maxLng {
+		return nil, true
+	}
+	lat0 := math.Floor((minLat+90)/dlat)*dlat - 90
+	lng0 := math.Floor((minLng+180)/dlng)*dlng - 180
+	rows := int((maxLat-lat0)/dlat) + 1
+	cols := int((maxLng-lng0)/dlng) + 1
+	if rows*cols > maxShardCells {
+		return nil, false
+	}
+	cells := make([]string, 0, rows*cols)
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			lat, lng := lat0+(float64(i)+0.5)*dlat, lng0+(float64(j)+0.5)*dlng
+			if lat < 90 && lng < 180 {
+				cells = append(cells, s.cell(lat, lng))
+			}
+		}
+	}
+	return cells, true
+}
+
+// neighbors returns a shard and the shards around it
+func (s *shardStore) neighbors(cell string) []string {
+	dlat, dlng := shardCellSize(s.precision)
+	lat, lng, _ := geohash.Decode(cell)
+	cells := make([]string, 0, 9)
+	seen := make(map[string]bool, 9)
+	for i := -1; i <= 1; i++ {
+		for j := -1; j <= 1; j++ {
+			nlat, nlng := lat+float64(i)*dlat, lng+float64(j)*dlng
+			if nlat <= -90 || nlat >= 90 {
+				continue
+			}
+			nlng = math.Mod(nlng+540, 360) - 180
+			if n := s.cell(nlat, nlng); !seen[n] {
+				seen[n] = true
+				cells = append(cells, n)
+			}
+		}
+	}
+	return cells
+}
+
+// inUse returns the shards of a collection in use
+func (s *shardStore) inUse(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shards := make([]string, 0, len(s.known[key]))
+	for shard := range s.known[key] {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// cover returns the shards that cover a bounding box, only the shards in use
+// when the box covers too many
+func (s *shardStore) cover(key string, r rect) []string {
+	if cells, ok := s.cells(r); ok {
+		return cells
+	}
+	var cells []string
+	for _, shard := range s.inUse(key) {
+		if cellRect(shard).intersects(r) {
+			cells = append(cells, shard)
+		}
+	}
+	return cells
+}
+
+// useShard records that a shard of a collection is in use and sets the
+// fences of the shard, and with publish tells the other instances
+func (s *shardStore) useShard(key, shard string, publish bool) {
+	s.mu.Lock()
+	if s.known[key][shard] {
+		s.mu.Unlock()
+		if publish {
+			s.touch(key, shard)
+		}
+		return
+	}
+	if s.known[key] == nil {
+		s.known[key] = make(map[string]bool)
+	}
+	s.known[key][shard] = true
+	fences := make(map[string]*shardFence)
+	for name, f := range s.fences {
+		if !f.expires.IsZero() && time.Now().After(f.expires) {
+			delete(s.fences, name)
+			continue
+		}
+		fences[name] = f
+	}
+	s.mu.Unlock()
+	if publish {
+		s.touch(key, shard)
+	}
+	for name, f := range fences {
+		var applies bool
+		switch {
+		case f.Roam > 0:
+			applies = f.Key == key || f.target() == key
+		default:
+			applies = f.Key == key && cellRect(shard).intersects(f.rect())
+		}
+		if !applies {
+			continue
+		}
+		if err := s.setShardFences(name, f, shard); err != nil {
+			lg.Error("shard fence failed", "channel", name, "shard", shard, "err", err)
+		}
+	}
+}
+
+// touch tells the other instances that a shard is in use, at most once per
+// shard refresh
+func (s *shardStore) touch(key, shard string) {
+	member := shardedName(key, shard)
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(s.touched[member]) < shardRefresh {
+		s.mu.Unlock()
+		return
+	}
+	s.touched[member] = now
+	s.mu.Unlock()
+	if _, err := storeDo("ZADD", shardsKey, now.UnixNano()/int64(time.Millisecond), member); err != nil {
+		lg.Error("shard registration failed", "key", key, "shard", shard, "err", err)
+	}
+}
+
+// run refreshes the shards in use once per shard refresh
+func (s *shardStore) run() {
+	for {
+		s.refresh(time.Now())
+		time.Sleep(shardRefresh)
+	}
+}
+
+// refresh reads the shards in use by all instances, sets the fences of the
+// new ones and drops those that were not used since the idle time, along
+// with the objects that expired
+func (s *shardStore) refresh(now time.Time) {
+	cutoff := now.Add(-s.idle()).UnixNano() / int64(time.Millisecond)
+	storeDo("ZREMRANGEBYSCORE", shardsKey, "-inf", "("+strconv.FormatInt(cutoff, 10))
+	members, err := redis.Strings(storeDo("ZRANGEBYSCORE", shardsKey, cutoff, "+inf"))
+	if err != nil {
+		lg.Error("shard refresh failed", "err", err)
+		return
+	}
+	inUse := make(map[string]bool, len(members))
+	for _, member := range members {
+		if key, shard := splitShard(member); shard != "" {
+			inUse[member] = true
+			s.useShard(key, shard, false)
+		}
+	}
+	var idle [][2]string
+	s.mu.Lock()
+	for key, shards := range s.known {
+		for shard := range shards {
+			if !inUse[shardedName(key, shard)] {
+				idle = append(idle, [2]string{key, shard})
+			}
+		}
+	}
+	for id, e := range s.shardM {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.shardM, id)
+		}
+	}
+	for name, f := range s.fences {
+		if !f.expires.IsZero() && now.After(f.expires) {
+			delete(s.fences, name)
+		}
+	}
+	for id, c := range s.crossed {
+		if now.Sub(c.at) > shardRefresh {
+			delete(s.crossed, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, idle := range idle {
+		s.dropShard(idle[0], idle[1])
+	}
+}
+
+// dropShard forgets a shard of a collection that is not in use anymore and
+// deletes its fences
+func (s *shardStore) dropShard(key, shard string) {
+	s.mu.Lock()
+	delete(s.known[key], shard)
+	if len(s.known[key]) == 0 {
+		delete(s.known, key)
+	}
+	delete(s.touched, shardedName(key, shard))
+	for id, c := range s.crossed {
+		if (c.from == shard || c.to == shard) && strings.HasPrefix(id, key+"\x00") {
+			delete(s.crossed, id)
+		}
+	}
+	for id, e := range s.shardM {
+		if e.shard == shard && strings.HasPrefix(id, key+"\x00") {
+			delete(s.shardM, id)
+		}
+	}
+	var names []string
+	for name, f := range s.fences {
+		if f.Key == key || f.target() == key {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+	for _, name := range names {
+		for _, pattern := range []string{shardedName(name, shard), shardedName(name, shard+"-*"),
+			shardedName(name, "*-"+shard)} {
+			chans, err := s.GeoStore.Channels(pattern)
+			if err != nil {
+				lg.Error("shard fence delete failed", "channel", name, "shard", shard, "err", err)
+				continue
+			}
+			for _, channel := range chans {
+				s.GeoStore.DelFence(channel)
+			}
+		}
+	}
+}
+
+// objectShard returns the shard of the position of an object
+func (s *shardStore) objectShard(object string) string {
+	if coords := gjson.Get(object, "geometry.coordinates"); gjson.Get(object, "geometry.type").String() == "Point" {
+		return s.cell(coords.Get("1").Float(), coords.Get("0").Float())
+	}
+	r := fenceRect(object)
+	return s.cell((r.minLat+r.maxLat)/2, (r.minLng+r.maxLng)/2)
+}
+
+// shardOf returns the shard that this instance stored an object in
+func (s *shardStore) shardOf(key, id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.shardM[key+"\x00"+id]
+	return e.shard, ok
+}
+
+// stored records the shard that an object was stored in, for a ttl, and
+// returns the shard it was in before
+func (s *shardStore) stored(key, id, shard string, ttl time.Duration) (string, bool) {
+	e := shardEntry{shard: shard}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.shardM[key+"\x00"+id]
+	s.shardM[key+"\x00"+id] = e
+	return prev.shard, ok
+}
+
+// locate returns the shard of an object that another instance stored, by
+// looking for it in every shard in use
+func (s *shardStore) locate(key, id string) (shard, object string, err error) {
+	for _, shard := range s.inUse(key) {
+		object, err := s.GeoStore.GetFeature(shardedName(key, shard), id)
+		if err == nil {
+			return shard, object, nil
+		}
+		if err != ErrNotFound {
+			return "", "", err
+		}
+	}
+	return "", "", ErrNotFound
+}
+
+// SetFeature stores an object in the shard of its position. An object that
+// crossed into another shard is deleted from the one it was in after it is
+// stored in the new one, so that it is never missing.
+func (s *shardStore) SetFeature(key, id, object string, ttl time.Duration) error {
+	if !s.sharded(key) {
+		return s.GeoStore.SetFeature(key, id, object, ttl)
+	}
+	shard := s.objectShard(object)
+	s.useShard(key, shard, true)
+	if prev, ok := s.shardOf(key, id); ok && prev != shard {
+		// the fences of both shards tell the crossing by the positions
+		if before, err := s.GeoStore.GetFeature(shardedName(key, prev), id); err == nil {
+			s.mu.Lock()
+			s.crossed[key+"\x00"+id] = shardCrossing{prev, shard, before, object, time.Now()}
+			s.mu.Unlock()
+		}
+	}
+	if err := s.GeoStore.SetFeature(shardedName(key, shard), id, object, ttl); err != nil {
+		return err
+	}
+	if prev, ok := s.stored(key, id, shard, ttl); ok && prev != shard {
+		return s.GeoStore.DelFeature(shardedName(key, prev), id)
+	}
+	return nil
+}
+
+// GetFeature returns an object from its shard
+func (s *shardStore) GetFeature(key, id string) (string, error) {
+	if !s.sharded(key) {
+		return s.GeoStore.GetFeature(key, id)
+	}
+	if shard, ok := s.shardOf(key, id); ok {
+		if object, err := s.GeoStore.GetFeature(shardedName(key, shard), id); err != ErrNotFound {
+			return object, err
+		}
+	}
+	_, object, err := s.locate(key, id)
+	return object, err
+}
+
+// DelFeature deletes an object from its shard
+func (s *shardStore) DelFeature(key, id string) error {
+	if !s.sharded(key) {
+		return s.GeoStore.DelFeature(key, id)
+	}
+	shard, ok := s.shardOf(key, id)
+	s.mu.Lock()
+	delete(s.shardM, key+"\x00"+id)
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		if shard, _, err = s.locate(key, id); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return s.GeoStore.DelFeature(shardedName(key, shard), id)
+}
+
+// Expire sets the ttl of an object in its shard
+func (s *shardStore) Expire(key, id string, ttl time.Duration) error {
+	if !s.sharded(key) {
+		return s.GeoStore.Expire(key, id, ttl)
+	}
+	shard, ok := s.shardOf(key, id)
+	err := ErrNotFound
+	if ok {
+		err = s.GeoStore.Expire(shardedName(key, shard), id, ttl)
+	}
+	if err == ErrNotFound {
+		if shard, _, err = s.locate(key, id); err != nil {
+			return err
+		}
+		err = s.GeoStore.Expire(shardedName(key, shard), id, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	s.stored(key, id, shard, ttl)
+	s.touch(key, shard)
+	return nil
+}
+
+// Nearby searches the shards within meters of a point, and returns the
+// objects of all of them closest first
+func (s *shardStore) Nearby(key string, lat, lng, meters float64, opts Search) ([]Object, error) {
+	if !s.sharded(key) {
+		return s.GeoStore.Nearby(key, lat, lng, meters, opts)
+	}
+	r := viewportRect(&protocol.Viewport{Center: &protocol.LatLng{Lat: lat, Lng: lng}, Radius: meters})
+	objs, err := s.search(key, s.cover(key, r), func(shard string) ([]Object, error) {
+		return s.GeoStore.Nearby(shardedName(key, shard), lat, lng, meters, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.IDs {
+		d := make(map[string]float64, len(objs))
+		for _, obj := range objs {
+			coords := gjson.Get(obj.Object, "geometry.coordinates")
+			d[obj.ID] = distance(lat, lng, coords.Get("1").Float(), coords.Get("0").Float())
+		}
+		sort.SliceStable(objs, func(i, j int) bool { return d[objs[i].ID] < d[objs[j].ID] })
+	}
+	return limitObjects(objs, opts.Limit), nil
+}
+
+// Intersects searches the shards that an area covers
+func (s *shardStore) Intersects(key string, area Area, opts Search) ([]Object, error) {
+	if !s.sharded(key) {
+		return s.GeoStore.Intersects(key, area, opts)
+	}
+	var r rect
+	if b := area.Bounds; b != nil {
+		r = rect{b.SW.Lat, b.SW.Lng, b.NE.Lat, b.NE.Lng}
+	} else {
+		r = areaRect(area.Object)
+	}
+	objs, err := s.search(key, s.cover(key, r), func(shard string) ([]Object, error) {
+		return s.GeoStore.Intersects(shardedName(key, shard), area, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return limitObjects(objs, opts.Limit), nil
+}
+
+// search runs a search on shards at once and returns the objects of all of
+// them, once each, as an object that crossed into another shard may be in
+// both for a moment
+func (s *shardStore) search(key string, shards []string, fn func(shard string) ([]Object, error)) ([]Object, error) {
+	results := make([][]Object, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			results[i], errs[i] = fn(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	var objs []Object
+	for i := range shards {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for _, obj := range results[i] {
+			if !seen[obj.ID] {
+				seen[obj.ID] = true
+				objs = append(objs, obj)
+			}
+		}
+	}
+	return objs, nil
+}
+
+// limitObjects returns the first limit objects, all of them for a limit of 0
+func limitObjects(objs []Object, limit int) []Object {
+	if limit > 0 && len(objs) > limit {
+		return objs[:limit]
+	}
+	return objs
+}
+
+// areaRect returns the bounding box of a GeoJSON geometry or feature
+func areaRect(object string) rect {
+	if gjson.Get(object, "geometry").Exists() {
+		return fenceRect(object)
+	}
+	return fenceRect(`{"geometry":` + object + `}`)
+}
+
+// rect returns the bounding box of the area of an object or circle fence
+func (f *shardFence) rect() rect {
+	if f.Center != nil {
+		return viewportRect(&protocol.Viewport{Center: f.Center, Radius: f.Radius})
+	}
+	return areaRect(f.Object)
+}
+
+// contains returns true when an object is inside of the area of an object or
+// circle fence
+func (f *shardFence) contains(object string) bool {
+	if f.Center != nil {
+		coords := gjson.Get(object, "geometry.coordinates")
+		return distance(f.Center.Lat, f.Center.Lng,
+			coords.Get("1").Float(), coords.Get("0").Float()) <= f.Radius
+	}
+	obj, err := geojson.ObjectJSON(object)
+	return err == nil && f.obj != nil && obj.Within(f.obj)
+}
+
+// SetFence sets a fence on the shards of a sharded collection: an object or
+// circle fence on the shards that its area covers, and a roaming fence on
+// the shards in use. Shards that come in use later get the fence then.
+func (s *shardStore) SetFence(name string, fence Fence) error {
+	keySharded := s.sharded(fence.Key)
+	targetSharded := fence.Roam > 0 && s.sharded(fence.target())
+	if !keySharded && !targetSharded {
+		return s.GeoStore.SetFence(name, fence)
+	}
+	f := &shardFence{Fence: fence}
+	if fence.TTL > 0 {
+		f.expires = time.Now().Add(fence.TTL)
+	}
+	if fence.Roam <= 0 && fence.Center == nil {
+		obj, err := geojson.ObjectJSON(fence.Object)
+		if err != nil {
+			return err
+		}
+		f.obj = obj
+	}
+	s.mu.Lock()
+	s.fences[name] = f
+	s.mu.Unlock()
+	var shards []string
+	switch {
+	case fence.Roam > 0 && keySharded:
+		shards = s.inUse(fence.Key)
+	case fence.Roam > 0:
+		shards = s.inUse(fence.target())
+	default:
+		shards = s.cover(fence.Key, f.rect())
+	}
+	for _, shard := range shards {
+		if err := s.setShardFences(name, f, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setShardFences sets the fences of a shard that a fence on a sharded
+// collection is made of. The roaming fences of people are set on the shard
+// against the shard itself and its neighbors.
+func (s *shardStore) setShardFences(name string, f *shardFence, shard string) error {
+	fence := f.Fence
+	if !f.expires.IsZero() {
+		if fence.TTL = time.Until(f.expires); fence.TTL < time.Second {
+			return nil
+		}
+	}
+	keySharded := s.sharded(f.Key)
+	switch {
+	case f.Roam > 0 && keySharded && s.sharded(f.target()):
+		target := f.target()
+		fence.Key = shardedName(f.Key, shard)
+		for _, n := range s.neighbors(shard) {
+			fence.Target = shardedName(target, n)
+			if err := s.GeoStore.SetFence(shardedName(name, shard+"-"+n), fence); err != nil {
+				return err
+			}
+		}
+		return nil
+	case keySharded:
+		fence.Key = shardedName(f.Key, shard)
+	default:
+		fence.Target = shardedName(f.target(), shard)
+	}
+	return s.GeoStore.SetFence(shardedName(name, shard), fence)
+}
+
+// DelFence deletes a fence and the fences of its shards
+func (s *shardStore) DelFence(name string) error {
+	s.mu.Lock()
+	delete(s.fences, name)
+	s.mu.Unlock()
+	if err := s.GeoStore.DelFence(name); err != nil {
+		return err
+	}
+	chans, err := s.GeoStore.Channels(shardedName(name, "*"))
+	if err != nil {
+		return err
+	}
+	for _, channel := range chans {
+		if err := s.GeoStore.DelFence(channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Channels returns the names of the fence channels matching a pattern, with
+// the fences of shards as the fence they are made of
+func (s *shardStore) Channels(pattern string) ([]string, error) {
+	chans, err := s.GeoStore.Channels(pattern)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(chans))
+	names := chans[:0]
+	for _, channel := range chans {
+		if name, _ := splitShard(channel); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Subscribe opens a subscription to fence channels and the channels of the
+// fences of their shards
+func (s *shardStore) Subscribe(channels, patterns []string) (Subscription, error) {
+	all := append([]string(nil), patterns...)
+	for _, channel := range channels {
+		all = append(all, shardedName(channel, "*"))
+	}
+	sub, err := s.GeoStore.Subscribe(channels, all)
+	if err != nil {
+		return nil, err
+	}
+	return &shardSubscription{Subscription: sub, s: s}, nil
+}
+
+// shardSubscription is a subscription that receives the notifications of the
+// fences of shards on the channel of the fence they are made of
+type shardSubscription struct {
+	Subscription
+	s *shardStore
+}
+
+// Receive returns the next notification. A person who crossed into another
+// shard inside of an object or circle fence neither enters nor exits it:
+// the enter of the new shard is an inside, and the exit of the delete from
+// the old shard is dropped, as is the delete for a roaming fence.
+func (sub *shardSubscription) Receive() (string, []byte, error) {
+	for {
+		channel, data, err := sub.Subscription.Receive()
+		if err != nil {
+			return channel, data, err
+		}
+		name, shard := splitShard(channel)
+		if shard != "" {
+			var keep bool
+			if data, keep = sub.s.crossing(name, data); !keep {
+				continue
+			}
+		}
+		return name, data, nil
+	}
+}
+
+// crossing rewrites the notification of a fence for a person who crossed
+// into another shard, and returns false when it is dropped. The delete of a
+// person from the shard they left is not a leave for a roaming fence either.
+func (s *shardStore) crossing(name string, data []byte) ([]byte, bool) {
+	detect := gjson.GetBytes(data, "detect").String()
+	del := gjson.GetBytes(data, "command").String() == "del"
+	s.mu.Lock()
+	f, ok := s.fences[name]
+	s.mu.Unlock()
+	if !ok {
+		return data, true
+	}
+	key, shard := splitShard(gjson.GetBytes(data, "key").String())
+	id := gjson.GetBytes(data, "id").String()
+	if shard == "" {
+		return data, true
+	}
+	if f.Roam > 0 {
+		if del && s.moved(key, id, shard) {
+			return nil, false
+		}
+		return data, true
+	}
+	if detect != "enter" && !(detect == "exit" && del) {
+		return data, true
+	}
+	s.mu.Lock()
+	c, ok := s.crossed[key+"\x00"+id]
+	s.mu.Unlock()
+	switch {
+	case ok && !del && c.to == shard:
+		if f.contains(c.before) {
+			data, _ = sjson.SetBytes(data, "detect", "inside")
+		}
+		return data, true
+	case ok && del && c.from == shard:
+		return data, !f.contains(c.after)
+	}
+	// the crossing of an object of another instance, whose copy in the
+	// other shard may be there still
+	for _, n := range s.neighbors(shard) {
+		if n == shard {
+			continue
+		}
+		// the copy in the other shard is the old position of an enter, or
+		// the new one of the exit of a delete
+		other, err := s.GeoStore.GetFeature(shardedName(key, n), id)
+		if err != nil || !f.contains(other) {
+			continue
+		}
+		if del {
+			return nil, false
+		}
+		data, _ = sjson.SetBytes(data, "detect", "inside")
+		return data, true
+	}
+	return data, true
+}
+
+// moved returns true when an object that was deleted from a shard is in one
+// of the shards around it
+func (s *shardStore) moved(key, id, shard string) bool {
+	if cur, ok := s.shardOf(key, id); ok {
+		return cur != shard
+	}
+	for _, n := range s.neighbors(shard) {
+		if n == shard {
+			continue
+		}
+		if _, err := s.GeoStore.GetFeature(shardedName(key, n), id); err == nil {
+			return true
+		}
+	}
+	return false
+}
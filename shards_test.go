@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// testShards returns a shard store of precision 6 over an empty memory store,
+// and two positions on either side of the east edge of a shard
+func testShards(t *testing.T, idle time.Duration) (s *shardStore, west, east [2]float64) {
+	testServer(t)
+	s = newShardStore(newMemStore(), 6, isPeopleKey, func() time.Duration { return idle })
+	t.Cleanup(func() { s.Close() })
+	r := cellRect(s.cell(39.7425, -104.9965))
+	lat := (r.minLat + r.maxLat) / 2
+	return s, [2]float64{lat, r.maxLng - 0.0005}, [2]float64{lat, r.maxLng + 0.0005}
+}
+
+// squareAround returns a polygon of about a kilometer around a position
+func squareAround(p [2]float64) string {
+	return fmt.Sprintf(`{"type":"Polygon","coordinates":[[[%[1]v,%[3]v],[%[2]v,%[3]v],[%[2]v,%[4]v],[%[1]v,%[4]v],[%[1]v,%[3]v]]]}`,
+		p[1]-0.01, p[1]+0.01, p[0]-0.01, p[0]+0.01)
+}
+
+func TestShardCrossingFence(t *testing.T) {
+	s, west, east := testShards(t, time.Hour)
+	if s.cell(west[0], west[1]) == s.cell(east[0], east[1]) {
+		t.Fatal("the positions must be in two shards")
+	}
+	if err := s.SetFence("room-chan:test", Fence{Key: "people", Object: squareAround(west)}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := s.Subscribe(nil, []string{"room-chan:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	s.SetFeature("people", "a", point("a", west[0], west[1]), 0)
+	if channel, data := receiveTest(t, sub); channel != "room-chan:test" || gjson.Get(data, "detect").String() != "enter" {
+		t.Fatalf("first position: got %s %s", channel, data)
+	}
+	// crossing into the next shard inside of the room is neither an exit
+	// nor an enter
+	s.SetFeature("people", "a", point("a", east[0], east[1]), 0)
+	if _, data := receiveTest(t, sub); gjson.Get(data, "detect").String() != "inside" {
+		t.Fatalf("crossing: got %s, want inside", data)
+	}
+	if shard, _ := s.shardOf("people", "a"); shard != s.cell(east[0], east[1]) {
+		t.Fatalf("got shard %s", shard)
+	}
+	if _, err := s.GeoStore.GetFeature(shardedName("people", s.cell(west[0], west[1])), "a"); err != ErrNotFound {
+		t.Fatal("the person must leave the shard they crossed out of")
+	}
+	s.DelFeature("people", "a")
+	if _, data := receiveTest(t, sub); gjson.Get(data, "command").String() != "del" {
+		t.Fatalf("delete: got %s, want the exit", data)
+	}
+}
+
+func TestShardCrossingRoam(t *testing.T) {
+	s, west, east := testShards(t, time.Hour)
+	s.SetFence("roam-chan", Fence{Key: "people", Roam: 100})
+	s.SetFeature("people", "a", point("a", west[0], west[1]), 0)
+	s.SetFeature("people", "b", point("b", east[0], east[1]), 0)
+	westShard := s.cell(west[0], west[1])
+
+	// people who meet across the boundary of shards
+	sub, _ := s.Subscribe([]string{"roam-chan"}, nil)
+	defer sub.Close()
+	s.SetFeature("people", "a", point("a", west[0], west[1]+0.0001), 0)
+	if channel, data := receiveTest(t, sub); channel != "roam-chan" || gjson.Get(data, "nearby.id").String() != "b" {
+		t.Fatalf("got %s %s, want a nearby b", channel, data)
+	}
+
+	// the delete of a person from the shard they crossed out of is dropped
+	s.SetFeature("people", "a", point("a", east[0], east[1]), 0)
+	del := []byte(fmt.Sprintf(`{"command":"del","key":%q,"id":"a"}`, shardedName("people", westShard)))
+	if _, keep := s.crossing("roam-chan", del); keep {
+		t.Fatal("the delete of a crossing must be dropped")
+	}
+	s.DelFeature("people", "a")
+	if _, keep := s.crossing("roam-chan", del); !keep {
+		t.Fatal("the delete of a person who left must be kept")
+	}
+}
+
+func TestShardEviction(t *testing.T) {
+	s, west, east := testShards(t, 50*time.Millisecond)
+	shard := s.cell(west[0], west[1])
+	s.SetFence("room-chan:evict", Fence{Key: "people", Object: squareAround(west)})
+	s.SetFeature("people", "a", point("a", west[0], west[1]), 10*time.Millisecond)
+	s.SetFeature("people", "b", point("b", east[0], east[1]), time.Hour)
+	if names, _ := s.GeoStore.Channels(shardedName("room-chan:evict", shard)); len(names) != 1 {
+		t.Fatalf("shard fences: got %v", names)
+	}
+
+	// the shard of b stays in use, by another instance for instance
+	later := time.Now().Add(time.Second)
+	storeDo("ZADD", shardsKey, later.UnixNano()/int64(time.Millisecond),
+		shardedName("people", s.cell(east[0], east[1])))
+	s.refresh(later)
+	if _, ok := s.shardOf("people", "a"); ok {
+		t.Fatal("the shard of an expired object must be forgotten")
+	}
+	if _, ok := s.shardOf("people", "b"); !ok {
+		t.Fatal("the shard of b must be kept")
+	}
+	if shards := s.inUse("people"); len(shards) != 1 || shards[0] != s.cell(east[0], east[1]) {
+		t.Fatalf("shards in use: got %v", shards)
+	}
+	if names, _ := s.GeoStore.Channels(shardedName("room-chan:evict", shard)); len(names) != 0 {
+		t.Fatalf("fences of the idle shard: got %v", names)
+	}
+	s.DelFence("room-chan:evict")
+	storeDo("DEL", shardsKey)
+}
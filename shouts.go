@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on shouts
+const (
+	maxShoutRadius = 2000      // meters
+	maxShoutTTL    = time.Hour // how long a shout can last
+	maxShoutsSent  = 100       // shouts sent when catching up at once
+)
+
+// The throttle of the shouts that people come within the radius of. Shouts
+// are looked up again once a person moved or changed floors, or a while after
+// the last lookup.
+const (
+	shoutMove    = 25               // meters moved before another lookup
+	shoutRefresh = 30 * time.Second // time before another lookup in place
+)
+
+// shoutLookup is where and when the shouts near a person were looked up
+type shoutLookup struct {
+	lat, lng float64
+	floor    string
+	at       time.Time
+}
+
+var (
+	shoutmu      sync.Mutex             // guard shoutLookupM
+	shoutLookupM map[string]shoutLookup // clientID -> last lookup of nearby shouts
+)
+
+// shoutsKey returns the Tile38 collection of the shouts of a namespace
+func shoutsKey(ns string) string {
+	if ns == "" {
+		return "shouts"
+	}
+	return "shouts:" + ns
+}
+
+// shoutSeenKey returns the Redis key of the set of people a shout was sent to
+func shoutSeenKey(shoutID string) string {
+	return "shoutseen:" + shoutID
+}
+
+// shoutMessage is a websocket message handler for shouts: chat messages that
+// stay at the position of the sender for a while. The shout is sent to the
+// people within its radius right away, and later to people who come within
+// the radius or whose viewport covers it, until it expires.
+func shoutMessage(connID, msg string) {
+	var s protocol.Shout
+	if err := protocol.Decode(msg, &s); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	feature := string(s.Feature)
+	if err := validateFeature(connID, feature); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	clientID := gjson.Get(feature, "id").String()
+	if err := filterMessage(clientID, s.Text); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	if s.Radius <= 0 || s.Radius > maxShoutRadius {
+		sendError(connID, "invalid_shout", "Shout radius must be 1 to 2000 meters")
+		return
+	}
+	ttl := time.Duration(s.TTL) * time.Second
+	if ttl <= 0 || ttl > maxShoutTTL {
+		sendError(connID, "invalid_shout", "Shout ttl must be 1 to 3600 seconds")
+		return
+	}
+
+	shoutID := newMessageID()
+	sender := privateFeature(clientID, attachProfile(clientID, feature))
+	nmsg, _ := protocol.Encode(protocol.Shout{
+		Envelope: protocol.Envelope{Type: protocol.TypeShout},
+		ID:       shoutID,
+		Feature:  []byte(shownFeature(secureFeature(sender))),
+		Text:     s.Text,
+		Radius:   s.Radius,
+		Expires:  time.Now().Add(ttl).UnixNano() / int64(time.Millisecond),
+	})
+	if shadowBanned(clientID) {
+		// only the shadow banned sender hears their shout
+		send(connID, nmsg)
+		return
+	}
+
+	// Store the shout at the position of the sender, with the message in its
+	// properties
+	ns := connNamespace(connID)
+	object := `{"type":"Feature","geometry":` + gjson.Get(feature, "geometry").Raw + `}`
+	object, _ = sjson.SetRaw(object, "properties.shout", nmsg)
+	floor := clientFloor(clientID)
+	if floor != "" {
+		object, _ = sjson.Set(object, "properties.floor", floor)
+	}
+	if err := geo.SetFeature(shoutsKey(ns), shoutID, object, ttl); err != nil {
+		lg.Error("shout store failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Shout could not be stored")
+		return
+	}
+
+	lat := gjson.Get(feature, "geometry.coordinates.1").Float()
+	lng := gjson.Get(feature, "geometry.coordinates.0").Float()
+	clientIDs, err := nearbyIDs(ns, floor, lat, lng, s.Radius)
+	if err != nil {
+		lg.Error("nearby query failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Shout could not be sent")
+		return
+	}
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("SADD", redis.Args{shoutSeenKey(shoutID), clientID}.AddFlat(clientIDs)...)
+	b.Send("EXPIRE", shoutSeenKey(shoutID), int(ttl/time.Second))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("shout store failed", "conn", connID, "err", err)
+	}
+	send(connID, nmsg)
+	recipients := clientIDs[:0]
+	for _, recipient := range clientIDs {
+		if recipient != clientID {
+			recipients = append(recipients, recipient)
+		}
+	}
+	deliver(recipients, nmsg)
+}
+
+// nearbyShouts sends the shouts that a person at a position is within the
+// radius of, and has not received yet. Shouts are sent to the people within
+// their radius when they are shouted, so the lookup is throttled while a
+// person stays in place.
+func nearbyShouts(connID, clientID string, lat, lng float64) {
+	if clientID == "" || !shoutLookupDue(clientID, lat, lng) {
+		return
+	}
+	objs, err := geo.Nearby(shoutsKey(connNamespace(connID)), lat, lng,
+		maxShoutRadius, Search{Limit: maxShoutsSent})
+	if err != nil {
+		return
+	}
+	catchUpShouts(connID, clientID, objs, func(shout string) bool {
+		return distance(lat, lng,
+			gjson.Get(shout, "feature.geometry.coordinates.1").Float(),
+			gjson.Get(shout, "feature.geometry.coordinates.0").Float(),
+		) <= gjson.Get(shout, "radius").Float()
+	})
+}
+
+// shoutLookupDue returns true when the shouts near a person at a position are
+// to be looked up, and records the lookup
+func shoutLookupDue(clientID string, lat, lng float64) bool {
+	now := time.Now()
+	floor := clientFloor(clientID)
+	shoutmu.Lock()
+	defer shoutmu.Unlock()
+	prev, ok := shoutLookupM[clientID]
+	if ok && prev.floor == floor && now.Sub(prev.at) < shoutRefresh &&
+		distance(prev.lat, prev.lng, lat, lng) < shoutMove {
+		return false
+	}
+	shoutLookupM[clientID] = shoutLookup{lat: lat, lng: lng, floor: floor, at: now}
+	return true
+}
+
+// forgetShouts drops the last shout lookup of a person
+func forgetShouts(clientID string) {
+	shoutmu.Lock()
+	delete(shoutLookupM, clientID)
+	shoutmu.Unlock()
+}
+
+// viewportShouts sends the shouts in the viewport of a connection that its
+// person has not received yet
+func viewportShouts(connID string, vp *protocol.Viewport) {
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		return
+	}
+	objs, err := viewportSearch(shoutsKey(connNamespace(connID)), vp,
+		Search{Limit: maxShoutsSent})
+	if err != nil {
+		return
+	}
+	catchUpShouts(connID, clientID, objs, nil)
+}
+
+// catchUpShouts sends the shouts of the objects on the floor of the person
+// that pass the filter, when given, and were not sent to the person before
+func catchUpShouts(connID, clientID string, objs []Object, filter func(shout string) bool) {
+	floor := clientFloor(clientID)
+	var shouts []string
+	for _, obj := range objs {
+		if gjson.Get(obj.Object, "properties.floor").String() != floor {
+			continue
+		}
+		shout := gjson.Get(obj.Object, "properties.shout").Raw
+		if shout != "" && (filter == nil || filter(shout)) {
+			shouts = append(shouts, shout)
+		}
+	}
+	if len(shouts) == 0 {
+		return
+	}
+
+	// Claim every shout for the person, the ones that were claimed before
+	// have been sent already
+	b := newBatch(store)
+	defer b.Close()
+	for _, shout := range shouts {
+		b.Send("SADD", shoutSeenKey(gjson.Get(shout, "id").String()), clientID)
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("shout lookup failed", "conn", connID, "err", err)
+		return
+	}
+	for i, shout := range shouts {
+		if added, _ := redis.Int(replies[i], nil); added == 1 && !hiddenConn(connID, shout) {
+			send(connID, shout)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestShoutLookupDue(t *testing.T) {
+	testServer(t)
+	a := testID(1)
+	defer forgetShouts(a)
+	if !shoutLookupDue(a, 39.7425, -104.9965) {
+		t.Fatal("the first lookup must be due")
+	}
+	if shoutLookupDue(a, 39.74251, -104.9965) {
+		t.Fatal("a lookup a meter away must be throttled")
+	}
+	if !shoutLookupDue(a, 39.7430, -104.9965) {
+		t.Fatal("a lookup 55 meters away must be due")
+	}
+	shoutmu.Lock()
+	l := shoutLookupM[a]
+	l.at = l.at.Add(-shoutRefresh - time.Second)
+	shoutLookupM[a] = l
+	shoutmu.Unlock()
+	if !shoutLookupDue(a, 39.7430, -104.9965) {
+		t.Fatal("a lookup in place must be due after the refresh")
+	}
+}
+
+func TestNearbyShoutsCatchUp(t *testing.T) {
+	a, b := testID(1), testID(2)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	ca.send(`{"type":"Shout","text":"coffee here","radius":100,"ttl":60,"feature":` +
+		testFeature(a, 39.7425, -104.9965) + `}`)
+	ca.expect("Shout")
+	cb := joinTest(t, b, 39.7525, -104.9965)
+	cb.send(testFeature(b, 39.7426, -104.9965))
+	if shout := cb.expect("Shout"); gjson.Get(shout, "text").String() != "coffee here" {
+		t.Fatalf("got %s", shout)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tile38/proximity-chat/protocol"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// shutdownTimeout is how long to wait for the HTTP server to stop
+const shutdownTimeout = 5 * time.Second
+
+var draining int32 // set to 1 when the server is shutting down
+
+// isDraining returns true when the server is shutting down
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// waitForShutdown blocks until an interrupt or terminate signal is received
+// and then gracefully shuts down the server
+func waitForShutdown(srvs ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	lg.Info("shutting down", "signal", <-sig)
+	shutdown(srvs...)
+}
+
+// shutdown stops accepting new connections, notifies all connected clients,
+// removes their state from Tile38 and closes the connection pool
+func shutdown(srvs ...*http.Server) {
+	atomic.StoreInt32(&draining, 1)
+
+	// Stop accepting new connections
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			lg.Error("http shutdown failed", "addr", srv.Addr, "err", err)
+		}
+	}
+	stopGRPC()
+	stopMQTT()
+
+	// Let all connected clients know the server is going away
+	shutdownMsg, _ := protocol.Encode(protocol.Envelope{
+		Type: protocol.TypeShutdown,
+	})
+	m := socket.NewMessage(shutdownMsg)
+	h.Range(func(_ string, c *socket.Conn) bool {
+		sendConn(c, m)
+		return true
+	})
+	h.Flush(shutdownTimeout)
+
+	// Delete every connected or suspended person from the people collection
+	idmu.Lock()
+	clientIDs := make([]string, 0, len(connClientM))
+	for _, clientID := range connClientM {
+		clientIDs = append(clientIDs, clientID)
+	}
+	idmu.Unlock()
+	sessionmu.Lock()
+	for clientID, s := range clientSessionM {
+		if s.connID == "" {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	sessionmu.Unlock()
+	for _, clientID := range clientIDs {
+		if err := geo.DelFeature(personKey(clientID), clientID); err != nil {
+			lg.Error("delete person failed", "client", clientID, "err", err)
+		}
+	}
+	leaveCluster()
+
+	if err := geo.Close(); err != nil {
+		lg.Error("close tile38 pool failed", "err", err)
+	}
+	if err := store.Close(); err != nil {
+		lg.Error("close redis pool failed", "err", err)
+	}
+	stopTracing()
+	lg.Info("shutdown complete", "people", len(clientIDs))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// archetype is a kind of simulated client, with how fast it moves, how often
+// it sends its position and how much it chats
+type archetype struct {
+	name  string
+	speed float64       // meters per second
+	gps   time.Duration // time between position updates
+	chat  float64       // chat rate, relative to the -chat rate
+}
+
+// The archetypes of simulated clients. Walkers are the default, and make up
+// the clients that the percentages of the others leave.
+var (
+	walker = &archetype{name: "walker", speed: speed, gps: gpsFrequency, chat: 1}
+	booth  = &archetype{name: "booth", speed: 0, gps: 10 * time.Second, chat: 2}
+	fast   = &archetype{name: "fast", speed: 4, gps: gpsFrequency, chat: 0.5}
+	driver = &archetype{name: "driver", speed: 13, gps: 2 * time.Second, chat: 0.1}
+	lurker = &archetype{name: "lurker", speed: 1, gps: 2 * time.Second, chat: 0}
+)
+
+// mix is the percentage of clients of each archetype but walkers
+var mix = map[*archetype]*float64{
+	booth:  new(float64),
+	fast:   new(float64),
+	driver: new(float64),
+	lurker: new(float64),
+}
+
+// assignArchetypes returns the archetypes of n clients by the percentages
+// of the mix, in random order
+func assignArchetypes(n int) ([]*archetype, error) {
+	var total float64
+	for _, a := range []*archetype{booth, fast, driver, lurker} {
+		p := *mix[a]
+		if p < 0 {
+			return nil, fmt.Errorf("-%s: negative percentage", a.name)
+		}
+		total += p
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("archetype percentages add up to %g, more than 100", total)
+	}
+	assigned := make([]*archetype, 0, n)
+	for _, a := range []*archetype{booth, fast, driver, lurker} {
+		for i := 0; i < int(float64(n)**mix[a]/100+0.5) && len(assigned) < n; i++ {
+			assigned = append(assigned, a)
+		}
+	}
+	for len(assigned) < n {
+		assigned = append(assigned, walker)
+	}
+	rand.Shuffle(len(assigned), func(i, j int) {
+		assigned[i], assigned[j] = assigned[j], assigned[i]
+	})
+	return assigned, nil
+}
+
+// mixReport returns the number of clients of each archetype
+func mixReport(assigned []*archetype) string {
+	counts := make(map[*archetype]int)
+	for _, a := range assigned {
+		counts[a]++
+	}
+	var parts []string
+	for _, a := range []*archetype{walker, booth, fast, driver, lurker} {
+		if counts[a] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %ss", counts[a], a.name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatPrefix marks the chat messages sent by simload. The text is
+// "simload:<sender>:<unix nanos>", so that receivers can measure latency.
+const chatPrefix = "simload:"
+
+var (
+	latencyMu sync.Mutex
+	latencies []time.Duration // delivery latencies of received chat messages
+	chatSent  int64           // chat messages sent
+)
+
+// chatText returns the text of a chat message from a person carrying the send
+// time
+func chatText(id string) string {
+	return chatPrefix + id + ":" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+// recordChat records the latency of a received chat message when it was sent
+// by another simulated client
+func recordChat(id, text string) {
+	if !strings.HasPrefix(text, chatPrefix) {
+		return
+	}
+	parts := strings.Split(text[len(chatPrefix):], ":")
+	if len(parts) != 2 || parts[0] == id {
+		return
+	}
+	sent, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return
+	}
+	latency := time.Since(time.Unix(0, sent))
+	latencyMu.Lock()
+	latencies = append(latencies, latency)
+	latencyMu.Unlock()
+}
+
+// latencyReport returns the delivery latency percentiles of the chat messages
+func latencyReport() string {
+	latencyMu.Lock()
+	ls := append([]time.Duration(nil), latencies...)
+	sent := chatSent
+	latencyMu.Unlock()
+	if len(ls) == 0 {
+		return fmt.Sprintf("chat: %d sent, none received", sent)
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	pct := func(p float64) time.Duration {
+		return ls[int(p*float64(len(ls)-1))]
+	}
+	return fmt.Sprintf(
+		"chat: %d sent, %d received, latency p50=%v p90=%v p99=%v max=%v",
+		sent, len(ls), pct(0.5), pct(0.9), pct(0.99), ls[len(ls)-1],
+	)
+}
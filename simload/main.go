@@ -3,20 +3,22 @@ package main
 import (
 	"encoding/hex"
 	"flag"
-	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/tidwall/tile38/pkg/geojson/geo"
 
-	"github.com/gorilla/websocket"
 	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/client"
+	"github.com/tile38/proximity-chat/protocol"
 )
 
 const (
@@ -30,22 +32,98 @@ const (
 var addr string
 var clients int
 var coords string
+var routes []*route
+var chatRate float64
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	flag.StringVar(&addr, "a", ":8000", "server address")
 	flag.IntVar(&clients, "n", 100, "number of clients")
 	flag.StringVar(&coords, "c", "[-104.99649808,39.74254437]", "origin coordinates")
+	flag.Float64Var(&chatRate, "chat", 0, "chat messages per second per client, 0 disables")
+	duration := flag.Duration("t", 0, "run time, 0 runs until interrupted")
+	ramp := flag.String("ramp", "", "rate at which clients are started and stopped, such as 10/s, empty starts all at once")
+	statsInterval := flag.Duration("stats", 5*time.Second, "interval of the stats printout, 0 disables")
+	out := flag.String("o", "", "results file, CSV or JSON when it ends in .json")
+	routeList := flag.String("routes", "", "comma separated GPX or GeoJSON route files, each optionally followed by :speed in m/s")
+	flag.Float64Var(mix[booth], "booth", 0, "percent of clients that are stationary booths, which chat twice as much")
+	flag.Float64Var(mix[fast], "fast", 0, "percent of clients that are fast walkers at 4 m/s, which chat half as much")
+	flag.Float64Var(mix[driver], "driver", 0, "percent of clients that are drivers at 13 m/s, which rarely chat")
+	flag.Float64Var(mix[lurker], "lurker", 0, "percent of clients that are lurkers, which never chat")
 
 	flag.Parse()
-	log.Printf("firing up %d clients", clients)
-	for i := 0; i < clients; i++ {
-		go runClient(i)
+	assigned, err := assignArchetypes(clients)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *routeList != "" {
+		var err error
+		if routes, err = loadRoutes(*routeList); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d routes", len(routes))
+	}
+	var rampRate float64
+	if *ramp != "" {
+		var err error
+		if rampRate, err = parseRate(*ramp); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *statsInterval > 0 {
+		go reportStats(*statsInterval)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+
+	log.Printf("firing up %d clients: %s", clients, mixReport(assigned))
+	quits := make([]chan struct{}, 0, clients)
+	stopped := false
+	for i := 0; i < clients && !stopped; i++ {
+		quit := make(chan struct{})
+		quits = append(quits, quit)
+		go runClient(i, assigned[i], quit)
+		if rampRate > 0 {
+			select {
+			case <-sig:
+				stopped = true
+			case <-deadline:
+				stopped = true
+			case <-time.After(time.Duration(float64(time.Second) / rampRate)):
+			}
+		}
+	}
+	if !stopped {
+		select {
+		case <-sig:
+		case <-deadline:
+		}
+	}
+	if rampRate > 0 {
+		log.Printf("ramping down %d clients", len(quits))
+		for _, quit := range quits {
+			close(quit)
+			time.Sleep(time.Duration(float64(time.Second) / rampRate))
+		}
+	}
+	if chatRate > 0 {
+		log.Print(latencyReport())
+	}
+	if *out != "" {
+		if err := writeResults(*out); err != nil {
+			log.Fatal(err)
+		}
 	}
-	select {}
 }
 
-func runClient(idx int) {
+// runClient runs a simulated client of an archetype until quit is closed
+func runClient(idx int, a *archetype, quit chan struct{}) {
+	atomic.AddInt64(&running, 1)
+	defer atomic.AddInt64(&running, -1)
 	var b [12]byte
 	rand.Read(b[:])
 	id := hex.EncodeToString(b[:])
@@ -65,79 +143,117 @@ func runClient(idx int) {
 	// lng := gjson.Get(coords, "0").Float() + (rand.Float64() * spread) - spread/2
 	time.Sleep(time.Duration(rand.Float64() * float64(time.Second*2)))
 
-	// move the point in the background
+	// move the point in the background, along a route when routes are
+	// loaded or in a random straight line otherwise. Routes are followed at
+	// their speed, scaled by how much faster than a walker the archetype is.
+	var rt *route
+	var walked float64
+	if len(routes) > 0 && a.speed > 0 {
+		rt = routes[idx%len(routes)]
+		walked = rand.Float64() * 2 * rt.length()
+		lat, lng = rt.at(walked)
+	}
 	go func() {
 		bearing := rand.Float64() * math.Pi * 2 * degrees
 		tickDur := time.Millisecond * 50
 		tick := time.NewTicker(tickDur)
-		for range tick.C {
+		defer tick.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-tick.C:
+			}
 			posnMu.Lock()
-			lat, lng = geo.DestinationPoint(lat, lng, (speed / (1 / tickDur.Seconds())), bearing)
+			if rt != nil {
+				walked += rt.speed * a.speed / speed * tickDur.Seconds()
+				lat, lng = rt.at(walked)
+			} else {
+				lat, lng = geo.DestinationPoint(lat, lng, (a.speed / (1 / tickDur.Seconds())), bearing)
+			}
 			posnMu.Unlock()
 
 		}
 	}()
 
-	for {
-		func() {
-			// connect to server
-			ws, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", http.Header{})
-			if err != nil {
-				log.Printf("err %v: %v", idx, err)
-				return
+	var conns int64
+	opts := client.Options{
+		ID:           id,
+		Properties:   map[string]interface{}{"color": color},
+		ReconnectMin: time.Second,
+		ReconnectMax: time.Second,
+		OnConnect: func() {
+			if atomic.AddInt64(&conns, 1) > 1 {
+				atomic.AddInt64(&reconnects, 1)
 			}
-			defer resp.Body.Close()
-			var stop int32
-			defer atomic.StoreInt32(&stop, 1)
-			defer ws.Close()
-
+			atomic.AddInt64(&connected, 1)
 			log.Printf("connected %d", idx)
-			defer log.Printf("disconnected %d", idx)
-
-			go func() {
-				meTicker := time.NewTicker(gpsFrequency)
-				defer meTicker.Stop()
-				viewportTicker := time.NewTicker(viewportFrequency)
-				defer viewportTicker.Stop()
-				for atomic.LoadInt32(&stop) == 0 {
-					select {
-					case <-meTicker.C:
-						posnMu.Lock()
-						lat1, lng1 := lat, lng
-						posnMu.Unlock()
-						me := `{"type": "Feature",
-							"geometry": {"type":"Point","coordinates":[` +
-							strconv.FormatFloat(lng1, 'f', -1, 64) + `,` +
-							strconv.FormatFloat(lat1, 'f', -1, 64) + `]},
-							"id":"` + id + `",
-							"properties":{"color":"` + color + `"}}`
-						ws.WriteMessage(1, []byte(me))
-					case <-viewportTicker.C:
-						posnMu.Lock()
-						lat1, lng1 := lat, lng
-						posnMu.Unlock()
-						nLat, _ := destinationPoint(lat1, lng1, viewportMeters/2, 0)
-						_, eLng := destinationPoint(lat1, lng1, viewportMeters/2, 90)
-						sLat, _ := destinationPoint(lat1, lng1, viewportMeters/2, 180)
-						_, wLng := destinationPoint(lat1, lng1, viewportMeters/2, 270)
-						msg := fmt.Sprintf(
-							`{"type":"Viewport","bounds":{"_sw":{"lat":%f,"lng":%f},"_ne":{"lat":%f,"lng":%f}}}`,
-							sLat, wLng, nLat, eLng,
-						)
-						ws.WriteMessage(1, []byte(msg))
-					}
-				}
-			}()
-			for {
-				_, _, err := ws.ReadMessage()
-				if err != nil {
-					log.Printf("err %v: %v", idx, err.Error())
-					return
-				}
+		},
+		OnDisconnect: func(err error) {
+			atomic.AddInt64(&connected, -1)
+			log.Printf("disconnected %d: %v", idx, err)
+		},
+		OnFrame: func(string, string) {
+			atomic.AddInt64(&received, 1)
+		},
+	}
+	if chatRate > 0 {
+		opts.OnMessage = func(m protocol.ChatMessage) {
+			recordChat(id, m.Text)
+		}
+	}
+	var c *client.Client
+	for c == nil {
+		var err error
+		if c, err = client.Connect(addr, opts); err != nil {
+			log.Printf("err %v: %v", idx, err)
+			select {
+			case <-quit:
+				return
+			case <-time.After(time.Second):
 			}
-		}()
-		time.Sleep(time.Second)
+		}
+	}
+	defer c.Close()
 
+	meTicker := time.NewTicker(a.gps)
+	defer meTicker.Stop()
+	viewportTicker := time.NewTicker(viewportFrequency)
+	defer viewportTicker.Stop()
+	var chatC <-chan time.Time
+	if rate := chatRate * a.chat; rate > 0 {
+		chatTicker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer chatTicker.Stop()
+		chatC = chatTicker.C
+	}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-meTicker.C:
+			posnMu.Lock()
+			lat1, lng1 := lat, lng
+			posnMu.Unlock()
+			countErr(c.UpdatePosition(lat1, lng1))
+		case <-chatC:
+			if _, err := c.Send(chatText(id)); countErr(err) == nil {
+				latencyMu.Lock()
+				chatSent++
+				latencyMu.Unlock()
+			}
+		case <-viewportTicker.C:
+			posnMu.Lock()
+			lat1, lng1 := lat, lng
+			posnMu.Unlock()
+			nLat, _ := destinationPoint(lat1, lng1, viewportMeters/2, 0)
+			_, eLng := destinationPoint(lat1, lng1, viewportMeters/2, 90)
+			sLat, _ := destinationPoint(lat1, lng1, viewportMeters/2, 180)
+			_, wLng := destinationPoint(lat1, lng1, viewportMeters/2, 270)
+			countErr(c.SetViewport(protocol.Viewport{Bounds: protocol.Bounds{
+				SW: protocol.LatLng{Lat: sLat, Lng: wLng},
+				NE: protocol.LatLng{Lat: nLat, Lng: eLng},
+			}}))
+		}
 	}
 }
 
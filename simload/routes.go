@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// route is a path followed by simulated clients, walked back and forth
+type route struct {
+	name  string
+	lats  []float64
+	lngs  []float64
+	dists []float64 // distance in meters from the start to each point
+	speed float64   // meters per second
+}
+
+// length returns the length of the route in meters
+func (r *route) length() float64 {
+	return r.dists[len(r.dists)-1]
+}
+
+// at returns the position after walking a distance along the route. Walkers
+// turn around at the ends.
+func (r *route) at(dist float64) (lat, lng float64) {
+	length := r.length()
+	if length == 0 {
+		return r.lats[0], r.lngs[0]
+	}
+	for dist < 0 {
+		dist += 2 * length
+	}
+	for dist >= 2*length {
+		dist -= 2 * length
+	}
+	if dist > length {
+		dist = 2*length - dist
+	}
+	i := 1
+	for i < len(r.dists)-1 && r.dists[i] < dist {
+		i++
+	}
+	seg := r.dists[i] - r.dists[i-1]
+	if seg == 0 {
+		return r.lats[i], r.lngs[i]
+	}
+	f := (dist - r.dists[i-1]) / seg
+	return r.lats[i-1] + (r.lats[i]-r.lats[i-1])*f,
+		r.lngs[i-1] + (r.lngs[i]-r.lngs[i-1])*f
+}
+
+// add appends a point to the route
+func (r *route) add(lat, lng float64) {
+	d := 0.0
+	if n := len(r.lats); n > 0 {
+		d = r.dists[n-1] + distanceTo(r.lats[n-1], r.lngs[n-1], lat, lng)
+	}
+	r.lats = append(r.lats, lat)
+	r.lngs = append(r.lngs, lng)
+	r.dists = append(r.dists, d)
+}
+
+// loadRoutes loads the routes of a comma separated list of GPX and GeoJSON
+// files. A file may be followed by ":speed" in meters per second, otherwise
+// the "speed" property of GeoJSON features or the default speed is used.
+func loadRoutes(list string) ([]*route, error) {
+	var routes []*route
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		path, rspeed := item, 0.0
+		if i := strings.LastIndexByte(item, ':'); i > 0 {
+			if v, err := strconv.ParseFloat(item[i+1:], 64); err == nil {
+				path, rspeed = item[:i], v
+			}
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var loaded []*route
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".gpx":
+			loaded, err = parseGPX(data)
+		default:
+			loaded, err = parseGeoJSON(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for i, r := range loaded {
+			r.name = fmt.Sprintf("%s#%d", filepath.Base(path), i)
+			if rspeed > 0 {
+				r.speed = rspeed
+			} else if r.speed <= 0 {
+				r.speed = speed
+			}
+		}
+		routes = append(routes, loaded...)
+	}
+	return routes, nil
+}
+
+// parseGPX reads a route for every track segment and route of a GPX file
+func parseGPX(data []byte) ([]*route, error) {
+	type point struct {
+		Lat float64 `xml:"lat,attr"`
+		Lon float64 `xml:"lon,attr"`
+	}
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []point `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+		Routes []struct {
+			Points []point `xml:"rtept"`
+		} `xml:"rte"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var lines [][]point
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			lines = append(lines, seg.Points)
+		}
+	}
+	for _, rte := range doc.Routes {
+		lines = append(lines, rte.Points)
+	}
+	var routes []*route
+	for _, line := range lines {
+		if len(line) < 2 {
+			continue
+		}
+		r := &route{}
+		for _, p := range line {
+			r.add(p.Lat, p.Lon)
+		}
+		routes = append(routes, r)
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no tracks or routes")
+	}
+	return routes, nil
+}
+
+// parseGeoJSON reads a route for every LineString of a GeoJSON geometry,
+// feature or feature collection
+func parseGeoJSON(data []byte) ([]*route, error) {
+	if !gjson.ValidBytes(data) {
+		return nil, fmt.Errorf("invalid json")
+	}
+	var routes []*route
+	var walk func(v gjson.Result, rspeed float64)
+	walk = func(v gjson.Result, rspeed float64) {
+		switch v.Get("type").String() {
+		case "FeatureCollection":
+			for _, f := range v.Get("features").Array() {
+				walk(f, rspeed)
+			}
+		case "Feature":
+			if s := v.Get("properties.speed"); s.Exists() {
+				rspeed = s.Float()
+			}
+			walk(v.Get("geometry"), rspeed)
+		case "GeometryCollection":
+			for _, g := range v.Get("geometries").Array() {
+				walk(g, rspeed)
+			}
+		case "LineString":
+			routes = appendLine(routes, v.Get("coordinates"), rspeed)
+		case "MultiLineString":
+			for _, line := range v.Get("coordinates").Array() {
+				routes = appendLine(routes, line, rspeed)
+			}
+		}
+	}
+	walk(gjson.ParseBytes(data), 0)
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no LineString geometries")
+	}
+	return routes, nil
+}
+
+// appendLine appends a route for GeoJSON LineString coordinates
+func appendLine(routes []*route, coords gjson.Result, rspeed float64) []*route {
+	points := coords.Array()
+	if len(points) < 2 {
+		return routes
+	}
+	r := &route{speed: rspeed}
+	for _, p := range points {
+		r.add(p.Get("1").Float(), p.Get("0").Float())
+	}
+	return append(routes, r)
+}
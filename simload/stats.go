@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counters of all clients
+var (
+	running    int64 // clients started and not stopped
+	connected  int64 // clients with an open connection
+	reconnects int64 // connections after the first one of a client
+	sendErrors int64 // failed writes
+	received   int64 // messages received
+)
+
+// sample is a periodic snapshot of the counters
+type sample struct {
+	Time       time.Time `json:"time"`
+	Clients    int64     `json:"clients"`
+	Connected  int64     `json:"connected"`
+	Reconnects int64     `json:"reconnects"`
+	SendErrors int64     `json:"sendErrors"`
+	Received   float64   `json:"receivedPerSecond"`
+}
+
+var (
+	samplesMu sync.Mutex
+	samples   []sample
+)
+
+// countErr counts a failed send to the server
+func countErr(err error) error {
+	if err != nil {
+		atomic.AddInt64(&sendErrors, 1)
+	}
+	return err
+}
+
+// parseRate parses a rate such as "10/s" or "100/m" into clients per second.
+// A bare number is per second.
+func parseRate(s string) (float64, error) {
+	per := time.Second
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		switch s[i+1:] {
+		case "s":
+		case "m":
+			per = time.Minute
+		default:
+			return 0, fmt.Errorf("invalid rate %q", s)
+		}
+		s = s[:i]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return n / per.Seconds(), nil
+}
+
+// reportStats logs the counters at every interval and keeps them as samples
+// for the results file
+func reportStats(interval time.Duration) {
+	last := time.Now()
+	var lastReceived int64
+	for now := range time.NewTicker(interval).C {
+		recv := atomic.LoadInt64(&received)
+		s := sample{
+			Time:       now,
+			Clients:    atomic.LoadInt64(&running),
+			Connected:  atomic.LoadInt64(&connected),
+			Reconnects: atomic.LoadInt64(&reconnects),
+			SendErrors: atomic.LoadInt64(&sendErrors),
+			Received:   float64(recv-lastReceived) / now.Sub(last).Seconds(),
+		}
+		last, lastReceived = now, recv
+		samplesMu.Lock()
+		samples = append(samples, s)
+		samplesMu.Unlock()
+		log.Printf("clients=%d connected=%d reconnects=%d send_errors=%d recv=%.0f/s",
+			s.Clients, s.Connected, s.Reconnects, s.SendErrors, s.Received)
+	}
+}
+
+// writeResults writes the samples to a CSV file, or a JSON file when the path
+// ends in .json, for comparing runs
+func writeResults(path string) error {
+	samplesMu.Lock()
+	ss := append([]sample(nil), samples...)
+	samplesMu.Unlock()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		results := struct {
+			Samples []sample `json:"samples"`
+			Chat    string   `json:"chat,omitempty"`
+		}{Samples: ss}
+		if chatRate > 0 {
+			results.Chat = latencyReport()
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "clients", "connected", "reconnects", "send_errors", "received_per_second"})
+	for _, s := range ss {
+		w.Write([]string{
+			s.Time.Format(time.RFC3339),
+			strconv.FormatInt(s.Clients, 10),
+			strconv.FormatInt(s.Connected, 10),
+			strconv.FormatInt(s.Reconnects, 10),
+			strconv.FormatInt(s.SendErrors, 10),
+			strconv.FormatFloat(s.Received, 'f', 1, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,46 @@
+package socket
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// SetCompression turns compression of the messages sent to a connection on
+// or off. It has no effect on connections that did not negotiate
+// permessage-deflate.
+func (h *Handler) SetCompression(id string, enable bool) {
+	if s, ok := h.conns.load(id); ok {
+		s.mu.Lock()
+		s.conn.EnableWriteCompression(enable)
+		s.mu.Unlock()
+	}
+}
+
+// countingWriter is a ResponseWriter whose hijacked connection counts the
+// bytes written to it
+type countingWriter struct {
+	http.ResponseWriter
+	n *uint64
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{conn, w.n}, brw, nil
+}
+
+// countingConn is a connection that counts the bytes written to it
+type countingConn struct {
+	net.Conn
+	n *uint64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(c.n, uint64(n))
+	return n, err
+}
@@ -0,0 +1,355 @@
+// Package socket is a simple websocket json message handling package. It is
+// derived from github.com/tile38/msgkit and keeps the same http style
+// request/message handlers, while giving the server access to the upgrade
+// request and control over the lifetime of each connection.
+package socket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// MaxRefLen is the length of a message ref that is echoed in errors
+const MaxRefLen = 64
+
+// Conn is a websocket connection of a Handler
+type Conn struct {
+	id    string
+	h     *Handler
+	mu    sync.Mutex
+	conn  *websocket.Conn
+	codec Codec // nil for JSON text messages
+
+	missed int32 // pings sent since the last pong
+
+	qmu       sync.Mutex // guards the send queue
+	queue     []frame    // frames waiting to be written
+	scheduled bool       // the connection is ready or being written
+	dropped   int        // frames dropped since the queue last drained
+	slow      bool       // closed as a slow consumer
+	closing   bool       // a close is queued
+}
+
+// Codec transcodes the JSON messages of the handlers to and from the binary
+// messages of a websocket subprotocol
+type Codec interface {
+	Encode(msg string) ([]byte, error)
+	Decode(data []byte) (string, error)
+}
+
+// IDProvider generates the ids of new connections from their upgrade
+// requests
+type IDProvider interface {
+	NewID(r *http.Request) string
+}
+
+// Handler is a package of all required dependencies to run a websocket server
+type Handler struct {
+	conns    registry           // holds the websockets
+	upgrader websocket.Upgrader // shared upgrader
+	once     sync.Once          // sets up the upgrader
+
+	// Event handlers for all connections
+	handlers map[string]func(id, msg string)
+
+	// IDs generates the ids of connections, random hex ids when nil. An
+	// empty id or one that is in use is replaced by a random one.
+	IDs IDProvider
+
+	// OnOpen binds an on-open handler to the server which will be triggered
+	// every time a connection is made. The request is the original upgrade
+	// request.
+	OnOpen func(id string, r *http.Request)
+
+	// OnClose binds an on-close handler to the server which will trigger every
+	// time a connection is closed
+	OnClose func(id string)
+
+	// Codecs maps websocket subprotocols to the codec used by connections
+	// that negotiate them. Other connections exchange JSON text messages.
+	Codecs map[string]Codec
+
+	// PingInterval is the time between the pings sent to every connection,
+	// zero disables pings. Connections that miss MaxMissedPongs pongs in a
+	// row are closed as dead peers.
+	PingInterval   time.Duration
+	MaxMissedPongs int
+
+	// OnDead is triggered before a dead peer is closed, the OnClose handler
+	// follows once the connection has been torn down
+	OnDead func(id string)
+
+	// OnPong is triggered for every pong of a connection
+	OnPong func(id string)
+
+	// CheckOrigin returns true when the origin of an upgrade request is
+	// allowed. Nil only allows the origin of the request host.
+	CheckOrigin func(r *http.Request) bool
+
+	// Compression negotiates permessage-deflate with clients that offer it.
+	// CompressionLevel is the flate level of the messages sent, zero uses
+	// the default level.
+	Compression      bool
+	CompressionLevel int
+
+	// QueueSize is the number of frames that can wait to be sent to each
+	// connection, written by a pool of Workers so that a slow connection
+	// does not hold up the others. Zero writes frames right away. Every
+	// write must complete within WriteTimeout, and a connection that drops
+	// MaxDropped frames from its full queue before it drains is closed.
+	QueueSize    int
+	Workers      int
+	WriteTimeout time.Duration
+	MaxDropped   int
+
+	payload uint64 // bytes of the messages sent
+	wire    uint64 // bytes written to the network
+	dropped uint64 // frames dropped from full queues
+	slow    uint64 // connections closed as slow consumers
+
+	readymu sync.Mutex
+	readyc  *sync.Cond
+	ready   []*Conn // connections with queued frames
+}
+
+// Stats are the counters of a Handler. Payload is the size of the messages
+// sent and Wire what was written to the network for them, so the difference
+// is about what compression saved. Dropped counts the frames dropped from
+// full send queues, and Slow the connections closed as slow consumers.
+type Stats struct {
+	Payload uint64 `json:"payload"`
+	Wire    uint64 `json:"wire"`
+	Dropped uint64 `json:"dropped"`
+	Slow    uint64 `json:"slow"`
+}
+
+// Stats returns the byte counters of the handler
+func (h *Handler) Stats() Stats {
+	return Stats{
+		Payload: atomic.LoadUint64(&h.payload),
+		Wire:    atomic.LoadUint64(&h.wire),
+		Dropped: atomic.LoadUint64(&h.dropped),
+		Slow:    atomic.LoadUint64(&h.slow),
+	}
+}
+
+// Handle adds a HandlerFunc to the map of websocket message handlers
+func (h *Handler) Handle(name string, handler func(id, msg string)) {
+	if h.handlers == nil {
+		h.handlers = make(map[string]func(id, msg string))
+	}
+	h.handlers[name] = handler
+}
+
+// Send a message to a websocket.
+func (h *Handler) Send(id string, message string) {
+	if c, ok := h.conns.load(id); ok {
+		c.Send(message)
+	}
+}
+
+// Close closes the websocket connection for the id, after the frames queued
+// for it are sent. The OnClose handler is triggered once the connection has
+// been torn down.
+func (h *Handler) Close(id string) {
+	if c, ok := h.conns.load(id); ok {
+		c.Close()
+	}
+}
+
+// Range ranges over all connections with their ids. Sending to the
+// connection passed to f saves looking it up by id.
+func (h *Handler) Range(f func(id string, c *Conn) bool) {
+	h.conns.rangeConns(func(c *Conn) bool {
+		return f(c.id, c)
+	})
+}
+
+// Len returns the number of connections
+func (h *Handler) Len() int {
+	return h.conns.len()
+}
+
+// ID returns the id of the connection
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Send sends a message to the connection
+func (c *Conn) Send(message string) {
+	msgType, data := websocket.TextMessage, []byte(message)
+	if c.codec != nil {
+		var err error
+		if data, err = c.codec.Encode(message); err != nil {
+			log.Println("encode:", err)
+			return
+		}
+		msgType = websocket.BinaryMessage
+	}
+	c.h.send(c, frame{msgType: msgType, data: data})
+}
+
+// Close closes the connection after the frames queued for it are sent
+func (c *Conn) Close() {
+	if c.h.QueueSize > 0 {
+		c.h.enqueue(c, frame{msgType: closeFrame})
+	} else {
+		c.conn.Close()
+	}
+}
+
+// send queues a frame for a connection, or writes it right away without
+// send queues
+func (h *Handler) send(c *Conn, f frame) {
+	if h.QueueSize > 0 {
+		h.enqueue(c, f)
+	} else {
+		h.writeNow(c, f)
+	}
+}
+
+// heartbeat pings a connection until done is closed, and closes it when too
+// many pongs are missed
+func (h *Handler) heartbeat(id string, s *Conn, done chan struct{}) {
+	ticker := time.NewTicker(h.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if int(atomic.AddInt32(&s.missed, 1)) > h.MaxMissedPongs {
+			if h.OnDead != nil {
+				h.OnDead(id)
+			}
+			s.conn.Close()
+			return
+		}
+		deadline := time.Now().Add(h.PingInterval)
+		if err := s.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// store stores a new socket by the id of the id provider, or by a random id
+// when the provider has none or it is in use. Returns the id.
+func (h *Handler) store(r *http.Request, s *Conn) string {
+	if h.IDs != nil {
+		if s.id = h.IDs.NewID(r); s.id != "" && h.conns.add(s) {
+			return s.id
+		}
+	}
+	for {
+		var b [12]byte
+		rand.Read(b[:])
+		if s.id = hex.EncodeToString(b[:]); h.conns.add(s) {
+			return s.id
+		}
+	}
+}
+
+// ServeHTTP is the primary websocket handler method and conforms to the
+// http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Open and register the websocket
+	h.once.Do(func() {
+		for name := range h.Codecs {
+			h.upgrader.Subprotocols = append(h.upgrader.Subprotocols, name)
+		}
+		sort.Strings(h.upgrader.Subprotocols)
+		h.upgrader.EnableCompression = h.Compression
+		h.upgrader.CheckOrigin = h.CheckOrigin
+		h.startWorkers()
+	})
+	if _, ok := w.(http.Hijacker); ok {
+		w = countingWriter{w, &h.wire}
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("register:", err)
+		return
+	}
+	defer conn.Close() // Defer close the websocket
+	if h.CompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(h.CompressionLevel); err != nil {
+			log.Println("compression:", err)
+		}
+	}
+
+	// Store the socket by a unique identifier
+	s := &Conn{h: h, conn: conn, codec: h.Codecs[conn.Subprotocol()]}
+	id := h.store(r, s)
+	defer h.conns.remove(id) // Defer unregister the connection
+
+	// Trigger the OnOpen handler if one is defined
+	if h.OnOpen != nil {
+		h.OnOpen(id, r)
+	}
+
+	if h.OnClose != nil {
+		// Defer trigger the OnClose handler if one is defined
+		defer h.OnClose(id)
+	}
+
+	if h.PingInterval > 0 {
+		conn.SetPongHandler(func(string) error {
+			atomic.StoreInt32(&s.missed, 0)
+			if h.OnPong != nil {
+				h.OnPong(id)
+			}
+			return nil
+		})
+		done := make(chan struct{})
+		defer close(done)
+		go h.heartbeat(id, s, done)
+	}
+
+	// For every message that comes through on the connection
+	for {
+		// Read the next message on the connection
+		msgKind, msgb, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgKind == websocket.BinaryMessage && s.codec != nil {
+			msg, err := s.codec.Decode(msgb)
+			if err != nil {
+				h.Send(id, `{"type":"Error","code":"invalid_message","message":"Invalid binary message"}`)
+				continue
+			}
+			msgb = []byte(msg)
+		}
+
+		// JSON decode the type from the json formatted message
+		msgType := gjson.GetBytes(msgb, "type").String()
+
+		// If a handler exists for the message type, handle it
+		if fn, ok := h.handlers[msgType]; ok {
+			fn(id, string(msgb))
+		} else {
+			// Send an error back to the client letting them know that the
+			// incoming type is unknown, with the ref of the message
+			msg := `{"type":"Error","code":"unknown_type","message":"Unknown type"}`
+			if msgType != "" && len(msgType) <= MaxRefLen {
+				msg, _ = sjson.Set(msg, "request", msgType)
+			}
+			if ref := gjson.GetBytes(msgb, "ref").String(); ref != "" && len(ref) <= MaxRefLen {
+				msg, _ = sjson.Set(msg, "ref", ref)
+			}
+			h.Send(id, msg)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package socket
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message is a message that is sent to many connections. It is encoded once
+// for each codec, and framed and compressed once for each compression
+// setting, instead of for every connection it is sent to.
+type Message struct {
+	text     string
+	mu       sync.Mutex
+	prepared map[Codec]frame // codec -> prepared frame, nil for JSON text
+}
+
+// NewMessage returns a message of the handlers to send to many connections
+func NewMessage(text string) *Message {
+	return &Message{text: text}
+}
+
+// String returns the JSON text of the message
+func (m *Message) String() string {
+	return m.text
+}
+
+// prepare returns the frame of the message for the connections of a codec,
+// preparing it the first time
+func (m *Message) prepare(codec Codec) (frame, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.prepared[codec]; ok {
+		return f, nil
+	}
+	msgType, data := websocket.TextMessage, []byte(m.text)
+	if codec != nil {
+		var err error
+		if data, err = codec.Encode(m.text); err != nil {
+			return frame{}, err
+		}
+		msgType = websocket.BinaryMessage
+	}
+	pm, err := websocket.NewPreparedMessage(msgType, data)
+	if err != nil {
+		return frame{}, err
+	}
+	f := frame{msgType: msgType, data: data, prepared: pm}
+	if m.prepared == nil {
+		m.prepared = make(map[Codec]frame, 1)
+	}
+	m.prepared[codec] = f
+	return f, nil
+}
+
+// SendMessage sends a message that is sent to many connections to a
+// websocket
+func (h *Handler) SendMessage(id string, m *Message) {
+	if c, ok := h.conns.load(id); ok {
+		c.SendMessage(m)
+	}
+}
+
+// SendMessage sends a message that is sent to many connections to the
+// connection
+func (c *Conn) SendMessage(m *Message) {
+	f, err := m.prepare(c.codec)
+	if err != nil {
+		log.Println("encode:", err)
+		return
+	}
+	c.h.send(c, f)
+}
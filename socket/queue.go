@@ -0,0 +1,184 @@
+package socket
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// frame is a message waiting in the send queue of a connection. Frames of a
+// Message carry its prepared message, which is written instead of the data.
+type frame struct {
+	msgType  int
+	data     []byte
+	prepared *websocket.PreparedMessage
+}
+
+// closeFrame is queued by Close so that the connection is closed once the
+// frames before it are written
+const closeFrame = -1
+
+// enqueue adds a frame to the send queue of a connection and schedules the
+// connection on the worker pool. When the queue is full the oldest frame is
+// dropped, and a connection that drops MaxDropped frames before its queue
+// drains is closed as a slow consumer.
+func (h *Handler) enqueue(s *Conn, f frame) {
+	s.qmu.Lock()
+	if s.closing {
+		s.qmu.Unlock()
+		return
+	}
+	s.closing = f.msgType == closeFrame
+	if len(s.queue) >= h.QueueSize {
+		s.queue = append(s.queue[:0], s.queue[1:]...)
+		s.dropped++
+		atomic.AddUint64(&h.dropped, 1)
+		if h.MaxDropped > 0 && s.dropped >= h.MaxDropped && !s.slow {
+			s.slow = true
+			atomic.AddUint64(&h.slow, 1)
+			log.Println("slow consumer:", s.id)
+			s.conn.Close()
+		}
+	}
+	s.queue = append(s.queue, f)
+	scheduled := s.scheduled
+	s.scheduled = true
+	s.qmu.Unlock()
+	if !scheduled {
+		h.readymu.Lock()
+		h.ready = append(h.ready, s)
+		h.readymu.Unlock()
+		h.readyc.Signal()
+	}
+}
+
+// next waits for a connection that is ready to be written to
+func (h *Handler) next() *Conn {
+	h.readymu.Lock()
+	defer h.readymu.Unlock()
+	for len(h.ready) == 0 {
+		h.readyc.Wait()
+	}
+	s := h.ready[0]
+	h.ready[0] = nil
+	h.ready = h.ready[1:]
+	return s
+}
+
+// worker writes the queued frames of the connections that are ready. A
+// connection is handled by one worker at a time so its frames stay in order.
+func (h *Handler) worker() {
+	for {
+		s := h.next()
+		for {
+			s.qmu.Lock()
+			queue := s.queue
+			s.queue = nil
+			if len(queue) == 0 {
+				s.scheduled = false
+				s.dropped = 0
+				s.qmu.Unlock()
+				break
+			}
+			s.qmu.Unlock()
+			if !h.write(s, queue) {
+				s.qmu.Lock()
+				s.queue = nil
+				s.scheduled = false
+				s.qmu.Unlock()
+				break
+			}
+		}
+	}
+}
+
+// write writes frames to a connection. Returns false when the connection
+// failed.
+func (h *Handler) write(s *Conn, frames []frame) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range frames {
+		if f.msgType == closeFrame {
+			s.conn.Close()
+			return false
+		}
+		if err := h.writeFrame(s, f); err != nil {
+			s.conn.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// writeFrame writes a frame to a locked connection
+func (h *Handler) writeFrame(s *Conn, f frame) error {
+	if h.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
+	}
+	var err error
+	if f.prepared != nil {
+		err = s.conn.WritePreparedMessage(f.prepared)
+	} else {
+		err = s.conn.WriteMessage(f.msgType, f.data)
+	}
+	if err == nil {
+		atomic.AddUint64(&h.payload, uint64(len(f.data)))
+	}
+	return err
+}
+
+// Flush waits up to timeout for the send queues of all connections to drain
+func (h *Handler) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		pending := false
+		h.conns.rangeConns(func(s *Conn) bool {
+			s.qmu.Lock()
+			pending = s.scheduled
+			s.qmu.Unlock()
+			return !pending
+		})
+		if !pending {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Queued returns the number of frames waiting in the send queues of all
+// connections, and the number of connections
+func (h *Handler) Queued() (frames, conns int) {
+	h.conns.rangeConns(func(s *Conn) bool {
+		s.qmu.Lock()
+		frames += len(s.queue)
+		s.qmu.Unlock()
+		conns++
+		return true
+	})
+	return frames, conns
+}
+
+// startWorkers starts the worker pool when send queues are enabled
+func (h *Handler) startWorkers() {
+	if h.QueueSize <= 0 {
+		return
+	}
+	workers := h.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	h.readyc = sync.NewCond(&h.readymu)
+	for i := 0; i < workers; i++ {
+		go h.worker()
+	}
+}
+
+// writeNow writes a frame right away, for handlers without send queues
+func (h *Handler) writeNow(s *Conn, f frame) {
+	s.mu.Lock()
+	h.writeFrame(s, f)
+	s.mu.Unlock()
+}
@@ -0,0 +1,94 @@
+package socket
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// registryShards is the number of shards of the connection registry, each
+// with its own lock
+const registryShards = 64
+
+// registry holds the connections of a handler in shards by the hash of their
+// ids, so that opening and closing connections contend on one shard only and
+// a broadcast walks the connections without looking each one up by id
+type registry struct {
+	shards [registryShards]shard
+	count  int64 // number of connections
+}
+
+// shard is a shard of the connection registry
+type shard struct {
+	mu    sync.RWMutex
+	conns map[string]*Conn
+}
+
+// shard returns the shard of an id
+func (r *registry) shard(id string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return &r.shards[hash.Sum32()%registryShards]
+}
+
+// load returns the connection of an id
+func (r *registry) load(id string) (*Conn, bool) {
+	sh := r.shard(id)
+	sh.mu.RLock()
+	c, ok := sh.conns[id]
+	sh.mu.RUnlock()
+	return c, ok
+}
+
+// add adds a connection by its id. Returns false when the id is in use.
+func (r *registry) add(c *Conn) bool {
+	sh := r.shard(c.id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, taken := sh.conns[c.id]; taken {
+		return false
+	}
+	if sh.conns == nil {
+		sh.conns = make(map[string]*Conn)
+	}
+	sh.conns[c.id] = c
+	atomic.AddInt64(&r.count, 1)
+	return true
+}
+
+// remove removes the connection of an id
+func (r *registry) remove(id string) {
+	sh := r.shard(id)
+	sh.mu.Lock()
+	if _, ok := sh.conns[id]; ok {
+		delete(sh.conns, id)
+		atomic.AddInt64(&r.count, -1)
+	}
+	sh.mu.Unlock()
+}
+
+// rangeConns calls f for every connection until it returns false. Each shard
+// is copied under its lock and f is called without holding it, so f may send
+// to, close or look up connections.
+func (r *registry) rangeConns(f func(c *Conn) bool) {
+	var conns []*Conn
+	for i := range r.shards {
+		sh := &r.shards[i]
+		sh.mu.RLock()
+		conns = conns[:0]
+		for _, c := range sh.conns {
+			conns = append(conns, c)
+		}
+		sh.mu.RUnlock()
+		for _, c := range conns {
+			if !f(c) {
+				return
+			}
+		}
+	}
+}
+
+// len returns the number of connections
+func (r *registry) len() int {
+	return int(atomic.LoadInt64(&r.count))
+}
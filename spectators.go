@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/auth"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// spectatorScope is the "scope" claim of tokens that only allow spectating
+const spectatorScope = "spectator"
+
+// spectatorTypes are the messages that spectators can send. Everything else
+// publishes a feature or a message, or changes what others see.
+var spectatorTypes = map[string]bool{
+	protocol.TypeHello:         true,
+	protocol.TypeViewport:      true,
+	protocol.TypeSnapshot:      true,
+	protocol.TypeRooms:         true,
+	protocol.TypeGetProfile:    true,
+	protocol.TypeOccupancy:     true,
+	protocol.TypeTrail:         true,
+	protocol.TypeMessageStatus: true,
+}
+
+var (
+	spectatormu sync.Mutex      // guard spectatorM
+	spectatorM  map[string]bool // connID -> spectating
+)
+
+// bindSpectator makes a connection a spectator when the upgrade request asks
+// for it with "spectate=true", or its token has the spectator scope.
+// Spectators watch their viewport and the chat in it without being on the
+// map themselves.
+func bindSpectator(connID string, r *http.Request) {
+	spectate := r.URL.Query().Get("spectate") == "true"
+	if verifier != nil {
+		if token, err := auth.TokenFromRequest(r); err == nil {
+			spectate = spectate || auth.Claim(token, "scope") == spectatorScope
+		}
+	}
+	if spectate {
+		spectatormu.Lock()
+		spectatorM[connID] = true
+		spectatormu.Unlock()
+	}
+}
+
+// spectating returns true when a connection is a spectator
+func spectating(connID string) bool {
+	spectatormu.Lock()
+	defer spectatormu.Unlock()
+	return spectatorM[connID]
+}
+
+// forgetSpectator removes a closed connection from the spectators
+func forgetSpectator(connID string) {
+	spectatormu.Lock()
+	delete(spectatorM, connID)
+	spectatormu.Unlock()
+}
+
+// spectatorAllowed returns true when a connection may send a message of the
+// type, which spectators only may for those that do not publish anything
+func spectatorAllowed(connID, typ string) bool {
+	return spectatorTypes[typ] || !spectating(connID)
+}
+
+// spectateMessage sends a chat message to the spectators of every instance
+// whose viewport shows the sender. End-to-end encrypted messages are left
+// out, spectators cannot read them.
+func spectateMessage(ns, msg string) {
+	if gjson.Get(msg, "encrypted").Exists() {
+		return
+	}
+	spectateLocal(ns, msg)
+	env, _ := sjson.Set(`{"kind":"spectate"}`, "ns", ns)
+	publish(env, msg)
+}
+
+// spectateLocal sends a chat message to the spectators of a namespace on this
+// instance whose viewport shows the position the sender is shown at
+func spectateLocal(ns, msg string) {
+	spectatormu.Lock()
+	n := len(spectatorM)
+	spectatormu.Unlock()
+	if n == 0 {
+		return
+	}
+	lat := gjson.Get(msg, "feature.geometry.coordinates.1").Float()
+	lng := gjson.Get(msg, "feature.geometry.coordinates.0").Float()
+	at := rect{lat, lng, lat, lng}
+	var viewers []string
+	viewportmu.Lock()
+	for connID, r := range viewportM {
+		if r.intersects(at) {
+			viewers = append(viewers, connID)
+		}
+	}
+	viewportmu.Unlock()
+	feature := gjson.Get(msg, "feature").Raw
+	for _, connID := range viewers {
+		if spectating(connID) && connNamespace(connID) == ns &&
+			connViewFilter(connID).match(feature) {
+			send(connID, msg)
+		}
+	}
+}
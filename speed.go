@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+// The speed check settings
+const (
+	speedSlack    = 50          // meters of GPS jitter that are never too fast
+	speedInterval = time.Second // shortest time between positions that a speed is computed over
+	flagInterval  = time.Minute // time between moderator events about the same person
+)
+
+// lastPosition is the previous accepted position of a person
+type lastPosition struct {
+	lat, lng float64
+	at       time.Time
+	flagged  time.Time // when moderators last heard about the person
+}
+
+var (
+	speedmu       sync.Mutex              // guard lastPositionM
+	lastPositionM map[string]lastPosition // clientID -> previous position
+)
+
+// checkSpeed compares a position of a person with their previous one and
+// returns an error when the implied speed is above the max speed and such
+// updates are rejected. Flagged updates are accepted. Moderators are told
+// about both, at most once a minute per person. A person who was removed
+// starts over anywhere.
+func checkSpeed(clientID, ns string, lat, lng float64) *validationError {
+	if cfg.MaxSpeed <= 0 {
+		return nil
+	}
+	now := time.Now()
+	speedmu.Lock()
+	last, ok := lastPositionM[clientID]
+	if !ok {
+		lastPositionM[clientID] = lastPosition{lat: lat, lng: lng, at: now}
+		speedmu.Unlock()
+		return nil
+	}
+	dist := distance(last.lat, last.lng, lat, lng)
+	elapsed := now.Sub(last.at)
+	if elapsed < speedInterval {
+		elapsed = speedInterval
+	}
+	speed := dist / elapsed.Seconds()
+	tooFast := dist > speedSlack && speed > cfg.MaxSpeed
+	notify := tooFast && now.Sub(last.flagged) >= flagInterval
+	if notify {
+		last.flagged = now
+	}
+	if !tooFast || cfg.SpeedAction == "flag" {
+		last.lat, last.lng, last.at = lat, lng, now
+	}
+	lastPositionM[clientID] = last
+	speedmu.Unlock()
+
+	if !tooFast {
+		return nil
+	}
+	speedSignal(clientID, ns)
+	lg.Debug("implausible speed", "client", clientID, "speed", speed, "meters", dist)
+	if notify {
+		speedEvent(clientID, ns, speed, dist, last, lat, lng)
+	}
+	if cfg.SpeedAction == "flag" {
+		return nil
+	}
+	return invalid("too_fast", "Position is too far from the previous one")
+}
+
+// speedEvent posts a moderator event about a person who moved too fast. The
+// event has the clientID, so that moderators can kick the person.
+func speedEvent(clientID, ns string, speed, dist float64, from lastPosition, lat, lng float64) {
+	if webhookJobs == nil || cfg.ModWebhook == "" {
+		return
+	}
+	event := `{}`
+	event, _ = sjson.Set(event, "event", "too_fast")
+	event, _ = sjson.Set(event, "action", cfg.SpeedAction)
+	event, _ = sjson.Set(event, "id", clientID)
+	if ns != "" {
+		event, _ = sjson.Set(event, "namespace", ns)
+	}
+	event, _ = sjson.Set(event, "speed", math.Round(speed*10)/10)
+	event, _ = sjson.Set(event, "meters", math.Round(dist))
+	event, _ = sjson.Set(event, "from", []float64{from.lng, from.lat})
+	event, _ = sjson.Set(event, "to", []float64{lng, lat})
+	event, _ = sjson.Set(event, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	if job := (webhookJob{url: cfg.ModWebhook, event: event}); !queueJob(job) {
+		deadLetter(job, "queue full")
+	}
+}
+
+// forgetSpeed drops the previous position of a person
+func forgetSpeed(clientID string) {
+	speedmu.Lock()
+	delete(lastPositionM, clientID)
+	speedmu.Unlock()
+}
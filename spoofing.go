@@ -0,0 +1,379 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The signals of location spoofing
+const (
+	signalTooFast = "too_fast" // moved faster than the max speed
+	signalJump    = "jump"     // jumped further than jumpMeters between two positions
+	signalShared  = "shared"   // at the exact coordinates of other people
+)
+
+// signalWeights are what each signal adds to the suspicion score of a person
+var signalWeights = map[string]int{
+	signalTooFast: 3,
+	signalJump:    2,
+	signalShared:  4,
+}
+
+// The spoofing detection settings
+const (
+	suspectsKey    = "suspects"       // sorted set of clientID -> time of the last signal in Unix ms
+	suspectTTL     = 24 * time.Hour   // how long signals count toward the score
+	signalInterval = time.Minute      // time between signals of the same kind about a person
+	jumpMeters     = 1000             // meters between two positions that are a jump
+	sharedWindow   = 10 * time.Minute // how long people are remembered at their coordinates
+	sharedIDs      = 3                // people at the same coordinates that are suspicious
+	maxSuspects    = 1000             // suspects listed by the admin API
+)
+
+// suspectKey returns the Redis key of the signals and score of a person
+func suspectKey(clientID string) string {
+	return "suspect:" + clientID
+}
+
+// shadowKey returns the Redis key that marks a person as shadow banned
+func shadowKey(clientID string) string {
+	return "shadow:" + clientID
+}
+
+// spoofState is the previous position of a person and when they last raised
+// each signal
+type spoofState struct {
+	lat, lng float64
+	coord    string
+	signaled map[string]time.Time
+}
+
+var (
+	spoofmu sync.Mutex                      // guard spoofM, coordM and shadowM
+	spoofM  map[string]*spoofState          // clientID -> spoofing state
+	coordM  map[string]map[string]time.Time // coordinates -> clientID -> last seen there
+	shadowM map[string]bool                 // clientID -> shadow banned
+)
+
+// checkSpoofing looks for signs of location spoofing in an accepted position
+// of a person: a jump from their previous position, or the exact coordinates
+// that other people on this instance have. Real GPS fixes of different
+// devices almost never match to the last digit, copies of one fake location
+// do.
+func checkSpoofing(clientID, ns string, lat, lng float64) {
+	if cfg.SpoofScore <= 0 {
+		return
+	}
+	now := time.Now()
+	coord := strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64)
+	var signals []string
+	spoofmu.Lock()
+	s, ok := spoofM[clientID]
+	if !ok {
+		s = &spoofState{signaled: make(map[string]time.Time)}
+		spoofM[clientID] = s
+	} else if distance(s.lat, s.lng, lat, lng) > jumpMeters {
+		signals = append(signals, signalJump)
+	}
+	s.lat, s.lng = lat, lng
+	if s.coord != coord {
+		leaveCoord(clientID, s.coord)
+		s.coord = coord
+	}
+	at := coordM[coord]
+	if at == nil {
+		at = make(map[string]time.Time)
+		coordM[coord] = at
+	}
+	at[clientID] = now
+	for id, seen := range at {
+		if now.Sub(seen) > sharedWindow {
+			delete(at, id)
+		}
+	}
+	if len(at) >= sharedIDs {
+		signals = append(signals, signalShared)
+	}
+	signals = s.admit(signals, now)
+	spoofmu.Unlock()
+	for _, signal := range signals {
+		suspect(clientID, ns, signal)
+	}
+}
+
+// admit returns the signals that the person has not raised within the signal
+// interval, and records that they raised them. The caller holds spoofmu.
+func (s *spoofState) admit(signals []string, now time.Time) []string {
+	admitted := signals[:0]
+	for _, signal := range signals {
+		if now.Sub(s.signaled[signal]) >= signalInterval {
+			s.signaled[signal] = now
+			admitted = append(admitted, signal)
+		}
+	}
+	return admitted
+}
+
+// leaveCoord forgets a person at coordinates. The caller holds spoofmu.
+func leaveCoord(clientID, coord string) {
+	if at, ok := coordM[coord]; ok {
+		delete(at, clientID)
+		if len(at) == 0 {
+			delete(coordM, coord)
+		}
+	}
+}
+
+// speedSignal raises the too fast signal of a person, at most once per signal
+// interval
+func speedSignal(clientID, ns string) {
+	if cfg.SpoofScore <= 0 {
+		return
+	}
+	spoofmu.Lock()
+	s, ok := spoofM[clientID]
+	if !ok {
+		s = &spoofState{signaled: make(map[string]time.Time)}
+		spoofM[clientID] = s
+	}
+	signals := s.admit([]string{signalTooFast}, time.Now())
+	spoofmu.Unlock()
+	if len(signals) > 0 {
+		suspect(clientID, ns, signalTooFast)
+	}
+}
+
+// suspect adds a signal to the suspicion score of a person in Redis, where
+// the signals of all instances add up for suspectTTL after the last one. A
+// person whose score reaches the spoof score is flagged to the moderators,
+// and shadow banned with the shadow spoof action.
+func suspect(clientID, ns, signal string) {
+	weight := signalWeights[signal]
+	key := suspectKey(clientID)
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HINCRBY", key, signal, 1)
+	b.Send("HINCRBY", key, "score", weight)
+	b.Send("HSET", key, "ns", ns)
+	b.Send("EXPIRE", key, int(suspectTTL/time.Second))
+	b.Send("ZADD", suspectsKey, time.Now().UnixNano()/int64(time.Millisecond), clientID)
+	replies, err := b.Flush()
+	if err != nil {
+		lg.Error("suspect record failed", "client", clientID, "err", err)
+		return
+	}
+	score, _ := redis.Int(replies[1], nil)
+	lg.Debug("spoofing signal", "client", clientID, "signal", signal, "score", score)
+	if score < cfg.SpoofScore || score-weight >= cfg.SpoofScore {
+		return
+	}
+	lg.Warn("suspected location spoofing", "client", clientID, "score", score,
+		"action", cfg.SpoofAction)
+	if cfg.SpoofAction == "shadow" {
+		shadowBan(clientID)
+	}
+	suspectEvent(clientID, ns, score)
+}
+
+// suspectEvent posts a moderator event about a person whose suspicion score
+// reached the spoof score
+func suspectEvent(clientID, ns string, score int) {
+	if webhookJobs == nil || cfg.ModWebhook == "" {
+		return
+	}
+	event := `{}`
+	event, _ = sjson.Set(event, "event", "spoofing")
+	event, _ = sjson.Set(event, "action", cfg.SpoofAction)
+	event, _ = sjson.Set(event, "id", clientID)
+	if ns != "" {
+		event, _ = sjson.Set(event, "namespace", ns)
+	}
+	event, _ = sjson.Set(event, "score", score)
+	event, _ = sjson.Set(event, "time", time.Now().UTC().Format(time.RFC3339Nano))
+	if job := (webhookJob{url: cfg.ModWebhook, event: event}); !queueJob(job) {
+		deadLetter(job, "queue full")
+	}
+}
+
+// shadowBan hides the chat of a person from everyone else for suspectTTL,
+// without telling them
+func shadowBan(clientID string) {
+	if _, err := storeDo("SET", shadowKey(clientID), 1, "EX", int(suspectTTL/time.Second)); err != nil {
+		lg.Error("shadow ban failed", "client", clientID, "err", err)
+	}
+	spoofmu.Lock()
+	shadowM[clientID] = true
+	spoofmu.Unlock()
+}
+
+// loadShadow looks up whether a person who just arrived on this instance is
+// shadow banned
+func loadShadow(clientID string) {
+	if cfg.SpoofScore <= 0 {
+		return
+	}
+	n, err := redis.Int(storeDo("EXISTS", shadowKey(clientID)))
+	if err != nil {
+		lg.Error("shadow ban lookup failed", "client", clientID, "err", err)
+		return
+	}
+	if n > 0 {
+		spoofmu.Lock()
+		shadowM[clientID] = true
+		spoofmu.Unlock()
+	}
+}
+
+// liftShadow forgets the shadow ban of a person on this instance
+func liftShadow(clientID string) {
+	spoofmu.Lock()
+	delete(shadowM, clientID)
+	spoofmu.Unlock()
+}
+
+// shadowBanned returns true when the chat of a person is hidden from others
+func shadowBanned(clientID string) bool {
+	spoofmu.Lock()
+	defer spoofmu.Unlock()
+	return shadowM[clientID]
+}
+
+// shadowMessage answers a chat message of a shadow banned person as if it
+// was delivered to the recipients, while only the sender receives it
+func shadowMessage(connID, msgID, ref, msg string, recipients int) {
+	send(connID, msg)
+	ack, _ := protocol.Encode(protocol.MessageAck{
+		Envelope:   protocol.Envelope{Type: protocol.TypeMessageAck},
+		ID:         msgID,
+		Ref:        ref,
+		Recipients: recipients,
+		Delivered:  recipients,
+	})
+	send(connID, ack)
+}
+
+// forgetSpoofing drops the spoofing state of a person who left. Their score
+// and shadow ban stay in Redis.
+func forgetSpoofing(clientID string) {
+	spoofmu.Lock()
+	if s, ok := spoofM[clientID]; ok {
+		leaveCoord(clientID, s.coord)
+		delete(spoofM, clientID)
+	}
+	delete(shadowM, clientID)
+	spoofmu.Unlock()
+}
+
+// suspectInfo is a person suspected of location spoofing
+type suspectInfo struct {
+	ID        string         `json:"id"`
+	Namespace string         `json:"namespace,omitempty"`
+	Score     int            `json:"score"`
+	Signals   map[string]int `json:"signals"`
+	Last      time.Time      `json:"last"`
+	Flagged   bool           `json:"flagged"`
+	Shadow    bool           `json:"shadow"`
+}
+
+// suspectsAPI is an HTTP handler for the people suspected of location
+// spoofing on every instance, by their signals of the last day. Clearing a
+// person resets their score and lifts their shadow ban.
+//
+//	GET    /api/admin/suspects       suspects, highest score first
+//	DELETE /api/admin/suspects/{id}  clear a suspect
+func suspectsAPI(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/suspects"), "/")
+	switch {
+	case r.Method == http.MethodGet && clientID == "":
+		suspects, err := loadSuspects()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, suspects)
+	case r.Method == http.MethodDelete && clientID != "":
+		if !validClientID(clientID) {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		b := newBatch(store)
+		defer b.Close()
+		b.Send("DEL", suspectKey(clientID), shadowKey(clientID))
+		b.Send("ZREM", suspectsKey, clientID)
+		if _, err := b.Flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		liftShadow(clientID)
+		cleared, _ := sjson.Set(`{}`, "id", clientID)
+		publish(`{"kind":"unshadow"}`, cleared)
+		auditRequest(r, "suspect_clear", cleared)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadSuspects returns the suspects of the last day, highest score first.
+// Suspects whose signals expired are dropped from the suspects set.
+func loadSuspects() ([]suspectInfo, error) {
+	now := time.Now()
+	since := now.Add(-suspectTTL).UnixNano() / int64(time.Millisecond)
+	if _, err := storeDo("ZREMRANGEBYSCORE", suspectsKey, "-inf", since); err != nil {
+		return nil, err
+	}
+	entries, err := redis.StringMap(storeDo("ZREVRANGE", suspectsKey, 0, maxSuspects-1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for clientID := range entries {
+		ids = append(ids, clientID)
+	}
+	b := newBatch(store)
+	defer b.Close()
+	for _, clientID := range ids {
+		b.Send("HGETALL", suspectKey(clientID))
+		b.Send("EXISTS", shadowKey(clientID))
+	}
+	replies, err := b.Flush()
+	if err != nil {
+		return nil, err
+	}
+	suspects := []suspectInfo{}
+	for i, clientID := range ids {
+		fields, _ := redis.StringMap(replies[i*2], nil)
+		if len(fields) == 0 {
+			continue
+		}
+		shadow, _ := redis.Int(replies[i*2+1], nil)
+		s := suspectInfo{
+			ID:        clientID,
+			Namespace: fields["ns"],
+			Signals:   make(map[string]int),
+			Shadow:    shadow > 0,
+		}
+		if ms, err := strconv.ParseFloat(entries[clientID], 64); err == nil {
+			s.Last = time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+		}
+		s.Score, _ = strconv.Atoi(fields["score"])
+		s.Flagged = s.Score >= cfg.SpoofScore
+		for signal := range signalWeights {
+			if n, err := strconv.Atoi(fields[signal]); err == nil {
+				s.Signals[signal] = n
+			}
+		}
+		suspects = append(suspects, s)
+	}
+	sort.Slice(suspects, func(i, j int) bool { return suspects[i].Score > suspects[j].Score })
+	return suspects, nil
+}
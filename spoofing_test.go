@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestShadowBan(t *testing.T) {
+	a, b := testID(1), testID(2)
+	ca := joinTest(t, a, 39.7425, -104.9965)
+	cb := joinTest(t, b, 39.7426, -104.9965)
+	room := testRoom(t, "lobby", a, b)
+	msgID := testID(3)
+	recordHistory([]string{room}, fmt.Sprintf(`{"type":"Message","id":%q,"text":"hi"}`, msgID))
+	groupID := testGroup(t, a)
+	storeDo("HSET", groupMembersKey(groupID), b, "")
+	spoofmu.Lock()
+	shadowM[a] = true
+	spoofmu.Unlock()
+	t.Cleanup(func() { liftShadow(a) })
+
+	ca.send(fmt.Sprintf(`{"type":"Reaction","id":%q,"room":%q,"emoji":":wave:"}`, msgID, room))
+	if r := ca.expect("Reaction"); gjson.Get(r, "counts.:wave:").Int() != 1 {
+		t.Fatalf("reaction: got %s", r)
+	}
+	ca.send(fmt.Sprintf(`{"type":"Poll","room":%q,"question":"Lunch?","options":["yes","no"]}`, room))
+	ca.expect("Poll")
+	ca.send(fmt.Sprintf(`{"type":"GroupMessage","group":%q,"text":"hi"}`, groupID))
+	ca.expect("GroupMessage")
+	ca.send(fmt.Sprintf(`{"type":"Message","feature":%s,"text":"me too","replyTo":%q,"room":%q}`,
+		testFeature(a, 39.7425, -104.9965), msgID, room))
+	ca.expect("MessageAck")
+
+	for _, typ := range []string{"Reaction", "Poll", "GroupMessage", "Message"} {
+		cb.none(typ, 100*time.Millisecond)
+	}
+	if counts, _ := storeDo("HGETALL", reactionsKey(msgID)); len(counts.([]interface{})) != 0 {
+		t.Fatalf("the reaction must not be stored, got %v", counts)
+	}
+}
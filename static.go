@@ -0,0 +1,30 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// webFiles is the web client and the sample room fences, built into the
+// binary so that it runs without the web directory next to it
+//
+//go:embed web
+var webFiles embed.FS
+
+// staticFS returns the files of the static web site: the static directory
+// when one is configured, such as to work on the web client without
+// rebuilding, or else the embedded web directory
+func staticFS() fs.FS {
+	if cfg.StaticDir != "" {
+		return os.DirFS(cfg.StaticDir)
+	}
+	web, _ := fs.Sub(webFiles, "web")
+	return web
+}
+
+// staticHandler is an HTTP handler that serves the static web site
+func staticHandler() http.Handler {
+	return http.FileServer(http.FS(staticFS()))
+}
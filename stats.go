@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/socket"
+)
+
+// rateWindow is the window over which message rates are measured
+const rateWindow = time.Minute
+
+// startTime is when the server started
+var startTime = time.Now()
+
+var (
+	handledRates = make(map[string]*ratecounter.RateCounter) // message type -> handled messages
+	sentRate     = ratecounter.NewRateCounter(rateWindow)    // frames sent to connections
+)
+
+// connInfo is what the admin API shows about a connection
+type connInfo struct {
+	opened time.Time
+	remote string
+}
+
+var (
+	connInfomu sync.Mutex           // guard connInfoM
+	connInfoM  map[string]*connInfo // connID -> connection info
+)
+
+// countHandled registers a rate counter for a message type and returns it.
+// Must be called before the server starts.
+func countHandled(msgType string) *ratecounter.RateCounter {
+	rate := ratecounter.NewRateCounter(rateWindow)
+	handledRates[msgType] = rate
+	return rate
+}
+
+// perSecond returns the average rate per second of a counter over the window
+func perSecond(rate *ratecounter.RateCounter) float64 {
+	return float64(rate.Rate()) / rateWindow.Seconds()
+}
+
+// trackConn records the connection info of a new connection
+func trackConn(connID string, r *http.Request) {
+	connInfomu.Lock()
+	connInfoM[connID] = &connInfo{opened: time.Now(), remote: r.RemoteAddr}
+	connInfomu.Unlock()
+}
+
+// forgetConn removes the connection info of a connection
+func forgetConn(connID string) {
+	connInfomu.Lock()
+	delete(connInfoM, connID)
+	connInfomu.Unlock()
+}
+
+// adminStats is the live state of the server for operators
+type adminStats struct {
+	Instance    string                     `json:"instance"`
+	Uptime      string                     `json:"uptime"`
+	Draining    bool                       `json:"draining"`
+	Connections int                        `json:"connections"`
+	People      int                        `json:"people"`
+	Suspended   int                        `json:"suspended"`
+	Rates       map[string]float64         `json:"rates"` // messages per second by type
+	Sent        float64                    `json:"sent"`  // frames per second
+	Rooms       map[string]int             `json:"rooms"` // members by room
+	Subscribers map[string]SubscriberStats `json:"subscribers"`
+	Bytes       byteStats                  `json:"bytes"`
+	Dropped     uint64                     `json:"dropped"`              // frames dropped from full send queues
+	SlowConns   uint64                     `json:"slowConns"`            // connections closed as slow consumers
+	Unrecorded  int64                      `json:"unrecorded,omitempty"` // frames the recorder dropped
+	Overloaded  bool                       `json:"overloaded"`           // the server sheds load
+	Coalesced   uint64                     `json:"coalesced,omitempty"`  // positions skipped by the feature flush for a newer one
+	Unqueued    uint64                     `json:"unqueued,omitempty"`   // webhook events that did not fit in the queue
+}
+
+// byteStats are the bytes sent to connections since the server started.
+// Saved is about what compression saved, Wire includes the framing and
+// handshakes.
+type byteStats struct {
+	Payload uint64 `json:"payload"`
+	Wire    uint64 `json:"wire"`
+	Saved   int64  `json:"saved"`
+}
+
+// adminConn is a connection as shown by the admin API
+type adminConn struct {
+	ID        string      `json:"id"`
+	ClientID  string      `json:"clientId,omitempty"`
+	UserID    string      `json:"userId,omitempty"`
+	Namespace string      `json:"namespace,omitempty"`
+	Version   int         `json:"version"`
+	Remote    string      `json:"remote"`
+	Opened    time.Time   `json:"opened"`
+	Position  *[2]float64 `json:"position,omitempty"` // lng, lat of the last feature
+}
+
+// statsAPI is an HTTP handler with live stats of this instance.
+//
+//	GET /api/admin/stats  connection counts, message rates and room occupancy
+func statsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := adminStats{
+		Instance: instanceID,
+		Uptime:   time.Since(startTime).Round(time.Second).String(),
+		Draining: isDraining(),
+		Rates:    make(map[string]float64, len(handledRates)),
+		Sent:     perSecond(sentRate),
+		Rooms:    make(map[string]int),
+		Subscribers: map[string]SubscriberStats{
+			geofenceSub.Name: geofenceSub.Stats(),
+			busSub.Name:      busSub.Stats(),
+		},
+	}
+	stats.Connections = h.Len()
+	bytes := h.Stats()
+	stats.Bytes = byteStats{
+		Payload: bytes.Payload,
+		Wire:    bytes.Wire,
+		Saved:   int64(bytes.Payload) - int64(bytes.Wire),
+	}
+	stats.Dropped, stats.SlowConns = bytes.Dropped, bytes.Slow
+	stats.Unrecorded = atomic.LoadInt64(&recordDropped)
+	stats.Overloaded = isOverloaded()
+	stats.Coalesced = atomic.LoadUint64(&coalesced)
+	stats.Unqueued = atomic.LoadUint64(&webhookDropped)
+	idmu.Lock()
+	stats.People = len(clientConnM)
+	idmu.Unlock()
+	sessionmu.Lock()
+	for _, s := range clientSessionM {
+		if s.connID == "" {
+			stats.Suspended++
+		}
+	}
+	sessionmu.Unlock()
+	for msgType, rate := range handledRates {
+		stats.Rates[msgType] = perSecond(rate)
+	}
+	roommu.Lock()
+	for _, room := range rooms {
+		stats.Rooms[room.ID] = len(room.members)
+	}
+	roommu.Unlock()
+	writeJSON(w, stats)
+}
+
+// connectionsAPI is an HTTP handler that lists the connections of this
+// instance.
+//
+//	GET /api/admin/connections  connections with their person and position
+func connectionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conns := []adminConn{}
+	h.Range(func(connID string, _ *socket.Conn) bool {
+		conn := adminConn{
+			ID:        connID,
+			Namespace: connNamespace(connID),
+			Version:   connVersion(connID),
+		}
+		idmu.Lock()
+		conn.ClientID = connClientM[connID]
+		idmu.Unlock()
+		usermu.Lock()
+		conn.UserID = connUserM[connID]
+		usermu.Unlock()
+		connInfomu.Lock()
+		if info, ok := connInfoM[connID]; ok {
+			conn.Remote, conn.Opened = info.remote, info.opened
+		}
+		connInfomu.Unlock()
+		sessionmu.Lock()
+		if s, ok := connSessionM[connID]; ok && s.feature != "" {
+			coords := gjson.Get(s.feature, "geometry.coordinates").Array()
+			if len(coords) >= 2 {
+				conn.Position = &[2]float64{coords[0].Float(), coords[1].Float()}
+			}
+		}
+		sessionmu.Unlock()
+		conns = append(conns, conn)
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Opened.Before(conns[j].Opened) })
+	writeJSON(w, conns)
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// statusTTL is how long the delivery status of a chat message can be queried
+const statusTTL = time.Hour
+
+// newMessageID returns a new unique chat message id
+func newMessageID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusKey returns the Redis key of the delivery status of a chat message
+func statusKey(msgID string) string {
+	return "status:" + msgID
+}
+
+// trackMessage records the sender and the number of recipients of a chat
+// message, before it is delivered
+func trackMessage(msgID, clientID string, recipients int) {
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("HMSET", statusKey(msgID), "sender", clientID,
+		"recipients", recipients)
+	b.Send("EXPIRE", statusKey(msgID), int(statusTTL/time.Second))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("message status failed", "msg", msgID, "err", err)
+	}
+}
+
+// countDelivered adds to the number of recipients that received a chat
+// message. Called by every instance that delivered the message.
+func countDelivered(msgID string, delivered int) {
+	if delivered == 0 {
+		return
+	}
+	if _, err := storeDo("HINCRBY", statusKey(msgID), "delivered", delivered); err != nil {
+		lg.Error("message status failed", "msg", msgID, "err", err)
+	}
+}
+
+// messageStatus is a websocket message handler that sends the delivery status
+// of a chat message back to its sender
+func messageStatus(connID, msg string) {
+	msgID := gjson.Get(msg, "id").String()
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+
+	vals, err := redis.StringMap(storeDo("HGETALL", statusKey(msgID)))
+	if err != nil {
+		lg.Error("message status failed", "msg", msgID, "err", err)
+		sendError(connID, "unavailable", "Message status is unavailable")
+		return
+	}
+	if clientID == "" || vals["sender"] != clientID {
+		sendError(connID, "unknown_message", "Unknown message")
+		return
+	}
+	recipients, _ := strconv.Atoi(vals["recipients"])
+	delivered, _ := strconv.Atoi(vals["delivered"])
+	status, _ := protocol.Encode(protocol.MessageStatus{
+		Envelope:   protocol.Envelope{Type: protocol.TypeMessageStatus},
+		ID:         msgID,
+		Recipients: recipients,
+		Delivered:  delivered,
+	})
+	send(connID, status)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default reconnect backoff of a Subscriber
+const (
+	minBackoff = 250 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// PubSub opens pub/sub subscriptions
+type PubSub interface {
+	Subscribe(channels, patterns []string) (Subscription, error)
+}
+
+// Subscription is an open pub/sub subscription. Receive blocks until a
+// message arrives or the subscription fails.
+type Subscription interface {
+	Subscribe(channels ...string) error
+	Unsubscribe(channels ...string) error
+	Receive() (channel string, data []byte, err error)
+	Close() error
+}
+
+// Subscriber is a pub/sub subscription that survives connection failures. It
+// reconnects with exponential backoff and jitter, and resubscribes to all of
+// its channels, including channels added at runtime, after every reconnect.
+type Subscriber struct {
+	Name     string   // name used in logs
+	Source   PubSub   // opens the subscription on every connect
+	Channels []string // channels subscribed on every connect
+	Patterns []string // patterns subscribed on every connect
+
+	// Setup is called before every subscription, such as to create the fence
+	// channels that are subscribed to
+	Setup func() error
+
+	// Handle is called for every message. It returns false when the message
+	// was dropped.
+	Handle func(channel string, data []byte) bool
+
+	mu      sync.Mutex
+	sub     Subscription    // current subscription, nil when disconnected
+	dynamic map[string]bool // channels added at runtime
+
+	up         int32
+	received   uint64
+	dropped    uint64
+	reconnects uint64
+}
+
+// SubscriberStats are the counters of a Subscriber
+type SubscriberStats struct {
+	Received   uint64 `json:"received"`
+	Dropped    uint64 `json:"dropped"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// Healthy returns true while the subscription is active
+func (s *Subscriber) Healthy() bool {
+	return atomic.LoadInt32(&s.up) == 1
+}
+
+// Stats returns the counters of the subscriber
+func (s *Subscriber) Stats() SubscriberStats {
+	return SubscriberStats{
+		Received:   atomic.LoadUint64(&s.received),
+		Dropped:    atomic.LoadUint64(&s.dropped),
+		Reconnects: atomic.LoadUint64(&s.reconnects),
+	}
+}
+
+// Subscribe adds a channel at runtime. The channel is resubscribed after every
+// reconnect until it is unsubscribed.
+func (s *Subscriber) Subscribe(channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dynamic == nil {
+		s.dynamic = make(map[string]bool)
+	}
+	s.dynamic[channel] = true
+	if s.sub != nil {
+		return s.sub.Subscribe(channel)
+	}
+	return nil
+}
+
+// Unsubscribe removes a channel that was added at runtime
+func (s *Subscriber) Unsubscribe(channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dynamic, channel)
+	if s.sub != nil {
+		return s.sub.Unsubscribe(channel)
+	}
+	return nil
+}
+
+// Run subscribes and handles messages forever
+func (s *Subscriber) Run() {
+	backoff := minBackoff
+	for {
+		subscribed, err := s.run()
+		atomic.AddUint64(&s.reconnects, 1)
+		var delay time.Duration
+		delay, backoff = retryBackoff(backoff, subscribed)
+		lg.Error("subscription failed", "subscriber", s.Name, "err", err,
+			"retry", delay)
+		time.Sleep(delay)
+	}
+}
+
+// retryBackoff returns the jittered delay before the next attempt and the
+// backoff after it. A subscription that was established starts over from the
+// minimum backoff, and only an attempt that failed to subscribe doubles it.
+func retryBackoff(backoff time.Duration, subscribed bool) (delay, next time.Duration) {
+	if subscribed {
+		backoff = minBackoff
+	}
+	delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	next = backoff
+	if !subscribed {
+		if next *= 2; next > maxBackoff {
+			next = maxBackoff
+		}
+	}
+	return delay, next
+}
+
+// run subscribes once and handles messages until the connection fails.
+// subscribed is true when the subscription was established.
+func (s *Subscriber) run() (subscribed bool, err error) {
+	if s.Setup != nil {
+		if err := s.Setup(); err != nil {
+			return false, err
+		}
+	}
+	s.mu.Lock()
+	channels := append([]string(nil), s.Channels...)
+	for channel := range s.dynamic {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	sub, err := s.Source.Subscribe(channels, s.Patterns)
+	if err == nil {
+		s.sub = sub
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	defer sub.Close()
+	defer func() {
+		s.mu.Lock()
+		s.sub = nil
+		s.mu.Unlock()
+	}()
+
+	atomic.StoreInt32(&s.up, 1)
+	defer atomic.StoreInt32(&s.up, 0)
+	for {
+		channel, data, err := sub.Receive()
+		if err != nil {
+			return true, err
+		}
+		atomic.AddUint64(&s.received, 1)
+		if !s.Handle(channel, data) {
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	delay, next := retryBackoff(8*time.Second, true)
+	if delay < minBackoff/2 || delay > minBackoff || next != minBackoff {
+		t.Fatalf("after a subscription: got delay %v, next %v", delay, next)
+	}
+	delay, next = retryBackoff(next, false)
+	if delay < minBackoff/2 || delay > minBackoff || next != 2*minBackoff {
+		t.Fatalf("after a failed attempt: got delay %v, next %v", delay, next)
+	}
+	if _, next = retryBackoff(maxBackoff, false); next != maxBackoff {
+		t.Fatalf("got %v, want the backoff capped", next)
+	}
+}
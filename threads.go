@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// validateReply checks that the chat message a person replies to is in the
+// history of a room that the person is inside of
+func validateReply(clientID, ns string, cm *protocol.ChatMessage) *validationError {
+	if cm.Room == "" {
+		return invalid("invalid_reply", "Reply needs the room of the message")
+	}
+	roomID := namespaceRoom(ns, cm.Room)
+	if !isInside(clientID, roomID) {
+		return invalid("not_in_room", "Only members of the room can reply to its messages")
+	}
+	inRoom, err := inHistory(roomID, cm.ReplyTo)
+	if err != nil {
+		lg.Error("reply lookup failed", "msg", cm.ReplyTo, "err", err)
+		return invalid("unavailable", "Replies are unavailable")
+	}
+	if !inRoom {
+		return invalid("unknown_message", "Unknown message")
+	}
+	return nil
+}
+
+// threadMessage is a websocket message handler that answers with the thread
+// of a chat message in the history of a room: the message that started it and
+// all replies to it and to its replies, oldest first
+func threadMessage(connID, msg string) {
+	var t protocol.Thread
+	if err := protocol.Decode(msg, &t); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	roomID := namespaceRoom(connNamespace(connID), t.Room)
+	if clientID == "" || !isInside(clientID, roomID) {
+		sendError(connID, "not_in_room", "Only members of the room can read its threads")
+		return
+	}
+	msgs, err := redis.Strings(storeDo("LRANGE", historyKey(roomID), 0, -1))
+	if err != nil {
+		lg.Error("thread lookup failed", "msg", t.ID, "err", err)
+		sendError(connID, "unavailable", "Threads are unavailable")
+		return
+	}
+	root, thread := threadOf(unexpired(msgs), t.ID)
+	if root == "" {
+		sendError(connID, "unknown_message", "Unknown message")
+		return
+	}
+	attachReads(thread)
+	attachReactions(thread)
+	reply := protocol.Thread{
+		Envelope: protocol.Envelope{Type: protocol.TypeThread},
+		ID:       root,
+		Room:     t.Room,
+		Messages: make([]json.RawMessage, len(thread)),
+	}
+	for i, m := range thread {
+		reply.Messages[i] = json.RawMessage(m)
+	}
+	out, _ := protocol.Encode(reply)
+	send(connID, out)
+}
+
+// threadOf returns the id of the message that started the thread of a
+// message and the messages of the thread, oldest first, from a history that
+// is newest first. A thread starts at the oldest message of the chain of
+// replies that is still in the history. The root is empty when the message
+// is not in the history.
+func threadOf(history []string, msgID string) (root string, thread []string) {
+	parents := make(map[string]string, len(history))
+	for _, m := range history {
+		parents[gjson.Get(m, "id").String()] = gjson.Get(m, "replyTo").String()
+	}
+	rootOf := func(id string) string {
+		for n := 0; n < len(history); n++ {
+			parent := parents[id]
+			if _, ok := parents[parent]; parent == "" || !ok {
+				break
+			}
+			id = parent
+		}
+		return id
+	}
+	if _, ok := parents[msgID]; !ok {
+		return "", nil
+	}
+	root = rootOf(msgID)
+	for i := len(history) - 1; i >= 0; i-- {
+		if rootOf(gjson.Get(history[i], "id").String()) == root {
+			thread = append(thread, history[i])
+		}
+	}
+	return root, thread
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// tile38Store is the GeoStore backed by a Tile38 server
+type tile38Store struct {
+	pool *redis.Pool
+	redisPubSub
+}
+
+// newTile38Store returns a GeoStore for the Tile38 server at addr
+func newTile38Store(addr string) *tile38Store {
+	p := newPool(addr)
+	return &tile38Store{pool: p, redisPubSub: redisPubSub{p}}
+}
+
+// do executes a command on a connection from the pool
+func (t *tile38Store) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := t.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// expiry returns the EX arguments for a ttl
+func expiry(ttl time.Duration) redis.Args {
+	if ttl <= 0 {
+		return nil
+	}
+	return redis.Args{"EX", int(math.Ceil(ttl.Seconds()))}
+}
+
+func (t *tile38Store) SetFeature(key, id, object string, ttl time.Duration) error {
+	args := redis.Args{key, id}.AddFlat(expiry(ttl)).Add("OBJECT", object)
+	_, err := t.do("SET", args...)
+	return err
+}
+
+func (t *tile38Store) GetFeature(key, id string) (string, error) {
+	object, err := redis.String(t.do("GET", key, id))
+	if err == redis.ErrNil {
+		return "", ErrNotFound
+	}
+	return object, err
+}
+
+func (t *tile38Store) DelFeature(key, id string) error {
+	_, err := t.do("DEL", key, id)
+	return err
+}
+
+func (t *tile38Store) Expire(key, id string, ttl time.Duration) error {
+	n, err := redis.Int(t.do("EXPIRE", key, id, int(math.Ceil(ttl.Seconds()))))
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (t *tile38Store) SetFence(name string, fence Fence) error {
+	args := redis.Args{name}.AddFlat(expiry(fence.TTL))
+	switch {
+	case fence.Roam > 0:
+		args = args.Add("NEARBY", fence.Key, "ROAM", fence.target(), "*", fence.Roam)
+	case fence.Center != nil:
+		args = args.Add("NEARBY", fence.Key, "FENCE", "DETECT", "enter,exit",
+			"POINT", fence.Center.Lat, fence.Center.Lng, fence.Radius)
+	default:
+		args = args.Add("WITHIN", fence.Key, "DETECT", "enter,inside,exit",
+			"OBJECT", fence.Object)
+	}
+	_, err := t.do("SETCHAN", args...)
+	return err
+}
+
+func (t *tile38Store) DelFence(name string) error {
+	_, err := t.do("DELCHAN", name)
+	return err
+}
+
+func (t *tile38Store) Channels(pattern string) ([]string, error) {
+	chans, err := redis.Values(t.do("CHANS", pattern))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(chans))
+	for _, c := range chans {
+		if info, _ := redis.Values(c, nil); len(info) > 0 {
+			name, _ := redis.String(info[0], nil)
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (t *tile38Store) Nearby(key string, lat, lng, meters float64, opts Search) ([]Object, error) {
+	return t.search("NEARBY", key, opts, "POINT", lat, lng, meters)
+}
+
+func (t *tile38Store) Intersects(key string, area Area, opts Search) ([]Object, error) {
+	if b := area.Bounds; b != nil {
+		return t.search("INTERSECTS", key, opts,
+			"BOUNDS", b.SW.Lat, b.SW.Lng, b.NE.Lat, b.NE.Lng)
+	}
+	return t.search("INTERSECTS", key, opts, "OBJECT", area.Object)
+}
+
+// search runs a search command, fetching all pages of results on one
+// connection unless the search is limited
+func (t *tile38Store) search(cmd, key string, opts Search, area ...interface{}) ([]Object, error) {
+	conn := t.pool.Get()
+	defer conn.Close()
+	var objs []Object
+	var cursor int64
+	for {
+		args := redis.Args{key, "CURSOR", cursor}
+		if opts.Limit > 0 {
+			args = args.Add("LIMIT", opts.Limit)
+		}
+		if opts.IDs {
+			args = args.Add("IDS")
+		}
+		page, err := redis.Values(conn.Do(cmd, append(args, area...)...))
+		if err != nil {
+			return nil, err
+		}
+		if len(page) < 2 {
+			return objs, nil
+		}
+		cursor, _ = redis.Int64(page[0], nil)
+		items, _ := redis.Values(page[1], nil)
+		for _, item := range items {
+			if opts.IDs {
+				id, _ := redis.String(item, nil)
+				objs = append(objs, Object{ID: id})
+				continue
+			}
+			strs, _ := redis.Strings(item, nil)
+			if len(strs) > 1 {
+				objs = append(objs, Object{ID: strs[0], Object: strs[1]})
+			}
+		}
+		if cursor == 0 || opts.Limit > 0 {
+			return objs, nil
+		}
+	}
+}
+
+func (t *tile38Store) Ping() error {
+	return pingPool(t.pool)
+}
+
+func (t *tile38Store) Close() error {
+	return t.pool.Close()
+}
+
+// pingPool checks that a redis protocol server answers a PING
+func pingPool(p *redis.Pool) error {
+	conn := p.Get()
+	defer conn.Close()
+	resp, err := redis.String(conn.Do("PING"))
+	if err == nil && resp != "PONG" {
+		err = errors.New("unexpected " + resp)
+	}
+	return err
+}
+
+// redisPubSub opens subscriptions on connections from a redis protocol pool
+type redisPubSub struct {
+	pool *redis.Pool
+}
+
+// Subscribe opens a subscription on a new connection
+func (r redisPubSub) Subscribe(channels, patterns []string) (Subscription, error) {
+	psc := &redis.PubSubConn{Conn: r.pool.Get()}
+	var err error
+	if len(channels) > 0 {
+		err = psc.Subscribe(redis.Args{}.AddFlat(channels)...)
+	}
+	if err == nil && len(patterns) > 0 {
+		err = psc.PSubscribe(redis.Args{}.AddFlat(patterns)...)
+	}
+	if err != nil {
+		psc.Close()
+		return nil, err
+	}
+	return &redisSubscription{psc}, nil
+}
+
+// redisSubscription is a Subscription on a redis pub/sub connection
+type redisSubscription struct {
+	psc *redis.PubSubConn
+}
+
+func (s *redisSubscription) Subscribe(channels ...string) error {
+	return s.psc.Subscribe(redis.Args{}.AddFlat(channels)...)
+}
+
+func (s *redisSubscription) Unsubscribe(channels ...string) error {
+	return s.psc.Unsubscribe(redis.Args{}.AddFlat(channels)...)
+}
+
+func (s *redisSubscription) Receive() (channel string, data []byte, err error) {
+	for {
+		switch v := s.psc.Receive().(type) {
+		case redis.Message:
+			return v.Channel, v.Data, nil
+		case error:
+			return "", nil, v
+		}
+	}
+}
+
+func (s *redisSubscription) Close() error {
+	return s.psc.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS configures the server for HTTPS when a certificate or autocert
+// hosts are configured. It returns the function that starts serving, and an
+// optional plain HTTP server that redirects to HTTPS and answers ACME
+// challenges.
+func setupTLS(srv *http.Server) (serve func() error, redirect *http.Server) {
+	var fallback http.Handler = http.HandlerFunc(redirectHTTPS)
+	switch {
+	case cfg.TLSCert != "":
+		serve = func() error {
+			return srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		}
+	case len(cfg.AutocertHosts) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertHosts...),
+			Cache:      autocert.DirCache(cfg.AutocertCache),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+		fallback = m.HTTPHandler(fallback)
+	default:
+		return srv.ListenAndServe, nil
+	}
+	if cfg.RedirectAddr != "" {
+		redirect = &http.Server{Addr: cfg.RedirectAddr, Handler: fallback}
+	}
+	return serve, redirect
+}
+
+// redirectHTTPS permanently redirects a plain HTTP request to the HTTPS server
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, _ := net.SplitHostPort(cfg.ListenAddr); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
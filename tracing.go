@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer         = trace.NewNoopTracerProvider().Tracer("") // the tracer, a no-op when tracing is disabled
+	tracerProvider *sdktrace.TracerProvider                   // nil when tracing is disabled
+	traceContext   = propagation.TraceContext{}               // W3C traceparent propagation
+)
+
+// startTracing exports the spans of message handlers, their Tile38 and Redis
+// commands and chat deliveries to an OTLP collector when one is configured
+func startTracing() error {
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+	u, _ := url.Parse(cfg.OTLPEndpoint)
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSample))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("proximity-chat"),
+			semconv.ServiceInstanceIDKey.String(instanceID),
+		)),
+	)
+	tracer = tracerProvider.Tracer("github.com/tile38/proximity-chat")
+	lg.Info("tracing enabled", "endpoint", u.Host, "sample", cfg.TraceSample)
+	return nil
+}
+
+// stopTracing exports the spans that are still buffered
+func stopTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		lg.Error("tracing shutdown failed", "err", err)
+	}
+}
+
+// startSpan starts a span within the span of the message that a connection
+// is handled for. The caller ends it.
+func startSpan(connID, name string, attrs ...attribute.KeyValue) trace.Span {
+	ctx := currentRequest(connID).ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// failSpan marks the span of the message that a connection is handled for as
+// failed with an error code
+func failSpan(connID, code string) {
+	if ctx := currentRequest(connID).ctx; ctx != nil {
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, code)
+	}
+}
+
+// traceParent returns the W3C traceparent of the message that a connection
+// is handled for, or "" when it is not traced
+func traceParent(connID string) string {
+	ctx := currentRequest(connID).ctx
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsSampled() {
+		return ""
+	}
+	carrier := propagation.HeaderCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// storeSpan starts a span of commands on the Redis store. Store commands do
+// not know the message they run for, so the span starts a trace of its own.
+// The caller ends it with endStoreSpan.
+func storeSpan(cmd string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, attribute.String("db.system", "redis"))
+	_, span := tracer.Start(context.Background(), "redis "+strings.ToLower(cmd),
+		trace.WithAttributes(attrs...))
+	return span
+}
+
+// endStoreSpan ends the span of store commands, failed when they returned an
+// error other than a nil reply
+func endStoreSpan(span trace.Span, err error) {
+	if err != nil && err != redis.ErrNil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// remoteSpan starts a span that continues the trace of a traceparent, such as
+// of a chat message delivered for another instance. The caller ends it.
+func remoteSpan(traceparent, name string, attrs ...attribute.KeyValue) trace.Span {
+	ctx := context.Background()
+	if traceparent != "" {
+		carrier := propagation.HeaderCarrier{}
+		carrier.Set("traceparent", traceparent)
+		ctx = traceContext.Extract(ctx, carrier)
+	}
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// trailTTL is how long the trail of a person is kept after their last move
+const trailTTL = 10 * time.Minute
+
+// trailKey returns the Redis key of the trail of a person
+func trailKey(clientID string) string {
+	return "trail:" + clientID
+}
+
+// recordTrail adds the position of a feature to the trail of its person, when
+// trails are enabled and the person opted in
+func recordTrail(clientID, feature string) {
+	if cfg.TrailSize <= 0 || !gjson.Get(feature, "properties.trail").Bool() {
+		return
+	}
+	point, _ := protocol.Encode(protocol.TrailPoint{
+		LatLng: protocol.LatLng{
+			Lat: gjson.Get(feature, "geometry.coordinates.1").Float(),
+			Lng: gjson.Get(feature, "geometry.coordinates.0").Float(),
+		},
+		Time: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("LPUSH", trailKey(clientID), point)
+	b.Send("LTRIM", trailKey(clientID), 0, cfg.TrailSize-1)
+	b.Send("EXPIRE", trailKey(clientID), int(trailTTL/time.Second))
+	if _, err := b.Flush(); err != nil {
+		lg.Error("trail record failed", "client", clientID, "err", err)
+	}
+}
+
+// trailMessage is a websocket message handler that sends the trails of the
+// people in the requested bounds, or in the viewport of the connection
+func trailMessage(connID, msg string) {
+	if cfg.TrailSize <= 0 {
+		sendError(connID, "disabled", "Trails are disabled")
+		return
+	}
+	var req protocol.Trail
+	if err := protocol.Decode(msg, &req); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	var vp *protocol.Viewport
+	if req.Bounds != nil {
+		vp = &protocol.Viewport{Bounds: *req.Bounds}
+	} else {
+		sessionmu.Lock()
+		if s, ok := connSessionM[connID]; ok && s.viewport != "" {
+			vp = new(protocol.Viewport)
+			if protocol.Decode(s.viewport, vp) != nil {
+				vp = nil
+			}
+		}
+		sessionmu.Unlock()
+	}
+	if vp == nil {
+		sendError(connID, "no_viewport", "Send a Viewport or bounds before a Trail")
+		return
+	}
+
+	// Find the people in the viewport and fetch all of their trails at once
+	objs, err := viewportSearch(connPeopleKey(connID), vp, Search{IDs: true})
+	clientIDs := objectIDs(objs)
+	if err != nil {
+		lg.Error("trail query failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Trails are unavailable")
+		return
+	}
+
+	idmu.Lock()
+	viewer := connClientM[connID]
+	idmu.Unlock()
+	trails := protocol.Trail{
+		Envelope: protocol.Envelope{Type: protocol.TypeTrail},
+		Trails:   []protocol.PersonTrail{},
+	}
+	if len(clientIDs) > 0 {
+		b := newBatch(store)
+		defer b.Close()
+		for _, clientID := range clientIDs {
+			b.Send("LRANGE", trailKey(clientID), 0, cfg.TrailSize-1)
+		}
+		replies, err := b.Flush()
+		if err != nil {
+			lg.Error("trail query failed", "conn", connID, "err", err)
+			sendError(connID, "unavailable", "Trails are unavailable")
+			return
+		}
+		for i, clientID := range clientIDs {
+			points, _ := redis.Strings(replies[i], nil)
+			if len(points) == 0 {
+				continue
+			}
+			trail := protocol.PersonTrail{ID: secureClientID(clientID)}
+			if viewer != "" && hidden(viewer, `{"id":"`+trail.ID+`"}`) {
+				continue
+			}
+			for _, point := range points {
+				var p protocol.TrailPoint
+				if json.Unmarshal([]byte(point), &p) == nil {
+					trail.Points = append(trail.Points, p)
+				}
+			}
+			trails.Trails = append(trails.Trails, trail)
+		}
+	}
+	out, _ := protocol.Encode(trails)
+	send(connID, out)
+}
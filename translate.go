@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+)
+
+// The translation settings
+const (
+	maxTranslations   = 5                  // languages a message is translated to
+	translateCacheTTL = 24 * time.Hour     // how long a translation is kept in Redis
+	translateCacheMax = 10000              // translations kept in memory
+	translateTimeout  = 3 * time.Second    // timeout of a single translation
+	maxTranslateSize  = 64 << 10           // bytes of a translation response
+	translateSource   = "auto"             // source language when the sender has none
+	translateFormat   = "text"             // format of the texts sent to the provider
+	translateAgent    = "proximity-chat"   // user agent of translation requests
+	translateType     = "application/json" // content type of translation requests
+)
+
+// Translator translates the text of chat messages
+type Translator interface {
+	// Translate returns a text in the language to, from the language from or
+	// from any language when it is empty
+	Translate(text, from, to string) (string, error)
+}
+
+var (
+	translator  Translator        // nil when translation is disabled
+	translatemu sync.Mutex        // guard translateM
+	translateM  map[string]string // language and text hash -> translation
+)
+
+// translationKey returns the Redis key of the translation of a text to a
+// language
+func translationKey(lang, text string) string {
+	sum := sha1.Sum([]byte(text))
+	return "translation:" + lang + ":" + hex.EncodeToString(sum[:])
+}
+
+// startTranslator enables translation when a translation URL is configured
+func startTranslator() {
+	if cfg.TranslateURL == "" {
+		return
+	}
+	translateM = make(map[string]string)
+	translator = &httpTranslator{
+		url:    cfg.TranslateURL,
+		key:    cfg.TranslateKey,
+		client: &http.Client{Timeout: translateTimeout},
+	}
+}
+
+// httpTranslator is a Translator for providers with the LibreTranslate API,
+// which take a JSON body with the text in "q" and answer with the translation
+// in "translatedText"
+type httpTranslator struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (t *httpTranslator) Translate(text, from, to string) (string, error) {
+	if from == "" {
+		from = translateSource
+	}
+	body, _ := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  from,
+		"target":  to,
+		"format":  translateFormat,
+		"api_key": t.key,
+	})
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", translateAgent)
+	req.Header.Set("Content-Type", translateType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxTranslateSize))
+	if err != nil {
+		return "", err
+	}
+	translated := gjson.GetBytes(data, "translatedText")
+	if !translated.Exists() {
+		return "", fmt.Errorf("no translatedText in response")
+	}
+	return translated.String(), nil
+}
+
+// translateMessage returns the text of a chat message translated to the
+// languages of the profiles of its recipients, by language. Recipients with
+// the language of the sender, or without one, read the text as is.
+func translateMessage(clientID string, recipients []string, text string) map[string]string {
+	if translator == nil || text == "" || len(recipients) == 0 {
+		return nil
+	}
+	from := gjson.Get(loadProfile(clientID), "language").String()
+	args := make([]interface{}, len(recipients))
+	for i, recipient := range recipients {
+		args[i] = profileKey(secureClientID(recipient))
+	}
+	profiles, err := redis.Strings(storeDo("MGET", args...))
+	if err != nil {
+		lg.Error("profile lookup failed", "client", clientID, "err", err)
+		return nil
+	}
+	var langs []string
+	seen := map[string]bool{from: true, "": true}
+	for _, profile := range profiles {
+		lang := gjson.Get(profile, "language").String()
+		if !seen[lang] && len(langs) < maxTranslations {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	translations := make(map[string]string, len(langs))
+	for _, lang := range langs {
+		wg.Add(1)
+		go func(lang string) {
+			defer wg.Done()
+			if translated, ok := translate(text, from, lang); ok {
+				mu.Lock()
+				translations[lang] = translated
+				mu.Unlock()
+			}
+		}(lang)
+	}
+	wg.Wait()
+	return translations
+}
+
+// translate returns the translation of a text to a language, from the
+// caches or the translator. Returns false when the translator failed.
+func translate(text, from, to string) (string, bool) {
+	key := translationKey(to, text)
+	translatemu.Lock()
+	translated, ok := translateM[key]
+	translatemu.Unlock()
+	if ok {
+		return translated, true
+	}
+	translated, err := redis.String(storeDo("GET", key))
+	if err != nil {
+		if translated, err = translator.Translate(text, from, to); err != nil {
+			lg.Warn("translation failed", "lang", to, "err", err)
+			return "", false
+		}
+		storeDo("SET", key, translated, "EX", int(translateCacheTTL/time.Second))
+	}
+	translatemu.Lock()
+	if len(translateM) >= translateCacheMax {
+		translateM = make(map[string]string)
+	}
+	translateM[key] = translated
+	translatemu.Unlock()
+	return translated, true
+}
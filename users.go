@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/tile38/proximity-chat/auth"
+)
+
+type ctxKey int
+
+const userIDKey ctxKey = 0
+
+var (
+	verifier  auth.Verifier     // The token verifier, nil allows anonymous users
+	usermu    sync.Mutex        // guard connUserM
+	connUserM map[string]string // connID -> authenticated userID map
+)
+
+// serveWS authenticates and upgrades new websocket connections unless the
+// server is draining
+func serveWS(w http.ResponseWriter, r *http.Request) {
+	if isDraining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ip := clientIP(r)
+	if rej := admitIP(ip); rej != nil {
+		rej.write(w)
+		return
+	}
+	defer releaseIP(ip)
+	r, err := authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if _, err := requestNamespace(r); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// authenticate verifies the token on a websocket upgrade request and returns
+// the request with the authenticated user ID attached to its context
+func authenticate(r *http.Request) (*http.Request, error) {
+	if verifier == nil {
+		return r, nil
+	}
+	token, err := auth.TokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	userID = userClientID(userID)
+	return r.WithContext(context.WithValue(r.Context(), userIDKey, userID)), nil
+}
+
+// userClientID returns the clientID of the sub claim of a token. A sub that
+// is a clientID already is kept, any other sub is hashed into a clientID of
+// 24 hex characters, so that "auth0|5f3a" can chat as well.
+func userClientID(sub string) string {
+	if validClientID(sub) {
+		return sub
+	}
+	sum := sha256.Sum256([]byte(sub))
+	return hex.EncodeToString(sum[:12])
+}
+
+// bindUser binds the authenticated user of the upgrade request to a connection
+func bindUser(connID string, r *http.Request) {
+	if userID, ok := r.Context().Value(userIDKey).(string); ok {
+		usermu.Lock()
+		connUserM[connID] = userID
+		usermu.Unlock()
+	}
+}
+
+// unbindUser removes the authenticated user from a connection
+func unbindUser(connID string) {
+	usermu.Lock()
+	delete(connUserM, connID)
+	usermu.Unlock()
+}
+
+// authorized returns true when the clientID in a payload belongs to the
+// connection. Anonymous servers allow all clientIDs.
+func authorized(connID, clientID string) bool {
+	if verifier == nil {
+		return true
+	}
+	usermu.Lock()
+	userID, ok := connUserM[connID]
+	usermu.Unlock()
+	return ok && userID == clientID
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tile38/proximity-chat/auth"
+)
+
+func TestUserClientID(t *testing.T) {
+	id := testID(1)
+	if got := userClientID(id); got != id {
+		t.Fatalf("got %q, want the clientID kept", got)
+	}
+	got := userClientID("auth0|5f3a")
+	if !validClientID(got) || got != userClientID("auth0|5f3a") || got == userClientID("auth0|5f3b") {
+		t.Fatalf("got %q, want a stable clientID for the sub", got)
+	}
+}
+
+func TestAuthenticateHashesSub(t *testing.T) {
+	testServer(t)
+	prev := verifier
+	verifier = auth.VerifierFunc(func(token string) (string, error) { return "auth0|5f3a", nil })
+	defer func() { verifier = prev }()
+	r, err := authenticate(tokenRequest("token", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, _ := r.Context().Value(userIDKey).(string); userID != userClientID("auth0|5f3a") {
+		t.Fatalf("got %q", userID)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/tidwall/gjson"
+)
+
+// The limits on client supplied features
+const (
+	maxPropsSize  = 1024 // bytes of the properties object
+	maxPropsCount = 32   // number of properties
+)
+
+// validationError is an error that is reported back to the client with a
+// machine readable code
+type validationError struct {
+	Code    string
+	Message string
+}
+
+func (err *validationError) Error() string {
+	return err.Message
+}
+
+func invalid(code, message string) *validationError {
+	return &validationError{Code: code, Message: message}
+}
+
+// validateFeature checks that a client supplied feature is a GeoJSON Point
+// with coordinates inside of the world bounds, a valid id that belongs to the
+// connection and properties of a reasonable size
+func validateFeature(connID, feature string) *validationError {
+	if err := validatePoint(feature); err != nil {
+		return err
+	}
+	if !ownsClientID(connID, gjson.Get(feature, "id").String()) {
+		return invalid("unauthorized", "Id does not belong to the connection")
+	}
+	return nil
+}
+
+// validatePoint is validateFeature for features that do not come from a
+// connection
+func validatePoint(feature string) *validationError {
+	if gjson.Get(feature, "type").String() != "Feature" {
+		return invalid("invalid_feature", "Feature type must be Feature")
+	}
+	if gjson.Get(feature, "geometry.type").String() != "Point" {
+		return invalid("invalid_geometry", "Geometry must be a Point")
+	}
+	coords := gjson.Get(feature, "geometry.coordinates").Array()
+	if len(coords) < 2 || len(coords) > 3 {
+		return invalid("invalid_coordinates", "Point must have 2 or 3 coordinates")
+	}
+	for _, c := range coords {
+		if c.Type != gjson.Number {
+			return invalid("invalid_coordinates", "Coordinates must be numbers")
+		}
+	}
+	if lng := coords[0].Float(); lng < -180 || lng > 180 {
+		return invalid("invalid_coordinates", "Longitude out of range")
+	}
+	if lat := coords[1].Float(); lat < -90 || lat > 90 {
+		return invalid("invalid_coordinates", "Latitude out of range")
+	}
+
+	id := gjson.Get(feature, "id")
+	if id.Type != gjson.String || !validClientID(id.String()) {
+		return invalid("invalid_id", "Id must be 24 hex characters")
+	}
+
+	props := gjson.Get(feature, "properties")
+	if props.Exists() {
+		if !props.IsObject() {
+			return invalid("invalid_properties", "Properties must be an object")
+		}
+		if len(props.Raw) > maxPropsSize {
+			return invalid("invalid_properties", "Properties are too large")
+		}
+		if len(props.Map()) > maxPropsCount {
+			return invalid("invalid_properties", "Too many properties")
+		}
+	}
+	if _, ok := featureFloor(feature); !ok {
+		return invalid("invalid_floor", "Floor must be one of the configured floors")
+	}
+	return nil
+}
+
+// validClientID returns true for ids of 24 hex characters
+func validClientID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// ownsClientID returns true when the clientID may be used by the connection.
+// A connection is bound to the first clientID that it sends and to its
+// authenticated user.
+func ownsClientID(connID, clientID string) bool {
+	idmu.Lock()
+	bound, ok := connClientM[connID]
+	idmu.Unlock()
+	if ok && bound != clientID {
+		return false
+	}
+	return authorized(connID, clientID)
+}
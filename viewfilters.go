@@ -0,0 +1,123 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on viewport filters
+const (
+	maxFilterProps  = 10   // properties of a filter
+	maxFilterValues = 50   // values of a property
+	maxFilterIDs    = 1000 // people of a filter
+)
+
+// validFilterProp matches the names of the properties a filter can check
+var validFilterProp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// viewFilter is the filter of the viewport of a connection, narrowing the
+// people it is told about. A nil filter passes everyone.
+type viewFilter struct {
+	props map[string]map[string]bool // property -> accepted values
+	ids   map[string]bool            // secure ids of the accepted people
+}
+
+var (
+	viewFiltermu sync.Mutex             // guard viewFilterM
+	viewFilterM  map[string]*viewFilter // connID -> filter of its viewport
+)
+
+// validateFilter checks the size of a viewport filter
+func validateFilter(f *protocol.Filter) *validationError {
+	if f == nil {
+		return nil
+	}
+	if len(f.Properties) > maxFilterProps {
+		return invalid("invalid_filter", "Filter has too many properties")
+	}
+	for prop, values := range f.Properties {
+		if !validFilterProp.MatchString(prop) {
+			return invalid("invalid_filter", "Invalid filter property")
+		}
+		if len(values) == 0 || len(values) > maxFilterValues {
+			return invalid("invalid_filter", "Filter properties need 1 to 50 values")
+		}
+	}
+	if len(f.IDs) > maxFilterIDs {
+		return invalid("invalid_filter", "Filter has too many people")
+	}
+	return nil
+}
+
+// newViewFilter compiles a viewport filter, nil for none
+func newViewFilter(f *protocol.Filter) *viewFilter {
+	if f == nil || (len(f.Properties) == 0 && f.IDs == nil) {
+		return nil
+	}
+	vf := &viewFilter{props: make(map[string]map[string]bool, len(f.Properties))}
+	for prop, values := range f.Properties {
+		vf.props[prop] = make(map[string]bool, len(values))
+		for _, v := range values {
+			vf.props[prop][v] = true
+		}
+	}
+	if f.IDs != nil {
+		vf.ids = make(map[string]bool, len(f.IDs))
+		for _, id := range f.IDs {
+			vf.ids[id] = true
+		}
+	}
+	return vf
+}
+
+// match returns true when a feature passes the filter: it has one of the
+// accepted values of every property, any element matching for arrays such
+// as tags, and is one of the accepted people when the filter lists them.
+// The id of the feature is its secure id.
+func (vf *viewFilter) match(feature string) bool {
+	if vf == nil {
+		return true
+	}
+	if vf.ids != nil && !vf.ids[gjson.Get(feature, "id").String()] {
+		return false
+	}
+	for prop, values := range vf.props {
+		v := gjson.Get(feature, "properties."+prop)
+		ok := false
+		if v.IsArray() {
+			for _, el := range v.Array() {
+				if ok = values[el.String()]; ok {
+					break
+				}
+			}
+		} else {
+			ok = v.Exists() && values[v.String()]
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// setViewFilter records the filter of the viewport of a connection
+func setViewFilter(connID string, vf *viewFilter) {
+	viewFiltermu.Lock()
+	if vf == nil {
+		delete(viewFilterM, connID)
+	} else {
+		viewFilterM[connID] = vf
+	}
+	viewFiltermu.Unlock()
+}
+
+// connViewFilter returns the filter of the viewport of a connection, nil for
+// none
+func connViewFilter(connID string) *viewFilter {
+	viewFiltermu.Lock()
+	defer viewFiltermu.Unlock()
+	return viewFilterM[connID]
+}
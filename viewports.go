@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"github.com/tile38/proximity-chat/protocol"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The limits on viewports
+const (
+	maxViewportRadius  = 50000   // meters of a circle viewport
+	maxViewportPolygon = 1 << 14 // bytes of a polygon viewport
+	viewportPage       = 100     // people per Update message
+	maxSnapshot        = 1000    // people and places each of a Snapshot
+)
+
+// viewportQuery is the last viewport query of a connection and the viewport
+// waiting for the debounce window to end
+type viewportQuery struct {
+	bounds  rect
+	zoom    float64
+	at      time.Time
+	pending string      // latest deferred Viewport message
+	timer   *time.Timer // runs the pending viewport, nil when none waits
+}
+
+var (
+	debouncemu     sync.Mutex                // guard viewportQueryM
+	viewportQueryM map[string]*viewportQuery // connID -> last viewport query
+)
+
+// validateViewport checks the area and zoom of a viewport
+func validateViewport(vp *protocol.Viewport) *validationError {
+	if vp.Zoom < 0 || vp.Zoom > 24 {
+		return invalid("invalid_viewport", "Viewport zoom out of range")
+	}
+	switch {
+	case vp.Polygon != nil:
+		if vp.Polygon.Type != "Polygon" {
+			return invalid("invalid_viewport", "Viewport polygon must be a Polygon")
+		}
+		if len(vp.Polygon.Coordinates) > maxViewportPolygon {
+			return invalid("invalid_viewport", "Viewport polygon is too large")
+		}
+		var rings [][][]float64
+		if err := json.Unmarshal(vp.Polygon.Coordinates, &rings); err != nil ||
+			len(rings) == 0 || len(rings[0]) < 4 {
+			return invalid("invalid_viewport", "Viewport polygon needs a closed ring")
+		}
+	case vp.Center != nil:
+		if vp.Center.Lat < -90 || vp.Center.Lat > 90 ||
+			vp.Center.Lng < -180 || vp.Center.Lng > 180 {
+			return invalid("invalid_viewport", "Viewport center out of range")
+		}
+		if vp.Radius <= 0 || vp.Radius > maxViewportRadius {
+			return invalid("invalid_viewport", "Viewport radius out of range")
+		}
+	}
+	return validateFilter(vp.Filter)
+}
+
+// admitViewport returns true when a viewport of a connection is queried
+// right away. Within the debounce window of the previous query, a viewport
+// that moved less than the slack is dropped, and others are deferred to the
+// end of the window, where only the latest of them is queried.
+func admitViewport(connID, msg string, vp *protocol.Viewport) bool {
+	c := live()
+	if c.ViewDebounce <= 0 {
+		return true
+	}
+	r := viewportRect(vp)
+	now := time.Now()
+	debouncemu.Lock()
+	defer debouncemu.Unlock()
+	q, ok := viewportQueryM[connID]
+	if !ok {
+		q = &viewportQuery{}
+		viewportQueryM[connID] = q
+	}
+	since := now.Sub(q.at)
+	if !ok || since >= c.ViewDebounce {
+		q.bounds, q.zoom, q.at, q.pending = r, vp.Zoom, now, ""
+		return true
+	}
+	if vp.Zoom == q.zoom && nearRect(q.bounds, r, c.ViewportSlack) {
+		q.pending = ""
+		return false
+	}
+	q.pending = msg
+	if q.timer == nil {
+		q.timer = time.AfterFunc(c.ViewDebounce-since, func() {
+			debouncemu.Lock()
+			msg := q.pending
+			q.pending, q.timer = "", nil
+			debouncemu.Unlock()
+			if msg != "" {
+				viewport(connID, msg)
+			}
+		})
+	}
+	return false
+}
+
+// nearRect returns true when every edge of b is within slack times the size
+// of a from the same edge of a
+func nearRect(a, b rect, slack float64) bool {
+	dlat := (a.maxLat - a.minLat) * slack
+	dlng := (a.maxLng - a.minLng) * slack
+	return math.Abs(a.minLat-b.minLat) <= dlat && math.Abs(a.maxLat-b.maxLat) <= dlat &&
+		math.Abs(a.minLng-b.minLng) <= dlng && math.Abs(a.maxLng-b.maxLng) <= dlng
+}
+
+// forgetViewportQuery drops the viewport query of a closed connection,
+// along with a deferred viewport
+func forgetViewportQuery(connID string) {
+	debouncemu.Lock()
+	if q, ok := viewportQueryM[connID]; ok {
+		if q.timer != nil {
+			q.timer.Stop()
+		}
+		q.pending = ""
+		delete(viewportQueryM, connID)
+	}
+	debouncemu.Unlock()
+}
+
+// snapshotMessage is a websocket message handler that answers with the
+// people and places in a viewport in one FeatureCollection, so that a client
+// can draw the map right away instead of waiting for notifications
+func snapshotMessage(connID, msg string) {
+	var s protocol.Snapshot
+	if err := protocol.Decode(msg, &s); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	if err := validateViewport(&s.Viewport); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	filter := newViewFilter(s.Filter)
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	span := startSpan(connID, "tile38 snapshot")
+	people, err := viewportSearch(connPeopleKey(connID), &s.Viewport, Search{Limit: maxSnapshot})
+	var entities, places []Object
+	if err == nil {
+		entities, err = entitySearch(connNamespace(connID), &s.Viewport, Search{Limit: maxSnapshot})
+	}
+	if err == nil {
+		places, err = viewportSearch(roomsKey(connNamespace(connID)), &s.Viewport, Search{Limit: maxSnapshot})
+	}
+	span.SetAttributes(attribute.Int("people", len(people)), attribute.Int("entities", len(entities)),
+		attribute.Int("places", len(places)))
+	span.End()
+	if err != nil {
+		lg.Error("snapshot query failed", "conn", connID, "err", err)
+		sendError(connID, "unavailable", "Snapshots are unavailable")
+		return
+	}
+
+	floor := clientFloor(clientID)
+	features := []byte(`{"type":"` + protocol.TypeSnapshot + `","features":{"type":"FeatureCollection","features":[`)
+	var n int
+	add := func(feature, kind string) {
+		feature, _ = sjson.Set(feature, "properties.kind", kind)
+		if n > 0 {
+			features = append(features, ',')
+		}
+		features = append(features, feature...)
+		n++
+	}
+	for _, p := range people {
+		if p.ID == clientID || isHidden(p.Object) {
+			continue
+		}
+		feature := secureFeature(p.Object)
+		if clientID != "" && hidden(clientID, feature) || !filter.match(feature) {
+			continue
+		}
+		add(feature, "person")
+	}
+	for _, p := range entities {
+		feature := secureFeature(p.Object)
+		if filter.match(feature) {
+			add(feature, gjson.Get(feature, "entityType").String())
+		}
+	}
+	for _, p := range places {
+		if f := roomFloor(p.Object); f != "" && f != floor {
+			continue
+		}
+		feature, _ := sjson.Set(p.Object, "id", p.ID)
+		add(feature, "place")
+	}
+	features = append(features, `]}}`...)
+	send(connID, string(features))
+}
+
+// entitySearch returns the entities of every kind of a namespace in a
+// viewport, the first opts.Limit of each kind
+func entitySearch(ns string, vp *protocol.Viewport, opts Search) ([]Object, error) {
+	var objs []Object
+	for _, key := range kindKeys(ns) {
+		found, err := viewportSearch(key, vp, opts)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, found...)
+	}
+	return objs, nil
+}
+
+// viewportSearch returns the objects of a collection in a viewport
+func viewportSearch(key string, vp *protocol.Viewport, opts Search) ([]Object, error) {
+	switch {
+	case vp.Polygon != nil:
+		object, _ := json.Marshal(vp.Polygon)
+		return geo.Intersects(key, Area{Object: string(object)}, opts)
+	case vp.Center != nil:
+		return geo.Nearby(key, vp.Center.Lat, vp.Center.Lng, vp.Radius, opts)
+	}
+	return geo.Intersects(key, Area{Bounds: &vp.Bounds}, opts)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+	"github.com/tile38/proximity-chat/protocol"
+)
+
+// The limits on watches
+const (
+	maxWatches     = 10             // watches per person
+	maxWatchRadius = 1000           // meters
+	maxWatchName   = 64             // characters of the name of a watch
+	watchTTL       = 24 * time.Hour // how long a watch lasts
+)
+
+// watch is a place that a person is alerted about arrivals at
+type watch struct {
+	clientID string
+	name     string
+	channels []string
+}
+
+var (
+	watchmu      sync.Mutex                 // guard watchM and clientWatchM
+	watchM       map[string]*watch          // watchID -> watch of a person of this instance
+	clientWatchM map[string]map[string]bool // clientID -> watchIDs
+)
+
+// watchChannel returns the name of the fence channel of a watch
+func watchChannel(watchID string) string {
+	return "watch:" + watchID
+}
+
+// validateWatch checks the place of a watch
+func validateWatch(w *protocol.Watch) *validationError {
+	if w.Center == nil || w.Center.Lat < -90 || w.Center.Lat > 90 ||
+		w.Center.Lng < -180 || w.Center.Lng > 180 {
+		return invalid("invalid_watch", "Watch center out of range")
+	}
+	if w.Radius <= 0 || w.Radius > maxWatchRadius {
+		return invalid("invalid_watch", "Watch radius must be 1 to 1000 meters")
+	}
+	if !utf8.ValidString(w.Name) || utf8.RuneCountInString(w.Name) > maxWatchName {
+		return invalid("invalid_watch", "Watch name must be up to 64 characters")
+	}
+	return nil
+}
+
+// watchMessage is a websocket message handler for watches: pins that a
+// person drops to be told when someone arrives there. Every watch is a
+// nearby fence channel on the people of the namespace, on every floor,
+// whose enters only go to the person who set it.
+func watchMessage(connID, msg string) {
+	var w protocol.Watch
+	if err := protocol.Decode(msg, &w); err != nil {
+		sendError(connID, "invalid_message", err.Error())
+		return
+	}
+	idmu.Lock()
+	clientID := connClientM[connID]
+	idmu.Unlock()
+	if clientID == "" {
+		sendError(connID, "no_feature", "Send a Feature before a Watch")
+		return
+	}
+	if w.Remove {
+		if !removeWatch(clientID, w.ID) {
+			sendError(connID, "unknown_watch", "Unknown watch")
+			return
+		}
+		reply, _ := protocol.Encode(protocol.Watch{
+			Envelope: protocol.Envelope{Type: protocol.TypeWatch},
+			ID:       w.ID,
+			Remove:   true,
+		})
+		send(connID, reply)
+		return
+	}
+	if err := validateWatch(&w); err != nil {
+		sendError(connID, err.Code, err.Message)
+		return
+	}
+	watchmu.Lock()
+	full := len(clientWatchM[clientID]) >= maxWatches
+	watchmu.Unlock()
+	if full {
+		sendError(connID, "too_many_watches", "Watch up to 10 places at once")
+		return
+	}
+
+	watchID := newMessageID()
+	ns := connNamespace(connID)
+	wt := &watch{clientID: clientID, name: w.Name}
+	for _, key := range floorKeys(peopleKey(ns)) {
+		_, floor := splitFloor(key)
+		channel := floorKey(watchChannel(watchID), floor)
+		err := geo.SetFence(channel, Fence{Key: key, Center: w.Center, Radius: w.Radius, TTL: watchTTL})
+		if err != nil {
+			lg.Error("watch create failed", "conn", connID, "err", err)
+			delWatchFences(wt.channels)
+			sendError(connID, "unavailable", "Watch could not be created")
+			return
+		}
+		wt.channels = append(wt.channels, channel)
+	}
+	watchmu.Lock()
+	watchM[watchID] = wt
+	if clientWatchM[clientID] == nil {
+		clientWatchM[clientID] = make(map[string]bool)
+	}
+	clientWatchM[clientID][watchID] = true
+	watchmu.Unlock()
+	// the channels expire after the watch ttl, even when this instance is
+	// gone by then
+	time.AfterFunc(watchTTL, func() { removeWatch(clientID, watchID) })
+
+	w.ID, w.Type = watchID, protocol.TypeWatch
+	reply, _ := protocol.Encode(w)
+	send(connID, reply)
+}
+
+// watchNotification relays the enter of a person into the circle of a watch
+// to the person who set it, when the watch is theirs on this instance. Every
+// instance receives the notifications of all watches.
+func watchNotification(channel, msg string) {
+	watchID, _ := splitFloor(strings.TrimPrefix(channel, watchChannel("")))
+	if gjson.Get(msg, "detect").String() != "enter" {
+		return
+	}
+	watchmu.Lock()
+	wt, ok := watchM[watchID]
+	watchmu.Unlock()
+	object := gjson.Get(msg, "object").Raw
+	if !ok || gjson.Get(msg, "id").String() == wt.clientID || isHidden(object) {
+		return
+	}
+	arrival, _ := protocol.Encode(protocol.Arrival{
+		Envelope: protocol.Envelope{Type: protocol.TypeArrival},
+		Watch:    watchID,
+		Name:     wt.name,
+		Feature:  []byte(secureFeature(object)),
+	})
+	sendClient(wt.clientID, arrival)
+}
+
+// removeWatch deletes a watch of a person. Returns false when the person has
+// no such watch.
+func removeWatch(clientID, watchID string) bool {
+	watchmu.Lock()
+	wt, ok := watchM[watchID]
+	if !ok || wt.clientID != clientID {
+		watchmu.Unlock()
+		return false
+	}
+	delete(watchM, watchID)
+	delete(clientWatchM[clientID], watchID)
+	if len(clientWatchM[clientID]) == 0 {
+		delete(clientWatchM, clientID)
+	}
+	watchmu.Unlock()
+	delWatchFences(wt.channels)
+	return true
+}
+
+// delWatchFences deletes the fence channels of a watch
+func delWatchFences(channels []string) {
+	for _, channel := range channels {
+		if err := geo.DelFence(channel); err != nil {
+			lg.Error("watch delete failed", "channel", channel, "err", err)
+		}
+	}
+}
+
+// forgetWatches deletes the watches of a person who left
+func forgetWatches(clientID string) {
+	watchmu.Lock()
+	var watchIDs []string
+	for watchID := range clientWatchM[clientID] {
+		watchIDs = append(watchIDs, watchID)
+	}
+	watchmu.Unlock()
+	for _, watchID := range watchIDs {
+		removeWatch(clientID, watchID)
+	}
+}
@@ -25,6 +25,7 @@ let staticGeofenceLine = '#acd049' // '#725a5d';
 
 
 let staticGeofenceData = './fences/convention-center.geojson';
+let staticGeofenceRoom = 'convention-center'; // server room of the geofence
 let origin = [-104.99649808, 39.74254437];
 let bounds = [-104.99938488006592, 39.74012836540008, -104.99406337738036, 39.74481418327878];
 
@@ -538,10 +539,14 @@ function setMarkerFeature(marker, feature, anim){
 
 // openWS creates a websocket connection to our GO geolocation service
 function openWS() {
-    ws = new WebSocket((location.protocol=='https:'?'wss:':'ws:')+'//' + location.host + '/ws');
+    let session = sessionStorage.getItem('session');
+    ws = new WebSocket((location.protocol=='https:'?'wss:':'ws:')+'//' + location.host + '/ws' +
+        (session ? '?session=' + encodeURIComponent(session) : ''));
     ws.onopen = function () {
         console.log("socket opened")
         connected = true;
+        // version 2 batches notifications into FeatureCollection frames
+        ws.send(JSON.stringify({'type':'Hello','version':2}));
         sendMe(false);
     }
     ws.onclose = function () {
@@ -550,40 +555,58 @@ function openWS() {
         setTimeout(function () { openWS(); }, 1000); // retry in one second
     }
     ws.onmessage = function (e) {
-        let msg = JSON.parse(e.data);
-        switch (msg.type){
-        case "Update":
-            for (let i=0;i<msg.features.length;i++){
-                updateMarker(msg.features[i], undefined, true);
-            }
-            break;
-        case "Nearby":
-            updateMarker(msg.feature, true, true);
-            break;
-        case "Faraway":
-            updateMarker(msg.feature, false, true);
-            break;
-        case "Message":
-            updateChat(msg.feature, msg.text, true);
-            storeChat(msg.feature, msg.text)
-            break;
-        case "Inside":
-             if (!msg.me){
-                updateMarker(msg.feature, undefined, true);
-                updateStatic(msg.feature.id, true)
-            } else {
-                updateStatic(me.id, true)
-            }
+        handleMsg(JSON.parse(e.data));
+    }
+}
+
+// handleMsg handles a single message from the server
+function handleMsg(msg) {
+    switch (msg.type){
+    case "FeatureCollection":
+        for (let i=0;i<msg.notifications.length;i++){
+            handleMsg(msg.notifications[i]);
+        }
+        break;
+    case "Session":
+        sessionStorage.setItem('session', msg.token);
+        break;
+    case "Update":
+        for (let i=0;i<msg.features.length;i++){
+            updateMarker(msg.features[i], undefined, true);
+        }
+        break;
+    case "Nearby":
+        updateMarker(msg.feature, true, true);
+        break;
+    case "Faraway":
+        updateMarker(msg.feature, false, true);
+        break;
+    case "Message":
+        updateChat(msg.feature, msg.text, true);
+        storeChat(msg.feature, msg.text)
+        break;
+    case "Inside":
+        if (msg.room != staticGeofenceRoom){
             break;
-        case "Outside":
-            if (!msg.me){
-                updateMarker(msg.feature, undefined, true);
-                updateStatic(msg.feature.id, false)
-            } else {
-                updateStatic(me.id, false)
-            }
+        }
+        if (!msg.me){
+            updateMarker(msg.feature, undefined, true);
+            updateStatic(msg.feature.id, true)
+        } else {
+            updateStatic(me.id, true)
+        }
+        break;
+    case "Outside":
+        if (msg.room != staticGeofenceRoom){
             break;
         }
+        if (!msg.me){
+            updateMarker(msg.feature, undefined, true);
+            updateStatic(msg.feature.id, false)
+        } else {
+            updateStatic(me.id, false)
+        }
+        break;
     }
 }
 
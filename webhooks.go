@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// The webhook delivery settings
+const (
+	webhookWorkers  = 4                // concurrent deliveries
+	webhookQueue    = 1024             // events waiting for delivery
+	webhookAttempts = 5                // deliveries before an event is dead
+	webhookBackoff  = time.Second      // delay before the first retry, doubled after each
+	webhookTimeout  = 10 * time.Second // timeout of a single delivery
+	webhookDedupe   = time.Minute      // how long an event is claimed by an instance
+	deadLetterSize  = 1000             // dead events kept in Redis
+)
+
+// deadLetterKey is the Redis list of events that could not be delivered
+const deadLetterKey = "webhooks:dead"
+
+// webhookJob is an event for a single endpoint
+type webhookJob struct {
+	url   string
+	event string
+}
+
+var (
+	webhookJobs    chan webhookJob // events waiting for delivery
+	webhookDropped uint64          // events that did not fit in the queue
+	webhookClient  = &http.Client{Timeout: webhookTimeout}
+)
+
+// startWebhooks starts the delivery workers when room or moderator endpoints
+// are configured
+func startWebhooks() {
+	if len(cfg.Webhooks) == 0 && cfg.ModWebhook == "" {
+		return
+	}
+	webhookJobs = make(chan webhookJob, webhookQueue)
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for job := range webhookJobs {
+				deliverWebhook(job)
+			}
+		}()
+	}
+}
+
+// queueWebhook queues an enter or exit event of a room for every endpoint.
+// All instances see the same Tile38 notification, so the event is claimed in
+// Redis and only sent by the first instance to claim it.
+func queueWebhook(detect, roomID, msg string) {
+	if webhookJobs == nil {
+		return
+	}
+	eventID, ok := claimRoomEvent("webhook", detect, roomID, msg)
+	if !ok {
+		return // another instance sends this event
+	}
+	clientID := gjson.Get(msg, "object.id").String()
+	at := gjson.Get(msg, "time").String()
+
+	event := `{}`
+	event, _ = sjson.Set(event, "id", eventID)
+	event, _ = sjson.Set(event, "event", detect)
+	ns, fenceID := splitRoom(roomID)
+	event, _ = sjson.Set(event, "room", fenceID)
+	if ns != "" {
+		event, _ = sjson.Set(event, "namespace", ns)
+	}
+	event, _ = sjson.Set(event, "person", secureClientID(clientID))
+	event, _ = sjson.Set(event, "time", at)
+	event, _ = sjson.SetRaw(event, "feature",
+		secureFeature(gjson.Get(msg, "object").Raw))
+	for _, url := range cfg.Webhooks {
+		if job := (webhookJob{url: url, event: event}); !queueJob(job) {
+			deadLetter(job, "queue full")
+		}
+	}
+}
+
+// queueJob queues an event for delivery without waiting, and returns false
+// when the queue is full
+func queueJob(job webhookJob) bool {
+	select {
+	case webhookJobs <- job:
+		return true
+	default:
+		atomic.AddUint64(&webhookDropped, 1)
+		return false
+	}
+}
+
+// claimRoomEvent claims the enter or exit event of a room notification for
+// this instance, so that work done for the events of a kind happens once
+// across all instances. Returns the id of the event and false when another
+// instance claimed it first.
+func claimRoomEvent(kind, detect, roomID, msg string) (string, bool) {
+	clientID := gjson.Get(msg, "object.id").String()
+	at := gjson.Get(msg, "time").String()
+	sum := sha256.Sum256([]byte(roomID + "\x00" + clientID + "\x00" + detect + "\x00" + at))
+	eventID := hex.EncodeToString(sum[:12])
+	claimed, err := redis.String(storeDo("SET", kind+":"+eventID, instanceID,
+		"NX", "EX", int(webhookDedupe/time.Second)))
+	if err == redis.ErrNil {
+		return eventID, false
+	} else if err != nil || claimed != "OK" {
+		lg.Error("event claim failed", "kind", kind, "event", eventID, "err", err)
+		return eventID, false
+	}
+	return eventID, true
+}
+
+// deliverWebhook posts an event to an endpoint, retrying with backoff, and
+// moves it to the dead letter queue when all attempts failed
+func deliverWebhook(job webhookJob) {
+	backoff := webhookBackoff
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = postWebhook(job); err == nil {
+			return
+		}
+		lg.Warn("webhook delivery failed", "url", job.url, "attempt", attempt,
+			"err", err)
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	deadLetter(job, err.Error())
+}
+
+// postWebhook posts an event once. The body is signed with the webhook secret
+// as "X-Signature: sha256=<hex>" over the timestamp header, a dot and the
+// body.
+func postWebhook(job webhookJob) error {
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewBufferString(job.event))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Timestamp", ts)
+	if cfg.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+		mac.Write([]byte(ts + "."))
+		mac.Write([]byte(job.event))
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter stores an event that could not be delivered in Redis
+func deadLetter(job webhookJob, reason string) {
+	dead := `{}`
+	dead, _ = sjson.Set(dead, "url", job.url)
+	dead, _ = sjson.Set(dead, "error", reason)
+	dead, _ = sjson.Set(dead, "failed", time.Now().UTC().Format(time.RFC3339))
+	dead, _ = sjson.SetRaw(dead, "event", job.event)
+	b := newBatch(store)
+	defer b.Close()
+	b.Send("LPUSH", deadLetterKey, dead)
+	b.Send("LTRIM", deadLetterKey, 0, deadLetterSize-1)
+	if _, err := b.Flush(); err != nil {
+		lg.Error("webhook dead letter failed", "url", job.url, "err", err)
+	}
+}
+
+// deadLettersAPI is an HTTP handler for the webhook dead letter queue.
+//
+//	GET    /api/webhooks/dead  list the dead events, newest first
+//	POST   /api/webhooks/dead  queue the dead events for delivery again, as many as fit
+//	DELETE /api/webhooks/dead  drop all dead events
+func deadLettersAPI(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		dead, err := redis.Strings(storeDo("LRANGE", deadLetterKey, 0, -1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		list := `[]`
+		for _, d := range dead {
+			list, _ = sjson.SetRaw(list, "-1", d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(list))
+	case http.MethodPost:
+		if webhookJobs == nil {
+			http.Error(w, "webhooks are disabled", http.StatusConflict)
+			return
+		}
+		var n int
+		for n < deadLetterSize {
+			d, err := redis.String(storeDo("RPOP", deadLetterKey))
+			if err == redis.ErrNil {
+				break
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			job := webhookJob{
+				url:   gjson.Get(d, "url").String(),
+				event: gjson.Get(d, "event").Raw,
+			}
+			if !queueJob(job) {
+				// keep the rest for when the queue drained
+				storeDo("RPUSH", deadLetterKey, d)
+				break
+			}
+			n++
+		}
+		left, _ := redis.Int(storeDo("LLEN", deadLetterKey))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"queued":%d,"left":%d}`, n, left)
+	case http.MethodDelete:
+		if _, err := storeDo("DEL", deadLetterKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDeadLettersRetry(t *testing.T) {
+	testServer(t)
+	prev := webhookJobs
+	webhookJobs = make(chan webhookJob, 1)
+	t.Cleanup(func() {
+		webhookJobs = prev
+		storeDo("DEL", deadLetterKey)
+	})
+	storeDo("DEL", deadLetterKey)
+	for _, event := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`} {
+		deadLetter(webhookJob{url: "http://hooks.example.com", event: event}, "failed")
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		deadLettersAPI(w, httptest.NewRequest(http.MethodPost, "/api/webhooks/dead", nil))
+		done <- w
+	}()
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(testWait):
+		t.Fatal("a retry must not wait for room in the queue")
+	}
+	if body := w.Body.String(); gjson.Get(body, "queued").Int() != 1 || gjson.Get(body, "left").Int() != 2 {
+		t.Fatalf("got %s", body)
+	}
+	if job := <-webhookJobs; gjson.Get(job.event, "n").Int() != 1 {
+		t.Fatalf("queued %s, want the oldest dead event", job.event)
+	}
+}